@@ -0,0 +1,117 @@
+package chainpot
+
+import (
+	"github.com/fadeAce/chainpot/hdkey"
+	"github.com/fadeAce/chainpot/poterr"
+	"strings"
+)
+
+// address prefixes of a bitcoin network
+type btcNetwork struct {
+	pubKeyHash byte
+	scriptHash byte
+	hrp        string
+}
+
+var btcNetworks = map[string]btcNetwork{
+	"mainnet": {0x00, 0x05, "bc"},
+	"testnet": {0x6f, 0xc4, "tb"},
+	"signet":  {0x6f, 0xc4, "tb"},
+	"regtest": {0x6f, 0xc4, "bcrt"},
+}
+
+// bitcoin network of the chain, mainnet unless the conf tells otherwise
+func (c *chain) btcNetwork() btcNetwork {
+	if network, ok := btcNetworks[strings.ToLower(c.network)]; ok {
+		return network
+	}
+	return btcNetworks["mainnet"]
+}
+
+// canonical form of a valid address of the chain
+func (c *chain) canonical(addr string) (string, error) {
+	addr = strings.TrimSpace(addr)
+	if c.origin.Chain == "eth" {
+		return ethAddress(addr)
+	}
+	return c.btcAddress(addr)
+}
+
+// lowercase address, a mixed case one must carry a valid EIP-55 checksum
+func ethAddress(addr string) (string, error) {
+	if len(addr) != 42 || (addr[:2] != "0x" && addr[:2] != "0X") {
+		return "", poterr.AddressErr
+	}
+	var body = addr[2:]
+	for _, ch := range body {
+		if !(ch >= '0' && ch <= '9' || ch >= 'a' && ch <= 'f' || ch >= 'A' && ch <= 'F') {
+			return "", poterr.AddressErr
+		}
+	}
+	var lower = strings.ToLower(body)
+	if body != lower && body != strings.ToUpper(body) && hdkey.ChecksumAddress(body)[2:] != body {
+		return "", poterr.ChecksumErr
+	}
+	return "0x" + lower, nil
+}
+
+// base58check address of the network, or a segwit one of its hrp in lowercase
+func (c *chain) btcAddress(addr string) (string, error) {
+	var network = c.btcNetwork()
+	if sep := strings.LastIndexByte(addr, '1'); sep > 0 && isHrp(strings.ToLower(addr[:sep])) {
+		hrp, _, _, err := hdkey.DecodeSegwitAddress(addr)
+		if err == hdkey.ErrChecksum {
+			return "", poterr.ChecksumErr
+		} else if err != nil {
+			return "", poterr.AddressErr
+		}
+		if hrp != network.hrp {
+			return "", poterr.NetworkErr
+		}
+		return strings.ToLower(addr), nil
+	}
+
+	payload, err := hdkey.Base58CheckDecode(addr)
+	if err == hdkey.ErrChecksum {
+		return "", poterr.ChecksumErr
+	} else if err != nil || len(payload) != 21 {
+		return "", poterr.AddressErr
+	}
+	if payload[0] == network.pubKeyHash || payload[0] == network.scriptHash {
+		return addr, nil
+	}
+	for _, other := range btcNetworks {
+		if payload[0] == other.pubKeyHash || payload[0] == other.scriptHash {
+			return "", poterr.NetworkErr
+		}
+	}
+	return "", poterr.AddressErr
+}
+
+func isHrp(s string) bool {
+	for _, network := range btcNetworks {
+		if s == network.hrp {
+			return true
+		}
+	}
+	return false
+}
+
+// cheap canonical form of the addresses of the node, validated ones are left as they are
+func (c *chain) normalize(addr string) string {
+	if c.origin == nil {
+		return addr
+	}
+	return normalizeAddr(c.origin.Chain, addr)
+}
+
+// normalize of the chain named name, for callers holding no chain
+func normalizeAddr(name string, addr string) string {
+	if name == "eth" {
+		return strings.ToLower(addr)
+	}
+	if sep := strings.LastIndexByte(addr, '1'); sep > 0 && isHrp(strings.ToLower(addr[:sep])) {
+		return strings.ToLower(addr)
+	}
+	return addr
+}
@@ -0,0 +1,76 @@
+package chainpot
+
+import (
+	"github.com/fadeAce/chainpot/hdkey"
+	"github.com/fadeAce/chainpot/poterr"
+	"github.com/fadeAce/claws"
+	"os"
+	"testing"
+)
+
+func TestChainpot_AddBitcoin(t *testing.T) {
+	var dir = tempDir(t)
+	defer os.RemoveAll(dir)
+	var fake = NewFakeChain(100)
+	var cp = newTestPot(t, dir, fake, 2)
+
+	var segwit = "bc1qw508d6qejxtdg4y5r3zarvary0c5xw7kv8f3t4"
+	var testnet = hdkey.Base58Check(append([]byte{0x6f}, make([]byte, 20)...))
+	records, rejected := cp.Add(Bitcoin, []string{
+		testAddr,
+		"BC1QW508D6QEJXTDG4Y5R3ZARVARY0C5XW7KV8F3T4",
+		"1BvBMSEYstWetqTFn5Au4m4GFg7xJaNVN3",
+		"tb1qw508d6qejxtdg4y5r3zarvary0c5xw7kxpjzsx",
+		testnet,
+		"not an address",
+	})
+	if _, ok := records[segwit]; !ok || len(records) != 2 {
+		t.Fatalf("unexpected records %v", records)
+	}
+	for addr, want := range map[string]error{
+		"1BvBMSEYstWetqTFn5Au4m4GFg7xJaNVN3":         poterr.ChecksumErr,
+		"tb1qw508d6qejxtdg4y5r3zarvary0c5xw7kxpjzsx": poterr.NetworkErr,
+		testnet:          poterr.NetworkErr,
+		"not an address": poterr.AddressErr,
+	} {
+		if rejected[addr] != want {
+			t.Fatalf("%s: expect %v, got %v", addr, want, rejected[addr])
+		}
+	}
+
+	// the node output is matched whatever its case
+	var ch = startPot(t, cp, fake)
+	fake.Mine(BlockMessage{Hash: "n1", From: testOther, To: "BC1QW508D6QEJXTDG4Y5R3ZARVARY0C5XW7KV8F3T4"})
+	expectEvents(t, ch, expected{T_DEPOSIT, 1, "n1"})
+	stopPot(t, cp)
+}
+
+func TestChainpot_AddEthereum(t *testing.T) {
+	var dir = tempDir(t)
+	defer os.RemoveAll(dir)
+	var fake = NewFakeChain(100)
+	var cp = NewChainpot(&ChainConf{
+		Coins:    []Coins{{CoinType: "origin", Chain: "eth", Symbol: "eth"}},
+		Eth:      &EthConf{ConfirmTimes: 2, Storage: boltStorage(t, dir, "eth")},
+		Builders: map[string]claws.WalletBuilder{"eth": fake},
+	})
+	if err := cp.Register(Ethereum); err != nil {
+		t.Fatal(err)
+	}
+
+	var lower = "0x5aaeb6053f3e94c9b9a09f33669435e7ef1beaed"
+	records, rejected := cp.Add(Ethereum, []string{
+		"0x5aAeb6053F3E94C9b9A09f33669435E7Ef1BeAed",
+		lower,
+		"0xFB6916095CA1DF60BB79CE92CE3EA74C37C5D359",
+		"0x5aAeb6053F3E94C9b9A09f33669435E7Ef1BeAeD",
+		"0x5aaeb6",
+	})
+	if _, ok := records[lower]; !ok || len(records) != 2 {
+		t.Fatalf("unexpected records %v", records)
+	}
+	if rejected["0x5aAeb6053F3E94C9b9A09f33669435E7Ef1BeAeD"] != poterr.ChecksumErr || rejected["0x5aaeb6"] != poterr.AddressErr {
+		t.Fatalf("unexpected rejections %v", rejected)
+	}
+	cp.chains[int(Ethereum)].storage.(*BoltStorage).Close()
+}
@@ -6,8 +6,11 @@ import (
 	"github.com/fadeAce/claws"
 	"github.com/fadeAce/claws/types"
 	"github.com/rs/zerolog"
+	"io"
+	"net/http"
 	"os"
 	"sync"
+	"time"
 )
 
 type PublicChain uint8
@@ -17,37 +20,73 @@ const (
 	Ethereum
 )
 
-var (
-	wg      *sync.WaitGroup
-	runmode string
-)
-
-func init() {
-	wg = &sync.WaitGroup{}
-	runmode = os.Getenv("RUN_MODE")
-	if runmode == "" {
-		runmode = "debug"
+func (c PublicChain) String() string {
+	switch c {
+	case Bitcoin:
+		return "btc"
+	case Ethereum:
+		return "eth"
 	}
+	return "unknown"
+}
+
+// claws keeps its gate in package state, setting it up and building
+// the wallets of an instance must not interleave with another instance
+var gate sync.Mutex
 
+// logger used when ChainConf.Logger is nil, RUN_MODE=release only logs warnings
+func defaultLogger() zerolog.Logger {
 	level := zerolog.DebugLevel
-	if runmode == "release" {
+	if os.Getenv("RUN_MODE") == "release" {
 		level = zerolog.WarnLevel
 	}
-	zerolog.SetGlobalLevel(level)
+	return zerolog.New(os.Stderr).With().Timestamp().Logger().Level(level)
 }
 
 type Chainpot struct {
-	chains    []*chain
-	conf      *ChainConf
-	onMessage MessageHandler
+	chains  []*chain
+	conf    *ChainConf
+	logger  zerolog.Logger
+	wallets map[string]claws.Wallet
+	subsMu  sync.RWMutex
+	subs    map[int64]*Subscription
+	subSeq  int64
+	// events queued per subscription
+	subBuffer int
+
+	// guards the entries of chains, set by Register and cleared by Reset
+	chainsMu sync.RWMutex
+
+	streamsMu sync.Mutex
+	streams   map[int64]*stream
+
+	metrics  *Metrics
+	server   *http.Server
+	now      func() time.Time
+	limiters map[string]*limiter
 }
 
 type MessageHandler func(chain PublicChain, event *PotEvent)
 
 func NewChainpot(conf *ChainConf) *Chainpot {
 	var obj = &Chainpot{
-		chains: make([]*chain, 128),
-		conf:   conf,
+		chains:   make([]*chain, 128),
+		conf:     conf,
+		subs:     make(map[int64]*Subscription),
+		streams:  make(map[int64]*stream),
+		wallets:  make(map[string]claws.Wallet),
+		metrics:  NewMetrics(),
+		now:      conf.Clock,
+		limiters: make(map[string]*limiter),
+	}
+	obj.subBuffer = conf.SubscriptionBuffer
+	if obj.now == nil {
+		obj.now = time.Now
+	}
+	if conf.Logger != nil {
+		obj.logger = *conf.Logger
+	} else {
+		obj.logger = defaultLogger()
 	}
 
 	clawsConf := &types.Claws{
@@ -79,32 +118,185 @@ func NewChainpot(conf *ChainConf) *Chainpot {
 			ContractAddr: item.ContractAddr,
 		})
 	}
-	claws.SetupGate(clawsConf, nil)
+
+	var ethUrls, btcUrls []string
+	if conf.Eth != nil {
+		ethUrls = endpointUrls(conf.Eth.Url, conf.Eth.Urls)
+	}
+	if conf.Btc != nil {
+		btcUrls = endpointUrls(conf.Btc.Url, conf.Btc.Urls)
+	}
+	var rounds = len(ethUrls)
+	if len(btcUrls) > rounds {
+		rounds = len(btcUrls)
+	}
+
+	gate.Lock()
+	defer gate.Unlock()
+	// claws is left untouched when every coin is served by conf.Builders,
+	// otherwise its gate is set up once per endpoint to build a wallet on each
+	var claimed = false
+	for _, item := range conf.Coins {
+		if _, ok := conf.Builders[item.Symbol]; !ok {
+			claimed = true
+			break
+		}
+	}
+	var endpoints = make(map[string][]*endpoint)
+	for i := 0; claimed && i < rounds; i++ {
+		if conf.Eth != nil {
+			clawsConf.Eth.Url = ethUrls[minInt(i, len(ethUrls)-1)]
+		}
+		if conf.Btc != nil {
+			clawsConf.Btc.Url = btcUrls[minInt(i, len(btcUrls)-1)]
+		}
+		claws.SetupGate(clawsConf, conf.Builders)
+
+		for _, item := range conf.Coins {
+			var urls = btcUrls
+			if item.Chain == "eth" {
+				urls = ethUrls
+			}
+			if _, ok := conf.Builders[item.Symbol]; ok || i >= len(urls) {
+				continue
+			}
+			endpoints[item.Symbol] = append(endpoints[item.Symbol], &endpoint{
+				url:    urls[i],
+				wallet: obj.limit(item.Chain, urls[i], claws.Builder.BuildWallet(item.Symbol)),
+			})
+		}
+	}
+
+	for _, item := range conf.Coins {
+		if builder, ok := conf.Builders[item.Symbol]; ok {
+			obj.wallets[item.Symbol] = obj.limit(item.Chain, "", builder.Build())
+			continue
+		}
+		var list = endpoints[item.Symbol]
+		if len(list) == 1 {
+			obj.wallets[item.Symbol] = list[0].wallet
+		} else if len(list) > 1 {
+			var opt = &failoverOption{Clock: obj.now, Logger: obj.logger.With().Str("chain", item.Chain).Logger()}
+			if item.Chain == "eth" {
+				opt.Quorum, opt.Cooldown, opt.MaxLag = conf.Eth.Quorum, conf.Eth.Cooldown, conf.Eth.EndpointLag
+			} else {
+				opt.Quorum, opt.Cooldown, opt.MaxLag = conf.Btc.Quorum, conf.Btc.Cooldown, conf.Btc.EndpointLag
+			}
+			obj.wallets[item.Symbol] = newFailoverWallet(list, opt)
+		}
+	}
+	if conf.Record != nil {
+		var recorder = NewRecorder(conf.Record)
+		for symbol, wallet := range obj.wallets {
+			obj.wallets[symbol] = recorder.Wrap(symbol, wallet)
+		}
+	}
 
 	return obj
 }
 
+// the json-rpc lookup of chain over urls, each one behind the limiter of its endpoint
+// and failing over to the next like the wallets do. nil without urls
+func (c *Chainpot) lookupStack(chain string, urls []string, build func(url string) TxLookup) TxLookup {
+	var list = make([]*endpoint, 0)
+	for _, url := range urls {
+		if url != "" {
+			list = append(list, &endpoint{url: url, wallet: c.limit(chain, url, &lookupWallet{TxLookup: build(url)})})
+		}
+	}
+	if len(list) == 0 {
+		return nil
+	}
+	if len(list) == 1 {
+		return list[0].wallet.(TxLookup)
+	}
+	var opt = &failoverOption{Clock: c.now, Logger: c.logger.With().Str("chain", chain).Str("lookup", "json-rpc").Logger()}
+	if chain == "eth" {
+		opt.Cooldown = c.conf.Eth.Cooldown
+	} else {
+		opt.Cooldown = c.conf.Btc.Cooldown
+	}
+	return newFailoverWallet(list, opt)
+}
+
+// Url followed by the Urls not repeating it
+func endpointUrls(url string, urls []string) []string {
+	var res = make([]string, 0)
+	if url != "" || len(urls) == 0 {
+		res = append(res, url)
+	}
+	for _, item := range urls {
+		if item != url {
+			res = append(res, item)
+		}
+	}
+	return res
+}
+
+func minInt(a, b int) int {
+	if a < b {
+		return a
+	}
+	return b
+}
+
 func (c *Chainpot) Register(chain PublicChain) error {
 	var chainName string
 	var confirmTimes int64
 	var contracts = make([]*Coins, 0)
 	var storage Storage
+	var retention JournalRetention
+	var stallAfter time.Duration
+	var maxLag int64
+	var reconnect bool
+	var dropAfter time.Duration
+	var lookup TxLookup
+	var stuckAfter time.Duration
+	var feeBump, maxBumps int
+	var xpubs []string
+	var gapLimit int
+	var network string
+	var invoiceGrace time.Duration
 
 	if chain == Ethereum {
 		confirmTimes = c.conf.Eth.ConfirmTimes
 		storage = c.conf.Eth.Storage
+		retention = c.conf.Eth.Journal
+		stallAfter = c.conf.Eth.StallAfter
+		maxLag = c.conf.Eth.MaxLag
+		reconnect = c.conf.Eth.Reconnect
+		dropAfter = c.conf.Eth.DropAfter
+		stuckAfter, feeBump, maxBumps = c.conf.Eth.StuckAfter, c.conf.Eth.FeeBump, c.conf.Eth.MaxBumps
+		xpubs, gapLimit = c.conf.Eth.XPubs, c.conf.Eth.GapLimit
+		invoiceGrace = c.conf.Eth.InvoiceGrace
+		lookup = c.lookupStack("eth", endpointUrls(c.conf.Eth.Url, c.conf.Eth.Urls), func(url string) TxLookup {
+			var obj = newEthLookup(url)
+			obj.traces = c.conf.Eth.Traces
+			return obj
+		})
 		chainName = "eth"
 	} else if chain == Bitcoin {
 		confirmTimes = c.conf.Btc.ConfirmTimes
 		storage = c.conf.Btc.Storage
+		retention = c.conf.Btc.Journal
+		stallAfter = c.conf.Btc.StallAfter
+		maxLag = c.conf.Btc.MaxLag
+		reconnect = c.conf.Btc.Reconnect
+		dropAfter = c.conf.Btc.DropAfter
+		stuckAfter, feeBump, maxBumps = c.conf.Btc.StuckAfter, c.conf.Btc.FeeBump, c.conf.Btc.MaxBumps
+		xpubs, gapLimit = c.conf.Btc.XPubs, c.conf.Btc.GapLimit
+		invoiceGrace = c.conf.Btc.InvoiceGrace
+		network = c.conf.Btc.Network
+		lookup = c.lookupStack("btc", endpointUrls(c.conf.Btc.Url, c.conf.Btc.Urls), func(url string) TxLookup {
+			return newBtcLookup(url, c.conf.Btc.User, c.conf.Btc.Password)
+		})
 		chainName = "btc"
 	}
 	for i, _ := range c.conf.Coins {
 		contracts = append(contracts, &c.conf.Coins[i])
 	}
 
-	var idx = int(chain)
-	if c.chains[idx] != nil {
+	if c.chainOf(chain) != nil {
 		return errors.New("repeat register")
 	}
 
@@ -113,86 +305,229 @@ func (c *Chainpot) Register(chain PublicChain) error {
 		ConfirmTimes: confirmTimes,
 		Contracts:    contracts,
 		Storage:      storage,
+		Retention:    retention,
+		Wallets:      c.wallets,
+		Logger:       c.logger.With().Str("chain", chainName).Logger(),
+		Metrics:      c.metrics,
+		StallAfter:   stallAfter,
+		MaxLag:       maxLag,
+		Reconnect:    reconnect,
+		Clock:        c.now,
+		Lookup:       lookup,
+		DropAfter:    dropAfter,
+		Accounts:     c.conf.Accounts,
+		StuckAfter:   stuckAfter,
+		FeeBump:      feeBump,
+		MaxBumps:     maxBumps,
+		DecodeLogs:   chain == Ethereum && c.conf.Eth.DecodeLogs,
+		Discover:     chain == Ethereum && c.conf.Eth.DiscoverTokens,
+		Traces:       chain == Ethereum && c.conf.Eth.Traces != "",
+		UTXO:         chain == Bitcoin && c.conf.Btc.UTXO,
+		GapLimit:     gapLimit,
+		Network:      network,
+		InvoiceGrace: invoiceGrace,
 	})
+	for _, key := range xpubs {
+		if _, err := obj.addXPub(key); err != nil {
+			return err
+		}
+	}
 
-	c.chains[idx] = obj
 	obj.onMessage = func(msg *PotEvent) {
-		c.onMessage(chain, msg)
+		c.dispatch(chain, msg)
 	}
-
+	c.chainsMu.Lock()
+	defer c.chainsMu.Unlock()
+	if c.chains[int(chain)] != nil {
+		return errors.New("repeat register")
+	}
+	c.chains[int(chain)] = obj
 	return nil
 }
 
-func (c *Chainpot) Add(chain PublicChain, addrs []string) map[string]int64 {
-	var idx = int(chain)
-	obj := c.chains[idx]
+// registered chain of the instance, nil when it isn't
+func (c *Chainpot) chainOf(chain PublicChain) *chain {
+	c.chainsMu.RLock()
+	defer c.chainsMu.RUnlock()
+	return c.chains[int(chain)]
+}
+
+// copy of the chains indexed by PublicChain, the unregistered ones are nil
+func (c *Chainpot) allChains() []*chain {
+	c.chainsMu.RLock()
+	defer c.chainsMu.RUnlock()
+	return append([]*chain(nil), c.chains...)
+}
+
+// Add watches addrs on chain from its current height, the records are the heights of the watched addresses
+// in their canonical form, lowercase on ethereum, and the invalid ones are rejected with AddressErr,
+// ChecksumErr or NetworkErr
+func (c *Chainpot) Add(chain PublicChain, addrs []string) (records map[string]int64, rejected map[string]error) {
+	obj := c.chainOf(chain)
 	if obj != nil {
-		return c.chains[idx].add(addrs)
+		return obj.add(addrs)
 	}
 	panic("try to add address at non exist chain")
-	return nil
 }
 
+// start all registered chains, fn is subscribed to every event when given,
+// use Subscribe for filtered deliveries
 func (c *Chainpot) Start(fn MessageHandler) {
-	c.onMessage = fn
-	for _, chain := range c.chains {
+	if fn != nil {
+		c.Subscribe(nil, fn)
+	}
+	for _, chain := range c.allChains() {
 		if chain != nil {
 			chain.start()
 		}
 	}
+	if c.conf.HTTPAddr != "" && c.server == nil {
+		c.serve(c.conf.HTTPAddr)
+	}
+}
+
+// Metrics returns the metrics of the instance, it is an http.Handler
+// for those mounting /metrics on their own server
+func (c *Chainpot) Metrics() *Metrics {
+	return c.metrics
+}
+
+func (c *Chainpot) serve(addr string) {
+	var mux = http.NewServeMux()
+	mux.Handle("/metrics", c.metrics)
+	mux.Handle("/healthz", c.HealthHandler())
+	mux.Handle("/readyz", c.ReadyHandler())
+	c.server = &http.Server{Addr: addr, Handler: mux}
+	go func(server *http.Server) {
+		if err := server.ListenAndServe(); err != nil && err != http.ErrServerClosed {
+			c.logger.Error().Msgf("http server error: %s", err.Error())
+		}
+	}(c.server)
 }
 
 // // if chain matched idx has been registered return true otherwise return false
 func (c *Chainpot) Ready(chain PublicChain) bool {
-	var idx = int(chain)
-	return c.chains[idx] != nil
+	return c.chainOf(chain) != nil
 }
 
 // reset chain which matched with given []idx
-// if []idx is empty reset all
+// if []idx is empty reset all, the storage forgets the chain as BoltStorage.ClearConfig does
 func (c *Chainpot) Reset(idx ...int) {
-	wg = &sync.WaitGroup{}
+	var chains = make([]PublicChain, 0)
+	for _, i := range idx {
+		chains = append(chains, PublicChain(i))
+	}
+	c.closeStreams(chains...)
+
+	var list = c.allChains()
 	if len(idx) == 0 {
-		for i, _ := range c.chains {
-			if c.chains[i] != nil {
-				wg.Add(1)
-				c.chains[i].cancel()
-			}
+		for i := range list {
+			idx = append(idx, i)
 		}
-		wg.Wait()
-
-		for i, _ := range c.chains {
-			if c.chains[i] != nil {
-				c.chains[i].storage.ClearConfig()
-				c.chains[i] = nil
-			}
+	}
+	for _, i := range idx {
+		if list[i] != nil {
+			list[i].cancel()
 		}
-		return
 	}
-
 	for _, i := range idx {
-		if c.chains[i] != nil {
-			wg.Add(1)
-			c.chains[i].cancel()
+		if list[i] != nil {
+			list[i].wait()
 		}
 	}
-	wg.Wait()
+
+	c.chainsMu.Lock()
+	defer c.chainsMu.Unlock()
 	for _, i := range idx {
-		if c.chains[i] != nil {
-			c.chains[i].storage.ClearConfig()
+		if list[i] != nil && c.chains[i] == list[i] {
+			list[i].storage.ClearConfig()
 			c.chains[i] = nil
 		}
 	}
 }
 
 // call the function when process exit.
-func (c *Chainpot) Stop() {
-	wg = &sync.WaitGroup{}
-	for i, _ := range c.chains {
-		if c.chains[i] != nil {
-			wg.Add(1)
-			c.chains[i].cancel()
+// head intake stops at once, the block in progress is finished and queued events
+// are delivered until ctx is done, what is left is journaled and reported
+func (c *Chainpot) Stop(ctx context.Context) (*StopReport, error) {
+	var report = &StopReport{Chains: make(map[PublicChain]*ChainReport)}
+	var running = make([]*chain, 0)
+	var chains = c.allChains()
+	for i, _ := range chains {
+		if chains[i] != nil {
+			chains[i].headCancel()
+			running = append(running, chains[i])
+			report.Chains[PublicChain(i)] = &ChainReport{Undelivered: make([]*PotEvent, 0)}
+		}
+	}
+
+	for _, item := range running {
+		item.stopCtx = ctx
+		item.cancel()
+	}
+
+	// the report of a chain is written by its routines, it's only read once they're gone
+	var exited = make(map[*chain]chan struct{})
+	for _, item := range running {
+		var item, done = item, make(chan struct{})
+		exited[item] = done
+		go func() {
+			item.routines.Wait()
+			close(done)
+		}()
+	}
+	var finished = true
+	for _, item := range running {
+		select {
+		case <-exited[item]:
+		case <-ctx.Done():
+			finished = false
+		}
+	}
+
+	c.closeStreams()
+	if c.server != nil {
+		c.server.Shutdown(ctx)
+		c.server = nil
+	}
+	for _, item := range c.closeSubscriptions(ctx) {
+		var obj, ok = report.Chains[item.chain]
+		if !ok {
+			obj = &ChainReport{Undelivered: make([]*PotEvent, 0)}
+			report.Chains[item.chain] = obj
+		}
+		obj.Undelivered = append(obj.Undelivered, item.event)
+	}
+
+	for i, _ := range chains {
+		var item = chains[i]
+		if item == nil {
+			continue
 		}
+		var obj = report.Chains[PublicChain(i)]
+		select {
+		case <-exited[item]:
+			obj.Drained = true
+		default:
+			// still shutting down, its report isn't final
+			continue
+		}
+		if item.report != nil {
+			obj.EndPoint = item.report.EndPoint
+			obj.EventID = item.report.EventID
+			obj.Pending = item.report.Pending
+			obj.Undelivered = append(item.report.Undelivered, obj.Undelivered...)
+		}
+		// storage can only be released once the chain routines are gone
+		if closer, ok := item.storage.(io.Closer); ok {
+			if err := closer.Close(); err != nil {
+				c.logger.Error().Msgf("close storage error: %s", err.Error())
+			}
+		}
+	}
+
+	if !finished {
+		return report, ctx.Err()
 	}
-	wg.Wait()
+	return report, nil
 }
@@ -1,140 +1,448 @@
 package chainpot
 
 import (
+	"bytes"
 	"context"
+	"github.com/boltdb/bolt"
+	"github.com/fadeAce/chainpot/poterr"
 	"github.com/fadeAce/claws"
 	"github.com/fadeAce/claws/types"
-	"github.com/rs/zerolog/log"
+	"io/ioutil"
+	"math/big"
 	"os"
-	"os/signal"
-	"path/filepath"
-	"strings"
-	"syscall"
 	"testing"
+	"time"
 )
 
-// TEST MLGB
-func TestChainpot_Ready(t *testing.T) {
-	initMock()
-	conf := &Config{
-		CachePath: "./log",
-		Coins: []*CoinConf{
-			{Code: "mlgb", Idx: 2, ConfirmTimes: 3},
+const (
+	testAddr  = "1BvBMSEYstWetqTFn5Au4m4GFg7xJaNVN2"
+	testOther = "3J98t1WpEZ73CNmQviecrnyiWrnqRhWNLy"
+)
+
+type expected struct {
+	Event EventType
+	ID    int64
+	Hash  string
+}
+
+// chainpot on a fake bitcoin chain with a bolt storage in dir
+func newTestPot(t *testing.T, dir string, fake *FakeChain, confirmTimes int64) *Chainpot {
+	var cp = NewChainpot(&ChainConf{
+		Coins: []Coins{{CoinType: "origin", Chain: "btc", Symbol: "btc"}},
+		Btc: &BtcConf{
+			ConfirmTimes: confirmTimes,
+			Storage:      boltStorage(t, dir, "btc"),
 		},
+		Builders: map[string]claws.WalletBuilder{"btc": fake},
+	})
+	if err := cp.Register(Bitcoin); err != nil {
+		t.Fatal(err)
 	}
-	for i, _ := range conf.Coins {
-		item := conf.Coins[i]
-		item.Code = strings.ToLower(item.Code)
+	return cp
+}
+
+func tempDir(t *testing.T) string {
+	dir, err := ioutil.TempDir("", "chainpot")
+	if err != nil {
+		t.Fatal(err)
+	}
+	return dir
+}
+
+func boltStorage(t *testing.T, dir string, chain string) Storage {
+	storage, err := NewBoltStorage(dir, chain)
+	if err != nil {
+		t.Fatal(err)
 	}
+	return storage
+}
 
-	var obj = &Chainpot{
-		chains: make([]*chain, 128),
-		conf:   make(map[int]*CoinConf),
+func expectEvents(t *testing.T, ch <-chan *PotEvent, list ...expected) {
+	for i, item := range list {
+		select {
+		case event := <-ch:
+			if event.Event != item.Event || event.ID != item.ID || (item.Hash != "" && event.Content.Hash != item.Hash) {
+				t.Fatalf("event %d: expect %+v, got %s", i, item, mustMarshal(event))
+			}
+		case <-time.After(2 * time.Second):
+			t.Fatalf("event %d: timeout waiting for %+v", i, item)
+		}
 	}
-	if path, err := filepath.Abs(conf.CachePath); err != nil {
-		log.Fatal().Msgf(err.Error())
-	} else {
-		initStorage(path)
+}
+
+func expectNone(t *testing.T, ch <-chan *PotEvent) {
+	select {
+	case event := <-ch:
+		t.Fatalf("unexpected event %s", mustMarshal(event))
+	case <-time.After(200 * time.Millisecond):
 	}
+}
 
-	coins := make([]types.Coins, 0)
-	for _, item := range conf.Coins {
-		coins = append(coins, types.Coins{CoinType: item.Code})
+// start cp and stream its events once fake is listened to
+func startPot(t *testing.T, cp *Chainpot, fake *FakeChain) <-chan *PotEvent {
+	var ch = cp.Events(context.Background(), nil)
+	var n = fake.Listen(-1, 0)
+	cp.Start(nil)
+	if fake.Listen(n, 2*time.Second) <= n {
+		t.Fatal("chain is not listening to heads")
 	}
+	return ch
+}
 
-	claws.SetupGate(&types.Claws{
-		Ctx:     context.TODO(),
-		Version: "0.0.1",
-		Coins:   coins,
-	}, map[string]claws.WalletBuilder{
-		"mlgb": &MaskBuilder{},
-	})
-	for _, cfg := range conf.Coins {
-		obj.conf[cfg.Idx] = cfg
+func stopPot(t *testing.T, cp *Chainpot) *StopReport {
+	ctx, cancel := context.WithTimeout(context.Background(), 2*time.Second)
+	defer cancel()
+	report, err := cp.Stop(ctx)
+	if err != nil {
+		t.Fatal(err)
 	}
+	return report
+}
 
-	obj.Register(2)
-	Pend(9, BlockMessage{
-		Hash:   "0xda29054d35d1af9d54e5e8aafce62fec11c716c8bef67508e2dc4ae5e3882ebb",
-		From:   "0x78ae889cd04cb9274c2600d68ccc5058f43db63e",
-		To:     "0x54a298ee9fccbf0ad8e55bc641d3086b81a48c41",
-		Fee:    "0.000247385",
-		Amount: "0.01",
-	})
-	obj.Add(2, []string{"0x78ae889cd04cb9274c2600d68ccc5058f43db63e"})
-	obj.Start(func(idx int, event *PotEvent) {})
+func TestChainpot_Deposit(t *testing.T) {
+	var dir = tempDir(t)
+	defer os.RemoveAll(dir)
+	var fake = NewFakeChain(100)
+	var cp = newTestPot(t, dir, fake, 3)
+	cp.Add(Bitcoin, []string{testAddr})
+	var ch = startPot(t, cp, fake)
+
+	fake.Mine(BlockMessage{Hash: "a1", From: testOther, To: testAddr, Amount: "0.5"})
+	fake.Announce()
+	fake.Mine()
+	fake.Mine()
+	expectEvents(t, ch,
+		expected{T_DEPOSIT, 1, "a1"},
+		expected{T_DEPOSIT_UPDATE, 2, "a1"},
+		expected{T_DEPOSIT_CONFIRM, 3, "a1"},
+	)
+	fake.Mine()
+	expectNone(t, ch)
 
-	quit := make(chan os.Signal)
-	signal.Notify(quit, syscall.SIGINT, syscall.SIGTERM)
-	<-quit
-	obj.Reset()
-	println("Save data and exit.")
+	var report = stopPot(t, cp)
+	if report.Chains[Bitcoin].EndPoint != 104 || report.Chains[Bitcoin].Pending != 0 || !report.Chains[Bitcoin].Drained {
+		t.Fatalf("unexpected report %s", mustMarshal(report))
+	}
+	if _, ok := <-ch; ok {
+		t.Fatal("stream not closed by Stop")
+	}
 }
 
-func TestNewChainpot(t *testing.T) {
-	var cp = NewChainpot(&Config{
-		CachePath: "./log",
-		Coins: []*CoinConf{
-			{Code: "ETH", Idx: 1, ConfirmTimes: 7},
-		},
-	})
-	cp.Register(1)
-	cp.Add(1, []string{"0x78aE889cd04Cb9274C2600d68CCc5058F43dB63e"})
-	cp.Start(func(idx int, event *PotEvent) {})
+func TestChainpot_Withdraw(t *testing.T) {
+	var dir = tempDir(t)
+	defer os.RemoveAll(dir)
+	var fake = NewFakeChain(100)
+	var cp = newTestPot(t, dir, fake, 2)
+	cp.Add(Bitcoin, []string{testAddr})
+	var ch = startPot(t, cp, fake)
 
-	quit := make(chan os.Signal)
-	signal.Notify(quit, syscall.SIGINT, syscall.SIGTERM)
-	<-quit
-	cp.Reset()
-	println("Save data and exit.")
+	fake.Mine(BlockMessage{Hash: "b1", From: testAddr, To: testOther, Amount: "0.5"})
+	fake.Mine()
+	expectEvents(t, ch,
+		expected{T_WITHDRAW, 1, "b1"},
+		expected{T_WITHDRAW_CONFIRM, 2, "b1"},
+	)
+	stopPot(t, cp)
 }
 
-// 重复添加
-func TestChainpot_Add(t *testing.T) {
-	var cp = NewChainpot(&Config{
-		CachePath: "./log",
-		Coins: []*CoinConf{
-			{Code: "ETH", Idx: 1, ConfirmTimes: 7},
+// blocks skipped by the node announcements are not synced,
+// pending transactions jump to their confirmation
+func TestChainpot_Gap(t *testing.T) {
+	var dir = tempDir(t)
+	defer os.RemoveAll(dir)
+	var fake = NewFakeChain(100)
+	var cp = newTestPot(t, dir, fake, 3)
+	cp.Add(Bitcoin, []string{testAddr})
+	var ch = startPot(t, cp, fake)
+
+	fake.Mine(BlockMessage{Hash: "c1", From: testOther, To: testAddr})
+	fake.Gap(5)
+	expectEvents(t, ch,
+		expected{T_DEPOSIT, 1, "c1"},
+		expected{T_DEPOSIT_CONFIRM, 2, "c1"},
+	)
+	stopPot(t, cp)
+}
+
+// transactions dropped by a reorganization or failing never confirm
+func TestChainpot_ForkAndFailure(t *testing.T) {
+	var dir = tempDir(t)
+	defer os.RemoveAll(dir)
+	var fake = NewFakeChain(100)
+	var cp = newTestPot(t, dir, fake, 2)
+	cp.Add(Bitcoin, []string{testAddr})
+	var ch = startPot(t, cp, fake)
+
+	fake.Mine(BlockMessage{Hash: "d1", From: testOther, To: testAddr})
+	expectEvents(t, ch, expected{T_DEPOSIT, 1, "d1"})
+	fake.Fork(101, nil, nil)
+	expectNone(t, ch)
+
+	fake.FailTx("d2")
+	fake.Mine(BlockMessage{Hash: "d2", From: testOther, To: testAddr})
+	fake.Mine()
+	expectEvents(t, ch, expected{T_DEPOSIT, 3, "d2"})
+	expectNone(t, ch)
+	stopPot(t, cp)
+}
+
+// stuckChain holds UnfoldTxs until released, whatever its context says
+type stuckChain struct {
+	*FakeChain
+	stuck   chan struct{}
+	release chan struct{}
+}
+
+func (c *stuckChain) Build() claws.Wallet {
+	return c
+}
+
+func (c *stuckChain) UnfoldTxs(ctx context.Context, num *big.Int) ([]types.TXN, error) {
+	select {
+	case c.stuck <- struct{}{}:
+	default:
+	}
+	<-c.release
+	return c.FakeChain.UnfoldTxs(ctx, num)
+}
+
+// a chain still busy at the deadline is reported as not drained and its report is left empty
+func TestChainpot_StopDeadline(t *testing.T) {
+	var dir = tempDir(t)
+	defer os.RemoveAll(dir)
+	var fake = &stuckChain{FakeChain: NewFakeChain(100), stuck: make(chan struct{}, 1), release: make(chan struct{})}
+	var cp = NewChainpot(&ChainConf{
+		Coins: []Coins{{CoinType: "origin", Chain: "btc", Symbol: "btc"}},
+		Btc: &BtcConf{
+			ConfirmTimes: 3,
+			Storage:      boltStorage(t, dir, "btc"),
 		},
+		Builders: map[string]claws.WalletBuilder{"btc": fake},
 	})
-	cp.Register(1)
-	cp.Add(1, []string{"0x78aE889cd04Cb9274C2600d68CCc5058F43dB63e"})
-	cp.Add(1, []string{"0x78aE889cd04Cb9274C2600d68CCc5058F43dB63e"})
-	cp.Add(1, []string{"0xE08f0bccBCa8192620259aA402b29f7b862575D3"})
-	cp.Start(func(idx int, event *PotEvent) {})
-	select {}
+	if err := cp.Register(Bitcoin); err != nil {
+		t.Fatal(err)
+	}
+	cp.Add(Bitcoin, []string{testAddr})
+	startPot(t, cp, fake.FakeChain)
+
+	fake.Mine(BlockMessage{Hash: "s1", From: testOther, To: testAddr})
+	select {
+	case <-fake.stuck:
+	case <-time.After(2 * time.Second):
+		t.Fatal("block not unfolded")
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), 100*time.Millisecond)
+	defer cancel()
+	report, err := cp.Stop(ctx)
+	if err != context.DeadlineExceeded {
+		t.Fatalf("expect deadline error, got %v", err)
+	}
+	var obj = report.Chains[Bitcoin]
+	if obj == nil || obj.Drained || obj.EndPoint != 0 {
+		t.Fatalf("unexpected report %s", mustMarshal(report))
+	}
+	close(fake.release)
+}
+
+// a block failing to unfold is skipped, the following ones are still synced
+func TestChainpot_RPCError(t *testing.T) {
+	var dir = tempDir(t)
+	defer os.RemoveAll(dir)
+	var fake = NewFakeChain(100)
+	var cp = newTestPot(t, dir, fake, 2)
+	cp.Add(Bitcoin, []string{testAddr})
+	var ch = startPot(t, cp, fake)
+
+	fake.FailUnfold(101, 1)
+	fake.Mine(BlockMessage{Hash: "e1", From: testOther, To: testAddr})
+	fake.Mine(BlockMessage{Hash: "e2", From: testOther, To: testAddr})
+	expectEvents(t, ch, expected{T_DEPOSIT, 1, "e2"})
+	stopPot(t, cp)
+}
+
+// on restart the blocks before the saved endpoint are synced again
+// and their transactions are reported at once
+func TestChainpot_Restart(t *testing.T) {
+	var dir = tempDir(t)
+	defer os.RemoveAll(dir)
+	var fake = NewFakeChain(100)
+	var cp = newTestPot(t, dir, fake, 3)
+	cp.Add(Bitcoin, []string{testAddr})
+	var ch = startPot(t, cp, fake)
+
+	fake.Mine(BlockMessage{Hash: "f1", From: testOther, To: testAddr})
+	expectEvents(t, ch, expected{T_DEPOSIT, 1, "f1"})
+	var report = stopPot(t, cp)
+	if report.Chains[Bitcoin].EndPoint != 101 || report.Chains[Bitcoin].EventID != 4 || report.Chains[Bitcoin].Pending != 1 {
+		t.Fatalf("unexpected report %s", mustMarshal(report))
+	}
+
+	cp = newTestPot(t, dir, fake, 3)
+	ch = startPot(t, cp, fake)
+	fake.Mine()
+	expectEvents(t, ch,
+		expected{T_DEPOSIT, 4, "f1"},
+		expected{T_DEPOSIT_UPDATE, 5, "f1"},
+		expected{T_DEPOSIT_CONFIRM, 6, "f1"},
+	)
+	stopPot(t, cp)
 }
 
-// 重复注册
 func TestChainpot_Register(t *testing.T) {
-	var cp = NewChainpot(&Config{
-		CachePath: "./log",
-		Coins: []*CoinConf{
-			{Code: "ETH", Idx: 1, ConfirmTimes: 7},
-		},
-	})
-	cp.Register(1)
-	err := cp.Register(1)
-	if err != nil {
-		log.Error().Msg(err.Error())
+	var dir = tempDir(t)
+	defer os.RemoveAll(dir)
+	var cp = newTestPot(t, dir, NewFakeChain(100), 3)
+	if err := cp.Register(Bitcoin); err == nil {
+		t.Fatal("expect repeat register error")
+	}
+	if !cp.Ready(Bitcoin) || cp.Ready(Ethereum) {
+		t.Fatal("unexpected ready state")
 	}
 
-	cp.Add(1, []string{"0x78aE889cd04Cb9274C2600d68CCc5058F43dB63e"})
-	cp.Start(func(idx int, event *PotEvent) {})
-	select {}
+	var records, rejected = cp.Add(Bitcoin, []string{testAddr, testAddr, testOther})
+	if len(records) != 2 || len(rejected) != 0 {
+		t.Fatalf("unexpected records %v", records)
+	}
+	stopPot(t, cp)
 }
 
 func TestChainpot_Reset(t *testing.T) {
-	var cp = NewChainpot(&Config{
-		CachePath: "./log",
-		Coins: []*CoinConf{
-			{Code: "ETH", Idx: 1, ConfirmTimes: 7},
-		},
+	var dir = tempDir(t)
+	defer os.RemoveAll(dir)
+	var fake = NewFakeChain(100)
+	var cp = newTestPot(t, dir, fake, 3)
+	cp.Add(Bitcoin, []string{testAddr})
+	var ch = startPot(t, cp, fake)
+	fake.Mine()
+	if _, err := cp.AddMemo(Bitcoin, testOther, "m1"); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := cp.AddInvoice(Bitcoin, &InvoiceRequest{ID: "i1", Address: testAddr, Symbol: "btc", Amount: "1", Expiry: fake.Now().Add(time.Hour)}); err != nil {
+		t.Fatal(err)
+	}
+
+	var storage = cp.conf.Btc.Storage
+	cp.Reset()
+	if cp.Ready(Bitcoin) {
+		t.Fatal("chain still registered after reset")
+	}
+	// no routine is left to write the endpoint back
+	if cache, _ := storage.GetConfig(); cache.EndPoint != 0 || cache.EventID != 0 {
+		t.Fatalf("unexpected config after reset %s", mustMarshal(cache))
+	}
+	// nothing of the chain is left to be picked up by the next Register
+	storage.(*BoltStorage).Database.View(func(tx *bolt.Tx) error {
+		for _, name := range [][]byte{[]byte("addrs"), withdrawalsBucket, utxosBucket, xpubsBucket, memosBucket, invoicesBucket} {
+			if key, _ := tx.Bucket(name).Cursor().First(); key != nil {
+				t.Fatalf("bucket %s not cleared by reset", name)
+			}
+		}
+		return nil
 	})
-	cp.Register(1)
-	cp.Add(1, []string{"0x78aE889cd04Cb9274C2600d68CCc5058F43dB63e"})
-	cp.Start(func(idx int, event *PotEvent) {})
+	if _, ok := <-ch; ok {
+		t.Fatal("stream not closed by Reset")
+	}
+}
+
+// the accessors may run next to Reset, as the status handler does
+func TestChainpot_ResetConcurrent(t *testing.T) {
+	var dir = tempDir(t)
+	defer os.RemoveAll(dir)
+	var fake = NewFakeChain(100)
+	var cp = newTestPot(t, dir, fake, 3)
+	startPot(t, cp, fake)
 
+	var done = make(chan struct{})
+	go func() {
+		defer close(done)
+		for cp.Ready(Bitcoin) {
+			cp.Status()
+			cp.Track(Bitcoin, "t1")
+			cp.Withdrawal(Bitcoin, "w1")
+			cp.AddMemo(Bitcoin, testOther, "m1")
+		}
+	}()
 	cp.Reset()
-	select {}
+	<-done
+	if _, err := cp.AddMemo(Bitcoin, testOther, "m1"); err != poterr.NotRegErr {
+		t.Fatalf("expect NotRegErr after reset, got %v", err)
+	}
+}
+
+func TestChainpot_RecordReplay(t *testing.T) {
+	var dir = tempDir(t)
+	defer os.RemoveAll(dir)
+	var fake = NewFakeChain(100)
+	var buf = &bytes.Buffer{}
+	var cp = NewChainpot(&ChainConf{
+		Coins:    []Coins{{CoinType: "origin", Chain: "btc", Symbol: "btc"}},
+		Btc:      &BtcConf{ConfirmTimes: 2, Storage: boltStorage(t, dir, "btc")},
+		Builders: map[string]claws.WalletBuilder{"btc": fake},
+		Record:   buf,
+	})
+	cp.Register(Bitcoin)
+	cp.Add(Bitcoin, []string{testAddr})
+	var ch = startPot(t, cp, fake)
+
+	fake.Mine(BlockMessage{Hash: "g1", From: testOther, To: testAddr})
+	fake.FailUnfold(102, 1)
+	fake.Mine(BlockMessage{Hash: "g2", From: testOther, To: testAddr})
+	fake.Mine()
+	var list = []expected{{T_DEPOSIT, 1, "g1"}, {T_DEPOSIT_CONFIRM, 2, "g1"}}
+	expectEvents(t, ch, list...)
+	stopPot(t, cp)
+
+	replayer, err := NewReplayer(buf)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var replayDir = tempDir(t)
+	defer os.RemoveAll(replayDir)
+	cp = NewChainpot(&ChainConf{
+		Coins:    []Coins{{CoinType: "origin", Chain: "btc", Symbol: "btc"}},
+		Btc:      &BtcConf{ConfirmTimes: 2, Storage: boltStorage(t, replayDir, "btc")},
+		Builders: replayer.Builders(),
+	})
+	cp.Register(Bitcoin)
+	cp.Add(Bitcoin, []string{testAddr})
+	ch = cp.Events(context.Background(), nil)
+	cp.Start(nil)
+	expectEvents(t, ch, list...)
+	expectNone(t, ch)
+	stopPot(t, cp)
+}
+
+// transfers between watched addresses are reported once with both sides, self-sends included
+func TestChainpot_Internal(t *testing.T) {
+	var dir = tempDir(t)
+	defer os.RemoveAll(dir)
+	var fake = NewFakeChain(100)
+	var cp = newTestPot(t, dir, fake, 2)
+	cp.Add(Bitcoin, []string{testAddr, testOther})
+	var ch = startPot(t, cp, fake)
+
+	fake.Mine(
+		BlockMessage{Hash: "i1", From: testAddr, To: testOther, Amount: "5"},
+		BlockMessage{Hash: "i2", From: testAddr, To: testAddr, Fee: "1"},
+	)
+	var first = make([]*PotEvent, 0)
+	for _, item := range []expected{{T_INTERNAL, 1, "i1"}, {T_INTERNAL, 3, "i2"}} {
+		var event = <-ch
+		if event.Event != item.Event || event.ID != item.ID || event.Content.Hash != item.Hash {
+			t.Fatalf("expect %+v, got %s", item, mustMarshal(event))
+		}
+		first = append(first, event)
+	}
+	if first[0].CorrelationID != "i1:0" || first[0].Content.From != testAddr || first[0].Content.To != testOther {
+		t.Fatalf("unexpected internal transfer %s", mustMarshal(first[0]))
+	}
+	fake.Mine()
+	for _, item := range first {
+		if event := <-ch; event.Event != T_INTERNAL_CONFIRM || event.CorrelationID != item.CorrelationID {
+			t.Fatalf("unexpected confirm %s of %s", mustMarshal(event), mustMarshal(item))
+		}
+	}
+	expectNone(t, ch)
+	stopPot(t, cp)
 }
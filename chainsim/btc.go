@@ -0,0 +1,187 @@
+package chainsim
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"math/big"
+	"net/http"
+)
+
+// BtcServer serves the subset of the bitcoin core rpc used by chain adapters,
+// requests are checked against User and Password when set
+type BtcServer struct {
+	chain    *Chain
+	User     string
+	Password string
+	// serves getblock as the nodes before verbosity 3, without the previous outputs of the inputs
+	Legacy bool
+}
+
+func NewBtcServer(chain *Chain) *BtcServer {
+	return &BtcServer{chain: chain}
+}
+
+func (s *BtcServer) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	if s.User != "" || s.Password != "" {
+		user, password, ok := r.BasicAuth()
+		if !ok || user != s.User || password != s.Password {
+			http.Error(w, "unauthorized", http.StatusUnauthorized)
+			return
+		}
+	}
+	if r.Method != http.MethodPost {
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	serveRPC(w, r, s.call)
+}
+
+var errNotFound = &rpcError{Code: -5, Message: "Block not found"}
+
+func (s *BtcServer) call(method string, params []json.RawMessage) (interface{}, *rpcError) {
+	switch method {
+	case "getblockcount":
+		return s.chain.Head().Number, nil
+	case "getbestblockhash":
+		return strip0x(s.chain.Head().Hash), nil
+	case "getblockhash":
+		var height int64
+		if !param(params, 0, &height) {
+			return nil, errParams
+		}
+		var block = s.chain.Block(height)
+		if block == nil {
+			return nil, &rpcError{Code: -8, Message: "Block height out of range"}
+		}
+		return strip0x(block.Hash), nil
+	case "getblock":
+		var hash string
+		var verbosity = 1
+		if !param(params, 0, &hash) {
+			return nil, errParams
+		}
+		param(params, 1, &verbosity)
+		var block = s.chain.BlockByHash("0x" + strip0x(hash))
+		if block == nil {
+			return nil, errNotFound
+		}
+		return s.block(block, verbosity), nil
+	case "getrawtransaction":
+		var txid string
+		if !param(params, 0, &txid) {
+			return nil, errParams
+		}
+		tx, block := s.chain.Tx("0x" + strip0x(txid))
+		if tx == nil {
+			if tx = s.chain.Pending("0x" + strip0x(txid)); tx != nil {
+				return btcTx(tx), nil
+			}
+			return nil, &rpcError{Code: -5, Message: "No such mempool or blockchain transaction"}
+		}
+		var obj = btcTx(tx)
+		obj["blockhash"] = strip0x(block.Hash)
+		obj["confirmations"] = s.chain.Head().Number - block.Number + 1
+		return obj, nil
+	}
+	return nil, errMethod
+}
+
+func (s *BtcServer) block(block *Block, verbosity int) map[string]interface{} {
+	var txs = make([]interface{}, 0)
+	for _, tx := range block.Txs {
+		if verbosity >= 3 && !s.Legacy {
+			txs = append(txs, s.withPrevouts(tx))
+		} else if verbosity >= 2 {
+			txs = append(txs, btcTx(tx))
+		} else {
+			txs = append(txs, strip0x(tx.Hash))
+		}
+	}
+
+	var obj = map[string]interface{}{
+		"hash":          strip0x(block.Hash),
+		"height":        block.Number,
+		"confirmations": s.chain.Head().Number - block.Number + 1,
+		"time":          block.Time,
+		"nTx":           len(block.Txs),
+		"tx":            txs,
+	}
+	if block.Parent != "" {
+		obj["previousblockhash"] = strip0x(block.Parent)
+	}
+	return obj
+}
+
+// transaction with the outputs spent by its inputs
+func (s *BtcServer) withPrevouts(tx *Tx) map[string]interface{} {
+	var obj = btcTx(tx)
+	for i, item := range tx.Inputs {
+		prev, _ := s.chain.Tx("0x" + strip0x(item.Txid))
+		if prev == nil || int(item.Vout) >= len(prev.Outputs) {
+			continue
+		}
+		var out = prev.Outputs[item.Vout]
+		obj["vin"].([]interface{})[i].(map[string]interface{})["prevout"] = map[string]interface{}{
+			"value":        btcValue(out.Value),
+			"scriptPubKey": map[string]interface{}{"address": out.Address},
+		}
+	}
+	return obj
+}
+
+func btcTx(tx *Tx) map[string]interface{} {
+	var vin = make([]interface{}, 0)
+	if len(tx.Inputs) == 0 {
+		vin = append(vin, map[string]interface{}{"coinbase": "00", "sequence": 4294967295})
+	}
+	for _, item := range tx.Inputs {
+		vin = append(vin, map[string]interface{}{
+			"txid":     strip0x(item.Txid),
+			"vout":     item.Vout,
+			"sequence": 4294967295,
+		})
+	}
+
+	var vout = make([]interface{}, 0)
+	for i, item := range tx.Outputs {
+		var script map[string]interface{}
+		if item.Data != "" {
+			var data = strip0x(item.Data)
+			script = map[string]interface{}{
+				"type": "nulldata",
+				"asm":  "OP_RETURN " + data,
+				"hex":  fmt.Sprintf("6a%02x%s", len(data)/2, data),
+			}
+		} else {
+			var hash = sha256.Sum256([]byte(item.Address))
+			script = map[string]interface{}{
+				"type":    "witness_v0_keyhash",
+				"address": item.Address,
+				"hex":     "0014" + hex.EncodeToString(hash[:20]),
+			}
+		}
+		vout = append(vout, map[string]interface{}{
+			"value":        btcValue(item.Value),
+			"n":            i,
+			"scriptPubKey": script,
+		})
+	}
+
+	return map[string]interface{}{
+		"txid": strip0x(tx.Hash),
+		"hash": strip0x(tx.Hash),
+		"vin":  vin,
+		"vout": vout,
+	}
+}
+
+// satoshis as a json number of BTC with 8 decimals
+func btcValue(sats *big.Int) json.Number {
+	if sats == nil {
+		sats = new(big.Int)
+	}
+	var q, r = new(big.Int).QuoRem(sats, big.NewInt(1e8), new(big.Int))
+	return json.Number(fmt.Sprintf("%s.%08d", q.String(), r.Int64()))
+}
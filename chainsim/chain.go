@@ -0,0 +1,390 @@
+// Package chainsim simulates ethereum and bitcoin nodes offline,
+// blocks are produced by scripts or by hand and served over the node RPC protocols
+package chainsim
+
+import (
+	"crypto/sha256"
+	"encoding/binary"
+	"encoding/hex"
+	"math/big"
+	"strings"
+	"sync"
+	"time"
+)
+
+// keccak256("Transfer(address,address,uint256)")
+const TransferTopic = "0xddf252ad1be2c89b69c2b068fc378daa952ba7f163c4a11628f55a4df523b3ef"
+
+type Log struct {
+	Address string
+	Topics  []string
+	Data    string
+	Index   uint64
+}
+
+// bitcoin input spending an earlier output
+type TxIn struct {
+	Txid string
+	Vout uint32
+}
+
+// bitcoin output, Data is the payload of an OP_RETURN output
+type TxOut struct {
+	Address string
+	Value   *big.Int
+	Data    string
+}
+
+// Call is a nested call of an ethereum transaction, served by the trace apis
+type Call struct {
+	// CALL, DELEGATECALL, STATICCALL, CREATE or SELFDESTRUCT
+	Type  string
+	From  string
+	To    string
+	Value *big.Int
+	// set on a reverted call
+	Error string
+	Calls []*Call
+}
+
+type Tx struct {
+	Hash  string
+	From  string
+	To    string
+	Value *big.Int
+	Nonce uint64
+	Input string
+	// receipt status, 1 for success and 0 for reverted
+	Status uint64
+	Logs   []*Log
+	// calls made by the contract executing the transaction
+	Calls []*Call
+
+	Inputs  []*TxIn
+	Outputs []*TxOut
+}
+
+type Block struct {
+	Number int64
+	Hash   string
+	Parent string
+	Time   int64
+	Txs    []*Tx
+}
+
+// Chain is a canonical list of blocks with a mempool,
+// heads are published to subscribers as they're mined
+type Chain struct {
+	mu      sync.Mutex
+	blocks  []*Block
+	pending []*Tx
+	nonces  map[string]uint64
+	subs    map[int]chan *Block
+	subSeq  int
+	seq     uint64
+	salt    uint64
+	now     func() time.Time
+	tokens  map[string]*Token
+}
+
+// Token is the metadata an ERC20 contract answers to eth_call
+type Token struct {
+	Symbol   string
+	Decimals uint8
+}
+
+func New(start int64) *Chain {
+	var c = &Chain{
+		nonces: make(map[string]uint64),
+		subs:   make(map[int]chan *Block),
+		now:    time.Now,
+		tokens: make(map[string]*Token),
+	}
+	c.blocks = append(c.blocks, &Block{Number: start, Hash: c.hash("block", start), Time: c.now().Unix()})
+	return c
+}
+
+func (c *Chain) hash(kind string, num int64) string {
+	var h = sha256.New()
+	var buf = make([]byte, 24)
+	binary.BigEndian.PutUint64(buf, uint64(num))
+	binary.BigEndian.PutUint64(buf[8:], c.seq)
+	binary.BigEndian.PutUint64(buf[16:], c.salt)
+	h.Write([]byte(kind))
+	h.Write(buf)
+	c.seq++
+	return "0x" + hex.EncodeToString(h.Sum(nil))
+}
+
+// Head returns the last canonical block
+func (c *Chain) Head() *Block {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.blocks[len(c.blocks)-1]
+}
+
+// Earliest returns the first block the chain was started with
+func (c *Chain) Earliest() *Block {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.blocks[0]
+}
+
+// Block returns the canonical block at height or nil
+func (c *Chain) Block(height int64) *Block {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	var idx = height - c.blocks[0].Number
+	if idx < 0 || idx >= int64(len(c.blocks)) {
+		return nil
+	}
+	return c.blocks[idx]
+}
+
+// BlockByHash returns the canonical block with hash or nil
+func (c *Chain) BlockByHash(hash string) *Block {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	for _, item := range c.blocks {
+		if item.Hash == hash {
+			return item
+		}
+	}
+	return nil
+}
+
+// Tx returns a mined transaction with its block
+func (c *Chain) Tx(hash string) (*Tx, *Block) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	for _, block := range c.blocks {
+		for _, tx := range block.Txs {
+			if tx.Hash == hash {
+				return tx, block
+			}
+		}
+	}
+	return nil, nil
+}
+
+// Pending returns a transaction of the mempool or nil
+func (c *Chain) Pending(hash string) *Tx {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	for _, tx := range c.pending {
+		if tx.Hash == hash {
+			return tx
+		}
+	}
+	return nil
+}
+
+// Submit puts tx into the mempool, hash and nonce are filled when empty
+func (c *Chain) Submit(tx *Tx) *Tx {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.prepare(tx)
+	c.pending = append(c.pending, tx)
+	return tx
+}
+
+func (c *Chain) prepare(tx *Tx) {
+	if tx.Hash == "" {
+		tx.Hash = c.hash("tx", int64(len(c.pending)))
+	}
+	if tx.Value == nil {
+		tx.Value = new(big.Int)
+	}
+	if tx.From != "" && tx.Inputs == nil {
+		if tx.Nonce == 0 {
+			tx.Nonce = c.nonces[tx.From]
+		}
+		if tx.Nonce >= c.nonces[tx.From] {
+			c.nonces[tx.From] = tx.Nonce + 1
+		}
+	}
+}
+
+// Drop evicts a transaction from the mempool, it reports whether it was there
+func (c *Chain) Drop(hash string) bool {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	for i, tx := range c.pending {
+		if tx.Hash == hash {
+			c.pending = append(c.pending[:i:i], c.pending[i+1:]...)
+			return true
+		}
+	}
+	return false
+}
+
+// Nonce returns the next nonce of an account, counting the mempool
+func (c *Chain) Nonce(addr string) uint64 {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.nonces[addr]
+}
+
+// MinedNonce returns the next nonce of an account on the canonical chain
+func (c *Chain) MinedNonce(addr string) uint64 {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	var next uint64
+	for _, block := range c.blocks {
+		for _, tx := range block.Txs {
+			if tx.From == addr && tx.Inputs == nil && tx.Nonce+1 > next {
+				next = tx.Nonce + 1
+			}
+		}
+	}
+	return next
+}
+
+// Mine appends a block holding the mempool and txs, then publishes it
+func (c *Chain) Mine(txs ...*Tx) *Block {
+	c.mu.Lock()
+	var block = c.mine(txs)
+	c.mu.Unlock()
+
+	c.publish(block)
+	return block
+}
+
+func (c *Chain) mine(txs []*Tx) *Block {
+	var parent = c.blocks[len(c.blocks)-1]
+	var block = &Block{
+		Number: parent.Number + 1,
+		Parent: parent.Hash,
+		Time:   c.now().Unix(),
+	}
+	block.Hash = c.hash("block", block.Number)
+
+	for _, tx := range txs {
+		c.prepare(tx)
+	}
+	block.Txs = append(c.pending, txs...)
+	c.pending = nil
+
+	var index uint64
+	for _, tx := range block.Txs {
+		for _, item := range tx.Logs {
+			item.Index = index
+			index++
+		}
+	}
+	c.blocks = append(c.blocks, block)
+	return block
+}
+
+// Reorg drops the last depth blocks and mines one block per txs list on the new branch,
+// the transactions of dropped blocks not mined again are lost
+func (c *Chain) Reorg(depth int, blocks ...[]*Tx) *Block {
+	c.mu.Lock()
+	if depth >= len(c.blocks) {
+		depth = len(c.blocks) - 1
+	}
+	c.blocks = c.blocks[:len(c.blocks)-depth]
+	c.salt++
+
+	var head = c.blocks[len(c.blocks)-1]
+	for _, txs := range blocks {
+		head = c.mine(txs)
+	}
+	c.mu.Unlock()
+
+	c.publish(head)
+	return head
+}
+
+// Subscribe returns a channel receiving the new heads until cancel is called
+func (c *Chain) Subscribe() (<-chan *Block, func()) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	c.subSeq++
+	var id = c.subSeq
+	var ch = make(chan *Block, 64)
+	c.subs[id] = ch
+	return ch, func() {
+		c.mu.Lock()
+		defer c.mu.Unlock()
+		if _, ok := c.subs[id]; ok {
+			delete(c.subs, id)
+			close(ch)
+		}
+	}
+}
+
+func (c *Chain) publish(block *Block) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	for _, ch := range c.subs {
+		select {
+		case ch <- block:
+		default:
+		}
+	}
+}
+
+// Deploy registers the metadata of the token at addr
+func (c *Chain) Deploy(addr string, token *Token) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.tokens[strings.ToLower(addr)] = token
+}
+
+// Token returns the metadata of the token at addr, nil when none is deployed
+func (c *Chain) Token(addr string) *Token {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.tokens[strings.ToLower(addr)]
+}
+
+// Pay builds a plain value transfer
+func Pay(from, to string, value *big.Int) *Tx {
+	return &Tx{From: from, To: to, Value: value, Status: 1}
+}
+
+// Spend builds a bitcoin transaction
+func Spend(inputs []*TxIn, outputs ...*TxOut) *Tx {
+	return &Tx{Inputs: inputs, Outputs: outputs, Status: 1}
+}
+
+// TokenTransfer builds an ERC20 transfer call on token with its Transfer log
+func TokenTransfer(token, from, to string, amount *big.Int) *Tx {
+	return &Tx{
+		From:   from,
+		To:     token,
+		Value:  new(big.Int),
+		Input:  "0xa9059cbb" + word(to) + wordInt(amount),
+		Status: 1,
+		Logs: []*Log{{
+			Address: token,
+			Topics:  []string{TransferTopic, "0x" + word(from), "0x" + word(to)},
+			Data:    "0x" + wordInt(amount),
+		}},
+	}
+}
+
+// left pad an address to a 32 bytes abi word without prefix
+func word(addr string) string {
+	if len(addr) >= 2 && addr[:2] == "0x" {
+		addr = addr[2:]
+	}
+	for len(addr) < 64 {
+		addr = "0" + addr
+	}
+	return addr
+}
+
+func wordInt(num *big.Int) string {
+	return word(num.Text(16))
+}
+
+// right pad bytes to a multiple of 32
+func padRight(bs []byte) []byte {
+	for len(bs)%32 != 0 {
+		bs = append(bs, 0)
+	}
+	return bs
+}
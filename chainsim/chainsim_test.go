@@ -0,0 +1,142 @@
+package chainsim
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/json"
+	"math/big"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+)
+
+func post(t *testing.T, url string, method string, params ...interface{}) json.RawMessage {
+	bs, _ := json.Marshal(map[string]interface{}{"jsonrpc": "2.0", "id": 1, "method": method, "params": params})
+	res, err := http.Post(url, "application/json", bytes.NewReader(bs))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer res.Body.Close()
+
+	var body struct {
+		Result json.RawMessage
+		Error  *rpcError
+	}
+	if err := json.NewDecoder(res.Body).Decode(&body); err != nil {
+		t.Fatal(err)
+	}
+	if body.Error != nil {
+		t.Fatalf("%s: %s", method, body.Error.Message)
+	}
+	return body.Result
+}
+
+func TestEthServer(t *testing.T) {
+	var chain = New(100)
+	var server = httptest.NewServer(NewEthServer(chain))
+	defer server.Close()
+
+	var token = "0x00000000000000000000000000000000000000aa"
+	var from = "0x00000000000000000000000000000000000000bb"
+	var to = "0x00000000000000000000000000000000000000cc"
+	chain.Mine(Pay(from, to, big.NewInt(5)))
+	var block = chain.Mine(TokenTransfer(token, from, to, big.NewInt(7)))
+
+	if res := post(t, server.URL, "eth_blockNumber"); string(res) != `"0x66"` {
+		t.Fatalf("unexpected block number %s", res)
+	}
+
+	var logs []map[string]interface{}
+	json.Unmarshal(post(t, server.URL, "eth_getLogs", map[string]interface{}{
+		"fromBlock": "0x65", "toBlock": "latest", "address": token, "topics": []interface{}{TransferTopic},
+	}), &logs)
+	if len(logs) != 1 || logs[0]["data"] != "0x"+wordInt(big.NewInt(7)) {
+		t.Fatalf("unexpected logs %v", logs)
+	}
+
+	var receipt map[string]interface{}
+	json.Unmarshal(post(t, server.URL, "eth_getTransactionReceipt", block.Txs[0].Hash), &receipt)
+	if receipt["status"] != "0x1" || receipt["blockNumber"] != "0x66" {
+		t.Fatalf("unexpected receipt %v", receipt)
+	}
+	if res := post(t, server.URL, "eth_getTransactionCount", from, "latest"); string(res) != `"0x2"` {
+		t.Fatalf("unexpected nonce %s", res)
+	}
+
+	var reorged = chain.Reorg(1, nil, nil)
+	if res := post(t, server.URL, "eth_getTransactionReceipt", block.Txs[0].Hash); string(res) != "null" || reorged.Number != 103 {
+		t.Fatalf("reorged transaction still mined: %s", res)
+	}
+}
+
+func TestEthServer_NewHeads(t *testing.T) {
+	var chain = New(100)
+	var server = httptest.NewServer(NewEthServer(chain))
+	defer server.Close()
+
+	conn, err := net.Dial("tcp", strings.TrimPrefix(server.URL, "http://"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	conn.Write([]byte("GET / HTTP/1.1\r\nHost: sim\r\nUpgrade: websocket\r\nConnection: Upgrade\r\n" +
+		"Sec-WebSocket-Key: dGhlIHNhbXBsZSBub25jZQ==\r\nSec-WebSocket-Version: 13\r\n\r\n"))
+	var reader = bufio.NewReader(conn)
+	res, err := http.ReadResponse(reader, nil)
+	if err != nil || res.StatusCode != http.StatusSwitchingProtocols {
+		t.Fatalf("upgrade failed: %v", err)
+	}
+
+	var client = &wsConn{conn: conn, rw: bufio.NewReadWriter(reader, bufio.NewWriter(conn))}
+	client.write([]byte(`{"jsonrpc":"2.0","id":1,"method":"eth_subscribe","params":["newHeads"]}`))
+	if _, err := client.read(); err != nil {
+		t.Fatal(err)
+	}
+
+	chain.Mine()
+	message, err := client.read()
+	if err != nil {
+		t.Fatal(err)
+	}
+	var notice struct {
+		Params struct {
+			Result map[string]interface{}
+		}
+	}
+	json.Unmarshal(message, &notice)
+	if notice.Params.Result["number"] != "0x65" {
+		t.Fatalf("unexpected head %s", message)
+	}
+}
+
+func TestBtcServer(t *testing.T) {
+	var chain = New(100)
+	var server = httptest.NewServer(NewBtcServer(chain))
+	defer server.Close()
+
+	var block = chain.Mine(Spend(nil, &TxOut{Address: "bc1qwatched", Value: big.NewInt(150000000)}, &TxOut{Data: "cafe"}))
+	if res := post(t, server.URL, "getblockcount"); string(res) != "101" {
+		t.Fatalf("unexpected block count %s", res)
+	}
+
+	var hash string
+	json.Unmarshal(post(t, server.URL, "getblockhash", 101), &hash)
+	var obj struct {
+		Tx []struct {
+			Txid string
+			Vout []struct {
+				Value        json.Number
+				ScriptPubKey map[string]interface{}
+			}
+		}
+	}
+	json.Unmarshal(post(t, server.URL, "getblock", hash, 2), &obj)
+	if len(obj.Tx) != 1 || "0x"+obj.Tx[0].Txid != block.Txs[0].Hash {
+		t.Fatalf("unexpected block %v", obj)
+	}
+	if obj.Tx[0].Vout[0].Value != "1.50000000" || obj.Tx[0].Vout[1].ScriptPubKey["type"] != "nulldata" {
+		t.Fatalf("unexpected outputs %v", obj.Tx[0].Vout)
+	}
+}
@@ -0,0 +1,433 @@
+package chainsim
+
+import (
+	"encoding/hex"
+	"encoding/json"
+	"math/big"
+	"net/http"
+	"strings"
+	"sync"
+)
+
+// EthServer serves the subset of the ethereum json-rpc used by chain adapters,
+// over http and over websocket with newHeads subscriptions
+type EthServer struct {
+	chain *Chain
+}
+
+func NewEthServer(chain *Chain) *EthServer {
+	return &EthServer{chain: chain}
+}
+
+func (s *EthServer) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	if isWebsocket(r) {
+		s.serveWebsocket(w, r)
+		return
+	}
+	if r.Method != http.MethodPost {
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	serveRPC(w, r, s.call)
+}
+
+func (s *EthServer) serveWebsocket(w http.ResponseWriter, r *http.Request) {
+	conn, err := upgrade(w, r)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	defer conn.close()
+
+	var mu sync.Mutex
+	var cancels = make(map[string]func())
+	var subSeq int64
+	defer func() {
+		mu.Lock()
+		for _, cancel := range cancels {
+			cancel()
+		}
+		mu.Unlock()
+	}()
+
+	for {
+		message, err := conn.read()
+		if err != nil {
+			return
+		}
+		var req = &rpcRequest{}
+		if err := json.Unmarshal(message, req); err != nil {
+			continue
+		}
+
+		var res *rpcResponse
+		switch req.Method {
+		case "eth_subscribe":
+			var kind string
+			if !param(req.Params, 0, &kind) || kind != "newHeads" {
+				res = &rpcResponse{JsonRpc: "2.0", ID: req.ID, Error: errParams}
+				break
+			}
+			ch, cancel := s.chain.Subscribe()
+			subSeq++
+			var id = hexInt(subSeq)
+			mu.Lock()
+			cancels[id] = cancel
+			mu.Unlock()
+			res = &rpcResponse{JsonRpc: "2.0", ID: req.ID, Result: id}
+			bs, _ := json.Marshal(res)
+			conn.write(bs)
+			res = nil
+
+			go func() {
+				for block := range ch {
+					bs, _ := json.Marshal(map[string]interface{}{
+						"jsonrpc": "2.0",
+						"method":  "eth_subscription",
+						"params": map[string]interface{}{
+							"subscription": id,
+							"result":       ethHeader(block),
+						},
+					})
+					if conn.write(bs) != nil {
+						return
+					}
+				}
+			}()
+		case "eth_unsubscribe":
+			var id string
+			param(req.Params, 0, &id)
+			mu.Lock()
+			cancel, ok := cancels[id]
+			delete(cancels, id)
+			mu.Unlock()
+			if ok {
+				cancel()
+			}
+			res = &rpcResponse{JsonRpc: "2.0", ID: req.ID, Result: ok}
+		default:
+			res = call(req, s.call)
+		}
+
+		if res != nil {
+			bs, _ := json.Marshal(res)
+			if conn.write(bs) != nil {
+				return
+			}
+		}
+	}
+}
+
+func (s *EthServer) call(method string, params []json.RawMessage) (interface{}, *rpcError) {
+	switch method {
+	case "eth_chainId":
+		return "0x539", nil
+	case "net_version":
+		return "1337", nil
+	case "eth_gasPrice":
+		return "0x3b9aca00", nil
+	case "eth_blockNumber":
+		return hexInt(s.chain.Head().Number), nil
+	case "eth_getBlockByNumber":
+		var tag string
+		var full bool
+		if !param(params, 0, &tag) {
+			return nil, errParams
+		}
+		param(params, 1, &full)
+		var block = s.blockByTag(tag)
+		if block == nil {
+			return nil, nil
+		}
+		return ethBlock(block, full), nil
+	case "eth_getBlockByHash":
+		var hash string
+		var full bool
+		if !param(params, 0, &hash) {
+			return nil, errParams
+		}
+		param(params, 1, &full)
+		var block = s.chain.BlockByHash(hash)
+		if block == nil {
+			return nil, nil
+		}
+		return ethBlock(block, full), nil
+	case "eth_getTransactionByHash":
+		var hash string
+		if !param(params, 0, &hash) {
+			return nil, errParams
+		}
+		if tx, block := s.chain.Tx(hash); tx != nil {
+			return ethTx(tx, block, txIndex(block, tx)), nil
+		}
+		if tx := s.chain.Pending(hash); tx != nil {
+			return ethTx(tx, nil, 0), nil
+		}
+		return nil, nil
+	case "eth_getTransactionReceipt":
+		var hash string
+		if !param(params, 0, &hash) {
+			return nil, errParams
+		}
+		tx, block := s.chain.Tx(hash)
+		if tx == nil {
+			return nil, nil
+		}
+		return ethReceipt(tx, block, txIndex(block, tx)), nil
+	case "eth_getTransactionCount":
+		var addr, tag string
+		if !param(params, 0, &addr) {
+			return nil, errParams
+		}
+		param(params, 1, &tag)
+		if tag == "pending" {
+			return hexUint(s.chain.Nonce(addr)), nil
+		}
+		return hexUint(s.chain.MinedNonce(addr)), nil
+	case "eth_call":
+		var call struct {
+			To   string `json:"to"`
+			Data string `json:"data"`
+		}
+		if !param(params, 0, &call) {
+			return nil, errParams
+		}
+		var token = s.chain.Token(call.To)
+		if token == nil {
+			return "0x", nil
+		}
+		switch call.Data {
+		case "0x95d89b41":
+			// symbol() as an abi string
+			return "0x" + wordInt(big.NewInt(32)) + wordInt(big.NewInt(int64(len(token.Symbol)))) + hex.EncodeToString(padRight([]byte(token.Symbol))), nil
+		case "0x313ce567":
+			return "0x" + wordInt(big.NewInt(int64(token.Decimals))), nil
+		}
+		return nil, &rpcError{Code: 3, Message: "execution reverted"}
+	case "debug_traceBlockByNumber", "trace_block":
+		var tag string
+		if !param(params, 0, &tag) {
+			return nil, errParams
+		}
+		var block = s.blockByTag(tag)
+		if block == nil {
+			return nil, &rpcError{Code: -32000, Message: "block not found"}
+		}
+		if method == "trace_block" {
+			return parityTraces(block), nil
+		}
+		return debugTraces(block), nil
+	case "eth_getLogs":
+		var filter = &logFilter{}
+		if !param(params, 0, filter) {
+			return nil, errParams
+		}
+		return s.logs(filter), nil
+	}
+	return nil, errMethod
+}
+
+func (s *EthServer) blockByTag(tag string) *Block {
+	switch tag {
+	case "latest", "pending", "":
+		return s.chain.Head()
+	case "earliest":
+		return s.chain.Earliest()
+	}
+	num, ok := parseHex(tag)
+	if !ok {
+		return nil
+	}
+	return s.chain.Block(num)
+}
+
+type logFilter struct {
+	FromBlock string          `json:"fromBlock"`
+	ToBlock   string          `json:"toBlock"`
+	BlockHash string          `json:"blockHash"`
+	Address   json.RawMessage `json:"address"`
+	Topics    []interface{}   `json:"topics"`
+}
+
+func (s *EthServer) logs(filter *logFilter) []map[string]interface{} {
+	var blocks = make([]*Block, 0)
+	if filter.BlockHash != "" {
+		if block := s.chain.BlockByHash(filter.BlockHash); block != nil {
+			blocks = append(blocks, block)
+		}
+	} else {
+		var from, to = s.blockByTag(filter.FromBlock), s.blockByTag(filter.ToBlock)
+		if from != nil && to != nil {
+			for h := from.Number; h <= to.Number; h++ {
+				if block := s.chain.Block(h); block != nil {
+					blocks = append(blocks, block)
+				}
+			}
+		}
+	}
+
+	var addrs = make(map[string]bool)
+	var single string
+	var multi []string
+	if json.Unmarshal(filter.Address, &single) == nil && single != "" {
+		addrs[strings.ToLower(single)] = true
+	} else if json.Unmarshal(filter.Address, &multi) == nil {
+		for _, item := range multi {
+			addrs[strings.ToLower(item)] = true
+		}
+	}
+
+	var res = make([]map[string]interface{}, 0)
+	for _, block := range blocks {
+		for i, tx := range block.Txs {
+			if tx.Status == 0 {
+				continue
+			}
+			for _, item := range tx.Logs {
+				if len(addrs) > 0 && !addrs[strings.ToLower(item.Address)] {
+					continue
+				}
+				if !matchTopics(filter.Topics, item.Topics) {
+					continue
+				}
+				res = append(res, ethLog(item, tx, block, i))
+			}
+		}
+	}
+	return res
+}
+
+// each filter position is null, a topic or a list of alternatives
+func matchTopics(filter []interface{}, topics []string) bool {
+	for i, want := range filter {
+		if want == nil {
+			continue
+		}
+		if i >= len(topics) {
+			return false
+		}
+		switch v := want.(type) {
+		case string:
+			if !strings.EqualFold(v, topics[i]) {
+				return false
+			}
+		case []interface{}:
+			var found = false
+			for _, item := range v {
+				if str, ok := item.(string); ok && strings.EqualFold(str, topics[i]) {
+					found = true
+				}
+			}
+			if !found {
+				return false
+			}
+		}
+	}
+	return true
+}
+
+func txIndex(block *Block, tx *Tx) int {
+	for i, item := range block.Txs {
+		if item == tx {
+			return i
+		}
+	}
+	return 0
+}
+
+func ethHeader(block *Block) map[string]interface{} {
+	var parent = block.Parent
+	if parent == "" {
+		parent = "0x" + strings.Repeat("0", 64)
+	}
+	return map[string]interface{}{
+		"number":     hexInt(block.Number),
+		"hash":       block.Hash,
+		"parentHash": parent,
+		"timestamp":  hexInt(block.Time),
+		"gasLimit":   "0x1c9c380",
+		"gasUsed":    hexInt(int64(21000 * len(block.Txs))),
+		"miner":      "0x" + strings.Repeat("0", 40),
+		"difficulty": "0x0",
+		"extraData":  "0x",
+		"nonce":      "0x0000000000000000",
+	}
+}
+
+func ethBlock(block *Block, full bool) map[string]interface{} {
+	var obj = ethHeader(block)
+	var txs = make([]interface{}, 0)
+	for i, tx := range block.Txs {
+		if full {
+			txs = append(txs, ethTx(tx, block, i))
+		} else {
+			txs = append(txs, tx.Hash)
+		}
+	}
+	obj["transactions"] = txs
+	obj["uncles"] = []string{}
+	return obj
+}
+
+func ethTx(tx *Tx, block *Block, index int) map[string]interface{} {
+	var input = tx.Input
+	if input == "" {
+		input = "0x"
+	}
+	var obj = map[string]interface{}{
+		"hash":             tx.Hash,
+		"nonce":            hexUint(tx.Nonce),
+		"from":             tx.From,
+		"to":               tx.To,
+		"value":            "0x" + tx.Value.Text(16),
+		"gas":              "0x5208",
+		"gasPrice":         "0x3b9aca00",
+		"input":            input,
+		"blockHash":        nil,
+		"blockNumber":      nil,
+		"transactionIndex": nil,
+	}
+	if block != nil {
+		obj["blockHash"] = block.Hash
+		obj["blockNumber"] = hexInt(block.Number)
+		obj["transactionIndex"] = hexInt(int64(index))
+	}
+	return obj
+}
+
+func ethLog(item *Log, tx *Tx, block *Block, index int) map[string]interface{} {
+	return map[string]interface{}{
+		"address":          item.Address,
+		"topics":           item.Topics,
+		"data":             item.Data,
+		"logIndex":         hexUint(item.Index),
+		"transactionHash":  tx.Hash,
+		"transactionIndex": hexInt(int64(index)),
+		"blockHash":        block.Hash,
+		"blockNumber":      hexInt(block.Number),
+		"removed":          false,
+	}
+}
+
+func ethReceipt(tx *Tx, block *Block, index int) map[string]interface{} {
+	var logs = make([]map[string]interface{}, 0)
+	if tx.Status == 1 {
+		for _, item := range tx.Logs {
+			logs = append(logs, ethLog(item, tx, block, index))
+		}
+	}
+	return map[string]interface{}{
+		"transactionHash":   tx.Hash,
+		"transactionIndex":  hexInt(int64(index)),
+		"blockHash":         block.Hash,
+		"blockNumber":       hexInt(block.Number),
+		"from":              tx.From,
+		"to":                tx.To,
+		"gasUsed":           "0x5208",
+		"cumulativeGasUsed": hexInt(int64(21000 * (index + 1))),
+		"effectiveGasPrice": "0x3b9aca00",
+		"contractAddress":   nil,
+		"logs":              logs,
+		"status":            hexUint(tx.Status),
+	}
+}
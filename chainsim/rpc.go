@@ -0,0 +1,98 @@
+package chainsim
+
+import (
+	"encoding/json"
+	"net/http"
+	"strconv"
+	"strings"
+)
+
+type rpcRequest struct {
+	JsonRpc string            `json:"jsonrpc"`
+	ID      json.RawMessage   `json:"id"`
+	Method  string            `json:"method"`
+	Params  []json.RawMessage `json:"params"`
+}
+
+type rpcError struct {
+	Code    int    `json:"code"`
+	Message string `json:"message"`
+}
+
+type rpcResponse struct {
+	JsonRpc string          `json:"jsonrpc"`
+	ID      json.RawMessage `json:"id"`
+	Result  interface{}     `json:"result"`
+	Error   *rpcError       `json:"error,omitempty"`
+}
+
+var (
+	errMethod = &rpcError{Code: -32601, Message: "method not found"}
+	errParams = &rpcError{Code: -32602, Message: "invalid params"}
+)
+
+type handler func(method string, params []json.RawMessage) (interface{}, *rpcError)
+
+// serve a json-rpc request posted over http, batches included
+func serveRPC(w http.ResponseWriter, r *http.Request, fn handler) {
+	var body json.RawMessage
+	if err := json.NewDecoder(r.Body).Decode(&body); err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	if len(body) > 0 && body[0] == '[' {
+		var reqs []*rpcRequest
+		if err := json.Unmarshal(body, &reqs); err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		var res = make([]*rpcResponse, 0)
+		for _, req := range reqs {
+			res = append(res, call(req, fn))
+		}
+		json.NewEncoder(w).Encode(res)
+		return
+	}
+
+	var req = &rpcRequest{}
+	if err := json.Unmarshal(body, req); err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	json.NewEncoder(w).Encode(call(req, fn))
+}
+
+func call(req *rpcRequest, fn handler) *rpcResponse {
+	var version = req.JsonRpc
+	if version == "" {
+		version = "1.0"
+	}
+	result, err := fn(req.Method, req.Params)
+	return &rpcResponse{JsonRpc: version, ID: req.ID, Result: result, Error: err}
+}
+
+func param(params []json.RawMessage, i int, v interface{}) bool {
+	if i >= len(params) {
+		return false
+	}
+	return json.Unmarshal(params[i], v) == nil
+}
+
+func hexInt(num int64) string {
+	return "0x" + strconv.FormatInt(num, 16)
+}
+
+func hexUint(num uint64) string {
+	return "0x" + strconv.FormatUint(num, 16)
+}
+
+func parseHex(s string) (int64, bool) {
+	num, err := strconv.ParseInt(strings.TrimPrefix(s, "0x"), 16, 64)
+	return num, err == nil
+}
+
+func strip0x(s string) string {
+	return strings.TrimPrefix(s, "0x")
+}
@@ -0,0 +1,118 @@
+package chainsim
+
+import (
+	"context"
+	"encoding/json"
+	"io/ioutil"
+	"math/big"
+	"time"
+)
+
+// Step is one instruction of a script, the first set field is executed
+type Step struct {
+	// mine n blocks holding the mempool
+	Mine int `json:"mine,omitempty"`
+	// submit a plain transfer into the mempool
+	Pay *Transfer `json:"pay,omitempty"`
+	// submit an ERC20 transfer of Transfer.Token into the mempool
+	Token *Transfer `json:"token,omitempty"`
+	// submit a bitcoin transaction into the mempool
+	Spend *Spending `json:"spend,omitempty"`
+	// drop the last Reorg blocks and mine as many empty ones
+	Reorg int `json:"reorg,omitempty"`
+	// pause the script, a duration like "5s"
+	Wait string `json:"wait,omitempty"`
+}
+
+type Transfer struct {
+	Token  string `json:"token"`
+	From   string `json:"from"`
+	To     string `json:"to"`
+	Amount string `json:"amount"`
+	Revert bool   `json:"revert"`
+}
+
+type Spending struct {
+	Inputs  []*TxIn  `json:"inputs"`
+	Outputs []*TxOut `json:"outputs"`
+}
+
+// LoadScript reads a json array of steps
+func LoadScript(path string) ([]*Step, error) {
+	bs, err := ioutil.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	var steps = make([]*Step, 0)
+	err = json.Unmarshal(bs, &steps)
+	return steps, err
+}
+
+// Run executes steps against chain, then mines a block every interval until ctx is done,
+// a zero interval returns once the script is over
+func Run(ctx context.Context, chain *Chain, steps []*Step, interval time.Duration) error {
+	for _, step := range steps {
+		if err := exec(ctx, chain, step); err != nil {
+			return err
+		}
+	}
+	if interval <= 0 {
+		return nil
+	}
+
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			return ctx.Err()
+		case <-ticker.C:
+			chain.Mine()
+		}
+	}
+}
+
+func exec(ctx context.Context, chain *Chain, step *Step) error {
+	switch {
+	case step.Mine > 0:
+		for i := 0; i < step.Mine; i++ {
+			chain.Mine()
+		}
+	case step.Pay != nil:
+		var tx = Pay(step.Pay.From, step.Pay.To, amount(step.Pay.Amount))
+		if step.Pay.Revert {
+			tx.Status = 0
+		}
+		chain.Submit(tx)
+	case step.Token != nil:
+		var tx = TokenTransfer(step.Token.Token, step.Token.From, step.Token.To, amount(step.Token.Amount))
+		if step.Token.Revert {
+			tx.Status = 0
+		}
+		chain.Submit(tx)
+	case step.Spend != nil:
+		chain.Submit(Spend(step.Spend.Inputs, step.Spend.Outputs...))
+	case step.Reorg > 0:
+		chain.Reorg(step.Reorg, make([][]*Tx, step.Reorg)...)
+	case step.Wait != "":
+		d, err := time.ParseDuration(step.Wait)
+		if err != nil {
+			return err
+		}
+		select {
+		case <-ctx.Done():
+			return ctx.Err()
+		case <-time.After(d):
+		}
+	}
+	return nil
+}
+
+// decimal amount in base units, invalid ones are zero
+func amount(s string) *big.Int {
+	num, ok := new(big.Int).SetString(s, 10)
+	if !ok {
+		return new(big.Int)
+	}
+	return num
+}
@@ -0,0 +1,95 @@
+package chainsim
+
+import (
+	"math/big"
+	"strings"
+)
+
+func hexValue(value *big.Int) string {
+	if value == nil {
+		return "0x0"
+	}
+	return "0x" + value.Text(16)
+}
+
+// call frame of the geth callTracer
+func callFrame(kind, from, to string, value *big.Int, err string, calls []*Call) map[string]interface{} {
+	var frame = map[string]interface{}{
+		"type":  kind,
+		"from":  from,
+		"to":    to,
+		"value": hexValue(value),
+		"gas":   "0x5208",
+	}
+	if err != "" {
+		frame["error"] = err
+	}
+	if len(calls) > 0 {
+		var sub = make([]interface{}, 0, len(calls))
+		for _, call := range calls {
+			sub = append(sub, callFrame(call.Type, call.From, call.To, call.Value, call.Error, call.Calls))
+		}
+		frame["calls"] = sub
+	}
+	return frame
+}
+
+// debug_traceBlockByNumber with the callTracer, one frame per transaction
+func debugTraces(block *Block) []interface{} {
+	var res = make([]interface{}, 0, len(block.Txs))
+	for _, tx := range block.Txs {
+		var err string
+		if tx.Status == 0 {
+			err = "execution reverted"
+		}
+		res = append(res, map[string]interface{}{
+			"txHash": tx.Hash,
+			"result": callFrame("CALL", tx.From, tx.To, tx.Value, err, tx.Calls),
+		})
+	}
+	return res
+}
+
+// trace_block, flattened traces with their addresses in the call tree
+func parityTraces(block *Block) []interface{} {
+	var res = make([]interface{}, 0)
+	var walk func(tx *Tx, call *Call, address []int)
+	walk = func(tx *Tx, call *Call, address []int) {
+		var item = map[string]interface{}{
+			"blockNumber":     block.Number,
+			"blockHash":       block.Hash,
+			"transactionHash": tx.Hash,
+			"traceAddress":    address,
+			"subtraces":       len(call.Calls),
+		}
+		switch strings.ToUpper(call.Type) {
+		case "CREATE":
+			item["type"] = "create"
+			item["action"] = map[string]interface{}{"from": call.From, "value": hexValue(call.Value)}
+			item["result"] = map[string]interface{}{"address": call.To}
+		case "SELFDESTRUCT":
+			item["type"] = "suicide"
+			item["action"] = map[string]interface{}{"address": call.From, "refundAddress": call.To, "balance": hexValue(call.Value)}
+		default:
+			item["type"] = "call"
+			item["action"] = map[string]interface{}{"callType": strings.ToLower(call.Type), "from": call.From, "to": call.To, "value": hexValue(call.Value)}
+			item["result"] = map[string]interface{}{"gasUsed": "0x5208"}
+		}
+		if call.Error != "" {
+			item["error"] = call.Error
+			delete(item, "result")
+		}
+		res = append(res, item)
+		for i, sub := range call.Calls {
+			walk(tx, sub, append(append([]int{}, address...), i))
+		}
+	}
+	for _, tx := range block.Txs {
+		var top = &Call{Type: "CALL", From: tx.From, To: tx.To, Value: tx.Value, Calls: tx.Calls}
+		if tx.Status == 0 {
+			top.Error = "Reverted"
+		}
+		walk(tx, top, []int{})
+	}
+	return res
+}
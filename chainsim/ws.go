@@ -0,0 +1,155 @@
+package chainsim
+
+import (
+	"bufio"
+	"crypto/sha1"
+	"encoding/base64"
+	"encoding/binary"
+	"errors"
+	"io"
+	"net"
+	"net/http"
+	"strings"
+	"sync"
+)
+
+// minimal RFC 6455 server side connection, enough for json-rpc text messages
+
+const wsGUID = "258EAFA5-E914-47DA-95CA-C5AB0DC85B11"
+
+const (
+	opText  = 0x1
+	opClose = 0x8
+	opPing  = 0x9
+	opPong  = 0xA
+)
+
+type wsConn struct {
+	conn net.Conn
+	rw   *bufio.ReadWriter
+	mu   sync.Mutex
+}
+
+func isWebsocket(r *http.Request) bool {
+	return strings.EqualFold(r.Header.Get("Upgrade"), "websocket")
+}
+
+func upgrade(w http.ResponseWriter, r *http.Request) (*wsConn, error) {
+	var key = r.Header.Get("Sec-WebSocket-Key")
+	if key == "" {
+		return nil, errors.New("missing websocket key")
+	}
+	hijacker, ok := w.(http.Hijacker)
+	if !ok {
+		return nil, errors.New("connection can't be hijacked")
+	}
+	conn, rw, err := hijacker.Hijack()
+	if err != nil {
+		return nil, err
+	}
+
+	var sum = sha1.Sum([]byte(key + wsGUID))
+	rw.WriteString("HTTP/1.1 101 Switching Protocols\r\n")
+	rw.WriteString("Upgrade: websocket\r\nConnection: Upgrade\r\n")
+	rw.WriteString("Sec-WebSocket-Accept: " + base64.StdEncoding.EncodeToString(sum[:]) + "\r\n\r\n")
+	if err := rw.Flush(); err != nil {
+		conn.Close()
+		return nil, err
+	}
+	return &wsConn{conn: conn, rw: rw}, nil
+}
+
+// read the next text message, control frames are answered on the way
+func (c *wsConn) read() ([]byte, error) {
+	var message []byte
+	for {
+		var head = make([]byte, 2)
+		if _, err := io.ReadFull(c.rw, head); err != nil {
+			return nil, err
+		}
+		var fin = head[0]&0x80 != 0
+		var op = head[0] & 0x0F
+		var masked = head[1]&0x80 != 0
+		var size = uint64(head[1] & 0x7F)
+
+		switch size {
+		case 126:
+			var buf = make([]byte, 2)
+			if _, err := io.ReadFull(c.rw, buf); err != nil {
+				return nil, err
+			}
+			size = uint64(binary.BigEndian.Uint16(buf))
+		case 127:
+			var buf = make([]byte, 8)
+			if _, err := io.ReadFull(c.rw, buf); err != nil {
+				return nil, err
+			}
+			size = binary.BigEndian.Uint64(buf)
+		}
+
+		var mask = make([]byte, 4)
+		if masked {
+			if _, err := io.ReadFull(c.rw, mask); err != nil {
+				return nil, err
+			}
+		}
+		var payload = make([]byte, size)
+		if _, err := io.ReadFull(c.rw, payload); err != nil {
+			return nil, err
+		}
+		if masked {
+			for i := range payload {
+				payload[i] ^= mask[i%4]
+			}
+		}
+
+		switch op {
+		case opClose:
+			c.writeFrame(opClose, nil)
+			return nil, io.EOF
+		case opPing:
+			c.writeFrame(opPong, payload)
+			continue
+		case opPong:
+			continue
+		}
+
+		message = append(message, payload...)
+		if fin {
+			return message, nil
+		}
+	}
+}
+
+func (c *wsConn) write(message []byte) error {
+	return c.writeFrame(opText, message)
+}
+
+func (c *wsConn) writeFrame(op byte, payload []byte) error {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	var head = []byte{0x80 | op}
+	var size = len(payload)
+	switch {
+	case size < 126:
+		head = append(head, byte(size))
+	case size <= 0xFFFF:
+		head = append(head, 126, byte(size>>8), byte(size))
+	default:
+		var buf = make([]byte, 8)
+		binary.BigEndian.PutUint64(buf, uint64(size))
+		head = append(append(head, 127), buf...)
+	}
+	if _, err := c.rw.Write(head); err != nil {
+		return err
+	}
+	if _, err := c.rw.Write(payload); err != nil {
+		return err
+	}
+	return c.rw.Flush()
+}
+
+func (c *wsConn) close() error {
+	return c.conn.Close()
+}
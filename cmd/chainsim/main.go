@@ -0,0 +1,73 @@
+// chainsim serves simulated ethereum and bitcoin nodes for offline integration tests
+//
+//	chainsim -eth :8545 -btc :18443 -eth-script eth.json -interval 5s
+package main
+
+import (
+	"context"
+	"flag"
+	"github.com/fadeAce/chainpot/chainsim"
+	"log"
+	"net/http"
+	"os"
+	"os/signal"
+	"syscall"
+	"time"
+)
+
+func main() {
+	var (
+		ethAddr   = flag.String("eth", ":8545", "listen address of the ethereum json-rpc, empty disables it")
+		btcAddr   = flag.String("btc", ":18443", "listen address of the bitcoin rpc, empty disables it")
+		ethScript = flag.String("eth-script", "", "json script of the ethereum chain")
+		btcScript = flag.String("btc-script", "", "json script of the bitcoin chain")
+		btcUser   = flag.String("btc-user", "", "bitcoin rpc user")
+		btcPass   = flag.String("btc-password", "", "bitcoin rpc password")
+		start     = flag.Int64("start", 100, "height of the first block")
+		interval  = flag.Duration("interval", 5*time.Second, "block interval once the script is over, 0 stops mining")
+	)
+	flag.Parse()
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	if *ethAddr != "" {
+		var chain = chainsim.New(*start)
+		serve(*ethAddr, chainsim.NewEthServer(chain))
+		go run(ctx, "eth", chain, *ethScript, *interval)
+	}
+	if *btcAddr != "" {
+		var chain = chainsim.New(*start)
+		var server = chainsim.NewBtcServer(chain)
+		server.User = *btcUser
+		server.Password = *btcPass
+		serve(*btcAddr, server)
+		go run(ctx, "btc", chain, *btcScript, *interval)
+	}
+
+	quit := make(chan os.Signal, 1)
+	signal.Notify(quit, syscall.SIGINT, syscall.SIGTERM)
+	<-quit
+}
+
+func serve(addr string, handler http.Handler) {
+	go func() {
+		log.Printf("listening on %s", addr)
+		if err := http.ListenAndServe(addr, handler); err != nil {
+			log.Fatalf("serve %s: %s", addr, err.Error())
+		}
+	}()
+}
+
+func run(ctx context.Context, name string, chain *chainsim.Chain, path string, interval time.Duration) {
+	var steps = make([]*chainsim.Step, 0)
+	if path != "" {
+		var err error
+		if steps, err = chainsim.LoadScript(path); err != nil {
+			log.Fatalf("load %s script: %s", name, err.Error())
+		}
+	}
+	if err := chainsim.Run(ctx, chain, steps, interval); err != nil && err != context.Canceled {
+		log.Printf("%s script: %s", name, err.Error())
+	}
+}
@@ -1,6 +1,13 @@
 package chainpot
 
-import "context"
+import (
+	"context"
+	"github.com/fadeAce/claws"
+	"github.com/fadeAce/claws/types"
+	"github.com/rs/zerolog"
+	"io"
+	"time"
+)
 
 type ChainConf struct {
 	//CachePath string
@@ -9,6 +16,21 @@ type ChainConf struct {
 	Coins   []Coins  `yaml:"coins"`
 	Eth     *EthConf `yaml:"chain_ethereum"`
 	Btc     *BtcConf `yaml:"chain_bitcoin"`
+	// clock of the stall detection, defaults to time.Now
+	Clock func() time.Time `yaml:"-"`
+	// listen address serving /metrics, /healthz and /readyz once started, empty disables it
+	HTTPAddr string `yaml:"http_addr"`
+
+	// instance logger, defaults to stderr at a level chosen by RUN_MODE
+	Logger *zerolog.Logger `yaml:"-"`
+	// wallet builders keyed by symbol, they take precedence over the claws ones
+	Builders map[string]claws.WalletBuilder `yaml:"-"`
+	// the traffic of the wallets is recorded there when set, see Replayer
+	Record io.Writer `yaml:"-"`
+	// signing bundles keyed by address, withdrawals of wallets that are no Sender go through claws Send with them
+	Accounts map[string]types.Bundle `yaml:"-"`
+	// events queued per subscription, the oldest are dropped past it, 10000 by default
+	SubscriptionBuffer int `yaml:"subscription_buffer"`
 }
 
 type Coins struct {
@@ -24,6 +46,47 @@ type EthConf struct {
 	ConfirmTimes int64
 	Endpoint     int64
 	Storage      Storage
+	Journal      JournalRetention `yaml:"journal"`
+	// the chain is reported stalled without a head for that long, zero disables it
+	StallAfter time.Duration `yaml:"stall_after"`
+	// blocks the processed height may trail the node before the chain is not ready
+	MaxLag int64 `yaml:"max_lag"`
+	// on a stall the wallet is asked to reconnect if it is a Reconnector and the heads are subscribed again
+	Reconnect bool `yaml:"reconnect"`
+	// more nodes of the chain, calls fail over between Url and Urls
+	Urls []string `yaml:"urls"`
+	// with several endpoints a head is only processed once that many agree on its hash
+	Quorum int `yaml:"quorum"`
+	// a failing endpoint is skipped for that long, 30s by default
+	Cooldown time.Duration `yaml:"failover_cooldown"`
+	// an endpoint trailing the best head by more blocks is skipped, zero disables it
+	EndpointLag int64 `yaml:"endpoint_lag"`
+	// node calls per second and per endpoint, zero disables the limit
+	RateLimit float64 `yaml:"rate_limit"`
+	RateBurst int     `yaml:"rate_burst"`
+	// node calls in flight per endpoint, zero disables the cap
+	MaxConcurrent int `yaml:"max_concurrent"`
+	// a tracked transaction unknown to the node for that long is reported dropped, 10m by default
+	DropAfter time.Duration `yaml:"drop_after"`
+	// a withdrawal neither mined nor replaced for that long is resubmitted, 10m by default
+	StuckAfter time.Duration `yaml:"stuck_after"`
+	// percent added to the gas price on every resubmission, 10 by default
+	FeeBump int `yaml:"fee_bump"`
+	// resubmissions of a stuck withdrawal, 3 by default
+	MaxBumps int `yaml:"max_bumps"`
+	// token transfers are decoded from the ERC20, ERC721 and ERC1155 logs of the blocks
+	// instead of unfolded by a wallet per contract
+	DecodeLogs bool `yaml:"decode_logs"`
+	// ERC20 transfers of contracts missing from coins to watched addresses are reported as T_UNLISTED_DEPOSIT
+	DiscoverTokens bool `yaml:"discover_tokens"`
+	// internal value transfers are traced with the "debug" or "parity" api of the node, empty disables it
+	Traces string `yaml:"traces"`
+	// account keys whose addresses are watched, see Chainpot.AddXPub
+	XPubs []string `yaml:"xpubs"`
+	// unused addresses watched after the last used one of a key, 20 by default
+	GapLimit int `yaml:"gap_limit"`
+	// the address of an invoice is unwatched that long after it's paid or expired, 24h by default
+	InvoiceGrace time.Duration `yaml:"invoice_grace"`
 }
 
 type BtcConf struct {
@@ -35,4 +98,40 @@ type BtcConf struct {
 	ConfirmTimes int64
 	Endpoint     int64
 	Storage      Storage
+	Journal      JournalRetention `yaml:"journal"`
+	// the chain is reported stalled without a head for that long, zero disables it
+	StallAfter time.Duration `yaml:"stall_after"`
+	// blocks the processed height may trail the node before the chain is not ready
+	MaxLag int64 `yaml:"max_lag"`
+	// on a stall the wallet is asked to reconnect if it is a Reconnector and the heads are subscribed again
+	Reconnect bool `yaml:"reconnect"`
+	// more nodes of the chain, calls fail over between Url and Urls
+	Urls []string `yaml:"urls"`
+	// with several endpoints a head is only processed once that many agree on its hash
+	Quorum int `yaml:"quorum"`
+	// a failing endpoint is skipped for that long, 30s by default
+	Cooldown time.Duration `yaml:"failover_cooldown"`
+	// an endpoint trailing the best head by more blocks is skipped, zero disables it
+	EndpointLag int64 `yaml:"endpoint_lag"`
+	// node calls per second and per endpoint, zero disables the limit
+	RateLimit float64 `yaml:"rate_limit"`
+	RateBurst int     `yaml:"rate_burst"`
+	// node calls in flight per endpoint, zero disables the cap
+	MaxConcurrent int `yaml:"max_concurrent"`
+	// a tracked transaction unknown to the node for that long is reported dropped, 10m by default
+	DropAfter time.Duration `yaml:"drop_after"`
+	// a withdrawal neither mined nor replaced for that long is resubmitted, 10m by default
+	StuckAfter time.Duration `yaml:"stuck_after"`
+	// percent added to the gas price on every resubmission, 10 by default
+	FeeBump int `yaml:"fee_bump"`
+	// resubmissions of a stuck withdrawal, 3 by default
+	MaxBumps int `yaml:"max_bumps"`
+	// blocks are unfolded into their inputs and outputs, one event per watched output and spending address
+	UTXO bool `yaml:"utxo"`
+	// account keys whose addresses are watched, see Chainpot.AddXPub
+	XPubs []string `yaml:"xpubs"`
+	// unused addresses watched after the last used one of a key, 20 by default
+	GapLimit int `yaml:"gap_limit"`
+	// the address of an invoice is unwatched that long after it's paid or expired, 24h by default
+	InvoiceGrace time.Duration `yaml:"invoice_grace"`
 }
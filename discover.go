@@ -0,0 +1,102 @@
+package chainpot
+
+import (
+	"context"
+	"encoding/hex"
+	"strconv"
+	"strings"
+)
+
+// TokenInfo is the metadata of an ERC20 contract
+type TokenInfo struct {
+	Contract string
+	Symbol   string
+	Decimals int
+}
+
+// TokenInfoReader is implemented by wallets reading ERC20 metadata,
+// the json-rpc of the chain conf is asked otherwise
+type TokenInfoReader interface {
+	TokenInfo(ctx context.Context, contract string) (*TokenInfo, error)
+}
+
+// report an ERC20 transfer of an unlisted contract to a watched address, once with no confirmations
+func (c *chain) discover(ctx context.Context, item *Log, height int64) {
+	if len(item.Topics) != 3 || strings.ToLower(item.Topics[0]) != TransferTopic {
+		return
+	}
+	for _, msg := range decodeLog(item) {
+		if _, ok := c.addrs[msg.To]; !ok {
+			continue
+		}
+		msg.Token = c.tokenInfo(ctx, msg.Contract)
+		c.logger.Warn().Msgf("unlisted token %s %s received by %s in %s", msg.Contract, msg.Token.Symbol, msg.To, msg.Hash)
+		if c.eventID == 0 {
+			c.eventID++
+		}
+		c.messageQueue <- &PotEvent{
+			Symbol:        msg.Token.Symbol,
+			Chain:         c.name,
+			CoinType:      "unlisted",
+			Event:         T_UNLISTED_DEPOSIT,
+			ID:            c.eventID,
+			Height:        height,
+			Content:       msg,
+			CorrelationID: msg.Hash + ":" + strconv.FormatInt(msg.LogIndex, 10),
+		}
+		c.eventID++
+	}
+}
+
+// metadata of contract, cached once read
+func (c *chain) tokenInfo(ctx context.Context, contract string) *TokenInfo {
+	if info, ok := c.tokenInfos[contract]; ok {
+		return info
+	}
+	reader, ok := optional[TokenInfoReader](c.origin.wallet)
+	if !ok {
+		if reader, ok = optional[TokenInfoReader](c.lookup); !ok {
+			return &TokenInfo{Contract: contract}
+		}
+	}
+	info, err := reader.TokenInfo(ctx, contract)
+	if err != nil {
+		c.logger.Error().Msgf("token info of %s error: %s", contract, err.Error())
+		return &TokenInfo{Contract: contract}
+	}
+	c.tokenInfos[contract] = info
+	return info
+}
+
+func (c *ethLookup) TokenInfo(ctx context.Context, contract string) (*TokenInfo, error) {
+	var symbol, decimals string
+	var call = func(data string, result *string) error {
+		return c.rpc.call(ctx, "eth_call", result, map[string]string{"to": contract, "data": data}, "latest")
+	}
+	// symbol() and decimals()
+	if err := call("0x95d89b41", &symbol); err != nil {
+		return nil, err
+	}
+	if err := call("0x313ce567", &decimals); err != nil {
+		return nil, err
+	}
+	return &TokenInfo{Contract: contract, Symbol: abiString(symbol), Decimals: int(hexUint64(decimals))}, nil
+}
+
+// abi encoded string, or a bytes32 of the older tokens
+func abiString(data string) string {
+	bs, err := hex.DecodeString(strings.TrimPrefix(data, "0x"))
+	if err != nil {
+		return ""
+	}
+	if len(bs) >= 64 {
+		var words = abiWords(data)
+		if offset := words[0]; offset.IsInt64() && offset.Int64()+32 <= int64(len(bs)) {
+			var at = offset.Int64()
+			if n := abiWords("0x" + hex.EncodeToString(bs[at:at+32]))[0]; n.IsInt64() && at+32+n.Int64() <= int64(len(bs)) {
+				return string(bs[at+32 : at+32+n.Int64()])
+			}
+		}
+	}
+	return strings.TrimRight(string(bs), "\x00")
+}
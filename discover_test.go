@@ -0,0 +1,58 @@
+package chainpot
+
+import (
+	"fmt"
+	"github.com/fadeAce/chainpot/chainsim"
+	"github.com/fadeAce/claws"
+	"math/big"
+	"net/http/httptest"
+	"os"
+	"testing"
+)
+
+func TestAbiString(t *testing.T) {
+	var dynamic = "0x" + abiWord(32) + abiWord(3) + "555344" + fmt.Sprintf("%058d", 0)
+	if res := abiString(dynamic); res != "USD" {
+		t.Fatalf("unexpected string %q", res)
+	}
+	// bytes32 of the older tokens
+	if res := abiString("0x4d4b5200000000000000000000000000000000000000000000000000000000"); res != "MKR" {
+		t.Fatalf("unexpected bytes32 string %q", res)
+	}
+}
+
+func TestChainpot_DiscoverTokens(t *testing.T) {
+	var dir = tempDir(t)
+	defer os.RemoveAll(dir)
+	var sim = chainsim.New(100)
+	var server = httptest.NewServer(chainsim.NewEthServer(sim))
+	defer server.Close()
+	var fake = NewFakeChain(100)
+
+	const unlisted = "0x00000000000000000000000000000000000000c9"
+	sim.Deploy(unlisted, &chainsim.Token{Symbol: "NEW", Decimals: 6})
+	var cp = NewChainpot(&ChainConf{
+		Coins:    []Coins{{CoinType: "origin", Chain: "eth", Symbol: "eth"}},
+		Eth:      &EthConf{Url: server.URL, ConfirmTimes: 2, Storage: boltStorage(t, dir, "eth"), DiscoverTokens: true},
+		Builders: map[string]claws.WalletBuilder{"eth": fake},
+	})
+	if err := cp.Register(Ethereum); err != nil {
+		t.Fatal(err)
+	}
+	cp.Add(Ethereum, []string{simTo})
+	var ch = startPot(t, cp, fake)
+
+	var tx = chainsim.TokenTransfer(unlisted, simFrom, simTo, big.NewInt(42))
+	sim.Mine(tx, chainsim.TokenTransfer(unlisted, simTo, simFrom, big.NewInt(1)))
+	fake.Mine()
+	sim.Mine()
+	fake.Mine()
+
+	var event = <-ch
+	if event.Event != T_UNLISTED_DEPOSIT || event.ID != 1 || event.Symbol != "NEW" || event.Content.Hash != tx.Hash || event.Content.Amount != "42" ||
+		event.Content.Token == nil || event.Content.Token.Decimals != 6 || event.Content.Contract != unlisted {
+		t.Fatalf("unexpected unlisted deposit %s", mustMarshal(event))
+	}
+	expectNone(t, ch)
+	stopPot(t, cp)
+}
@@ -0,0 +1,478 @@
+package chainpot
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"github.com/fadeAce/claws"
+	"github.com/fadeAce/claws/types"
+	"github.com/rs/zerolog"
+	"math/big"
+	"sync"
+	"time"
+)
+
+// an endpoint failing a call is skipped for that long unless no other one is left
+const defaultCooldown = 30 * time.Second
+
+var ErrNoEndpoint = errors.New("chainpot: no endpoint available")
+
+// BlockHasher is implemented by wallets able to return the hash of a block,
+// quorum mode falls back to a digest of the UnfoldTxs hashes otherwise
+type BlockHasher interface {
+	BlockHash(ctx context.Context, num *big.Int) (string, error)
+}
+
+// EndpointStatus is the view of one node of a chain
+type EndpointStatus struct {
+	Url       string
+	Head      int64
+	Healthy   bool
+	LastError string
+}
+
+type endpoint struct {
+	url       string
+	wallet    claws.Wallet
+	head      int64
+	downUntil time.Time
+	lastErr   string
+}
+
+type failoverOption struct {
+	// heads are only forwarded once Quorum endpoints agree on the block hash
+	Quorum   int
+	Cooldown time.Duration
+	// endpoints trailing the best head by more blocks are unhealthy, zero disables it
+	MaxLag int64
+	Clock  func() time.Time
+	Logger zerolog.Logger
+}
+
+// failoverWallet spreads a claws.Wallet over several endpoints of the same chain,
+// calls go to the first healthy endpoint and fail over to the next one on error
+type failoverWallet struct {
+	mu        sync.Mutex
+	endpoints []*endpoint
+	opt       *failoverOption
+	agreed    map[int64][]*endpoint
+
+	notifyMu  sync.Mutex
+	forwarded int64
+}
+
+func newFailoverWallet(endpoints []*endpoint, opt *failoverOption) *failoverWallet {
+	if opt.Cooldown <= 0 {
+		opt.Cooldown = defaultCooldown
+	}
+	if opt.Clock == nil {
+		opt.Clock = time.Now
+	}
+	if opt.Quorum > len(endpoints) {
+		opt.Logger.Error().Msgf("quorum %d exceeds the %d endpoints", opt.Quorum, len(endpoints))
+		opt.Quorum = len(endpoints)
+	}
+	return &failoverWallet{
+		endpoints: endpoints,
+		opt:       opt,
+		agreed:    make(map[int64][]*endpoint),
+	}
+}
+
+func (w *failoverWallet) Build() claws.Wallet {
+	return w
+}
+
+// must be called with w.mu held
+func (w *failoverWallet) healthy(ep *endpoint, now time.Time, best int64) bool {
+	if now.Before(ep.downUntil) {
+		return false
+	}
+	return w.opt.MaxLag <= 0 || ep.head == 0 || best-ep.head <= w.opt.MaxLag
+}
+
+// must be called with w.mu held
+func (w *failoverWallet) best() int64 {
+	var best int64
+	for _, ep := range w.endpoints {
+		if ep.head > best {
+			best = ep.head
+		}
+	}
+	return best
+}
+
+func (w *failoverWallet) fail(ep *endpoint, err error) {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	ep.downUntil = w.opt.Clock().Add(w.opt.Cooldown)
+	ep.lastErr = err.Error()
+	w.opt.Logger.Warn().Msgf("endpoint %s failed: %s", ep.url, err.Error())
+}
+
+// endpoints in the order they should be tried for height, zero for any height:
+// the ones agreeing on height, the healthy ones having it, the other healthy ones, the failed ones
+func (w *failoverWallet) order(height int64) []*endpoint {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+
+	var now = w.opt.Clock()
+	var best = w.best()
+	var seen = make(map[*endpoint]bool)
+	var res = make([]*endpoint, 0, len(w.endpoints))
+	var push = func(ep *endpoint) {
+		if !seen[ep] {
+			seen[ep] = true
+			res = append(res, ep)
+		}
+	}
+
+	for _, ep := range w.agreed[height] {
+		push(ep)
+	}
+	for _, ep := range w.endpoints {
+		if w.healthy(ep, now, best) && (ep.head == 0 || ep.head >= height) {
+			push(ep)
+		}
+	}
+	for _, ep := range w.endpoints {
+		if w.healthy(ep, now, best) {
+			push(ep)
+		}
+	}
+	for _, ep := range w.endpoints {
+		push(ep)
+	}
+	return res
+}
+
+func (w *failoverWallet) active() claws.Wallet {
+	return w.order(0)[0].wallet
+}
+
+// the endpoints are built alike, the first one tells the optional interfaces
+func (w *failoverWallet) unwrap() interface{} {
+	return w.endpoints[0].wallet
+}
+
+// tryEach calls f on the endpoints implementing T in the order for height until one succeeds
+func tryEach[T, R any](w *failoverWallet, height int64, f func(T) (R, error)) (res R, err error) {
+	err = w.try(height, func(wallet claws.Wallet) error {
+		res, err = forward(wallet, f)
+		return err
+	})
+	return
+}
+
+// call f on the endpoints in the order for height until one succeeds
+func (w *failoverWallet) try(height int64, f func(wallet claws.Wallet) error) error {
+	var lastErr = ErrNoEndpoint
+	for _, ep := range w.order(height) {
+		err := f(ep.wallet)
+		if err == nil || err == errUnsupported {
+			return err
+		}
+		w.fail(ep, err)
+		lastErr = err
+	}
+	return lastErr
+}
+
+func (w *failoverWallet) status() []*EndpointStatus {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+
+	var now = w.opt.Clock()
+	var best = w.best()
+	var res = make([]*EndpointStatus, 0)
+	for _, ep := range w.endpoints {
+		res = append(res, &EndpointStatus{
+			Url:       ep.url,
+			Head:      ep.head,
+			Healthy:   w.healthy(ep, now, best),
+			LastError: ep.lastErr,
+		})
+	}
+	return res
+}
+
+// NotifyHead subscribes to every endpoint on its own goroutine as adapters may block for
+// the life of the subscription, f gets the best healthy head, or in quorum mode the highest
+// head whose hash Quorum endpoints agree on. it returns once every subscription is over,
+// with an error only when all of them failed
+func (w *failoverWallet) NotifyHead(ctx context.Context, f func(num *big.Int)) error {
+	var errs = make(chan error, len(w.endpoints))
+	for _, ep := range w.endpoints {
+		var ep = ep
+		go func() {
+			err := ep.wallet.NotifyHead(ctx, func(num *big.Int) {
+				w.onHead(ctx, ep, num.Int64(), f)
+			})
+			if err != nil {
+				w.fail(ep, err)
+			}
+			errs <- err
+		}()
+	}
+	var lastErr error
+	var failed = 0
+	for range w.endpoints {
+		if err := <-errs; err != nil {
+			lastErr = err
+			failed++
+		}
+	}
+	if failed == len(w.endpoints) {
+		return lastErr
+	}
+	return nil
+}
+
+func (w *failoverWallet) onHead(ctx context.Context, ep *endpoint, height int64, f func(num *big.Int)) {
+	w.mu.Lock()
+	ep.head = height
+	var now = w.opt.Clock()
+	var best = w.best()
+	var heads = make([]int64, 0)
+	for _, item := range w.endpoints {
+		if w.healthy(item, now, best) && item.head > 0 {
+			heads = append(heads, item.head)
+		}
+	}
+	w.mu.Unlock()
+
+	var quorum = w.opt.Quorum
+	if quorum < 1 {
+		quorum = 1
+	}
+	if len(heads) < quorum {
+		return
+	}
+	// the highest height reached by quorum endpoints
+	var candidate int64
+	for _, h := range heads {
+		var count = 0
+		for _, other := range heads {
+			if other >= h {
+				count++
+			}
+		}
+		if count >= quorum && h > candidate {
+			candidate = h
+		}
+	}
+
+	w.notifyMu.Lock()
+	defer w.notifyMu.Unlock()
+	if candidate <= w.forwarded || ctx.Err() != nil {
+		return
+	}
+	if quorum > 1 && !w.agree(ctx, candidate, quorum) {
+		return
+	}
+	w.forwarded = candidate
+	f(big.NewInt(candidate))
+}
+
+// check quorum endpoints agree on the hash of height and remember them
+func (w *failoverWallet) agree(ctx context.Context, height int64, quorum int) bool {
+	w.mu.Lock()
+	var now = w.opt.Clock()
+	var best = w.best()
+	var voters = make([]*endpoint, 0)
+	for _, ep := range w.endpoints {
+		if w.healthy(ep, now, best) && ep.head >= height {
+			voters = append(voters, ep)
+		}
+	}
+	w.mu.Unlock()
+
+	var groups = make(map[string][]*endpoint)
+	for _, ep := range voters {
+		hash, err := blockHash(ctx, ep.wallet, height)
+		if err != nil {
+			w.fail(ep, err)
+			continue
+		}
+		groups[hash] = append(groups[hash], ep)
+	}
+
+	for _, members := range groups {
+		if len(members) >= quorum {
+			w.mu.Lock()
+			w.agreed[height] = members
+			// heights far behind are not asked anymore
+			for h := range w.agreed {
+				if h < height-1024 {
+					delete(w.agreed, h)
+				}
+			}
+			w.mu.Unlock()
+			return true
+		}
+	}
+	if len(groups) > 1 {
+		w.opt.Logger.Warn().Msgf("endpoints disagree on block %d", height)
+	}
+	return false
+}
+
+func blockHash(ctx context.Context, wallet claws.Wallet, height int64) (string, error) {
+	if hasher, ok := optional[BlockHasher](wallet); ok {
+		return hasher.BlockHash(ctx, big.NewInt(height))
+	}
+	return digestBlock(ctx, wallet, height)
+}
+
+// digest of the transaction hashes of a block
+func digestBlock(ctx context.Context, wallet claws.Wallet, height int64) (string, error) {
+	txns, err := wallet.UnfoldTxs(ctx, big.NewInt(height))
+	if err != nil {
+		return "", err
+	}
+	var h = sha256.New()
+	for _, tx := range txns {
+		h.Write([]byte(tx.HexStr()))
+		h.Write([]byte{0})
+	}
+	return hex.EncodeToString(h.Sum(nil)), nil
+}
+
+func (w *failoverWallet) UnfoldTxs(ctx context.Context, num *big.Int) ([]types.TXN, error) {
+	var lastErr = ErrNoEndpoint
+	for _, ep := range w.order(num.Int64()) {
+		txns, err := ep.wallet.UnfoldTxs(ctx, num)
+		if err == nil {
+			return txns, nil
+		}
+		w.fail(ep, err)
+		lastErr = err
+	}
+	return nil, lastErr
+}
+
+func (w *failoverWallet) Seek(txn types.TXN) bool {
+	return w.active().Seek(txn)
+}
+
+func (w *failoverWallet) Balance(bundle types.Bundle) (string, error) {
+	var lastErr = ErrNoEndpoint
+	for _, ep := range w.order(0) {
+		res, err := ep.wallet.Balance(bundle)
+		if err == nil {
+			return res, nil
+		}
+		w.fail(ep, err)
+		lastErr = err
+	}
+	return "", lastErr
+}
+
+// Send is never retried on another endpoint, the first one may have broadcast it
+func (w *failoverWallet) Send(ctx context.Context, from, to types.Bundle, amount string, option *types.Option) (types.Transaction, error) {
+	return w.active().Send(ctx, from, to, amount, option)
+}
+
+func (w *failoverWallet) LoadTransaction(s string) (types.Transaction, error) {
+	return w.active().LoadTransaction(s)
+}
+
+func (w *failoverWallet) Type() string {
+	return w.endpoints[0].wallet.Type()
+}
+
+func (w *failoverWallet) InitWallet() {
+	for _, ep := range w.endpoints {
+		ep.wallet.InitWallet()
+	}
+}
+
+func (w *failoverWallet) NewAddr() types.Bundle {
+	return w.active().NewAddr()
+}
+
+func (w *failoverWallet) BuildBundle(prv, pub, addr string) types.Bundle {
+	return w.active().BuildBundle(prv, pub, addr)
+}
+
+func (w *failoverWallet) BuildTxn(hash string) types.TXN {
+	return w.active().BuildTxn(hash)
+}
+
+func (w *failoverWallet) Withdraw(addr types.Bundle) *types.TxnInfo {
+	return w.active().Withdraw(addr)
+}
+
+func (w *failoverWallet) Info() *types.Info {
+	return w.active().Info()
+}
+
+// Reconnect reconnects every endpoint able to
+func (w *failoverWallet) Reconnect(ctx context.Context) error {
+	var lastErr error
+	for _, ep := range w.endpoints {
+		if obj, ok := optional[Reconnector](ep.wallet); ok {
+			if err := obj.Reconnect(ctx); err != nil {
+				lastErr = err
+			}
+		}
+	}
+	return lastErr
+}
+
+// the sends are never retried on another endpoint, the first one may have broadcast them
+func (w *failoverWallet) SendTx(ctx context.Context, tx *OutTx) (string, error) {
+	return forward(w.active(), func(obj Sender) (string, error) { return obj.SendTx(ctx, tx) })
+}
+
+func (w *failoverWallet) ReplaceTx(ctx context.Context, tx *OutTx) (string, error) {
+	return forward(w.active(), func(obj Replacer) (string, error) { return obj.ReplaceTx(ctx, tx) })
+}
+
+func (w *failoverWallet) Rebroadcast(ctx context.Context, hash string) error {
+	if obj, ok := optional[Rebroadcaster](w.active()); ok {
+		return obj.Rebroadcast(ctx, hash)
+	}
+	return errUnsupported
+}
+
+func (w *failoverWallet) LookupTx(ctx context.Context, hash string) (*TxInfo, error) {
+	return tryEach(w, 0, func(obj TxLookup) (*TxInfo, error) { return obj.LookupTx(ctx, hash) })
+}
+
+func (w *failoverWallet) Receipt(ctx context.Context, hash string) (*Receipt, error) {
+	return tryEach(w, 0, func(obj ReceiptReader) (*Receipt, error) { return obj.Receipt(ctx, hash) })
+}
+
+func (w *failoverWallet) UTXOTxs(ctx context.Context, num *big.Int) ([]*UTXOTx, error) {
+	return tryEach(w, num.Int64(), func(obj UTXOReader) ([]*UTXOTx, error) { return obj.UTXOTxs(ctx, num) })
+}
+
+func (w *failoverWallet) Calldata(ctx context.Context, hash string) (string, error) {
+	return tryEach(w, 0, func(obj CalldataReader) (string, error) { return obj.Calldata(ctx, hash) })
+}
+
+func (w *failoverWallet) PendingNonce(ctx context.Context, addr string) (uint64, error) {
+	return tryEach(w, 0, func(obj NonceSource) (uint64, error) { return obj.PendingNonce(ctx, addr) })
+}
+
+func (w *failoverWallet) GasPrice(ctx context.Context) (*big.Int, error) {
+	return tryEach(w, 0, func(obj GasPricer) (*big.Int, error) { return obj.GasPrice(ctx) })
+}
+
+func (w *failoverWallet) Logs(ctx context.Context, num *big.Int, addrs []string) ([]*Log, error) {
+	return tryEach(w, num.Int64(), func(obj LogReader) ([]*Log, error) { return obj.Logs(ctx, num, addrs) })
+}
+
+func (w *failoverWallet) TokenInfo(ctx context.Context, contract string) (*TokenInfo, error) {
+	return tryEach(w, 0, func(obj TokenInfoReader) (*TokenInfo, error) { return obj.TokenInfo(ctx, contract) })
+}
+
+func (w *failoverWallet) InternalTransfers(ctx context.Context, num *big.Int) ([]*InternalTransfer, error) {
+	return tryEach(w, num.Int64(), func(obj TraceReader) ([]*InternalTransfer, error) { return obj.InternalTransfers(ctx, num) })
+}
+
+func (w *failoverWallet) MinedAt(ctx context.Context, num *big.Int) (time.Time, error) {
+	return tryEach(w, num.Int64(), func(obj BlockTimer) (time.Time, error) { return obj.MinedAt(ctx, num) })
+}
@@ -0,0 +1,177 @@
+package chainpot
+
+import (
+	"context"
+	"github.com/fadeAce/claws"
+	"math/big"
+	"os"
+	"sync"
+	"testing"
+	"time"
+)
+
+func newTestFailover(quorum int, fakes ...*FakeChain) *failoverWallet {
+	var list = make([]*endpoint, 0)
+	for i, fake := range fakes {
+		list = append(list, &endpoint{url: string(rune('a' + i)), wallet: fake})
+	}
+	return newFailoverWallet(list, &failoverOption{Quorum: quorum, Clock: fakes[0].Now, Logger: defaultLogger()})
+}
+
+type headLog struct {
+	mu    sync.Mutex
+	heads []int64
+}
+
+func (h *headLog) push(num *big.Int) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	h.heads = append(h.heads, num.Int64())
+}
+
+func (h *headLog) last() int64 {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	if len(h.heads) == 0 {
+		return 0
+	}
+	return h.heads[len(h.heads)-1]
+}
+
+func TestFailover_Unfold(t *testing.T) {
+	var primary, backup = NewFakeChain(100), NewFakeChain(100)
+	var wallet = newTestFailover(0, primary, backup)
+	primary.Mine(BlockMessage{Hash: "f1"})
+	backup.Mine(BlockMessage{Hash: "f1"})
+	primary.FailUnfold(101, 1)
+
+	txns, err := wallet.UnfoldTxs(context.Background(), big.NewInt(101))
+	if err != nil || len(txns) != 1 || txns[0].HexStr() != "f1" {
+		t.Fatalf("no failover: %v %v", txns, err)
+	}
+	var status = wallet.status()
+	if status[0].Healthy || status[0].LastError != ErrFakeRPC.Error() || !status[1].Healthy {
+		t.Fatalf("unexpected endpoints %+v %+v", status[0], status[1])
+	}
+
+	// the failed endpoint is back after the cooldown
+	primary.Advance(defaultCooldown)
+	if !wallet.status()[0].Healthy {
+		t.Fatal("endpoint is still down after the cooldown")
+	}
+
+	backup.FailUnfold(101, 1)
+	primary.FailUnfold(101, 1)
+	if _, err := wallet.UnfoldTxs(context.Background(), big.NewInt(101)); err != ErrFakeRPC {
+		t.Fatalf("unexpected error %v", err)
+	}
+}
+
+func TestFailover_Quorum(t *testing.T) {
+	var a, b, c = NewFakeChain(100), NewFakeChain(100), NewFakeChain(100)
+	var wallet = newTestFailover(2, a, b, c)
+	var log = &headLog{}
+	if err := wallet.NotifyHead(context.Background(), log.push); err != nil {
+		t.Fatal(err)
+	}
+
+	// a lying node alone is not followed
+	c.Mine(BlockMessage{Hash: "forged"})
+	c.Mine()
+	if log.last() != 0 {
+		t.Fatalf("head %d forwarded without quorum", log.last())
+	}
+
+	a.Mine(BlockMessage{Hash: "q1"})
+	if log.last() != 0 {
+		t.Fatal("head forwarded on a disagreeing hash")
+	}
+	b.Mine(BlockMessage{Hash: "q1"})
+	if log.last() != 101 {
+		t.Fatalf("agreed head is not forwarded, got %d", log.last())
+	}
+
+	txns, err := wallet.UnfoldTxs(context.Background(), big.NewInt(101))
+	if err != nil || len(txns) != 1 || txns[0].HexStr() != "q1" {
+		t.Fatalf("unfold does not use the agreeing endpoints: %v %v", txns, err)
+	}
+}
+
+// a head failing to subscribe
+type brokenHead struct {
+	*FakeChain
+}
+
+func (w *brokenHead) NotifyHead(ctx context.Context, f func(num *big.Int)) error {
+	return ErrFakeRPC
+}
+
+func TestFailover_BlockingHead(t *testing.T) {
+	var a, b = NewFakeChain(100), NewFakeChain(100)
+	a.BlockingHead, b.BlockingHead = true, true
+	var wallet = newTestFailover(0, a, b)
+	var log = &headLog{}
+	ctx, cancel := context.WithCancel(context.Background())
+	var done = make(chan error, 1)
+	go func() {
+		done <- wallet.NotifyHead(ctx, log.push)
+	}()
+
+	// both are subscribed though the first one never returns
+	a.Listen(0, time.Second)
+	if b.Listen(0, time.Second) != 1 {
+		t.Fatal("the second endpoint is not subscribed")
+	}
+	b.Mine()
+	if log.last() != 101 {
+		t.Fatalf("head of the second endpoint not forwarded, got %d", log.last())
+	}
+	cancel()
+	select {
+	case err := <-done:
+		if err != nil {
+			t.Fatal(err)
+		}
+	case <-time.After(time.Second):
+		t.Fatal("NotifyHead still running after cancel")
+	}
+
+	// an error is reported once every endpoint failed
+	var broken = newFailoverWallet([]*endpoint{{url: "a", wallet: &brokenHead{a}}, {url: "b", wallet: NewFakeChain(100)}}, &failoverOption{Logger: defaultLogger()})
+	if err := broken.NotifyHead(context.Background(), log.push); err != nil {
+		t.Fatal(err)
+	}
+	broken = newFailoverWallet([]*endpoint{{url: "a", wallet: &brokenHead{a}}, {url: "b", wallet: &brokenHead{b}}}, &failoverOption{Logger: defaultLogger()})
+	if err := broken.NotifyHead(context.Background(), log.push); err != ErrFakeRPC {
+		t.Fatalf("unexpected error %v", err)
+	}
+}
+
+func TestChainpot_Failover(t *testing.T) {
+	var dir = tempDir(t)
+	defer os.RemoveAll(dir)
+	var primary, backup = NewFakeChain(100), NewFakeChain(100)
+	var cp = NewChainpot(&ChainConf{
+		Coins:    []Coins{{CoinType: "origin", Chain: "btc", Symbol: "btc"}},
+		Btc:      &BtcConf{ConfirmTimes: 2, Storage: boltStorage(t, dir, "btc")},
+		Builders: map[string]claws.WalletBuilder{"btc": newTestFailover(0, primary, backup)},
+	})
+	if err := cp.Register(Bitcoin); err != nil {
+		t.Fatal(err)
+	}
+	cp.Add(Bitcoin, []string{testAddr})
+
+	// both nodes hold the block before the primary announces it
+	primary.Mine(BlockMessage{Hash: "g1", From: testOther, To: testAddr})
+	backup.Mine(BlockMessage{Hash: "g1", From: testOther, To: testAddr})
+	primary.FailUnfold(101, 1)
+	var ch = startPot(t, cp, backup)
+	primary.Announce()
+	expectEvents(t, ch, expected{T_DEPOSIT, 1, "g1"})
+
+	var endpoints = cp.Status()[Bitcoin].Endpoints
+	if len(endpoints) != 2 || endpoints[0].Healthy || endpoints[0].Head != 101 {
+		t.Fatalf("unexpected endpoints %v", mustMarshal(endpoints))
+	}
+	stopPot(t, cp)
+}
@@ -0,0 +1,248 @@
+package chainpot
+
+import (
+	"encoding/json"
+	"github.com/boltdb/bolt"
+	"github.com/fadeAce/chainpot/hdkey"
+	"github.com/fadeAce/chainpot/poterr"
+)
+
+// unused addresses watched after the last used one of an extended key
+const defaultGapLimit = 20
+
+// XPub is the derivation state of an extended public key, addresses are derived on its external chain 0/i
+type XPub struct {
+	Key string
+	// index of the next address handed out by NextAddress
+	Next uint32
+	// highest index of an address that received funds, -1 when none did
+	Used int64
+	// addresses derived and watched from index 0
+	Watched uint32
+}
+
+// XPubStore is implemented by storages persisting the derivation of the extended keys
+type XPubStore interface {
+	SaveXPub(x *XPub) error
+	LoadXPubs() ([]*XPub, error)
+}
+
+type derivation struct {
+	key   string
+	index uint32
+}
+
+// AddXPub watches the addresses of an account key, BIP44, BIP49 and BIP84 ones on bitcoin
+// and BIP44 m/44'/60'/0' ones on ethereum, up to the gap limit
+func (c *Chainpot) AddXPub(chain PublicChain, key string) (*XPub, error) {
+	var obj = c.chainOf(chain)
+	if obj == nil {
+		return nil, poterr.NotRegErr
+	}
+	return obj.addXPub(key)
+}
+
+// NextAddress hands out the next address of an added key, it's watched from then on
+func (c *Chainpot) NextAddress(chain PublicChain, key string) (string, error) {
+	var obj = c.chainOf(chain)
+	if obj == nil {
+		return "", poterr.NotRegErr
+	}
+	return obj.nextAddress(key)
+}
+
+// external chain of key, XPubErr when it's no account key of the chain and NetworkErr
+// when it's one of another network
+func (c *chain) externalKey(key string) (*hdkey.Key, error) {
+	parsed, err := hdkey.Parse(key)
+	if err != nil {
+		return nil, poterr.XPubErr
+	}
+	// ethereum keys are plain xpubs
+	if c.origin.Chain == "eth" && parsed.Script() != hdkey.P2PKH {
+		return nil, poterr.XPubErr
+	}
+	if c.origin.Chain != "eth" && parsed.Testnet() != (c.btcNetwork().pubKeyHash != 0x00) {
+		return nil, poterr.NetworkErr
+	}
+	external, err := parsed.Child(0)
+	if err != nil {
+		return nil, poterr.XPubErr
+	}
+	return external, nil
+}
+
+func (c *chain) deriveAddress(external *hdkey.Key, index uint32) (string, error) {
+	child, err := external.Child(index)
+	if err != nil {
+		return "", err
+	}
+	if c.origin.Chain == "eth" {
+		return child.EthereumAddress(), nil
+	}
+	var network = c.btcNetwork()
+	return child.NetworkAddress(network.pubKeyHash, network.scriptHash, network.hrp), nil
+}
+
+func (c *chain) addXPub(key string) (*XPub, error) {
+	c.hdMu.Lock()
+	defer c.hdMu.Unlock()
+	if x, ok := c.xpubs[key]; ok {
+		var res = *x
+		return &res, nil
+	}
+	external, err := c.externalKey(key)
+	if err != nil {
+		return nil, err
+	}
+	var x = &XPub{Key: key, Used: -1}
+	c.xpubs[key] = x
+	c.hdKeys[key] = external
+	c.extend(x, uint32(c.gapLimit))
+	c.saveXPub(x)
+	var res = *x
+	return &res, nil
+}
+
+func (c *chain) nextAddress(key string) (string, error) {
+	c.hdMu.Lock()
+	defer c.hdMu.Unlock()
+	var x, ok = c.xpubs[key]
+	if !ok {
+		return "", poterr.XPubErr
+	}
+	addr, err := c.deriveAddress(c.hdKeys[key], x.Next)
+	if err != nil {
+		return "", err
+	}
+	x.Next++
+	c.extend(x, x.Next)
+	if x.Watched < x.Next {
+		// the chain rejected the address, it's not handed out
+		x.Next--
+		return "", poterr.AddressErr
+	}
+	c.saveXPub(x)
+	return addr, nil
+}
+
+// a derived address received funds, the watched range is extended to the gap limit after it
+func (c *chain) received(addr string) {
+	c.hdMu.Lock()
+	defer c.hdMu.Unlock()
+	var item, ok = c.derived[addr]
+	if !ok {
+		return
+	}
+	var x = c.xpubs[item.key]
+	if int64(item.index) <= x.Used {
+		return
+	}
+	x.Used = int64(item.index)
+	c.extend(x, item.index+1+uint32(c.gapLimit))
+	c.saveXPub(x)
+}
+
+// derive and watch the addresses of x up to count, must be called with c.hdMu held. Watched
+// stops at the first address the chain rejects
+func (c *chain) extend(x *XPub, count uint32) {
+	var addrs = make([]string, 0)
+	for x.Watched < count {
+		addr, err := c.deriveAddress(c.hdKeys[x.Key], x.Watched)
+		if err != nil {
+			// BIP32 skips the rare indexes without a key
+			c.logger.Warn().Msgf("address %d of %s skipped: %s", x.Watched, x.Key, err.Error())
+			x.Watched++
+			count++
+			continue
+		}
+		c.derived[addr] = derivation{key: x.Key, index: x.Watched}
+		addrs = append(addrs, addr)
+		x.Watched++
+	}
+	if len(addrs) == 0 {
+		return
+	}
+	_, rejected := c.add(addrs)
+	for addr, err := range rejected {
+		var item = c.derived[addr]
+		delete(c.derived, addr)
+		c.logger.Error().Msgf("address %d of %s rejected: %s", item.index, x.Key, err.Error())
+		if item.index < x.Watched {
+			x.Watched = item.index
+		}
+	}
+}
+
+// must be called with c.hdMu held
+func (c *chain) saveXPub(x *XPub) {
+	store, ok := c.storage.(XPubStore)
+	if !ok {
+		return
+	}
+	if err := store.SaveXPub(x); err != nil {
+		c.health.fail(err)
+		c.logger.Error().Msgf("save xpub %s error: %s", x.Key, err.Error())
+	}
+}
+
+// load the persisted extended keys and derive their watched addresses again
+func (c *chain) loadXPubs() {
+	store, ok := c.storage.(XPubStore)
+	if !ok {
+		return
+	}
+	list, err := store.LoadXPubs()
+	if err != nil {
+		c.logger.Error().Msgf("load xpubs error: %s", err.Error())
+		return
+	}
+	for _, x := range list {
+		external, err := c.externalKey(x.Key)
+		if err != nil {
+			c.logger.Error().Msgf("load xpub %s error: %s", x.Key, err.Error())
+			continue
+		}
+		c.xpubs[x.Key] = x
+		c.hdKeys[x.Key] = external
+		for i := uint32(0); i < x.Watched; i++ {
+			if addr, err := c.deriveAddress(external, i); err == nil {
+				c.derived[addr] = derivation{key: x.Key, index: i}
+			}
+		}
+	}
+}
+
+var xpubsBucket = []byte("xpubs")
+
+func (c *BoltStorage) createXPubs() error {
+	return c.Database.Update(func(tx *bolt.Tx) error {
+		_, err := tx.CreateBucketIfNotExists(xpubsBucket)
+		return err
+	})
+}
+
+func (c *BoltStorage) SaveXPub(x *XPub) error {
+	bs, err := json.Marshal(x)
+	if err != nil {
+		return err
+	}
+	return c.Database.Update(func(tx *bolt.Tx) error {
+		return tx.Bucket(xpubsBucket).Put([]byte(x.Key), bs)
+	})
+}
+
+func (c *BoltStorage) LoadXPubs() ([]*XPub, error) {
+	var res = make([]*XPub, 0)
+	err := c.Database.View(func(tx *bolt.Tx) error {
+		return tx.Bucket(xpubsBucket).ForEach(func(k, v []byte) error {
+			var x = &XPub{}
+			if err := json.Unmarshal(v, x); err != nil {
+				return err
+			}
+			res = append(res, x)
+			return nil
+		})
+	})
+	return res, err
+}
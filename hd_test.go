@@ -0,0 +1,120 @@
+package chainpot
+
+import (
+	"github.com/fadeAce/chainpot/hdkey"
+	"github.com/fadeAce/chainpot/poterr"
+	"github.com/fadeAce/claws"
+	"os"
+	"testing"
+)
+
+// BIP84 account key of the "abandon ... about" mnemonic
+const testZpub = "zpub6rFR7y4Q2AijBEqTUquhVz398htDFrtymD9xYYfG1m4wAcvPhXNfE3EfH1r1ADqtfSdVCToUG868RvUUkgDKf31mGDtKsAYz2oz2AGutZYs"
+
+func newXPubPot(t *testing.T, dir string, fake *FakeChain) *Chainpot {
+	var cp = NewChainpot(&ChainConf{
+		Coins:    []Coins{{CoinType: "origin", Chain: "btc", Symbol: "btc"}},
+		Btc:      &BtcConf{ConfirmTimes: 2, Storage: boltStorage(t, dir, "btc"), GapLimit: 2},
+		Builders: map[string]claws.WalletBuilder{"btc": fake},
+	})
+	if err := cp.Register(Bitcoin); err != nil {
+		t.Fatal(err)
+	}
+	return cp
+}
+
+func TestChainpot_XPub(t *testing.T) {
+	var dir = tempDir(t)
+	defer os.RemoveAll(dir)
+	var fake = NewFakeChain(100)
+	var cp = newXPubPot(t, dir, fake)
+
+	key, _ := hdkey.Parse(testZpub)
+	var addrs = make([]string, 6)
+	for i := range addrs {
+		child, _ := key.Path(0, uint32(i))
+		addrs[i] = child.BitcoinAddress()
+	}
+
+	if _, err := cp.AddXPub(Ethereum, testZpub); err != poterr.NotRegErr {
+		t.Fatalf("unexpected error %v", err)
+	}
+	if _, err := cp.AddXPub(Bitcoin, "xpub-broken"); err != poterr.XPubErr {
+		t.Fatalf("unexpected error %v", err)
+	}
+	if x, err := cp.AddXPub(Bitcoin, testZpub); err != nil || x.Watched != 2 || x.Used != -1 {
+		t.Fatalf("unexpected xpub %s %v", mustMarshal(x), err)
+	}
+	if addr, err := cp.NextAddress(Bitcoin, testZpub); err != nil || addr != "bc1qcr8te4kr609gcawutmrza0j4xv80jy8z306fyu" {
+		t.Fatalf("unexpected address %s %v", addr, err)
+	}
+	var ch = startPot(t, cp, fake)
+
+	// a deposit to the last watched address extends the range by the gap limit
+	fake.Mine(BlockMessage{Hash: "x1", From: testOther, To: addrs[1]})
+	expectEvents(t, ch, expected{T_DEPOSIT, 1, "x1"})
+	if x, _ := cp.AddXPub(Bitcoin, testZpub); x.Watched != 4 || x.Used != 1 || x.Next != 1 {
+		t.Fatalf("unexpected xpub %s", mustMarshal(x))
+	}
+	fake.Mine(BlockMessage{Hash: "x2", From: testOther, To: addrs[3]})
+	expectEvents(t, ch, expected{T_DEPOSIT_CONFIRM, 2, "x1"}, expected{T_DEPOSIT, 3, "x2"})
+	if x, _ := cp.AddXPub(Bitcoin, testZpub); x.Watched != 6 || x.Used != 3 {
+		t.Fatalf("unexpected xpub %s", mustMarshal(x))
+	}
+	stopPot(t, cp)
+
+	// the derivation survives a restart
+	cp = newXPubPot(t, dir, fake)
+	var obj = cp.chains[int(Bitcoin)]
+	if x, _ := cp.AddXPub(Bitcoin, testZpub); x.Watched != 6 || x.Used != 3 || x.Next != 1 {
+		t.Fatalf("unexpected xpub after restart %s", mustMarshal(x))
+	}
+	if item, ok := obj.derived[addrs[5]]; !ok || item.index != 5 {
+		t.Fatalf("address %s is not derived after restart", addrs[5])
+	}
+	if _, ok := obj.addrs[addrs[5]]; !ok {
+		t.Fatalf("address %s is not watched after restart", addrs[5])
+	}
+	obj.storage.(*BoltStorage).Close()
+}
+
+func TestChainpot_XPubNetwork(t *testing.T) {
+	var dir = tempDir(t)
+	defer os.RemoveAll(dir)
+
+	// the BIP84 test key in its testnet version
+	data, err := hdkey.Base58CheckDecode(testZpub)
+	if err != nil {
+		t.Fatal(err)
+	}
+	copy(data, []byte{0x04, 0x5f, 0x1c, 0xf6})
+	var vpub = hdkey.Base58Check(data)
+	key, _ := hdkey.Parse(vpub)
+	child, _ := key.Path(0, 0)
+	var want = hdkey.SegwitAddress("bcrt", 0, hdkey.Hash160(child.PublicKey()))
+
+	var fake = NewFakeChain(100)
+	var cp = NewChainpot(&ChainConf{
+		Coins:    []Coins{{CoinType: "origin", Chain: "btc", Symbol: "btc"}},
+		Btc:      &BtcConf{ConfirmTimes: 2, Storage: boltStorage(t, dir, "btc"), GapLimit: 2, Network: "regtest"},
+		Builders: map[string]claws.WalletBuilder{"btc": fake},
+	})
+	if err := cp.Register(Bitcoin); err != nil {
+		t.Fatal(err)
+	}
+	// mainnet keys are refused off mainnet, regtest addresses have their own hrp
+	if _, err := cp.AddXPub(Bitcoin, testZpub); err != poterr.NetworkErr {
+		t.Fatalf("unexpected error %v", err)
+	}
+	if x, err := cp.AddXPub(Bitcoin, vpub); err != nil || x.Watched != 2 {
+		t.Fatalf("unexpected xpub %s %v", mustMarshal(x), err)
+	}
+	var obj = cp.chains[int(Bitcoin)]
+	if _, ok := obj.addrs[want]; !ok || len(obj.addrs) != 2 {
+		t.Fatalf("address %s is not watched", want)
+	}
+	if addr, err := cp.NextAddress(Bitcoin, vpub); err != nil || addr != want {
+		t.Fatalf("unexpected address %s %v", addr, err)
+	}
+	obj.storage.(*BoltStorage).Close()
+}
@@ -0,0 +1,81 @@
+package hdkey
+
+import (
+	"crypto/sha256"
+	"math/big"
+	"strings"
+)
+
+const base58Alphabet = "123456789ABCDEFGHJKLMNPQRSTUVWXYZabcdefghijkmnopqrstuvwxyz"
+
+func doubleSha256(data []byte) []byte {
+	var first = sha256.Sum256(data)
+	var second = sha256.Sum256(first[:])
+	return second[:]
+}
+
+// Hash160 is the RIPEMD-160 of the SHA-256 of data, the hash of bitcoin keys and scripts
+func Hash160(data []byte) []byte {
+	var sum = sha256.Sum256(data)
+	return Ripemd160(sum[:])
+}
+
+func base58Encode(data []byte) string {
+	var num = new(big.Int).SetBytes(data)
+	var radix = big.NewInt(58)
+	var rem = new(big.Int)
+	var res = make([]byte, 0, len(data)*138/100+1)
+	for num.Sign() > 0 {
+		num.QuoRem(num, radix, rem)
+		res = append(res, base58Alphabet[rem.Int64()])
+	}
+	for _, b := range data {
+		if b != 0 {
+			break
+		}
+		res = append(res, base58Alphabet[0])
+	}
+	for i, j := 0, len(res)-1; i < j; i, j = i+1, j-1 {
+		res[i], res[j] = res[j], res[i]
+	}
+	return string(res)
+}
+
+func base58Decode(s string) ([]byte, bool) {
+	var num = new(big.Int)
+	var radix = big.NewInt(58)
+	for _, c := range s {
+		var i = strings.IndexRune(base58Alphabet, c)
+		if i < 0 {
+			return nil, false
+		}
+		num.Mul(num, radix)
+		num.Add(num, big.NewInt(int64(i)))
+	}
+	var zeros = 0
+	for zeros < len(s) && s[zeros] == base58Alphabet[0] {
+		zeros++
+	}
+	return append(make([]byte, zeros), num.Bytes()...), true
+}
+
+// Base58Check encodes payload followed by its checksum
+func Base58Check(payload []byte) string {
+	return base58Encode(append(append([]byte{}, payload...), doubleSha256(payload)[:4]...))
+}
+
+// Base58CheckDecode returns the payload of s
+func Base58CheckDecode(s string) ([]byte, error) {
+	data, ok := base58Decode(s)
+	if !ok || len(data) < 5 {
+		return nil, ErrEncoding
+	}
+	var payload = data[:len(data)-4]
+	var sum = doubleSha256(payload)
+	for i := 0; i < 4; i++ {
+		if sum[i] != data[len(data)-4+i] {
+			return nil, ErrChecksum
+		}
+	}
+	return payload, nil
+}
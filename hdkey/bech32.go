@@ -0,0 +1,138 @@
+package hdkey
+
+import "strings"
+
+const bech32Charset = "qpzry9x8gf2tvdw0s3jn54khce6mua7l"
+
+// checksum constants of bech32 and bech32m
+const (
+	bech32Const  = 1
+	bech32mConst = 0x2bc830a3
+)
+
+func bech32Polymod(values []byte) uint32 {
+	var gen = [5]uint32{0x3b6a57b2, 0x26508e6d, 0x1ea119fa, 0x3d4233dd, 0x2a1462b3}
+	var chk uint32 = 1
+	for _, v := range values {
+		var top = chk >> 25
+		chk = (chk&0x1ffffff)<<5 ^ uint32(v)
+		for i := 0; i < 5; i++ {
+			if (top>>uint(i))&1 == 1 {
+				chk ^= gen[i]
+			}
+		}
+	}
+	return chk
+}
+
+func bech32HrpExpand(hrp string) []byte {
+	var res = make([]byte, 0, len(hrp)*2+1)
+	for i := 0; i < len(hrp); i++ {
+		res = append(res, hrp[i]>>5)
+	}
+	res = append(res, 0)
+	for i := 0; i < len(hrp); i++ {
+		res = append(res, hrp[i]&31)
+	}
+	return res
+}
+
+// regroup the bits of data from groups of from bits to groups of to bits
+func convertBits(data []byte, from, to uint, pad bool) ([]byte, bool) {
+	var acc, nbits uint
+	var maxv = uint(1)<<to - 1
+	var res = make([]byte, 0, len(data)*int(from)/int(to)+1)
+	for _, v := range data {
+		if uint(v)>>from != 0 {
+			return nil, false
+		}
+		acc = acc<<from | uint(v)
+		nbits += from
+		for nbits >= to {
+			nbits -= to
+			res = append(res, byte(acc>>nbits&maxv))
+		}
+	}
+	if pad {
+		if nbits > 0 {
+			res = append(res, byte(acc<<(to-nbits)&maxv))
+		}
+	} else if nbits >= from || acc<<(to-nbits)&maxv != 0 {
+		return nil, false
+	}
+	return res, true
+}
+
+// SegwitAddress encodes a witness program for hrp, bech32 for version 0 and bech32m above
+func SegwitAddress(hrp string, version byte, program []byte) string {
+	var data, _ = convertBits(program, 8, 5, true)
+	data = append([]byte{version}, data...)
+	var constant uint32 = bech32Const
+	if version > 0 {
+		constant = bech32mConst
+	}
+	var values = append(bech32HrpExpand(hrp), data...)
+	var mod = bech32Polymod(append(values, 0, 0, 0, 0, 0, 0)) ^ constant
+	var res = []byte(hrp + "1")
+	for _, v := range data {
+		res = append(res, bech32Charset[v])
+	}
+	for i := 0; i < 6; i++ {
+		res = append(res, bech32Charset[(mod>>uint(5*(5-i)))&31])
+	}
+	return string(res)
+}
+
+// decode a bech32 or bech32m string into its hrp and data, without the checksum
+func bech32Decode(s string) (hrp string, data []byte, constant uint32, err error) {
+	if len(s) < 8 || len(s) > 90 {
+		return "", nil, 0, ErrEncoding
+	}
+	var lower = strings.ToLower(s)
+	if s != lower && s != strings.ToUpper(s) {
+		return "", nil, 0, ErrEncoding
+	}
+	var pos = strings.LastIndexByte(lower, '1')
+	if pos < 1 || pos+7 > len(lower) {
+		return "", nil, 0, ErrEncoding
+	}
+	hrp = lower[:pos]
+	for i := 0; i < len(hrp); i++ {
+		if hrp[i] < 33 || hrp[i] > 126 {
+			return "", nil, 0, ErrEncoding
+		}
+	}
+	for i := pos + 1; i < len(lower); i++ {
+		var v = strings.IndexByte(bech32Charset, lower[i])
+		if v < 0 {
+			return "", nil, 0, ErrEncoding
+		}
+		data = append(data, byte(v))
+	}
+	constant = bech32Polymod(append(bech32HrpExpand(hrp), data...))
+	if constant != bech32Const && constant != bech32mConst {
+		return "", nil, 0, ErrChecksum
+	}
+	return hrp, data[:len(data)-6], constant, nil
+}
+
+// DecodeSegwitAddress returns the hrp, witness version and program of a bech32 or bech32m address,
+// version 0 must be bech32 and the later ones bech32m
+func DecodeSegwitAddress(addr string) (hrp string, version byte, program []byte, err error) {
+	hrp, data, constant, err := bech32Decode(addr)
+	if err != nil {
+		return "", 0, nil, err
+	}
+	if len(data) < 1 || data[0] > 16 {
+		return "", 0, nil, ErrEncoding
+	}
+	version = data[0]
+	if (version == 0 && constant != bech32Const) || (version > 0 && constant != bech32mConst) {
+		return "", 0, nil, ErrChecksum
+	}
+	program, ok := convertBits(data[1:], 5, 8, false)
+	if !ok || len(program) < 2 || len(program) > 40 || (version == 0 && len(program) != 20 && len(program) != 32) {
+		return "", 0, nil, ErrEncoding
+	}
+	return hrp, version, program, nil
+}
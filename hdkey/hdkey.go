@@ -0,0 +1,192 @@
+// Package hdkey derives the public keys and addresses of BIP32 extended public keys,
+// xpub, ypub and zpub of BIP44, BIP49 and BIP84 and their testnet versions
+package hdkey
+
+import (
+	"crypto/hmac"
+	"crypto/sha512"
+	"encoding/binary"
+	"encoding/hex"
+	"errors"
+	"math/big"
+	"strings"
+)
+
+var (
+	ErrKey      = errors.New("hdkey: malformed extended public key")
+	ErrHardened = errors.New("hdkey: hardened child of a public key")
+	ErrChild    = errors.New("hdkey: invalid child, use the next index")
+	ErrEncoding = errors.New("hdkey: malformed encoding")
+	ErrChecksum = errors.New("hdkey: checksum mismatch")
+)
+
+// script of the addresses of an extended key
+type Script int
+
+const (
+	P2PKH Script = iota
+	P2SHP2WPKH
+	P2WPKH
+)
+
+type version struct {
+	script  Script
+	testnet bool
+}
+
+var versions = map[uint32]version{
+	0x0488b21e: {P2PKH, false},      // xpub
+	0x049d7cb2: {P2SHP2WPKH, false}, // ypub
+	0x04b24746: {P2WPKH, false},     // zpub
+	0x043587cf: {P2PKH, true},       // tpub
+	0x044a5262: {P2SHP2WPKH, true},  // upub
+	0x045f1cf6: {P2WPKH, true},      // vpub
+}
+
+// Key is an extended public key
+type Key struct {
+	version     uint32
+	depth       byte
+	fingerprint uint32
+	child       uint32
+	chainCode   []byte
+	pub         []byte
+}
+
+// Parse decodes an extended public key, private ones are refused
+func Parse(s string) (*Key, error) {
+	data, err := Base58CheckDecode(s)
+	if err != nil || len(data) != 78 {
+		return nil, ErrKey
+	}
+	var key = &Key{
+		version:     binary.BigEndian.Uint32(data[0:4]),
+		depth:       data[4],
+		fingerprint: binary.BigEndian.Uint32(data[5:9]),
+		child:       binary.BigEndian.Uint32(data[9:13]),
+		chainCode:   append([]byte{}, data[13:45]...),
+		pub:         append([]byte{}, data[45:78]...),
+	}
+	if _, ok := versions[key.version]; !ok {
+		return nil, ErrKey
+	}
+	if _, err := decompress(key.pub); err != nil {
+		return nil, ErrKey
+	}
+	return key, nil
+}
+
+// String encodes k with its version
+func (k *Key) String() string {
+	var data = make([]byte, 78)
+	binary.BigEndian.PutUint32(data[0:4], k.version)
+	data[4] = k.depth
+	binary.BigEndian.PutUint32(data[5:9], k.fingerprint)
+	binary.BigEndian.PutUint32(data[9:13], k.child)
+	copy(data[13:45], k.chainCode)
+	copy(data[45:78], k.pub)
+	return Base58Check(data)
+}
+
+func (k *Key) Script() Script {
+	return versions[k.version].script
+}
+
+func (k *Key) Testnet() bool {
+	return versions[k.version].testnet
+}
+
+// PublicKey is the compressed public key of k
+func (k *Key) PublicKey() []byte {
+	return append([]byte{}, k.pub...)
+}
+
+// Child derives the non-hardened child i of k
+func (k *Key) Child(i uint32) (*Key, error) {
+	if i >= 0x80000000 {
+		return nil, ErrHardened
+	}
+	var mac = hmac.New(sha512.New, k.chainCode)
+	mac.Write(k.pub)
+	var index = make([]byte, 4)
+	binary.BigEndian.PutUint32(index, i)
+	mac.Write(index)
+	var sum = mac.Sum(nil)
+
+	var tweak = new(big.Int).SetBytes(sum[:32])
+	if tweak.Cmp(curveN) >= 0 {
+		return nil, ErrChild
+	}
+	parent, err := decompress(k.pub)
+	if err != nil {
+		return nil, err
+	}
+	var child = baseMul(tweak).add(parent)
+	if child.infinity() {
+		return nil, ErrChild
+	}
+	return &Key{
+		version:     k.version,
+		depth:       k.depth + 1,
+		fingerprint: binary.BigEndian.Uint32(Hash160(k.pub)[:4]),
+		child:       i,
+		chainCode:   append([]byte{}, sum[32:]...),
+		pub:         child.compress(),
+	}, nil
+}
+
+// Path derives the non-hardened children of k one after another
+func (k *Key) Path(indexes ...uint32) (*Key, error) {
+	var res = k
+	for _, i := range indexes {
+		var err error
+		if res, err = res.Child(i); err != nil {
+			return nil, err
+		}
+	}
+	return res, nil
+}
+
+// BitcoinAddress is the address of k for the script of its version on mainnet or testnet
+func (k *Key) BitcoinAddress() string {
+	if k.Testnet() {
+		return k.NetworkAddress(0x6f, 0xc4, "tb")
+	}
+	return k.NetworkAddress(0x00, 0x05, "bc")
+}
+
+// NetworkAddress is the address of k for the script of its version with the prefixes of a network,
+// regtest keys share the testnet versions but not the segwit hrp
+func (k *Key) NetworkAddress(pubKeyHash, scriptHash byte, hrp string) string {
+	var hash = Hash160(k.pub)
+	switch k.Script() {
+	case P2SHP2WPKH:
+		return Base58Check(append([]byte{scriptHash}, Hash160(append([]byte{0x00, 0x14}, hash...))...))
+	case P2WPKH:
+		return SegwitAddress(hrp, 0, hash)
+	}
+	return Base58Check(append([]byte{pubKeyHash}, hash...))
+}
+
+// ChecksumAddress is the EIP-55 mixed case form of an ethereum address
+func ChecksumAddress(addr string) string {
+	var lower = strings.ToLower(strings.TrimPrefix(strings.TrimPrefix(addr, "0x"), "0X"))
+	var hash = hex.EncodeToString(Keccak256([]byte(lower)))
+	var res = []byte(lower)
+	for i, c := range res {
+		if c >= 'a' && c <= 'f' && hash[i] >= '8' {
+			res[i] = c - 'a' + 'A'
+		}
+	}
+	return "0x" + string(res)
+}
+
+// EthereumAddress is the lowercase address of k
+func (k *Key) EthereumAddress() string {
+	p, _ := decompress(k.pub)
+	var x, y = p.toAffine()
+	var data = make([]byte, 64)
+	x.FillBytes(data[:32])
+	y.FillBytes(data[32:])
+	return "0x" + hex.EncodeToString(Keccak256(data)[12:])
+}
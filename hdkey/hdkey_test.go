@@ -0,0 +1,122 @@
+package hdkey
+
+import (
+	"encoding/hex"
+	"strings"
+	"testing"
+)
+
+// account keys of the "abandon ... about" mnemonic
+const (
+	bip44Key    = "xpub6BosfCnifzxcFwrSzQiqu2DBVTshkCXacvNsWGYJVVhhawA7d4R5WSWGFNbi8Aw6ZRc1brxMyWMzG3DSSSSoekkudhUd9yLb6qx39T9nMdj"
+	bip49Key    = "ypub6Ww3ibxVfGzLrAH1PNcjyAWenMTbbAosGNB6VvmSEgytSER9azLDWCxoJwW7Ke7icmizBMXrzBx9979FfaHxHcrArf3zbeJJJUZPf663zsP"
+	bip84Key    = "zpub6rFR7y4Q2AijBEqTUquhVz398htDFrtymD9xYYfG1m4wAcvPhXNfE3EfH1r1ADqtfSdVCToUG868RvUUkgDKf31mGDtKsAYz2oz2AGutZYs"
+	ethereumKey = "xpub6DCoCpSuQZB2jawqnGMEPS63ePKWkwWPH4TU45Q7LPXWuNd8TMtVxRrgjtEshuqpK3mdhaWHPFsBngh5GFZaM6si3yZdUsT8ddYM3PwnATt"
+)
+
+func TestHashes(t *testing.T) {
+	for _, item := range []struct{ name, got, want string }{
+		{"ripemd160", hex.EncodeToString(Ripemd160(nil)), "9c1185a5c5e9fc54612808977ee8f548b2258d31"},
+		{"ripemd160", hex.EncodeToString(Ripemd160([]byte("abc"))), "8eb208f7e05d987a9b044a8e98c6b087f15a0bfc"},
+		{"ripemd160", hex.EncodeToString(Ripemd160(make([]byte, 200))), "c5f27a97fdbac67c665b74394e9b8d0e98e0b4a1"},
+		{"keccak256", hex.EncodeToString(Keccak256(nil)), "c5d2460186f7233c927e7db2dcc703c0e500b653ca82273b7bfad8045d85a470"},
+		{"keccak256", hex.EncodeToString(Keccak256([]byte("Transfer(address,address,uint256)"))), "ddf252ad1be2c89b69c2b068fc378daa952ba7f163c4a11628f55a4df523b3ef"},
+	} {
+		if item.got != item.want {
+			t.Fatalf("%s: expect %s, got %s", item.name, item.want, item.got)
+		}
+	}
+}
+
+func TestKey_Child(t *testing.T) {
+	// m/0H to m/0H/1 of the first BIP32 test vector
+	key, err := Parse("xpub68Gmy5EdvgibQVfPdqkBBCHxA5htiqg55crXYuXoQRKfDBFA1WEjWgP6LHhwBZeNK1VTsfTFUHCdrfp1bgwQ9xv5ski8PX9rL2dZXvgGDnw")
+	if err != nil {
+		t.Fatal(err)
+	}
+	child, err := key.Child(1)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if res := child.String(); res != "xpub6ASuArnXKPbfEwhqN6e3mwBcDTgzisQN1wXN9BJcM47sSikHjJf3UFHKkNAWbWMiGj7Wf5uMash7SyYq527Hqck2AxYysAA7xmALppuCkwQ" {
+		t.Fatalf("unexpected child %s", res)
+	}
+	if _, err := key.Child(0x80000000); err != ErrHardened {
+		t.Fatalf("unexpected error %v", err)
+	}
+	if _, err := Parse("xprv9s21ZrQH143K3QTDL4LXw2F7HEK3wJUD2nW2nRk4stbPy6cq3jPPqjiChkVvvNKmPGJxWUtg6LnF5kejMRNNU3TGtRBeJgk33yuGBxrMPHi"); err != ErrKey {
+		t.Fatalf("unexpected error %v", err)
+	}
+}
+
+func TestKey_Address(t *testing.T) {
+	for _, item := range []struct {
+		key      string
+		index    uint32
+		ethereum bool
+		want     string
+	}{
+		{bip44Key, 0, false, "1LqBGSKuX5yYUonjxT5qGfpUsXKYYWeabA"},
+		{bip44Key, 1, false, "1Ak8PffB2meyfYnbXZR9EGfLfFZVpzJvQP"},
+		{bip49Key, 0, false, "37VucYSaXLCAsxYyAPfbSi9eh4iEcbShgf"},
+		{bip84Key, 0, false, "bc1qcr8te4kr609gcawutmrza0j4xv80jy8z306fyu"},
+		{bip84Key, 1, false, "bc1qnjg0jd8228aq7egyzacy8cys3knf9xvrerkf9g"},
+		{ethereumKey, 0, true, "0x9858effd232b4033e47d90003d41ec34ecaeda94"},
+	} {
+		key, err := Parse(item.key)
+		if err != nil {
+			t.Fatal(err)
+		}
+		child, err := key.Path(0, item.index)
+		if err != nil {
+			t.Fatal(err)
+		}
+		var res = child.BitcoinAddress()
+		if item.ethereum {
+			res = child.EthereumAddress()
+		}
+		if res != item.want {
+			t.Fatalf("address %d of %s: expect %s, got %s", item.index, item.key[:4], item.want, res)
+		}
+		if !item.ethereum && child.NetworkAddress(0x00, 0x05, "bc") != res {
+			t.Fatalf("network address %d of %s: expect %s, got %s", item.index, item.key[:4], res, child.NetworkAddress(0x00, 0x05, "bc"))
+		}
+	}
+}
+
+func TestChecksumAddress(t *testing.T) {
+	for _, want := range []string{
+		"0x5aAeb6053F3E94C9b9A09f33669435E7Ef1BeAed",
+		"0xfB6916095ca1df60bB79Ce92cE3Ea74c37c5d359",
+		"0xdbF03B407c01E7cD3CBea99509d93f8DDDC8C6FB",
+		"0xD1220A0cf47c7B9Be7A2E6BA89F429762e7b9aDb",
+	} {
+		if res := ChecksumAddress(strings.ToLower(want)); res != want {
+			t.Fatalf("expect %s, got %s", want, res)
+		}
+	}
+}
+
+func TestDecodeSegwitAddress(t *testing.T) {
+	for _, item := range []struct {
+		addr    string
+		version byte
+		size    int
+		err     error
+	}{
+		{"bc1qw508d6qejxtdg4y5r3zarvary0c5xw7kv8f3t4", 0, 20, nil},
+		{"BC1QW508D6QEJXTDG4Y5R3ZARVARY0C5XW7KV8F3T4", 0, 20, nil},
+		{"tb1qrp33g0q5c5txsp9arysrx4k6zdkfs4nce4xj0gdcccefvpysxf3q0sl5k7", 0, 32, nil},
+		{SegwitAddress("bc", 1, make([]byte, 32)), 1, 32, nil},
+		{"BC1SW50QGDZ25J", 16, 2, nil},
+		{"bc1qW508d6qejxtdg4y5r3zarvary0c5xw7kv8f3t4", 0, 0, ErrEncoding},
+		{"bc1qw508d6qejxtdg4y5r3zarvary0c5xw7kv8f3t5", 0, 0, ErrChecksum},
+		// version 1 with a bech32 checksum
+		{"bc1p0xlxvlhemja6c4dqv22uapctqupfhlxm9h8z3k2e72q4k9hcz7vqh2y7hd", 0, 0, ErrChecksum},
+	} {
+		_, version, program, err := DecodeSegwitAddress(item.addr)
+		if err != item.err || (err == nil && (version != item.version || len(program) != item.size)) {
+			t.Fatalf("%s: unexpected %d %d %v", item.addr, version, len(program), err)
+		}
+	}
+}
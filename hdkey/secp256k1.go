@@ -0,0 +1,134 @@
+package hdkey
+
+import (
+	"errors"
+	"math/big"
+)
+
+var (
+	curveP, _  = new(big.Int).SetString("fffffffffffffffffffffffffffffffffffffffffffffffffffffffefffffc2f", 16)
+	curveN, _  = new(big.Int).SetString("fffffffffffffffffffffffffffffffebaaedce6af48a03bbfd25e8cd0364141", 16)
+	curveGx, _ = new(big.Int).SetString("79be667ef9dcbbac55a06295ce870b07029bfcdb2dce28d959f2815b16f81798", 16)
+	curveGy, _ = new(big.Int).SetString("483ada7726a3c4655da4fbfc0e1108a8fd17b448a68554199c47d08ffb10d4b8", 16)
+)
+
+var ErrPoint = errors.New("hdkey: invalid secp256k1 point")
+
+// point of secp256k1 in jacobian coordinates, z is zero at infinity
+type point struct {
+	x, y, z *big.Int
+}
+
+func affine(x, y *big.Int) *point {
+	return &point{x: new(big.Int).Set(x), y: new(big.Int).Set(y), z: big.NewInt(1)}
+}
+
+func (p *point) infinity() bool {
+	return p.z.Sign() == 0
+}
+
+func mod(v *big.Int) *big.Int {
+	return v.Mod(v, curveP)
+}
+
+func mul(a, b *big.Int) *big.Int {
+	return mod(new(big.Int).Mul(a, b))
+}
+
+func (p *point) double() *point {
+	if p.infinity() || p.y.Sign() == 0 {
+		return &point{x: new(big.Int), y: new(big.Int), z: new(big.Int)}
+	}
+	var a = mul(p.x, p.x)
+	var b = mul(p.y, p.y)
+	var c = mul(b, b)
+	var xb = new(big.Int).Add(p.x, b)
+	var d = mod(new(big.Int).Lsh(new(big.Int).Sub(new(big.Int).Sub(mul(xb, xb), a), c), 1))
+	var e = mod(new(big.Int).Mul(a, big.NewInt(3)))
+	var f = mul(e, e)
+	var x3 = mod(new(big.Int).Sub(f, new(big.Int).Lsh(d, 1)))
+	var y3 = mod(new(big.Int).Sub(mul(e, new(big.Int).Sub(d, x3)), new(big.Int).Lsh(c, 3)))
+	var z3 = mod(new(big.Int).Lsh(mul(p.y, p.z), 1))
+	return &point{x: x3, y: y3, z: z3}
+}
+
+func (p *point) add(q *point) *point {
+	if p.infinity() {
+		return q
+	}
+	if q.infinity() {
+		return p
+	}
+	var z1z1 = mul(p.z, p.z)
+	var z2z2 = mul(q.z, q.z)
+	var u1 = mul(p.x, z2z2)
+	var u2 = mul(q.x, z1z1)
+	var s1 = mul(mul(p.y, q.z), z2z2)
+	var s2 = mul(mul(q.y, p.z), z1z1)
+	if u1.Cmp(u2) == 0 {
+		if s1.Cmp(s2) != 0 {
+			return &point{x: new(big.Int), y: new(big.Int), z: new(big.Int)}
+		}
+		return p.double()
+	}
+	var h = mod(new(big.Int).Sub(u2, u1))
+	var h2 = mod(new(big.Int).Lsh(h, 1))
+	var i = mul(h2, h2)
+	var j = mul(h, i)
+	var r = mod(new(big.Int).Lsh(new(big.Int).Sub(s2, s1), 1))
+	var v = mul(u1, i)
+	var x3 = mod(new(big.Int).Sub(new(big.Int).Sub(mul(r, r), j), new(big.Int).Lsh(v, 1)))
+	var y3 = mod(new(big.Int).Sub(mul(r, new(big.Int).Sub(v, x3)), new(big.Int).Lsh(mul(s1, j), 1)))
+	var zz = new(big.Int).Add(p.z, q.z)
+	var z3 = mul(new(big.Int).Sub(new(big.Int).Sub(mul(zz, zz), z1z1), z2z2), h)
+	return &point{x: x3, y: y3, z: z3}
+}
+
+// k times the generator
+func baseMul(k *big.Int) *point {
+	var res = &point{x: new(big.Int), y: new(big.Int), z: new(big.Int)}
+	var g = affine(curveGx, curveGy)
+	for i := k.BitLen() - 1; i >= 0; i-- {
+		res = res.double()
+		if k.Bit(i) == 1 {
+			res = res.add(g)
+		}
+	}
+	return res
+}
+
+func (p *point) toAffine() (x, y *big.Int) {
+	var zinv = new(big.Int).ModInverse(p.z, curveP)
+	var zinv2 = mul(zinv, zinv)
+	return mul(p.x, zinv2), mul(p.y, mul(zinv2, zinv))
+}
+
+// compressed encoding of p, 33 bytes
+func (p *point) compress() []byte {
+	var x, y = p.toAffine()
+	var res = make([]byte, 33)
+	res[0] = 0x02 + byte(y.Bit(0))
+	x.FillBytes(res[1:])
+	return res
+}
+
+// point of a compressed key
+func decompress(key []byte) (*point, error) {
+	if len(key) != 33 || (key[0] != 0x02 && key[0] != 0x03) {
+		return nil, ErrPoint
+	}
+	var x = new(big.Int).SetBytes(key[1:])
+	if x.Cmp(curveP) >= 0 {
+		return nil, ErrPoint
+	}
+	// y² = x³ + 7, p ≡ 3 mod 4
+	var y2 = mod(new(big.Int).Add(mul(mul(x, x), x), big.NewInt(7)))
+	var y = new(big.Int).Exp(y2, new(big.Int).Rsh(new(big.Int).Add(curveP, big.NewInt(1)), 2), curveP)
+	if mul(y, y).Cmp(y2) != 0 {
+		return nil, ErrPoint
+	}
+	if y.Bit(0) != uint(key[0]&1) {
+		y.Sub(curveP, y)
+	}
+	return affine(x, y), nil
+}
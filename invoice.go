@@ -0,0 +1,480 @@
+package chainpot
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"github.com/boltdb/bolt"
+	"github.com/fadeAce/chainpot/poterr"
+	"math/big"
+	"strings"
+	"time"
+)
+
+// a settled invoice keeps its address watched for late payments that long
+const defaultInvoiceGrace = 24 * time.Hour
+
+var invoicesBucket = []byte("invoices")
+
+// InvoiceRequest asks a chain to collect Amount of Symbol on Address before Expiry
+type InvoiceRequest struct {
+	// idempotency key, a request repeating it gets the first invoice back
+	ID      string
+	Address string
+	Symbol  string
+	Amount  string
+	Expiry  time.Time
+}
+
+type InvoiceState int
+
+const (
+	InvoiceOpen InvoiceState = iota
+	// received less than its amount, still open until the expiry
+	InvoiceUnderpaid
+	InvoicePaid
+	InvoiceOverpaid
+	InvoiceExpired
+)
+
+// Invoice is the persisted progress of an InvoiceRequest
+type Invoice struct {
+	Request *InvoiceRequest
+	State   InvoiceState
+	// sum of the confirmed deposits seen before the expiry
+	Received string
+	// sum of the confirmed deposits seen after it
+	Late string
+	// correlation IDs of the counted deposits, a replayed block doesn't count them twice
+	Payments []string
+	// when it was paid, overpaid or expired, the grace period starts then
+	Settled time.Time
+	// the address was watched before the invoice, it's left watched once the invoice is done
+	Watched bool
+	// the grace period is over and the address unwatched
+	Done bool
+}
+
+func (i *Invoice) copy() *Invoice {
+	var obj = *i
+	var req = *i.Request
+	obj.Request = &req
+	obj.Payments = append([]string{}, i.Payments...)
+	return &obj
+}
+
+func (i *Invoice) settled() bool {
+	return i.State == InvoicePaid || i.State == InvoiceOverpaid || i.State == InvoiceExpired
+}
+
+// InvoiceStore is implemented by storages persisting the invoices,
+// they are only kept in memory otherwise
+type InvoiceStore interface {
+	SaveInvoice(i *Invoice) error
+	LoadInvoices() ([]*Invoice, error)
+}
+
+// AddrRemover is implemented by storages unwatching addresses
+type AddrRemover interface {
+	RemoveAddrs(addrs []string) error
+}
+
+// BlockTimer is implemented by wallets and lookups telling when a block was mined, the deposits
+// of the caught up blocks are put before or after the expiry of their invoice by it
+type BlockTimer interface {
+	MinedAt(ctx context.Context, num *big.Int) (time.Time, error)
+}
+
+// AddInvoice watches the address of req until its invoice is settled, a request with a known ID returns
+// the first invoice. its confirmed deposits are summed up and reported as T_INVOICE_UNDERPAID, T_INVOICE_PAID
+// or T_INVOICE_OVERPAID, then T_INVOICE_EXPIRED when it isn't paid in time and T_INVOICE_LATE for the deposits
+// seen after the expiry, with PotEvent.RequestID set. the address is unwatched after the grace period of the conf
+func (c *Chainpot) AddInvoice(chain PublicChain, req *InvoiceRequest) (*Invoice, error) {
+	var obj = c.chainOf(chain)
+	if obj == nil {
+		return nil, poterr.NotRegErr
+	}
+	return obj.addInvoice(req)
+}
+
+// Invoice returns the progress of the invoice id, nil when unknown
+func (c *Chainpot) Invoice(chain PublicChain, id string) *Invoice {
+	var obj = c.chainOf(chain)
+	if obj == nil {
+		return nil
+	}
+	obj.invoiceMu.Lock()
+	defer obj.invoiceMu.Unlock()
+	if i, ok := obj.invoices[id]; ok {
+		return i.copy()
+	}
+	return nil
+}
+
+func (c *chain) addInvoice(req *InvoiceRequest) (*Invoice, error) {
+	if req.ID == "" || req.Address == "" || req.Expiry.IsZero() || !c.hasSymbol(req.Symbol) {
+		return nil, poterr.InvoiceErr
+	}
+	if amount, ok := parseAmount(req.Amount); !ok || amount.Sign() <= 0 {
+		return nil, poterr.InvoiceErr
+	}
+	addr, err := c.canonical(req.Address)
+	if err != nil {
+		return nil, err
+	}
+
+	c.invoiceMu.Lock()
+	defer c.invoiceMu.Unlock()
+	if i, ok := c.invoices[req.ID]; ok {
+		return i.copy(), nil
+	}
+	for _, i := range c.invoices {
+		if !i.Done && i.Request.Address == addr {
+			return nil, poterr.InvoiceAddrErr
+		}
+	}
+
+	c.Lock()
+	_, watched := c.addrs[addr]
+	c.Unlock()
+	var obj = *req
+	obj.Address = addr
+	var i = &Invoice{Request: &obj, State: InvoiceOpen, Received: "0", Late: "0", Watched: watched}
+	if err := c.saveInvoice(i); err != nil {
+		return nil, err
+	}
+	c.invoices[req.ID] = i
+	c.add([]string{addr})
+	return i.copy(), nil
+}
+
+func (c *chain) hasSymbol(symbol string) bool {
+	if c.origin != nil && c.origin.Symbol == symbol {
+		return true
+	}
+	for _, item := range c.contracts {
+		if item.Symbol == symbol {
+			return true
+		}
+	}
+	return false
+}
+
+// must be called with c.invoiceMu held
+func (c *chain) saveInvoice(i *Invoice) error {
+	store, ok := c.storage.(InvoiceStore)
+	if !ok {
+		return nil
+	}
+	if err := store.SaveInvoice(i); err != nil {
+		c.health.fail(err)
+		c.logger.Error().Msgf("save invoice %s error: %s", i.Request.ID, err.Error())
+		return err
+	}
+	return nil
+}
+
+// load the persisted invoices, the addresses of the done ones stay unwatched
+func (c *chain) loadInvoices() {
+	store, ok := c.storage.(InvoiceStore)
+	if !ok {
+		return
+	}
+	list, err := store.LoadInvoices()
+	if err != nil {
+		c.logger.Error().Msgf("load invoices error: %s", err.Error())
+		return
+	}
+	for _, i := range list {
+		c.invoices[i.Request.ID] = i
+	}
+	var addrs = make([]string, 0)
+	for _, i := range list {
+		if _, ok := c.addrs[i.Request.Address]; ok && i.Done && !i.Watched && !c.inUse(i.Request.Address) {
+			addrs = append(addrs, i.Request.Address)
+		}
+	}
+	if len(addrs) > 0 {
+		c.unwatch(addrs)
+	}
+}
+
+// sum up a confirmed deposit or internal transfer to the address of an invoice, seen is when it was first matched
+func (c *chain) invoiced(event *PotEvent, seen time.Time) {
+	var addr = c.normalize(event.Content.To)
+	c.invoiceMu.Lock()
+	defer c.invoiceMu.Unlock()
+	var i *Invoice
+	for _, item := range c.invoices {
+		if !item.Done && item.Request.Address == addr && item.Request.Symbol == event.Symbol {
+			i = item
+			break
+		}
+	}
+	if i == nil {
+		return
+	}
+	for _, id := range i.Payments {
+		if id == event.CorrelationID {
+			return
+		}
+	}
+	amount, ok := parseAmount(event.Content.Amount)
+	if !ok {
+		c.logger.Warn().Msgf("invoice %s deposit %s has a bad amount %s", i.Request.ID, event.Content.Hash, event.Content.Amount)
+		return
+	}
+	i.Payments = append(i.Payments, event.CorrelationID)
+
+	if seen.After(i.Request.Expiry) {
+		if !i.settled() {
+			c.expire(i)
+			c.emitInvoice(i, T_INVOICE_EXPIRED, nil)
+		}
+		late, _ := parseAmount(i.Late)
+		i.Late = amountString(late.Add(late, amount))
+		c.saveInvoice(i)
+		c.emitInvoice(i, T_INVOICE_LATE, event)
+		return
+	}
+
+	received, _ := parseAmount(i.Received)
+	received.Add(received, amount)
+	i.Received = amountString(received)
+	expected, _ := parseAmount(i.Request.Amount)
+	var e EventType
+	switch cmp := received.Cmp(expected); {
+	case cmp < 0:
+		i.State, e = InvoiceUnderpaid, T_INVOICE_UNDERPAID
+	case cmp == 0 && !i.settled():
+		i.State, e = InvoicePaid, T_INVOICE_PAID
+	default:
+		i.State, e = InvoiceOverpaid, T_INVOICE_OVERPAID
+	}
+	if i.Settled.IsZero() && i.settled() {
+		i.Settled = c.now()
+	}
+	c.saveInvoice(i)
+	c.emitInvoice(i, e, event)
+}
+
+// expire the overdue invoices and unwatch the addresses of those past their grace period,
+// run by the chain loop after the events of a block
+func (c *chain) processInvoices() {
+	c.invoiceMu.Lock()
+	defer c.invoiceMu.Unlock()
+	var now = c.now()
+	for _, i := range c.invoices {
+		if i.Done {
+			continue
+		}
+		if !i.settled() && now.After(i.Request.Expiry) && !c.confirming(i) {
+			c.expire(i)
+			c.saveInvoice(i)
+			c.emitInvoice(i, T_INVOICE_EXPIRED, nil)
+		}
+		if i.settled() && now.Sub(i.Settled) >= c.invoiceGrace {
+			i.Done = true
+			c.saveInvoice(i)
+			if !i.Watched && !c.inUse(i.Request.Address) {
+				c.unwatch([]string{i.Request.Address})
+			}
+			c.logger.Info().Msgf("invoice %s done, %s received", i.Request.ID, i.Received)
+		}
+	}
+}
+
+// whether a deposit to i seen before its expiry waits for its confirmations, must be called with c.invoiceMu held
+func (c *chain) confirming(i *Invoice) bool {
+	for _, queue := range []*Queue{c.depositTxs, c.internalTxs} {
+		for _, val := range queue.data {
+			if !val.Seen.After(i.Request.Expiry) && c.normalize(val.TXN.ToStr()) == i.Request.Address {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+// when the block at height was mined, the clock when neither the wallet nor the lookup tell it
+func (c *chain) blockTime(height int64) time.Time {
+	if c.blockAtHeight == height && !c.blockAt.IsZero() {
+		return c.blockAt
+	}
+	timer, ok := optional[BlockTimer](c.origin.wallet)
+	if !ok {
+		timer, ok = optional[BlockTimer](c.lookup)
+	}
+	if !ok {
+		return c.now()
+	}
+	at, err := timer.MinedAt(WithPriority(context.Background(), PriorityBackground), big.NewInt(height))
+	if err != nil {
+		c.logger.Warn().Msgf("time of block %d error: %s", height, err.Error())
+		return c.now()
+	}
+	c.blockAt, c.blockAtHeight = at, height
+	return at
+}
+
+func (c *ethLookup) MinedAt(ctx context.Context, num *big.Int) (time.Time, error) {
+	var block *struct {
+		Timestamp string
+	}
+	if err := c.rpc.call(ctx, "eth_getBlockByNumber", &block, fmt.Sprintf("0x%x", num), false); err != nil {
+		return time.Time{}, err
+	}
+	if block == nil {
+		return time.Time{}, fmt.Errorf("block %s not found", num)
+	}
+	return time.Unix(int64(hexUint64(block.Timestamp)), 0), nil
+}
+
+func (c *btcLookup) MinedAt(ctx context.Context, num *big.Int) (time.Time, error) {
+	var hash string
+	if err := c.rpc.call(ctx, "getblockhash", &hash, num.Int64()); err != nil {
+		return time.Time{}, err
+	}
+	var block struct {
+		Time int64
+	}
+	if err := c.rpc.call(ctx, "getblock", &block, hash, 1); err != nil {
+		return time.Time{}, err
+	}
+	return time.Unix(block.Time, 0), nil
+}
+
+// must be called with c.invoiceMu held
+func (c *chain) expire(i *Invoice) {
+	c.logger.Warn().Msgf("invoice %s expired, %s of %s received", i.Request.ID, i.Received, i.Request.Amount)
+	i.State = InvoiceExpired
+	i.Settled = c.now()
+}
+
+// whether addr is still needed by an extended key, a memo or another invoice, must be called with c.invoiceMu held
+func (c *chain) inUse(addr string) bool {
+	c.hdMu.Lock()
+	_, derived := c.derived[addr]
+	c.hdMu.Unlock()
+	if derived || c.shared(addr) {
+		return true
+	}
+	for _, i := range c.invoices {
+		if !i.Done && i.Request.Address == addr {
+			return true
+		}
+	}
+	return false
+}
+
+// unwatch addrs in memory and in the storage, those without AddrRemover get the config
+// saved with the addresses left
+func (c *chain) unwatch(addrs []string) {
+	c.Lock()
+	for _, addr := range addrs {
+		delete(c.addrs, addr)
+	}
+	var left = make(map[string]int64, len(c.addrs))
+	for addr, height := range c.addrs {
+		left[addr] = height
+	}
+	c.Unlock()
+	if remover, ok := c.storage.(AddrRemover); ok {
+		if err := remover.RemoveAddrs(addrs); err != nil {
+			c.health.fail(err)
+			c.logger.Error().Msgf("remove addresses %v error: %s", addrs, err.Error())
+		}
+		return
+	}
+	var endpoint = c.processed
+	if endpoint == 0 {
+		endpoint = c.endpoint
+	}
+	c.saveConfig(&ConfigCache{EndPoint: endpoint, EventID: c.eventID}, left)
+}
+
+// the content of an invoice event is the deposit counted, the amount received so far when it expires
+func (c *chain) emitInvoice(i *Invoice, e EventType, deposit *PotEvent) {
+	var content = &BlockMessage{To: i.Request.Address, Amount: i.Received}
+	var height int64
+	var correlation, reason string
+	if deposit != nil {
+		content, height, correlation = deposit.Content, deposit.Height, deposit.CorrelationID
+	}
+	if e == T_INVOICE_EXPIRED && i.Received != "0" {
+		reason = "underpaid"
+	}
+	if c.eventID == 0 {
+		c.eventID++
+	}
+	c.messageQueue <- &PotEvent{
+		Symbol:        i.Request.Symbol,
+		Chain:         c.name,
+		CoinType:      c.coinType(i.Request.Symbol),
+		Event:         e,
+		ID:            c.eventID,
+		Height:        height,
+		Content:       content,
+		Reason:        reason,
+		RequestID:     i.Request.ID,
+		CorrelationID: correlation,
+	}
+	c.eventID++
+}
+
+// amounts are decimals, of the base unit or not
+func parseAmount(s string) (*big.Rat, bool) {
+	return new(big.Rat).SetString(strings.TrimSpace(s))
+}
+
+func amountString(r *big.Rat) string {
+	if r.IsInt() {
+		return r.Num().String()
+	}
+	var s = strings.TrimRight(r.FloatString(18), "0")
+	return strings.TrimSuffix(s, ".")
+}
+
+func (c *BoltStorage) createInvoices() error {
+	return c.Database.Update(func(tx *bolt.Tx) error {
+		_, err := tx.CreateBucketIfNotExists(invoicesBucket)
+		return err
+	})
+}
+
+func (c *BoltStorage) SaveInvoice(i *Invoice) error {
+	bs, err := json.Marshal(i)
+	if err != nil {
+		return err
+	}
+	return c.Database.Update(func(tx *bolt.Tx) error {
+		return tx.Bucket(invoicesBucket).Put([]byte(i.Request.ID), bs)
+	})
+}
+
+func (c *BoltStorage) LoadInvoices() ([]*Invoice, error) {
+	var res = make([]*Invoice, 0)
+	err := c.Database.View(func(tx *bolt.Tx) error {
+		return tx.Bucket(invoicesBucket).ForEach(func(k, v []byte) error {
+			var i = &Invoice{}
+			if err := json.Unmarshal(v, i); err != nil {
+				return err
+			}
+			res = append(res, i)
+			return nil
+		})
+	})
+	return res, err
+}
+
+func (c *BoltStorage) RemoveAddrs(addrs []string) error {
+	return c.Database.Update(func(tx *bolt.Tx) error {
+		var bucket = tx.Bucket([]byte("addrs"))
+		for _, addr := range addrs {
+			if err := bucket.Delete([]byte(addr)); err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+}
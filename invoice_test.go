@@ -0,0 +1,186 @@
+package chainpot
+
+import (
+	"context"
+	"github.com/fadeAce/chainpot/chainsim"
+	"github.com/fadeAce/chainpot/poterr"
+	"github.com/fadeAce/claws"
+	"math/big"
+	"net/http/httptest"
+	"os"
+	"testing"
+	"time"
+)
+
+func TestAmountString(t *testing.T) {
+	var sum = new(big.Rat)
+	for _, s := range []string{"0.4", "0.6", "0.1"} {
+		amount, ok := parseAmount(s)
+		if !ok {
+			t.Fatalf("bad amount %s", s)
+		}
+		sum.Add(sum, amount)
+	}
+	if res := amountString(sum); res != "1.1" {
+		t.Fatalf("unexpected sum %s", res)
+	}
+	if res := amountString(big.NewRat(3000, 1)); res != "3000" {
+		t.Fatalf("unexpected sum %s", res)
+	}
+}
+
+func TestChainpot_Invoice(t *testing.T) {
+	var dir = tempDir(t)
+	defer os.RemoveAll(dir)
+	var fake = NewFakeChain(100)
+	var storage = boltStorage(t, dir, "btc")
+	var cp = NewChainpot(&ChainConf{
+		Coins:    []Coins{{CoinType: "origin", Chain: "btc", Symbol: "btc"}},
+		Btc:      &BtcConf{ConfirmTimes: 2, Storage: storage, InvoiceGrace: time.Hour},
+		Builders: map[string]claws.WalletBuilder{"btc": fake},
+		Clock:    fake.Now,
+	})
+	if err := cp.Register(Bitcoin); err != nil {
+		t.Fatal(err)
+	}
+	var now = fake.Now()
+	var paid = &InvoiceRequest{ID: "inv-1", Address: testAddr, Symbol: "btc", Amount: "1", Expiry: now.Add(time.Hour)}
+	var expired = &InvoiceRequest{ID: "inv-2", Address: testOther, Symbol: "btc", Amount: "1", Expiry: now.Add(30 * time.Minute)}
+	for _, req := range []*InvoiceRequest{paid, expired} {
+		if _, err := cp.AddInvoice(Bitcoin, req); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if _, err := cp.AddInvoice(Bitcoin, &InvoiceRequest{ID: "inv-3", Address: testAddr, Symbol: "btc", Amount: "1", Expiry: now}); err != poterr.InvoiceAddrErr {
+		t.Fatalf("unexpected error %v", err)
+	}
+	if _, err := cp.AddInvoice(Bitcoin, &InvoiceRequest{ID: "inv-3", Address: testAddr, Symbol: "eth", Amount: "1", Expiry: now}); err != poterr.InvoiceErr {
+		t.Fatalf("unexpected error %v", err)
+	}
+	if _, err := cp.AddInvoice(Bitcoin, &InvoiceRequest{ID: "inv-3", Address: testAddr, Symbol: "btc", Amount: "-1", Expiry: now}); err != poterr.InvoiceErr {
+		t.Fatalf("unexpected error %v", err)
+	}
+	if i, err := cp.AddInvoice(Bitcoin, &InvoiceRequest{ID: "inv-1", Address: testOther, Symbol: "btc", Amount: "2", Expiry: now}); err != nil || i.Request.Address != testAddr {
+		t.Fatalf("expect the first invoice, got %v", err)
+	}
+	var ch = startPot(t, cp, fake)
+
+	// underpaid, paid then overpaid before the expiry, every confirmation takes the next event ID
+	fake.Mine(BlockMessage{Hash: "a1", From: "src", To: testAddr, Amount: "0.4"})
+	fake.Mine()
+	expectEvents(t, ch, expected{T_DEPOSIT, 1, "a1"}, expected{T_DEPOSIT_CONFIRM, 2, "a1"}, expected{T_INVOICE_UNDERPAID, 3, "a1"})
+	fake.Mine(BlockMessage{Hash: "a2", From: "src", To: testAddr, Amount: "0.6"})
+	fake.Mine()
+	expectEvents(t, ch, expected{T_DEPOSIT, 4, "a2"}, expected{T_DEPOSIT_CONFIRM, 5, "a2"}, expected{T_INVOICE_PAID, 6, "a2"})
+	fake.Mine(BlockMessage{Hash: "a3", From: "src", To: testAddr, Amount: "0.1"})
+	fake.Mine()
+	expectEvents(t, ch, expected{T_DEPOSIT, 7, "a3"}, expected{T_DEPOSIT_CONFIRM, 8, "a3"}, expected{T_INVOICE_OVERPAID, 9, "a3"})
+	if i := cp.Invoice(Bitcoin, "inv-1"); i == nil || i.State != InvoiceOverpaid || i.Received != "1.1" || len(i.Payments) != 3 {
+		t.Fatalf("unexpected invoice %s", mustMarshal(i))
+	}
+
+	// nothing received before the expiry, then a late payment
+	fake.Advance(45 * time.Minute)
+	fake.Mine()
+	select {
+	case event := <-ch:
+		if event.Event != T_INVOICE_EXPIRED || event.ID != 10 || event.RequestID != "inv-2" || event.Content.To != testOther || event.Reason != "" {
+			t.Fatalf("unexpected expiry %s", mustMarshal(event))
+		}
+	case <-time.After(2 * time.Second):
+		t.Fatal("timeout waiting for the expiry")
+	}
+	fake.Mine(BlockMessage{Hash: "a4", From: "src", To: testOther, Amount: "0.3"})
+	fake.Mine()
+	expectEvents(t, ch, expected{T_DEPOSIT, 11, "a4"}, expected{T_DEPOSIT_CONFIRM, 12, "a4"}, expected{T_INVOICE_LATE, 13, "a4"})
+	if i := cp.Invoice(Bitcoin, "inv-2"); i == nil || i.State != InvoiceExpired || i.Received != "0" || i.Late != "0.3" || i.Done {
+		t.Fatalf("unexpected invoice %s", mustMarshal(i))
+	}
+
+	// past the grace period both addresses are unwatched
+	fake.Advance(2 * time.Hour)
+	fake.Mine()
+	fake.Mine(BlockMessage{Hash: "a5", From: "src", To: testAddr, Amount: "0.5"})
+	fake.Mine()
+	expectNone(t, ch)
+	for _, id := range []string{"inv-1", "inv-2"} {
+		if i := cp.Invoice(Bitcoin, id); i == nil || !i.Done {
+			t.Fatalf("unexpected invoice %s", mustMarshal(i))
+		}
+	}
+	if _, addrs := storage.GetConfig(); len(addrs) != 0 {
+		t.Fatalf("unexpected addresses %v", addrs)
+	}
+	// the address is free for another invoice
+	if _, err := cp.AddInvoice(Bitcoin, &InvoiceRequest{ID: "inv-3", Address: testAddr, Symbol: "btc", Amount: "1", Expiry: fake.Now().Add(time.Hour)}); err != nil {
+		t.Fatal(err)
+	}
+	stopPot(t, cp)
+}
+
+func TestChainpot_InvoiceCatchUp(t *testing.T) {
+	var dir = tempDir(t)
+	defer os.RemoveAll(dir)
+	var fake = NewFakeChain(100)
+	var newPot = func() *Chainpot {
+		var cp = NewChainpot(&ChainConf{
+			Coins:    []Coins{{CoinType: "origin", Chain: "btc", Symbol: "btc"}},
+			Btc:      &BtcConf{ConfirmTimes: 2, Storage: boltStorage(t, dir, "btc"), InvoiceGrace: time.Hour},
+			Builders: map[string]claws.WalletBuilder{"btc": fake},
+			Clock:    fake.Now,
+		})
+		if err := cp.Register(Bitcoin); err != nil {
+			t.Fatal(err)
+		}
+		return cp
+	}
+	var third = "bc1qcr8te4kr609gcawutmrza0j4xv80jy8z306fyu"
+	var cp = newPot()
+	cp.Add(Bitcoin, []string{testAddr})
+	var expiry = fake.Now().Add(30 * time.Minute)
+	for _, req := range []*InvoiceRequest{
+		{ID: "inv-1", Address: testOther, Symbol: "btc", Amount: "1", Expiry: expiry},
+		{ID: "inv-2", Address: third, Symbol: "btc", Amount: "1", Expiry: expiry},
+	} {
+		if _, err := cp.AddInvoice(Bitcoin, req); err != nil {
+			t.Fatal(err)
+		}
+	}
+	var ch = startPot(t, cp, fake)
+
+	// a transfer from a watched address pays the invoice as an internal one
+	fake.Mine(BlockMessage{Hash: "i1", From: testAddr, To: testOther, Amount: "1"})
+	fake.Mine()
+	expectEvents(t, ch, expected{T_INTERNAL, 1, "i1"}, expected{T_INTERNAL_CONFIRM, 2, "i1"}, expected{T_INVOICE_PAID, 3, "i1"})
+
+	// a payment mined before the expiry and caught up after it is no late one
+	fake.Mine(BlockMessage{Hash: "d1", From: "src", To: third, Amount: "1"})
+	expectEvents(t, ch, expected{T_DEPOSIT, 4, "d1"})
+	stopPot(t, cp)
+	fake.Advance(2 * time.Hour)
+	cp = newPot()
+	ch = startPot(t, cp, fake)
+	fake.Mine()
+	expectEvents(t, ch, expected{T_DEPOSIT, 8, "d1"}, expected{T_DEPOSIT_CONFIRM, 9, "d1"}, expected{T_INVOICE_PAID, 10, "d1"})
+	// the replayed transfer isn't counted twice
+	expectEvents(t, ch, expected{T_INTERNAL, 6, "i1"}, expected{T_INTERNAL_CONFIRM, 7, "i1"})
+	expectNone(t, ch)
+	if i := cp.Invoice(Bitcoin, "inv-2"); i == nil || i.State != InvoicePaid || i.Late != "0" {
+		t.Fatalf("unexpected invoice %s", mustMarshal(i))
+	}
+	stopPot(t, cp)
+}
+
+func TestLookup_MinedAt(t *testing.T) {
+	var sim = chainsim.New(100)
+	var eth = httptest.NewServer(chainsim.NewEthServer(sim))
+	defer eth.Close()
+	var btc = httptest.NewServer(chainsim.NewBtcServer(sim))
+	defer btc.Close()
+	var block = sim.Mine()
+	for _, timer := range []BlockTimer{newEthLookup(eth.URL), newBtcLookup(btc.URL, "", "")} {
+		if at, err := timer.MinedAt(context.Background(), big.NewInt(block.Number)); err != nil || at.Unix() != block.Time {
+			t.Fatalf("unexpected time of block %d %v %v", block.Number, at, err)
+		}
+	}
+}
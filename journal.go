@@ -0,0 +1,323 @@
+package chainpot
+
+import (
+	"bytes"
+	"encoding/binary"
+	"encoding/json"
+	"github.com/boltdb/bolt"
+	"github.com/fadeAce/chainpot/poterr"
+	"strings"
+	"time"
+)
+
+// EventJournal is implemented by storages persisting the emitted events,
+// it allows streams to resume from a known event ID and support staff
+// to query what chainpot has emitted
+type EventJournal interface {
+	AppendEvent(event *PotEvent) error
+	EventsSince(id int64) ([]*PotEvent, error)
+	EventsByTx(hash string) ([]*PotEvent, error)
+	EventsByAddress(addr string) ([]*PotEvent, error)
+	EventsByHeight(height int64) ([]*PotEvent, error)
+	// drop the oldest events exceeding maxEvents or older than maxAge, zero disables a limit
+	Compact(maxEvents int, maxAge time.Duration) error
+}
+
+// ClockedStorage is implemented by storages stamping their records with the clock of the conf
+type ClockedStorage interface {
+	SetClock(now func() time.Time)
+}
+
+// JournalRetention limits the size of the event journal of a chain
+type JournalRetention struct {
+	MaxEvents int           `yaml:"max_events"`
+	MaxAge    time.Duration `yaml:"max_age"`
+}
+
+// compact the journal every compactInterval appended events
+const compactInterval = 1024
+
+var (
+	eventsBucket       = []byte("events")
+	eventsTxBucket     = []byte("events_tx")
+	eventsAddrBucket   = []byte("events_addr")
+	eventsHeightBucket = []byte("events_height")
+)
+
+type journalRecord struct {
+	Time  int64
+	Event *PotEvent
+}
+
+func (c *BoltStorage) createJournal() error {
+	return c.Database.Update(func(tx *bolt.Tx) error {
+		for _, name := range [][]byte{eventsBucket, eventsTxBucket, eventsAddrBucket, eventsHeightBucket} {
+			if _, err := tx.CreateBucketIfNotExists(name); err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+}
+
+// event key is ordered by event ID, seq keeps events sharing an ID apart
+func eventKey(id int64, seq uint64) []byte {
+	var key = make([]byte, 16)
+	binary.BigEndian.PutUint64(key[:8], uint64(id))
+	binary.BigEndian.PutUint64(key[8:], seq)
+	return key
+}
+
+func heightKey(height int64) []byte {
+	var key = make([]byte, 8)
+	binary.BigEndian.PutUint64(key, uint64(height))
+	return key
+}
+
+// index keys are the indexed value followed by a separator and the event key
+func indexKey(prefix []byte, key []byte) []byte {
+	var res = make([]byte, 0, len(prefix)+1+len(key))
+	res = append(res, prefix...)
+	res = append(res, 0)
+	return append(res, key...)
+}
+
+func (c *BoltStorage) indexPrefixes(event *PotEvent) (txs [][]byte, addrs [][]byte) {
+	if event.Content == nil {
+		return
+	}
+	if event.Content.Hash != "" {
+		txs = append(txs, []byte(event.Content.Hash))
+	}
+	var from, to = c.addrKey(event.Content.From), c.addrKey(event.Content.To)
+	if len(from) > 0 {
+		addrs = append(addrs, from)
+	}
+	if len(to) > 0 && !bytes.Equal(to, from) {
+		addrs = append(addrs, to)
+	}
+	return
+}
+
+// ethereum addresses are indexed lowercase, checksummed ones find the same events
+func (c *BoltStorage) addrKey(addr string) []byte {
+	if c.Chain == "eth" {
+		return []byte(strings.ToLower(addr))
+	}
+	return []byte(addr)
+}
+
+func (c *BoltStorage) SetClock(now func() time.Time) {
+	c.Clock = now
+}
+
+func (c *BoltStorage) now() time.Time {
+	if c.Clock != nil {
+		return c.Clock()
+	}
+	return time.Now()
+}
+
+func (c *BoltStorage) AppendEvent(event *PotEvent) error {
+	bs, err := json.Marshal(&journalRecord{Time: c.now().Unix(), Event: event})
+	if err != nil {
+		return err
+	}
+
+	return c.Database.Update(func(tx *bolt.Tx) error {
+		bucket := tx.Bucket(eventsBucket)
+		seq, err := bucket.NextSequence()
+		if err != nil {
+			return err
+		}
+		var key = eventKey(event.ID, seq)
+		if err := bucket.Put(key, bs); err != nil {
+			return err
+		}
+
+		txs, addrs := c.indexPrefixes(event)
+		for _, item := range txs {
+			if err := tx.Bucket(eventsTxBucket).Put(indexKey(item, key), nil); err != nil {
+				return err
+			}
+		}
+		for _, item := range addrs {
+			if err := tx.Bucket(eventsAddrBucket).Put(indexKey(item, key), nil); err != nil {
+				return err
+			}
+		}
+		return tx.Bucket(eventsHeightBucket).Put(indexKey(heightKey(event.Height), key), nil)
+	})
+}
+
+func (c *BoltStorage) EventsSince(id int64) ([]*PotEvent, error) {
+	var events = make([]*PotEvent, 0)
+	err := c.Database.View(func(tx *bolt.Tx) error {
+		cursor := tx.Bucket(eventsBucket).Cursor()
+		for k, v := cursor.Seek(eventKey(id+1, 0)); k != nil; k, v = cursor.Next() {
+			var record = &journalRecord{}
+			if err := json.Unmarshal(v, record); err != nil {
+				return err
+			}
+			events = append(events, record.Event)
+		}
+		return nil
+	})
+	return events, err
+}
+
+func (c *BoltStorage) EventsByTx(hash string) ([]*PotEvent, error) {
+	return c.eventsByIndex(eventsTxBucket, []byte(hash))
+}
+
+func (c *BoltStorage) EventsByAddress(addr string) ([]*PotEvent, error) {
+	return c.eventsByIndex(eventsAddrBucket, c.addrKey(addr))
+}
+
+func (c *BoltStorage) EventsByHeight(height int64) ([]*PotEvent, error) {
+	return c.eventsByIndex(eventsHeightBucket, heightKey(height))
+}
+
+func (c *BoltStorage) eventsByIndex(name []byte, value []byte) ([]*PotEvent, error) {
+	var prefix = append(append([]byte{}, value...), 0)
+	var events = make([]*PotEvent, 0)
+	err := c.Database.View(func(tx *bolt.Tx) error {
+		var bucket = tx.Bucket(eventsBucket)
+		cursor := tx.Bucket(name).Cursor()
+		for k, _ := cursor.Seek(prefix); k != nil && bytes.HasPrefix(k, prefix); k, _ = cursor.Next() {
+			var v = bucket.Get(k[len(prefix):])
+			if v == nil {
+				continue
+			}
+			var record = &journalRecord{}
+			if err := json.Unmarshal(v, record); err != nil {
+				return err
+			}
+			events = append(events, record.Event)
+		}
+		return nil
+	})
+	return events, err
+}
+
+func (c *BoltStorage) Compact(maxEvents int, maxAge time.Duration) error {
+	return c.Database.Update(func(tx *bolt.Tx) error {
+		var bucket = tx.Bucket(eventsBucket)
+		var total = bucket.Stats().KeyN
+		var deadline = c.now().Add(-maxAge).Unix()
+
+		var expired = make(map[string]*journalRecord)
+		cursor := bucket.Cursor()
+		for k, v := cursor.First(); k != nil; k, v = cursor.Next() {
+			var record = &journalRecord{}
+			if err := json.Unmarshal(v, record); err != nil {
+				return err
+			}
+			var overflow = maxEvents > 0 && total-len(expired) > maxEvents
+			var outdated = maxAge > 0 && record.Time < deadline
+			if !overflow && !outdated {
+				break
+			}
+			expired[string(k)] = record
+		}
+
+		for k, record := range expired {
+			var key = []byte(k)
+			if err := bucket.Delete(key); err != nil {
+				return err
+			}
+			txs, addrs := c.indexPrefixes(record.Event)
+			for _, item := range txs {
+				if err := tx.Bucket(eventsTxBucket).Delete(indexKey(item, key)); err != nil {
+					return err
+				}
+			}
+			for _, item := range addrs {
+				if err := tx.Bucket(eventsAddrBucket).Delete(indexKey(item, key)); err != nil {
+					return err
+				}
+			}
+			if err := tx.Bucket(eventsHeightBucket).Delete(indexKey(heightKey(record.Event.Height), key)); err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+}
+
+// write event into the journal of the chain storage if supported
+func (c *chain) journal(event *PotEvent) {
+	journal, ok := c.storage.(EventJournal)
+	if !ok {
+		return
+	}
+	var begin = time.Now()
+	err := journal.AppendEvent(event)
+	c.metrics.Since("chainpot_storage_write_duration_seconds", begin, c.name, "append_event")
+	if err != nil {
+		c.health.fail(err)
+		c.logger.Error().Msgf("append event journal error: %s", err.Error())
+		return
+	}
+
+	c.journaled++
+	if c.journaled%compactInterval != 0 || (c.retention.MaxEvents == 0 && c.retention.MaxAge == 0) {
+		return
+	}
+	if err := journal.Compact(c.retention.MaxEvents, c.retention.MaxAge); err != nil {
+		c.health.fail(err)
+		c.logger.Error().Msgf("compact event journal error: %s", err.Error())
+	}
+}
+
+func (c *Chainpot) eventJournal(chain PublicChain) (EventJournal, error) {
+	var obj = c.chainOf(chain)
+	if obj == nil {
+		return nil, poterr.NotRegErr
+	}
+	journal, ok := obj.storage.(EventJournal)
+	if !ok {
+		return nil, poterr.JournalErr
+	}
+	return journal, nil
+}
+
+// EventsSince returns the journaled events of chain with an ID greater than id
+func (c *Chainpot) EventsSince(chain PublicChain, id int64) ([]*PotEvent, error) {
+	journal, err := c.eventJournal(chain)
+	if err != nil {
+		return nil, err
+	}
+	return journal.EventsSince(id)
+}
+
+// EventsByTx returns the journaled events of chain about the transaction hash
+func (c *Chainpot) EventsByTx(chain PublicChain, hash string) ([]*PotEvent, error) {
+	journal, err := c.eventJournal(chain)
+	if err != nil {
+		return nil, err
+	}
+	return journal.EventsByTx(hash)
+}
+
+// EventsByAddress returns the journaled events of chain sent from or to addr, in any of its forms
+func (c *Chainpot) EventsByAddress(chain PublicChain, addr string) ([]*PotEvent, error) {
+	var obj = c.chainOf(chain)
+	if obj == nil {
+		return nil, poterr.NotRegErr
+	}
+	journal, ok := obj.storage.(EventJournal)
+	if !ok {
+		return nil, poterr.JournalErr
+	}
+	return journal.EventsByAddress(obj.normalize(addr))
+}
+
+// EventsByHeight returns the journaled events of chain about transactions mined at height
+func (c *Chainpot) EventsByHeight(chain PublicChain, height int64) ([]*PotEvent, error) {
+	journal, err := c.eventJournal(chain)
+	if err != nil {
+		return nil, err
+	}
+	return journal.EventsByHeight(height)
+}
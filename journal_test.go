@@ -0,0 +1,91 @@
+package chainpot
+
+import (
+	"io/ioutil"
+	"os"
+	"testing"
+	"time"
+)
+
+func TestNewBoltStorage_Error(t *testing.T) {
+	dir, err := ioutil.TempDir("", "chainpot")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	// the database path is taken by a directory
+	if err := os.Mkdir(dir+"/eth.db", 0755); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := NewBoltStorage(dir, "eth"); err == nil {
+		t.Fatal("expect an open error")
+	}
+}
+
+func TestBoltStorage_Journal(t *testing.T) {
+	dir, err := ioutil.TempDir("", "chainpot")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	var storage = boltStorage(t, dir, "eth").(*BoltStorage)
+	defer storage.Database.Close()
+
+	var msg = &BlockMessage{Hash: "0xaa", From: "0x01", To: "0x02", Amount: "1"}
+	storage.AppendEvent(&PotEvent{ID: 1, Height: 9, Event: T_DEPOSIT, Content: msg})
+	storage.AppendEvent(&PotEvent{ID: 2, Height: 9, Event: T_DEPOSIT_CONFIRM, Content: msg})
+	storage.AppendEvent(&PotEvent{ID: 4, Height: 10, Event: T_WITHDRAW, Content: &BlockMessage{Hash: "0xbb", From: "0x02", To: "0x03"}})
+
+	if events, _ := storage.EventsSince(1); len(events) != 2 || events[0].ID != 2 {
+		t.Fatalf("unexpected events since 1: %s", mustMarshal(events))
+	}
+	if events, _ := storage.EventsByTx("0xaa"); len(events) != 2 {
+		t.Fatalf("unexpected events by tx: %s", mustMarshal(events))
+	}
+	if events, _ := storage.EventsByAddress("0x02"); len(events) != 3 {
+		t.Fatalf("unexpected events by address: %s", mustMarshal(events))
+	}
+	if events, _ := storage.EventsByHeight(10); len(events) != 1 {
+		t.Fatalf("unexpected events by height: %s", mustMarshal(events))
+	}
+
+	if err := storage.Compact(1, 0); err != nil {
+		t.Fatal(err)
+	}
+	if events, _ := storage.EventsSince(0); len(events) != 1 || events[0].ID != 4 {
+		t.Fatalf("unexpected events after compaction: %s", mustMarshal(events))
+	}
+	if events, _ := storage.EventsByTx("0xaa"); len(events) != 0 {
+		t.Fatalf("index not compacted: %s", mustMarshal(events))
+	}
+}
+
+func TestBoltStorage_JournalClock(t *testing.T) {
+	dir, err := ioutil.TempDir("", "chainpot")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	var storage = boltStorage(t, dir, "eth").(*BoltStorage)
+	defer storage.Database.Close()
+	var now = time.Unix(1500000000, 0)
+	storage.SetClock(func() time.Time { return now })
+
+	var msg = &BlockMessage{Hash: "0xaa", From: "0x01", To: "0x52908400098527886e0f7030069857d2e4169ee7", Amount: "1"}
+	storage.AppendEvent(&PotEvent{ID: 1, Event: T_DEPOSIT, Content: msg})
+	now = now.Add(2 * time.Hour)
+	storage.AppendEvent(&PotEvent{ID: 2, Event: T_DEPOSIT_CONFIRM, Content: msg})
+
+	if events, _ := storage.EventsByAddress("0x52908400098527886E0F7030069857D2E4169EE7"); len(events) != 2 {
+		t.Fatalf("unexpected events by checksummed address: %s", mustMarshal(events))
+	}
+	if err := storage.Compact(0, time.Hour); err != nil {
+		t.Fatal(err)
+	}
+	if events, _ := storage.EventsSince(0); len(events) != 1 || events[0].ID != 2 {
+		t.Fatalf("unexpected events after compaction: %s", mustMarshal(events))
+	}
+}
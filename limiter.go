@@ -0,0 +1,316 @@
+package chainpot
+
+import (
+	"context"
+	"github.com/fadeAce/claws"
+	"github.com/fadeAce/claws/types"
+	"math/big"
+	"sync"
+	"time"
+)
+
+type Priority int
+
+// priority of the node calls sharing an endpoint limiter, live head processing goes first
+const (
+	PriorityLive Priority = iota
+	PriorityBackground
+)
+
+var priorityNames = []string{"live", "background"}
+
+type priorityKey struct{}
+
+// WithPriority marks the node calls made with ctx, calls are live by default
+func WithPriority(ctx context.Context, p Priority) context.Context {
+	return context.WithValue(ctx, priorityKey{}, p)
+}
+
+func priorityOf(ctx context.Context) Priority {
+	if p, ok := ctx.Value(priorityKey{}).(Priority); ok && p >= PriorityLive && p <= PriorityBackground {
+		return p
+	}
+	return PriorityLive
+}
+
+type waiter struct {
+	ready     chan struct{}
+	granted   bool
+	cancelled bool
+}
+
+// limiter is a token bucket with a concurrency cap, waiters of a higher
+// priority are always granted before the lower ones
+type limiter struct {
+	mu       sync.Mutex
+	rate     float64
+	burst    float64
+	tokens   float64
+	last     time.Time
+	slots    int
+	inflight int
+	queues   [2][]*waiter
+	timer    *time.Timer
+}
+
+// rate is in calls per second and slots caps the calls in flight, zero disables either
+func newLimiter(rate float64, burst int, slots int) *limiter {
+	if burst < 1 {
+		burst = 1
+	}
+	return &limiter{
+		rate:   rate,
+		burst:  float64(burst),
+		tokens: float64(burst),
+		last:   time.Now(),
+		slots:  slots,
+	}
+}
+
+func (l *limiter) acquire(ctx context.Context, p Priority) error {
+	var w = &waiter{ready: make(chan struct{})}
+	l.mu.Lock()
+	l.queues[p] = append(l.queues[p], w)
+	l.grant()
+	l.mu.Unlock()
+
+	select {
+	case <-w.ready:
+		return nil
+	case <-ctx.Done():
+		l.mu.Lock()
+		defer l.mu.Unlock()
+		if w.granted {
+			l.inflight--
+			l.grant()
+		} else {
+			w.cancelled = true
+		}
+		return ctx.Err()
+	}
+}
+
+func (l *limiter) release() {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	l.inflight--
+	l.grant()
+}
+
+// next waiter to grant, must be called with l.mu held
+func (l *limiter) next() (Priority, *waiter) {
+	for p := range l.queues {
+		for len(l.queues[p]) > 0 && l.queues[p][0].cancelled {
+			l.queues[p] = l.queues[p][1:]
+		}
+		if len(l.queues[p]) > 0 {
+			return Priority(p), l.queues[p][0]
+		}
+	}
+	return 0, nil
+}
+
+// grant the waiters while slots and tokens allow, must be called with l.mu held
+func (l *limiter) grant() {
+	if l.rate > 0 {
+		var now = time.Now()
+		l.tokens += now.Sub(l.last).Seconds() * l.rate
+		if l.tokens > l.burst {
+			l.tokens = l.burst
+		}
+		l.last = now
+	}
+
+	for {
+		p, w := l.next()
+		if w == nil {
+			return
+		}
+		if l.slots > 0 && l.inflight >= l.slots {
+			return
+		}
+		if l.rate > 0 && l.tokens < 1 {
+			if l.timer == nil {
+				var wait = time.Duration((1 - l.tokens) / l.rate * float64(time.Second))
+				l.timer = time.AfterFunc(wait, func() {
+					l.mu.Lock()
+					defer l.mu.Unlock()
+					l.timer = nil
+					l.grant()
+				})
+			}
+			return
+		}
+
+		l.queues[p] = l.queues[p][1:]
+		if l.rate > 0 {
+			l.tokens--
+		}
+		l.inflight++
+		w.granted = true
+		close(w.ready)
+	}
+}
+
+// limitedWallet passes the node calls of a wallet through the limiter of its endpoint
+type limitedWallet struct {
+	claws.Wallet
+	limiter  *limiter
+	metrics  *Metrics
+	chain    string
+	endpoint string
+}
+
+func (w *limitedWallet) wait(ctx context.Context) error {
+	var p = priorityOf(ctx)
+	var begin = time.Now()
+	err := w.limiter.acquire(ctx, p)
+	w.metrics.Since("chainpot_limiter_wait_seconds", begin, w.chain, w.endpoint, priorityNames[p])
+	return err
+}
+
+// call f through the limiter
+func (w *limitedWallet) do(ctx context.Context, f func() error) error {
+	if err := w.wait(ctx); err != nil {
+		return err
+	}
+	defer w.limiter.release()
+	return f()
+}
+
+func (w *limitedWallet) unwrap() interface{} {
+	return w.Wallet
+}
+
+// limited forwards f through the limiter when the wallet implements T, it's not waited for otherwise
+func limited[T, R any](w *limitedWallet, ctx context.Context, f func(T) (R, error)) (res R, err error) {
+	obj, ok := optional[T](w.Wallet)
+	if !ok {
+		return res, errUnsupported
+	}
+	err = w.do(ctx, func() error {
+		res, err = f(obj)
+		return err
+	})
+	return
+}
+
+func (w *limitedWallet) UnfoldTxs(ctx context.Context, num *big.Int) ([]types.TXN, error) {
+	if err := w.wait(ctx); err != nil {
+		return nil, err
+	}
+	defer w.limiter.release()
+	return w.Wallet.UnfoldTxs(ctx, num)
+}
+
+// Seek is made at confirm time of the live processing
+func (w *limitedWallet) Seek(txn types.TXN) bool {
+	w.wait(context.Background())
+	defer w.limiter.release()
+	return w.Wallet.Seek(txn)
+}
+
+func (w *limitedWallet) Balance(bundle types.Bundle) (string, error) {
+	w.wait(context.Background())
+	defer w.limiter.release()
+	return w.Wallet.Balance(bundle)
+}
+
+func (w *limitedWallet) BlockHash(ctx context.Context, num *big.Int) (string, error) {
+	hasher, ok := optional[BlockHasher](w.Wallet)
+	if !ok {
+		return digestBlock(ctx, w, num.Int64())
+	}
+	if err := w.wait(ctx); err != nil {
+		return "", err
+	}
+	defer w.limiter.release()
+	return hasher.BlockHash(ctx, num)
+}
+
+func (w *limitedWallet) Reconnect(ctx context.Context) error {
+	if obj, ok := optional[Reconnector](w.Wallet); ok {
+		return obj.Reconnect(ctx)
+	}
+	return nil
+}
+
+func (w *limitedWallet) SendTx(ctx context.Context, tx *OutTx) (string, error) {
+	return limited(w, ctx, func(obj Sender) (string, error) { return obj.SendTx(ctx, tx) })
+}
+
+func (w *limitedWallet) ReplaceTx(ctx context.Context, tx *OutTx) (string, error) {
+	return limited(w, ctx, func(obj Replacer) (string, error) { return obj.ReplaceTx(ctx, tx) })
+}
+
+func (w *limitedWallet) Rebroadcast(ctx context.Context, hash string) error {
+	obj, ok := optional[Rebroadcaster](w.Wallet)
+	if !ok {
+		return errUnsupported
+	}
+	return w.do(ctx, func() error {
+		return obj.Rebroadcast(ctx, hash)
+	})
+}
+
+func (w *limitedWallet) LookupTx(ctx context.Context, hash string) (*TxInfo, error) {
+	return limited(w, ctx, func(obj TxLookup) (*TxInfo, error) { return obj.LookupTx(ctx, hash) })
+}
+
+func (w *limitedWallet) Receipt(ctx context.Context, hash string) (*Receipt, error) {
+	return limited(w, ctx, func(obj ReceiptReader) (*Receipt, error) { return obj.Receipt(ctx, hash) })
+}
+
+func (w *limitedWallet) UTXOTxs(ctx context.Context, num *big.Int) ([]*UTXOTx, error) {
+	return limited(w, ctx, func(obj UTXOReader) ([]*UTXOTx, error) { return obj.UTXOTxs(ctx, num) })
+}
+
+func (w *limitedWallet) Calldata(ctx context.Context, hash string) (string, error) {
+	return limited(w, ctx, func(obj CalldataReader) (string, error) { return obj.Calldata(ctx, hash) })
+}
+
+func (w *limitedWallet) PendingNonce(ctx context.Context, addr string) (uint64, error) {
+	return limited(w, ctx, func(obj NonceSource) (uint64, error) { return obj.PendingNonce(ctx, addr) })
+}
+
+func (w *limitedWallet) GasPrice(ctx context.Context) (*big.Int, error) {
+	return limited(w, ctx, func(obj GasPricer) (*big.Int, error) { return obj.GasPrice(ctx) })
+}
+
+func (w *limitedWallet) Logs(ctx context.Context, num *big.Int, addrs []string) ([]*Log, error) {
+	return limited(w, ctx, func(obj LogReader) ([]*Log, error) { return obj.Logs(ctx, num, addrs) })
+}
+
+func (w *limitedWallet) TokenInfo(ctx context.Context, contract string) (*TokenInfo, error) {
+	return limited(w, ctx, func(obj TokenInfoReader) (*TokenInfo, error) { return obj.TokenInfo(ctx, contract) })
+}
+
+func (w *limitedWallet) InternalTransfers(ctx context.Context, num *big.Int) ([]*InternalTransfer, error) {
+	return limited(w, ctx, func(obj TraceReader) ([]*InternalTransfer, error) { return obj.InternalTransfers(ctx, num) })
+}
+
+func (w *limitedWallet) MinedAt(ctx context.Context, num *big.Int) (time.Time, error) {
+	return limited(w, ctx, func(obj BlockTimer) (time.Time, error) { return obj.MinedAt(ctx, num) })
+}
+
+// wrap wallet with the limiter of its endpoint when the chain conf limits it
+func (c *Chainpot) limit(chain string, url string, wallet claws.Wallet) claws.Wallet {
+	var rate float64
+	var burst, slots int
+	if chain == "eth" && c.conf.Eth != nil {
+		rate, burst, slots = c.conf.Eth.RateLimit, c.conf.Eth.RateBurst, c.conf.Eth.MaxConcurrent
+	} else if chain == "btc" && c.conf.Btc != nil {
+		rate, burst, slots = c.conf.Btc.RateLimit, c.conf.Btc.RateBurst, c.conf.Btc.MaxConcurrent
+	}
+	if rate <= 0 && slots <= 0 {
+		return wallet
+	}
+
+	var key = chain + " " + url
+	var obj, ok = c.limiters[key]
+	if !ok {
+		obj = newLimiter(rate, burst, slots)
+		c.limiters[key] = obj
+	}
+	return &limitedWallet{Wallet: wallet, limiter: obj, metrics: c.metrics, chain: chain, endpoint: url}
+}
@@ -0,0 +1,131 @@
+package chainpot
+
+import (
+	"context"
+	"github.com/fadeAce/claws"
+	"io/ioutil"
+	"os"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestLimiter_Rate(t *testing.T) {
+	var l = newLimiter(50, 1, 0)
+	var begin = time.Now()
+	for i := 0; i < 6; i++ {
+		if err := l.acquire(context.Background(), PriorityLive); err != nil {
+			t.Fatal(err)
+		}
+		l.release()
+	}
+	if elapsed := time.Since(begin); elapsed < 90*time.Millisecond {
+		t.Fatalf("6 calls at 50/s took %s", elapsed)
+	}
+}
+
+func TestLimiter_Priority(t *testing.T) {
+	var l = newLimiter(0, 0, 1)
+	l.acquire(context.Background(), PriorityLive)
+
+	var order = make(chan Priority, 2)
+	var take = func(p Priority) {
+		l.acquire(context.Background(), p)
+		order <- p
+		l.release()
+	}
+	go take(PriorityBackground)
+	time.Sleep(20 * time.Millisecond)
+	go take(PriorityLive)
+	time.Sleep(20 * time.Millisecond)
+
+	select {
+	case <-order:
+		t.Fatal("slot granted beyond the cap")
+	default:
+	}
+	l.release()
+	if first, second := <-order, <-order; first != PriorityLive || second != PriorityBackground {
+		t.Fatalf("unexpected order %s, %s", priorityNames[first], priorityNames[second])
+	}
+
+	// a cancelled waiter gives its turn away
+	l.acquire(context.Background(), PriorityLive)
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Millisecond)
+	defer cancel()
+	if err := l.acquire(ctx, PriorityLive); err != context.DeadlineExceeded {
+		t.Fatalf("unexpected error %v", err)
+	}
+	l.release()
+	if err := l.acquire(context.Background(), PriorityBackground); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestChainpot_Limiter(t *testing.T) {
+	var dir = tempDir(t)
+	defer os.RemoveAll(dir)
+	var fake = NewFakeChain(100)
+	var cp = NewChainpot(&ChainConf{
+		Coins: []Coins{{CoinType: "origin", Chain: "btc", Symbol: "btc"}},
+		Btc: &BtcConf{
+			ConfirmTimes:  2,
+			Storage:       boltStorage(t, dir, "btc"),
+			RateLimit:     1000,
+			MaxConcurrent: 1,
+		},
+		Builders: map[string]claws.WalletBuilder{"btc": fake},
+	})
+	if _, ok := cp.wallets["btc"].(*limitedWallet); !ok {
+		t.Fatal("wallet is not limited")
+	}
+	if err := cp.Register(Bitcoin); err != nil {
+		t.Fatal(err)
+	}
+	cp.Add(Bitcoin, []string{testAddr})
+	var ch = startPot(t, cp, fake)
+
+	fake.Mine(BlockMessage{Hash: "l1", From: testOther, To: testAddr})
+	fake.Mine()
+	expectEvents(t, ch, expected{T_DEPOSIT, 1, "l1"}, expected{T_DEPOSIT_CONFIRM, 2, "l1"})
+	stopPot(t, cp)
+
+	var body = scrape(cp.Metrics())
+	if !strings.Contains(body, `chainpot_limiter_wait_seconds_count{chain="btc",endpoint="",priority="live"} 3`) {
+		t.Fatalf("limiter wait is not measured\n%s", body)
+	}
+}
+
+func TestChainpot_LimitedWallet(t *testing.T) {
+	var dir = tempDir(t)
+	defer os.RemoveAll(dir)
+	var fake = NewFakeChain(100)
+	var wallet = NewFakeWallet(fake)
+	var cp = NewChainpot(&ChainConf{
+		Coins: []Coins{{CoinType: "origin", Chain: "eth", Symbol: "eth"}},
+		Eth: &EthConf{
+			ConfirmTimes:  2,
+			Storage:       boltStorage(t, dir, "eth"),
+			RateLimit:     1000,
+			MaxConcurrent: 1,
+		},
+		Builders: map[string]claws.WalletBuilder{"eth": wallet},
+		Record:   ioutil.Discard,
+	})
+	if err := cp.Register(Ethereum); err != nil {
+		t.Fatal(err)
+	}
+	cp.Add(Ethereum, []string{simFrom})
+	var ch = startPot(t, cp, fake)
+
+	// the receipts and the sends of the wallet are reached through the limiter and the recorder
+	fake.FailTx("0xr1")
+	fake.Mine(BlockMessage{Hash: "0xr1", From: simTo, To: simFrom, Amount: "5"})
+	fake.Mine()
+	expectEvents(t, ch, expected{T_DEPOSIT_FAIL, 1, "0xr1"})
+	if _, err := cp.Withdraw(Ethereum, &WithdrawRequest{ID: "w1", Symbol: "eth", From: simFrom, To: simTo, Amount: "1"}); err != nil {
+		t.Fatal(err)
+	}
+	expectWithdrawal(t, ch, T_WITHDRAW_PENDING, 2, "w1")
+	stopPot(t, cp)
+}
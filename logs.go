@@ -0,0 +1,209 @@
+package chainpot
+
+import (
+	"context"
+	"fmt"
+	"math/big"
+	"sort"
+	"strings"
+)
+
+// topics of the token transfer logs, Transfer is shared by ERC20 and ERC721
+const (
+	TransferTopic       = "0xddf252ad1be2c89b69c2b068fc378daa952ba7f163c4a11628f55a4df523b3ef"
+	TransferSingleTopic = "0xc3d58168c5ae7397731d063d5bbf3d657854427343f4c083240f7aacaa2d0f62"
+	TransferBatchTopic  = "0x4a39dc06d4c0dbc64b70af90fd698a233a518aa5d07e595d983b8c0526c8f7fb"
+)
+
+// Log is an ethereum event log
+type Log struct {
+	Address string
+	Topics  []string
+	Data    string
+	TxHash  string
+	Index   int64
+}
+
+// LogReader is implemented by wallets reading the transfer logs of the given contracts
+// in a block, or of every contract when addrs is empty. the json-rpc of the chain conf is asked otherwise
+type LogReader interface {
+	Logs(ctx context.Context, num *big.Int, addrs []string) ([]*Log, error)
+}
+
+// sync the token transfers of the block at num from its logs, a single call covers every configured token,
+// or every contract when unlisted tokens are discovered
+func (c *chain) syncLogs(ctx context.Context, num *big.Int, isOldBlock bool) {
+	if len(c.tokens) == 0 && !c.unlisted {
+		return
+	}
+	reader, ok := optional[LogReader](c.origin.wallet)
+	if !ok {
+		if reader, ok = optional[LogReader](c.lookup); !ok {
+			c.logger.Error().Msg("decode_logs needs the chain url or a LogReader wallet")
+			return
+		}
+	}
+
+	var addrs = make([]string, 0, len(c.tokens))
+	if !c.unlisted {
+		for addr := range c.tokens {
+			addrs = append(addrs, addr)
+		}
+		sort.Strings(addrs)
+	}
+	logs, err := reader.Logs(ctx, num, addrs)
+	if err != nil {
+		c.metrics.Add("chainpot_unfold_errors_total", 1, c.name, "logs")
+		c.health.fail(err)
+		c.logger.Error().Msgf("logs of block %d error: %s", num.Int64(), err.Error())
+		return
+	}
+
+	var height = num.Int64()
+	for _, item := range logs {
+		var cont = c.tokens[strings.ToLower(item.Address)]
+		if cont == nil {
+			if c.unlisted {
+				c.discover(ctx, item, height)
+			}
+			continue
+		}
+		// without decode_logs the configured tokens are unfolded by their wallets
+		if !c.decodeLogs {
+			continue
+		}
+		for _, msg := range decodeLog(item) {
+			var f1, f2 = c.watched(msg)
+			if !f1 && !f2 {
+				continue
+			}
+			c.metrics.Add("chainpot_matched_transactions_total", 1, c.name, cont.Symbol)
+			c.pend(&Value{TXN: msg, Height: height, Index: item.Index, IsOldBlock: isOldBlock, EventID: c.eventID, Contract: cont}, f1, f2)
+		}
+	}
+}
+
+// transfers of a Transfer, TransferSingle or TransferBatch log, nil for other logs
+func decodeLog(item *Log) []*BlockMessage {
+	if len(item.Topics) == 0 {
+		return nil
+	}
+	var words = abiWords(item.Data)
+	var msg = func(from, to, id, amount string) *BlockMessage {
+		return &BlockMessage{
+			Hash:     strings.ToLower(item.TxHash),
+			From:     topicAddr(from),
+			To:       topicAddr(to),
+			Amount:   amount,
+			Contract: strings.ToLower(item.Address),
+			TokenID:  id,
+			LogIndex: item.Index,
+		}
+	}
+
+	switch strings.ToLower(item.Topics[0]) {
+	case TransferTopic:
+		if len(item.Topics) == 4 {
+			// erc721, the token ID is indexed
+			return []*BlockMessage{msg(item.Topics[1], item.Topics[2], hexDecimal(item.Topics[3]), "1")}
+		}
+		if len(item.Topics) == 3 && len(words) >= 1 {
+			return []*BlockMessage{msg(item.Topics[1], item.Topics[2], "", words[0].String())}
+		}
+	case TransferSingleTopic:
+		if len(item.Topics) == 4 && len(words) >= 2 {
+			return []*BlockMessage{msg(item.Topics[2], item.Topics[3], words[0].String(), words[1].String())}
+		}
+	case TransferBatchTopic:
+		if len(item.Topics) != 4 || len(words) < 2 {
+			return nil
+		}
+		var ids, amounts = abiArray(words, words[0]), abiArray(words, words[1])
+		if ids == nil || len(ids) != len(amounts) {
+			return nil
+		}
+		var res = make([]*BlockMessage, 0, len(ids))
+		for i := range ids {
+			res = append(res, msg(item.Topics[2], item.Topics[3], ids[i].String(), amounts[i].String()))
+		}
+		return res
+	}
+	return nil
+}
+
+// address held by the last 20 bytes of a topic
+func topicAddr(topic string) string {
+	var s = strings.TrimPrefix(strings.ToLower(topic), "0x")
+	if len(s) > 40 {
+		s = s[len(s)-40:]
+	}
+	return "0x" + s
+}
+
+// 32 bytes words of abi encoded data
+func abiWords(data string) []*big.Int {
+	var s = strings.TrimPrefix(data, "0x")
+	var res = make([]*big.Int, 0, len(s)/64)
+	for i := 0; i+64 <= len(s); i += 64 {
+		num, ok := new(big.Int).SetString(s[i:i+64], 16)
+		if !ok {
+			return nil
+		}
+		res = append(res, num)
+	}
+	return res
+}
+
+// dynamic uint256 array at the byte offset of words, nil when out of bounds
+func abiArray(words []*big.Int, offset *big.Int) []*big.Int {
+	if !offset.IsInt64() || offset.Int64()%32 != 0 {
+		return nil
+	}
+	var at = int(offset.Int64() / 32)
+	if at < 0 || at >= len(words) {
+		return nil
+	}
+	var n = int(words[at].Int64())
+	if !words[at].IsInt64() || n < 0 || at+1+n > len(words) {
+		return nil
+	}
+	return words[at+1 : at+1+n]
+}
+
+func (c *ethLookup) Logs(ctx context.Context, num *big.Int, addrs []string) ([]*Log, error) {
+	var res []struct {
+		Address         string
+		Topics          []string
+		Data            string
+		LogIndex        string
+		TransactionHash string
+		Removed         bool
+	}
+	var block = fmt.Sprintf("0x%x", num)
+	var filter = map[string]interface{}{
+		"fromBlock": block,
+		"toBlock":   block,
+		"topics":    []interface{}{[]string{TransferTopic, TransferSingleTopic, TransferBatchTopic}},
+	}
+	if len(addrs) > 0 {
+		filter["address"] = addrs
+	}
+	err := c.rpc.call(ctx, "eth_getLogs", &res, filter)
+	if err != nil {
+		return nil, err
+	}
+	var logs = make([]*Log, 0, len(res))
+	for _, item := range res {
+		if item.Removed {
+			continue
+		}
+		logs = append(logs, &Log{
+			Address: item.Address,
+			Topics:  item.Topics,
+			Data:    item.Data,
+			TxHash:  item.TransactionHash,
+			Index:   int64(hexUint64(item.LogIndex)),
+		})
+	}
+	return logs, nil
+}
@@ -0,0 +1,99 @@
+package chainpot
+
+import (
+	"fmt"
+	"github.com/fadeAce/chainpot/chainsim"
+	"github.com/fadeAce/claws"
+	"math/big"
+	"net/http/httptest"
+	"os"
+	"testing"
+)
+
+const (
+	simToken = "0x00000000000000000000000000000000000000c1"
+	simNFT   = "0x00000000000000000000000000000000000000c2"
+)
+
+func abiWord(n int64) string {
+	return fmt.Sprintf("%064x", n)
+}
+
+func topic(addr string) string {
+	return "0x" + fmt.Sprintf("%064s", addr[2:])
+}
+
+func TestDecodeLog(t *testing.T) {
+	var erc721 = &Log{Address: simNFT, TxHash: "0xaa", Index: 3, Topics: []string{TransferTopic, topic(simFrom), topic(simTo), "0x" + abiWord(7)}}
+	if res := decodeLog(erc721); len(res) != 1 || res[0].TokenID != "7" || res[0].Amount != "1" || res[0].From != simFrom || res[0].LogIndex != 3 {
+		t.Fatalf("unexpected erc721 transfer %s", mustMarshal(res))
+	}
+
+	var single = &Log{Address: simNFT, Topics: []string{TransferSingleTopic, topic(simFrom), topic(simFrom), topic(simTo)}, Data: "0x" + abiWord(9) + abiWord(20)}
+	if res := decodeLog(single); len(res) != 1 || res[0].TokenID != "9" || res[0].Amount != "20" || res[0].To != simTo {
+		t.Fatalf("unexpected erc1155 transfer %s", mustMarshal(res))
+	}
+
+	// ids at byte 64 and amounts at byte 160
+	var batch = &Log{Address: simNFT, Topics: []string{TransferBatchTopic, topic(simFrom), topic(simFrom), topic(simTo)},
+		Data: "0x" + abiWord(64) + abiWord(160) + abiWord(2) + abiWord(1) + abiWord(2) + abiWord(2) + abiWord(10) + abiWord(20)}
+	if res := decodeLog(batch); len(res) != 2 || res[1].TokenID != "2" || res[1].Amount != "20" {
+		t.Fatalf("unexpected erc1155 batch %s", mustMarshal(res))
+	}
+
+	var broken = &Log{Topics: []string{TransferBatchTopic, topic(simFrom), topic(simFrom), topic(simTo)}, Data: "0x" + abiWord(640) + abiWord(160)}
+	if res := decodeLog(broken); res != nil {
+		t.Fatalf("unexpected transfers of a broken batch %s", mustMarshal(res))
+	}
+}
+
+func TestChainpot_DecodeLogs(t *testing.T) {
+	var dir = tempDir(t)
+	defer os.RemoveAll(dir)
+
+	// heads come from the fake chain, logs are read on the simulator
+	var sim = chainsim.New(100)
+	var server = httptest.NewServer(chainsim.NewEthServer(sim))
+	defer server.Close()
+	var fake = NewFakeChain(100)
+
+	var cp = NewChainpot(&ChainConf{
+		Coins: []Coins{
+			{CoinType: "origin", Chain: "eth", Symbol: "eth"},
+			{CoinType: "erc20", Chain: "eth", Symbol: "tok", ContractAddr: simToken},
+			{CoinType: "erc1155", Chain: "eth", Symbol: "nft", ContractAddr: simNFT},
+		},
+		Eth:      &EthConf{Url: server.URL, ConfirmTimes: 2, Storage: boltStorage(t, dir, "eth"), DecodeLogs: true},
+		Builders: map[string]claws.WalletBuilder{"eth": fake, "tok": fake, "nft": fake},
+	})
+	if err := cp.Register(Ethereum); err != nil {
+		t.Fatal(err)
+	}
+	cp.Add(Ethereum, []string{simTo})
+	var ch = startPot(t, cp, fake)
+
+	// one transaction moving the token and two nfts
+	var tx = chainsim.TokenTransfer(simToken, simFrom, simTo, big.NewInt(5))
+	tx.Logs = append(tx.Logs, &chainsim.Log{
+		Address: simNFT,
+		Topics:  []string{TransferBatchTopic, topic(simFrom), topic(simFrom), topic(simTo)},
+		Data:    "0x" + abiWord(64) + abiWord(160) + abiWord(2) + abiWord(1) + abiWord(2) + abiWord(2) + abiWord(10) + abiWord(20),
+	})
+	sim.Mine(tx)
+	fake.Mine()
+	sim.Mine()
+	fake.Mine()
+
+	var want = []struct {
+		symbol, id, amount string
+		index              int64
+	}{{"tok", "", "5", 0}, {"nft", "1", "10", 1}, {"nft", "2", "20", 1}}
+	for i, item := range want {
+		var event = <-ch
+		if event.Event != T_DEPOSIT || event.ID != int64(1+2*i) || event.Symbol != item.symbol || event.Content.TokenID != item.id ||
+			event.Content.Amount != item.amount || event.Content.LogIndex != item.index || event.Content.Hash != tx.Hash {
+			t.Fatalf("unexpected transfer %d: %s", i, mustMarshal(event))
+		}
+	}
+	stopPot(t, cp)
+}
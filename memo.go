@@ -0,0 +1,258 @@
+package chainpot
+
+import (
+	"context"
+	"encoding/hex"
+	"encoding/json"
+	"github.com/boltdb/bolt"
+	"github.com/fadeAce/chainpot/poterr"
+	"sort"
+	"strings"
+	"unicode"
+	"unicode/utf8"
+)
+
+// deposits to a shared address without one of its memos carry that reason
+const unknownMemo = "unknown memo"
+
+// selector of the ERC20 transfer(address,uint256), its memo follows the arguments
+const transferSelector = "a9059cbb"
+
+// MemoTxn is implemented by the transactions of chains with a native memo, tag or payment ID field
+type MemoTxn interface {
+	MemoStr() string
+}
+
+// CalldataReader is implemented by wallets reading the input of an ethereum transaction,
+// the json-rpc of the chain conf is asked otherwise
+type CalldataReader interface {
+	Calldata(ctx context.Context, hash string) (string, error)
+}
+
+// MemoStore is implemented by storages persisting the memos of the shared addresses
+type MemoStore interface {
+	SaveMemos(addr string, memos []string) error
+	LoadMemos() (map[string][]string, error)
+}
+
+// AddMemo watches a shared address for the deposits of memos, the deposits to it carry their decoded memo
+// in Content.Memo and those without one of its memos are reported with the Reason "unknown memo"
+func (c *Chainpot) AddMemo(chain PublicChain, addr string, memos ...string) (int64, error) {
+	var obj = c.chainOf(chain)
+	if obj == nil {
+		return 0, poterr.NotRegErr
+	}
+	return obj.addMemo(addr, memos)
+}
+
+func (c *chain) addMemo(addr string, memos []string) (int64, error) {
+	records, rejected := c.add([]string{addr})
+	if err, ok := rejected[addr]; ok {
+		return 0, err
+	}
+	var height int64
+	for key, value := range records {
+		addr, height = key, value
+	}
+
+	c.memoMu.Lock()
+	defer c.memoMu.Unlock()
+	var set = c.memos[addr]
+	if set == nil {
+		set = make(map[string]bool)
+		c.memos[addr] = set
+	}
+	for _, memo := range memos {
+		set[memo] = true
+	}
+	if store, ok := c.storage.(MemoStore); ok {
+		var list = make([]string, 0, len(set))
+		for memo := range set {
+			list = append(list, memo)
+		}
+		sort.Strings(list)
+		if err := store.SaveMemos(addr, list); err != nil {
+			c.health.fail(err)
+			c.logger.Error().Msgf("save memos of %s error: %s", addr, err.Error())
+		}
+	}
+	return height, nil
+}
+
+func (c *chain) loadMemos() {
+	store, ok := c.storage.(MemoStore)
+	if !ok {
+		return
+	}
+	list, err := store.LoadMemos()
+	if err != nil {
+		c.logger.Error().Msgf("load memos error: %s", err.Error())
+		return
+	}
+	for addr, memos := range list {
+		var set = make(map[string]bool)
+		for _, memo := range memos {
+			set[memo] = true
+		}
+		c.memos[addr] = set
+	}
+}
+
+func (c *chain) shared(addr string) bool {
+	c.memoMu.Lock()
+	defer c.memoMu.Unlock()
+	_, ok := c.memos[addr]
+	return ok
+}
+
+// whether the deposit to a shared address misses one of its memos
+func (c *chain) unknownMemo(msg *BlockMessage) bool {
+	c.memoMu.Lock()
+	defer c.memoMu.Unlock()
+	set, ok := c.memos[c.normalize(msg.To)]
+	return ok && !set[msg.Memo]
+}
+
+// decode the memo of a deposit to a shared address, it's the native one of the transaction,
+// the OP_RETURN data of a bitcoin one or the calldata suffix of an ethereum one
+func (c *chain) routeMemo(node *Value) {
+	if !c.shared(c.normalize(node.TXN.ToStr())) {
+		return
+	}
+	var msg, ok = node.TXN.(*BlockMessage)
+	if ok && msg.Memo != "" {
+		return
+	}
+	var memo string
+	if obj, ok := node.TXN.(MemoTxn); ok {
+		memo = obj.MemoStr()
+	} else if c.origin.Chain == "eth" {
+		memo = c.calldataMemo(node)
+	}
+	if memo == "" {
+		return
+	}
+	if !ok {
+		msg = NewBlockMessage(node.TXN)
+		node.TXN = msg
+	}
+	msg.Memo = memo
+}
+
+func (c *chain) calldataMemo(node *Value) string {
+	reader, ok := optional[CalldataReader](c.origin.wallet)
+	if !ok {
+		if reader, ok = optional[CalldataReader](c.lookup); !ok {
+			return ""
+		}
+	}
+	input, err := reader.Calldata(c.ctx, node.TXN.HexStr())
+	if err != nil {
+		c.logger.Error().Msgf("calldata of %s error: %s", node.TXN.HexStr(), err.Error())
+		return ""
+	}
+	data, err := hex.DecodeString(strings.TrimPrefix(input, "0x"))
+	if err != nil {
+		return ""
+	}
+	// token transfers carry the memo after their arguments
+	if node.Contract != nil && node.Contract.ContractAddr != "" {
+		if len(data) <= 68 || hex.EncodeToString(data[:4]) != transferSelector {
+			return ""
+		}
+		data = data[68:]
+	}
+	return memoString(data)
+}
+
+// printable text as it is, other data in hex
+func memoString(data []byte) string {
+	for len(data) > 0 && data[len(data)-1] == 0 {
+		data = data[:len(data)-1]
+	}
+	if len(data) == 0 {
+		return ""
+	}
+	if utf8.Valid(data) && strings.IndexFunc(string(data), func(r rune) bool { return !unicode.IsPrint(r) }) < 0 {
+		return string(data)
+	}
+	return "0x" + hex.EncodeToString(data)
+}
+
+// data pushed by an OP_RETURN script
+func nullData(script []byte) []byte {
+	if len(script) == 0 || script[0] != 0x6a {
+		return nil
+	}
+	var res = make([]byte, 0)
+	for i := 1; i < len(script); {
+		var op = int(script[i])
+		i++
+		var n int
+		switch {
+		case op >= 1 && op <= 75:
+			n = op
+		case op == 0x4c && i+1 <= len(script):
+			n = int(script[i])
+			i++
+		case op == 0x4d && i+2 <= len(script):
+			n = int(script[i]) | int(script[i+1])<<8
+			i += 2
+		default:
+			return res
+		}
+		if i+n > len(script) {
+			return res
+		}
+		res = append(res, script[i:i+n]...)
+		i += n
+	}
+	return res
+}
+
+func (c *ethLookup) Calldata(ctx context.Context, hash string) (string, error) {
+	var tx *struct {
+		Input string
+	}
+	if err := c.rpc.call(ctx, "eth_getTransactionByHash", &tx, hash); err != nil {
+		return "", err
+	}
+	if tx == nil {
+		return "", nil
+	}
+	return tx.Input, nil
+}
+
+var memosBucket = []byte("memos")
+
+func (c *BoltStorage) createMemos() error {
+	return c.Database.Update(func(tx *bolt.Tx) error {
+		_, err := tx.CreateBucketIfNotExists(memosBucket)
+		return err
+	})
+}
+
+func (c *BoltStorage) SaveMemos(addr string, memos []string) error {
+	bs, err := json.Marshal(memos)
+	if err != nil {
+		return err
+	}
+	return c.Database.Update(func(tx *bolt.Tx) error {
+		return tx.Bucket(memosBucket).Put([]byte(addr), bs)
+	})
+}
+
+func (c *BoltStorage) LoadMemos() (map[string][]string, error) {
+	var res = make(map[string][]string)
+	err := c.Database.View(func(tx *bolt.Tx) error {
+		return tx.Bucket(memosBucket).ForEach(func(k, v []byte) error {
+			var memos []string
+			if err := json.Unmarshal(v, &memos); err != nil {
+				return err
+			}
+			res[string(k)] = memos
+			return nil
+		})
+	})
+	return res, err
+}
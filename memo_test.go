@@ -0,0 +1,134 @@
+package chainpot
+
+import (
+	"context"
+	"encoding/hex"
+	"github.com/fadeAce/chainpot/chainsim"
+	"github.com/fadeAce/claws"
+	"math/big"
+	"net/http/httptest"
+	"os"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestNullData(t *testing.T) {
+	if res := string(nullData([]byte{0x6a, 0x03, 'a', 'b', 'c', 0x4c, 0x01, 'd'})); res != "abcd" {
+		t.Fatalf("unexpected data %q", res)
+	}
+	if res := nullData([]byte{0x76, 0xa9}); res != nil {
+		t.Fatalf("unexpected data of a payment script %x", res)
+	}
+	if res := memoString([]byte{0xff, 0x01, 0x00}); res != "0xff01" {
+		t.Fatalf("unexpected memo %s", res)
+	}
+}
+
+func TestChainpot_MemoEthereum(t *testing.T) {
+	var dir = tempDir(t)
+	defer os.RemoveAll(dir)
+
+	// heads and transactions come from the fake chain, calldata and logs are read on the simulator
+	var sim = chainsim.New(100)
+	var server = httptest.NewServer(chainsim.NewEthServer(sim))
+	defer server.Close()
+	var fake = NewFakeChain(100)
+
+	var cp = NewChainpot(&ChainConf{
+		Coins: []Coins{
+			{CoinType: "origin", Chain: "eth", Symbol: "eth"},
+			{CoinType: "erc20", Chain: "eth", Symbol: "tok", ContractAddr: simToken},
+		},
+		Eth:      &EthConf{Url: server.URL, ConfirmTimes: 2, Storage: boltStorage(t, dir, "eth"), DecodeLogs: true},
+		Builders: map[string]claws.WalletBuilder{"eth": fake, "tok": fake},
+	})
+	if err := cp.Register(Ethereum); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := cp.AddMemo(Ethereum, strings.ToUpper(simTo[2:]), "user-1"); err == nil {
+		t.Fatal("expect an invalid address error")
+	}
+	if _, err := cp.AddMemo(Ethereum, simTo, "user-1"); err != nil {
+		t.Fatal(err)
+	}
+	var ctx, cancel = context.WithCancel(context.Background())
+	defer cancel()
+	var routed = cp.Events(ctx, &Filter{Memos: []string{"user-1"}})
+	var ch = startPot(t, cp, fake)
+
+	// a token transfer with a known memo after its arguments and a payment with an unknown one
+	var token = chainsim.TokenTransfer(simToken, simFrom, simTo, big.NewInt(5))
+	token.Input += hex.EncodeToString([]byte("user-1"))
+	var pay = chainsim.Pay(simFrom, simTo, big.NewInt(7))
+	pay.Input = "0x" + hex.EncodeToString([]byte("user-9"))
+	sim.Mine(token, pay)
+	fake.Mine(BlockMessage{Hash: pay.Hash, From: simFrom, To: simTo, Amount: "7"})
+	sim.Mine()
+	fake.Mine()
+
+	var events = make(map[int64]*PotEvent)
+	for i := 0; i < 2; i++ {
+		var event = <-ch
+		events[event.ID] = event
+	}
+	if event := events[1]; event == nil || event.Content.Hash != pay.Hash || event.Content.Memo != "user-9" || event.Reason != unknownMemo {
+		t.Fatalf("unexpected payment %s", mustMarshal(events))
+	}
+	if event := events[3]; event == nil || event.Symbol != "tok" || event.Content.Memo != "user-1" || event.Reason != "" {
+		t.Fatalf("unexpected token transfer %s", mustMarshal(events))
+	}
+	select {
+	case event := <-routed:
+		if event.ID != 3 {
+			t.Fatalf("unexpected routed event %s", mustMarshal(event))
+		}
+	case <-time.After(2 * time.Second):
+		t.Fatal("timeout waiting for the routed event")
+	}
+	stopPot(t, cp)
+}
+
+func TestChainpot_MemoBitcoin(t *testing.T) {
+	var dir = tempDir(t)
+	defer os.RemoveAll(dir)
+
+	var sim = chainsim.New(100)
+	var server = httptest.NewServer(chainsim.NewBtcServer(sim))
+	defer server.Close()
+	var fake = NewFakeChain(100)
+
+	var cp = NewChainpot(&ChainConf{
+		Coins:    []Coins{{CoinType: "origin", Chain: "btc", Symbol: "btc"}},
+		Btc:      &BtcConf{Url: server.URL, ConfirmTimes: 2, Storage: boltStorage(t, dir, "btc"), UTXO: true},
+		Builders: map[string]claws.WalletBuilder{"btc": fake},
+	})
+	if err := cp.Register(Bitcoin); err != nil {
+		t.Fatal(err)
+	}
+	cp.AddMemo(Bitcoin, testAddr, "user-1")
+	cp.Add(Bitcoin, []string{testOther})
+	var ch = startPot(t, cp, fake)
+
+	// the memo of the OP_RETURN output is only carried to the shared address
+	sim.Mine(chainsim.Spend(nil,
+		&chainsim.TxOut{Address: testAddr, Value: big.NewInt(1000)},
+		&chainsim.TxOut{Data: hex.EncodeToString([]byte("user-1"))},
+		&chainsim.TxOut{Address: testOther, Value: big.NewInt(2000)},
+	))
+	fake.Mine()
+	if event := <-ch; event.Content.To != testAddr || event.Content.Memo != "user-1" || event.Reason != "" {
+		t.Fatalf("unexpected deposit %s", mustMarshal(event))
+	}
+	if event := <-ch; event.Content.To != testOther || event.Content.Memo != "" || event.Reason != "" {
+		t.Fatalf("unexpected deposit %s", mustMarshal(event))
+	}
+
+	// a deposit without memo to the shared address
+	sim.Mine(chainsim.Spend(nil, &chainsim.TxOut{Address: testAddr, Value: big.NewInt(3000)}))
+	fake.Mine()
+	if event := <-ch; event.Content.Amount != "3000" || event.Content.Memo != "" || event.Reason != unknownMemo {
+		t.Fatalf("unexpected deposit %s", mustMarshal(event))
+	}
+	stopPot(t, cp)
+}
@@ -0,0 +1,192 @@
+package chainpot
+
+import (
+	"fmt"
+	"math"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+type metricKind string
+
+const (
+	counter   metricKind = "counter"
+	gauge     metricKind = "gauge"
+	histogram metricKind = "histogram"
+)
+
+type metricDesc struct {
+	kind   metricKind
+	help   string
+	labels []string
+}
+
+// metrics exposed by chainpot, label values are given in the declared order
+var metricDescs = map[string]*metricDesc{
+	"chainpot_node_height":                    {gauge, "Last head height announced by the node.", []string{"chain"}},
+	"chainpot_processed_height":               {gauge, "Last block height processed.", []string{"chain"}},
+	"chainpot_blocks_processed_total":         {counter, "Blocks processed.", []string{"chain"}},
+	"chainpot_unfold_duration_seconds":        {histogram, "Latency of UnfoldTxs calls.", []string{"chain", "symbol"}},
+	"chainpot_unfold_errors_total":            {counter, "Failed UnfoldTxs calls.", []string{"chain", "symbol"}},
+	"chainpot_matched_transactions_total":     {counter, "Transactions involving a watched address.", []string{"chain", "symbol"}},
+	"chainpot_pending_transactions":           {gauge, "Transactions waiting for confirmations.", []string{"chain", "direction"}},
+	"chainpot_message_queue_depth":            {gauge, "Events waiting in the chain message queue.", []string{"chain"}},
+	"chainpot_events_total":                   {counter, "Events emitted.", []string{"chain", "symbol", "event"}},
+	"chainpot_handler_duration_seconds":       {histogram, "Latency of the subscription handlers.", []string{"chain"}},
+	"chainpot_handler_failures_total":         {counter, "Subscription handlers that panicked.", []string{"chain"}},
+	"chainpot_subscription_dropped_total":     {counter, "Events dropped by subscriptions past their buffer.", []string{"chain"}},
+	"chainpot_limiter_wait_seconds":           {histogram, "Time node calls waited on the endpoint limiter.", []string{"chain", "endpoint", "priority"}},
+	"chainpot_stalled":                        {gauge, "1 while no head came for the stall interval.", []string{"chain"}},
+	"chainpot_storage_write_duration_seconds": {histogram, "Latency of storage writes.", []string{"chain", "op"}},
+}
+
+var defaultBuckets = []float64{.005, .01, .025, .05, .1, .25, .5, 1, 2.5, 5, 10}
+
+type series struct {
+	labels  []string
+	value   float64
+	buckets []uint64
+	count   uint64
+}
+
+// Metrics collects chainpot metrics and serves them in the prometheus text format,
+// a nil *Metrics discards everything
+type Metrics struct {
+	mu     sync.Mutex
+	series map[string]map[string]*series
+}
+
+func NewMetrics() *Metrics {
+	return &Metrics{series: make(map[string]map[string]*series)}
+}
+
+func (m *Metrics) get(name string, labels []string) *series {
+	var desc, ok = metricDescs[name]
+	if !ok || len(desc.labels) != len(labels) {
+		panic("unknown metric or labels: " + name)
+	}
+	var key = strings.Join(labels, "\xff")
+	if m.series[name] == nil {
+		m.series[name] = make(map[string]*series)
+	}
+	var obj = m.series[name][key]
+	if obj == nil {
+		obj = &series{labels: append([]string{}, labels...)}
+		if desc.kind == histogram {
+			obj.buckets = make([]uint64, len(defaultBuckets))
+		}
+		m.series[name][key] = obj
+	}
+	return obj
+}
+
+// Add increases a counter
+func (m *Metrics) Add(name string, v float64, labels ...string) {
+	if m == nil {
+		return
+	}
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.get(name, labels).value += v
+}
+
+// Set assigns a gauge
+func (m *Metrics) Set(name string, v float64, labels ...string) {
+	if m == nil {
+		return
+	}
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.get(name, labels).value = v
+}
+
+// Observe records a sample of a histogram
+func (m *Metrics) Observe(name string, v float64, labels ...string) {
+	if m == nil {
+		return
+	}
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	var obj = m.get(name, labels)
+	obj.value += v
+	obj.count++
+	for i, bound := range defaultBuckets {
+		if v <= bound {
+			obj.buckets[i]++
+		}
+	}
+}
+
+// Since observes the seconds elapsed from start
+func (m *Metrics) Since(name string, start time.Time, labels ...string) {
+	m.Observe(name, time.Since(start).Seconds(), labels...)
+}
+
+func (m *Metrics) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "text/plain; version=0.0.4")
+	if m == nil {
+		return
+	}
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	var names = make([]string, 0)
+	for name := range m.series {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+
+	for _, name := range names {
+		var desc = metricDescs[name]
+		fmt.Fprintf(w, "# HELP %s %s\n# TYPE %s %s\n", name, desc.help, name, desc.kind)
+
+		var keys = make([]string, 0)
+		for key := range m.series[name] {
+			keys = append(keys, key)
+		}
+		sort.Strings(keys)
+		for _, key := range keys {
+			var obj = m.series[name][key]
+			var labels = formatLabels(desc.labels, obj.labels)
+			if desc.kind != histogram {
+				fmt.Fprintf(w, "%s%s %s\n", name, wrapLabels(labels), formatFloat(obj.value))
+				continue
+			}
+			for i, bound := range defaultBuckets {
+				var le = fmt.Sprintf(`le="%s"`, formatFloat(bound))
+				fmt.Fprintf(w, "%s_bucket%s %d\n", name, wrapLabels(labels, le), obj.buckets[i])
+			}
+			fmt.Fprintf(w, "%s_bucket%s %d\n", name, wrapLabels(labels, `le="+Inf"`), obj.count)
+			fmt.Fprintf(w, "%s_sum%s %s\n", name, wrapLabels(labels), formatFloat(obj.value))
+			fmt.Fprintf(w, "%s_count%s %d\n", name, wrapLabels(labels), obj.count)
+		}
+	}
+}
+
+func formatLabels(names []string, values []string) []string {
+	var res = make([]string, 0)
+	var replacer = strings.NewReplacer(`\`, `\\`, `"`, `\"`, "\n", `\n`)
+	for i, name := range names {
+		res = append(res, fmt.Sprintf(`%s="%s"`, name, replacer.Replace(values[i])))
+	}
+	return res
+}
+
+func wrapLabels(labels []string, extra ...string) string {
+	var all = append(append([]string{}, labels...), extra...)
+	if len(all) == 0 {
+		return ""
+	}
+	return "{" + strings.Join(all, ",") + "}"
+}
+
+func formatFloat(v float64) string {
+	if math.IsInf(v, 1) {
+		return "+Inf"
+	}
+	return strconv.FormatFloat(v, 'g', -1, 64)
+}
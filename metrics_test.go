@@ -0,0 +1,96 @@
+package chainpot
+
+import (
+	"context"
+	"net/http/httptest"
+	"os"
+	"strings"
+	"testing"
+	"time"
+)
+
+func scrape(m *Metrics) string {
+	var rec = httptest.NewRecorder()
+	m.ServeHTTP(rec, httptest.NewRequest("GET", "/metrics", nil))
+	return rec.Body.String()
+}
+
+func TestMetrics_Exposition(t *testing.T) {
+	var m = NewMetrics()
+	m.Add("chainpot_events_total", 2, "btc", "btc", "deposit")
+	m.Set("chainpot_node_height", 101, "btc")
+	m.Observe("chainpot_unfold_duration_seconds", 0.02, "btc", "b\"tc")
+
+	var body = scrape(m)
+	for _, line := range []string{
+		"# TYPE chainpot_events_total counter",
+		`chainpot_events_total{chain="btc",symbol="btc",event="deposit"} 2`,
+		`chainpot_node_height{chain="btc"} 101`,
+		`chainpot_unfold_duration_seconds_bucket{chain="btc",symbol="b\"tc",le="0.01"} 0`,
+		`chainpot_unfold_duration_seconds_bucket{chain="btc",symbol="b\"tc",le="0.025"} 1`,
+		`chainpot_unfold_duration_seconds_bucket{chain="btc",symbol="b\"tc",le="+Inf"} 1`,
+		`chainpot_unfold_duration_seconds_count{chain="btc",symbol="b\"tc"} 1`,
+	} {
+		if !strings.Contains(body, line+"\n") {
+			t.Fatalf("missing %q in\n%s", line, body)
+		}
+	}
+
+	var none *Metrics
+	none.Add("chainpot_events_total", 1, "btc", "btc", "deposit")
+}
+
+func TestChainpot_Metrics(t *testing.T) {
+	var dir = tempDir(t)
+	defer os.RemoveAll(dir)
+	var fake = NewFakeChain(100)
+	var cp = newTestPot(t, dir, fake, 2)
+	cp.Add(Bitcoin, []string{testAddr})
+	cp.Subscribe(&Filter{Events: []EventType{T_DEPOSIT}}, func(chain PublicChain, event *PotEvent) {
+		panic("handler failure")
+	})
+	var ch = startPot(t, cp, fake)
+
+	fake.FailUnfold(101, 1)
+	fake.Mine(BlockMessage{Hash: "m1", From: testOther, To: testAddr})
+	fake.Mine(BlockMessage{Hash: "m2", From: testOther, To: testAddr})
+	fake.Mine()
+	expectEvents(t, ch,
+		expected{T_DEPOSIT, 1, "m2"},
+		expected{T_DEPOSIT_CONFIRM, 2, "m2"},
+	)
+	stopPot(t, cp)
+
+	var body = scrape(cp.Metrics())
+	for _, line := range []string{
+		`chainpot_node_height{chain="btc"} 103`,
+		`chainpot_processed_height{chain="btc"} 103`,
+		`chainpot_blocks_processed_total{chain="btc"} 3`,
+		`chainpot_unfold_errors_total{chain="btc",symbol="btc"} 1`,
+		`chainpot_matched_transactions_total{chain="btc",symbol="btc"} 1`,
+		`chainpot_events_total{chain="btc",symbol="btc",event="deposit_confirm"} 1`,
+		`chainpot_handler_failures_total{chain="btc"} 1`,
+		`chainpot_storage_write_duration_seconds_count{chain="btc",op="save_addrs"} 1`,
+	} {
+		if !strings.Contains(body, line+"\n") {
+			t.Fatalf("missing %q in\n%s", line, body)
+		}
+	}
+}
+
+func TestChainpot_MetricsEndpoint(t *testing.T) {
+	var dir = tempDir(t)
+	defer os.RemoveAll(dir)
+	var fake = NewFakeChain(100)
+	var cp = newTestPot(t, dir, fake, 2)
+	cp.conf.HTTPAddr = "127.0.0.1:0"
+	cp.Start(nil)
+	if cp.server == nil {
+		t.Fatal("http server is not started")
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), 2*time.Second)
+	defer cancel()
+	if _, err := cp.Stop(ctx); err != nil || cp.server != nil {
+		t.Fatalf("http server is not stopped: %v", err)
+	}
+}
@@ -2,112 +2,518 @@ package chainpot
 
 import (
 	"context"
+	"errors"
+	"fmt"
 	"github.com/fadeAce/claws"
 	"github.com/fadeAce/claws/types"
 	"math/big"
+	"sync"
 	"time"
 )
 
-var (
-	testMsgs   map[int64]*[]BlockMessage
-	testHeight = 1
-)
+// FakeChain is a scriptable in-process chain implementing claws.Wallet,
+// tests push blocks, forks, gaps and failures and drive its clock with Advance.
+// it is also its own claws.WalletBuilder so it can be put in ChainConf.Builders
+type FakeChain struct {
+	mu         sync.Mutex
+	blocks     map[int64][]BlockMessage
+	times      map[int64]time.Time
+	pending    []BlockMessage
+	head       int64
+	notify     func(num *big.Int)
+	ctx        context.Context
+	unfoldErr  map[int64]int
+	receiptErr int
+	failed     map[string]bool
+	now        time.Time
+	elapsed    time.Duration
+	listened   int
+	reconnects int
+
+	// a block is mined every BlockTime of Advance, zero disables it
+	BlockTime time.Duration
+	// NotifyHead blocks until its context is done, as streaming adapters do
+	BlockingHead bool
+}
+
+var ErrFakeRPC = errors.New("fake chain rpc error")
+
+func NewFakeChain(head int64) *FakeChain {
+	return &FakeChain{
+		blocks:    make(map[int64][]BlockMessage),
+		times:     make(map[int64]time.Time),
+		head:      head,
+		unfoldErr: make(map[int64]int),
+		failed:    make(map[string]bool),
+		now:       time.Unix(0, 0),
+	}
+}
+
+func (c *FakeChain) Build() claws.Wallet {
+	return c
+}
+
+// Head returns the height of the last block
+func (c *FakeChain) Head() int64 {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.head
+}
 
-func initMock() {
-	testMsgs = make(map[int64]*[]BlockMessage)
+// Block scripts the transactions of height, replacing what was there
+func (c *FakeChain) Block(height int64, txs ...BlockMessage) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.blocks[height] = append([]BlockMessage{}, txs...)
+	c.times[height] = c.now
 }
 
-type MaskBuilder struct{}
+// Pend puts transactions into the mempool, the next mined block holds them
+func (c *FakeChain) Pend(txs ...BlockMessage) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.pending = append(c.pending, txs...)
+}
 
-func (c *MaskBuilder) Build() claws.Wallet {
-	return &MaskWallet{}
+// Mine appends a block holding the pending and given transactions and announces it
+func (c *FakeChain) Mine(txs ...BlockMessage) int64 {
+	c.mu.Lock()
+	c.mine(txs)
+	c.mu.Unlock()
+	return c.Announce()
 }
 
-type MaskWallet struct{}
+func (c *FakeChain) mine(txs []BlockMessage) {
+	c.head++
+	c.blocks[c.head] = append(c.pending, txs...)
+	c.times[c.head] = c.now
+	c.pending = nil
+}
 
+// Fork replaces the blocks from height on with the given ones and announces the new head
+func (c *FakeChain) Fork(height int64, blocks ...[]BlockMessage) int64 {
+	c.mu.Lock()
+	for h := height; h <= c.head; h++ {
+		delete(c.blocks, h)
+	}
+	c.head = height - 1
+	for _, txs := range blocks {
+		c.mine(txs)
+	}
+	c.mu.Unlock()
+	return c.Announce()
+}
 
-func (c *MaskWallet)LoadTransaction(s string) (tx types.Transaction, err error){
+// Gap mines n empty blocks but only announces the last one
+func (c *FakeChain) Gap(n int) int64 {
+	c.mu.Lock()
+	for i := 0; i < n; i++ {
+		c.mine(nil)
+	}
+	c.mu.Unlock()
+	return c.Announce()
+}
+
+// Announce notifies the current head to the subscriber of NotifyHead,
+// calling it again for the same head mimics nodes repeating themselves
+func (c *FakeChain) Announce() int64 {
+	c.mu.Lock()
+	var head = c.head
+	var notify = c.notify
+	if c.ctx != nil && c.ctx.Err() != nil {
+		notify = nil
+	}
+	c.mu.Unlock()
+
+	if notify != nil {
+		notify(big.NewInt(head))
+	}
+	return head
+}
+
+// FailUnfold makes the next times UnfoldTxs calls of height fail
+func (c *FakeChain) FailUnfold(height int64, times int) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.unfoldErr[height] = times
+}
+
+// FailTx makes Seek report the transaction as failed
+func (c *FakeChain) FailTx(hash string) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.failed[hash] = true
+}
+
+// Now is the time of the fake clock
+func (c *FakeChain) Now() time.Time {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.now
+}
+
+// Advance moves the fake clock forward, mining and announcing a block every BlockTime
+func (c *FakeChain) Advance(d time.Duration) {
+	c.mu.Lock()
+	c.now = c.now.Add(d)
+	c.elapsed += d
+	var mined = 0
+	for c.BlockTime > 0 && c.elapsed >= c.BlockTime {
+		c.elapsed -= c.BlockTime
+		c.mine(nil)
+		mined++
+	}
+	c.mu.Unlock()
+
+	if mined > 0 {
+		c.Announce()
+	}
+}
+
+func (c *FakeChain) LoadTransaction(s string) (tx types.Transaction, err error) {
 	return nil, nil
 }
 
-func (c *MaskWallet) Type() string {
-	return "mlgb"
+func (c *FakeChain) Type() string {
+	return "fake"
 }
 
-func (c *MaskWallet) InitWallet() {
+func (c *FakeChain) InitWallet() {
 
 }
 
-func (c *MaskWallet) NewAddr() types.Bundle {
+func (c *FakeChain) NewAddr() types.Bundle {
 	return types.Bundle(nil)
 }
 
-func (c *MaskWallet) BuildBundle(prv, pub, addr string) types.Bundle {
+func (c *FakeChain) BuildBundle(prv, pub, addr string) types.Bundle {
 	return types.Bundle(nil)
 }
 
-func (c *MaskWallet) BuildTxn(hash string) types.TXN {
+func (c *FakeChain) BuildTxn(hash string) types.TXN {
 	return &BlockMessage{Hash: hash}
 }
 
-func (c *MaskWallet) Withdraw(addr types.Bundle) *types.TxnInfo {
+func (c *FakeChain) Withdraw(addr types.Bundle) *types.TxnInfo {
 	return &types.TxnInfo{}
 }
 
-func (c *MaskWallet) Seek(txn types.TXN) bool {
-	return true
+// Seek reports whether the transaction is in the current chain and did not fail
+func (c *FakeChain) Seek(txn types.TXN) bool {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if c.failed[txn.HexStr()] {
+		return false
+	}
+	for _, txs := range c.blocks {
+		for _, item := range txs {
+			if item.Hash == txn.HexStr() {
+				return true
+			}
+		}
+	}
+	return false
 }
 
-func (c *MaskWallet) Balance(bundle types.Bundle) (string, error) {
-	return "10000", nil
+// FailReceipts makes the next n Receipt calls fail
+func (c *FakeChain) FailReceipts(n int) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.receiptErr = n
+}
+
+// Receipt reports the transactions failed by FailTx as reverted
+func (c *FakeChain) Receipt(ctx context.Context, hash string) (*Receipt, error) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if c.receiptErr > 0 {
+		c.receiptErr--
+		return nil, ErrFakeRPC
+	}
+	return &Receipt{Reverted: c.failed[hash]}, nil
 }
 
-func (c *MaskWallet) UnfoldTxs(ctx context.Context, num *big.Int) ([]types.TXN, error) {
-	height := num.Int64()
-	arr, ok := testMsgs[height]
+// MinedAt is the fake clock when the block was mined
+func (c *FakeChain) MinedAt(ctx context.Context, num *big.Int) (time.Time, error) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	at, ok := c.times[num.Int64()]
 	if !ok {
-		return make([]types.TXN, 0), nil
+		return time.Time{}, ErrFakeRPC
+	}
+	return at, nil
+}
+
+func (c *FakeChain) Balance(bundle types.Bundle) (string, error) {
+	return "10000", nil
+}
+
+func (c *FakeChain) UnfoldTxs(ctx context.Context, num *big.Int) ([]types.TXN, error) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	var height = num.Int64()
+	if c.unfoldErr[height] > 0 {
+		c.unfoldErr[height]--
+		return nil, ErrFakeRPC
 	}
 
 	txns := make([]types.TXN, 0)
-	for _, item := range *arr {
+	for i := range c.blocks[height] {
+		var item = c.blocks[height][i]
 		txns = append(txns, &item)
 	}
 	return txns, nil
 }
 
-func (c *MaskWallet) NotifyHead(ctx context.Context, f func(num *big.Int)) error {
-	go func() {
-		ticker := time.NewTicker(5 * time.Second)
-		var height int64 = 8
-		for {
-			select {
-			case <-ticker.C:
-				f(big.NewInt(height))
-				if height%3 == 1 {
-					f(big.NewInt(height))
-				}
-				height++
-			}
-		}
-	}()
+// NotifyHead keeps f until ctx is done, heads are pushed by Mine, Fork, Gap, Announce and Advance
+func (c *FakeChain) NotifyHead(ctx context.Context, f func(num *big.Int)) error {
+	c.mu.Lock()
+	c.ctx = ctx
+	c.notify = f
+	c.listened++
+	var blocking = c.BlockingHead
+	c.mu.Unlock()
+	if blocking {
+		<-ctx.Done()
+	}
 	return nil
 }
 
-func (c *MaskWallet) Send(ctx context.Context, from, to types.Bundle, amount string, option *types.Option) (res types.Transaction, err error) {
+// Reconnect counts the reconnections asked by the watchdog
+func (c *FakeChain) Reconnect(ctx context.Context) error {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.reconnects++
+	return nil
+}
+
+func (c *FakeChain) Reconnects() int {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.reconnects
+}
+
+// Listen waits until NotifyHead is called more than n times and returns the count,
+// it lets tests announce heads only after a chain has started listening
+func (c *FakeChain) Listen(n int, timeout time.Duration) int {
+	var deadline = time.Now().Add(timeout)
+	for {
+		c.mu.Lock()
+		var listened = c.listened
+		c.mu.Unlock()
+		if listened > n || !time.Now().Before(deadline) {
+			return listened
+		}
+		time.Sleep(time.Millisecond)
+	}
+}
+
+func (c *FakeChain) Send(ctx context.Context, from, to types.Bundle, amount string, option *types.Option) (res types.Transaction, err error) {
 	return nil, nil
 }
 
-func Pend(height int64, tx BlockMessage) {
-	arr, ok := testMsgs[height]
+func (c *FakeChain) Info() *types.Info {
+	return &types.Info{}
+}
+
+// FakeWallet is a FakeChain able to send, it implements Sender, Replacer, Rebroadcaster,
+// TxLookup and NonceSource so the withdrawal queue can be tested without a node
+type FakeWallet struct {
+	*FakeChain
+	sent      map[string]*OutTx
+	order     []string
+	sendErr   int
+	rejectErr int
+	lostErr   int
+}
+
+func NewFakeWallet(chain *FakeChain) *FakeWallet {
+	return &FakeWallet{FakeChain: chain, sent: make(map[string]*OutTx)}
+}
+
+func (w *FakeWallet) Build() claws.Wallet {
+	return w
+}
+
+// SendTx puts tx into the mempool under a new hash
+func (w *FakeWallet) SendTx(ctx context.Context, tx *OutTx) (string, error) {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	if w.sendErr > 0 {
+		w.sendErr--
+		return "", ErrFakeRPC
+	}
+	if w.rejectErr > 0 {
+		w.rejectErr--
+		return "", ErrRejected
+	}
+	var obj = *tx
+	var hash = w.pend(&obj)
+	if w.lostErr > 0 {
+		w.lostErr--
+		return "", ErrFakeRPC
+	}
+	return hash, nil
+}
+
+// ReplaceTx pends tx under a new hash, it must keep the nonce of a sent transaction
+func (w *FakeWallet) ReplaceTx(ctx context.Context, tx *OutTx) (string, error) {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	for _, item := range w.sent {
+		if item.From == tx.From && item.HasNonce && item.Nonce == tx.Nonce {
+			var obj = *tx
+			return w.pend(&obj), nil
+		}
+	}
+	return "", errors.New("no transaction to replace")
+}
+
+// Rebroadcast puts a sent transaction back into the mempool under its hash
+func (w *FakeWallet) Rebroadcast(ctx context.Context, hash string) error {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	var tx, ok = w.sent[hash]
 	if !ok {
-		list := make([]BlockMessage, 0)
-		testMsgs[height] = &list
-		arr = &list
+		return errors.New("unknown transaction " + hash)
+	}
+	if _, mined := w.mined(hash); mined {
+		return nil
 	}
-	*arr = append(*arr, tx)
+	for _, item := range w.pending {
+		if item.Hash == hash {
+			return nil
+		}
+	}
+	w.pending = append(w.pending, BlockMessage{Hash: hash, From: tx.From, To: tx.To, Amount: tx.Amount})
+	return nil
 }
 
-func (c *MaskWallet) Info() *types.Info {
-	return &types.Info{}
+// must be called with w.mu held
+func (w *FakeWallet) pend(tx *OutTx) string {
+	var hash = fmt.Sprintf("0x%064x", len(w.order)+1)
+	w.sent[hash] = tx
+	w.order = append(w.order, hash)
+	w.pending = append(w.pending, BlockMessage{Hash: hash, From: tx.From, To: tx.To, Amount: tx.Amount})
+	return hash
+}
+
+// FailSend makes the next n SendTx calls fail
+func (w *FakeWallet) FailSend(n int) {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	w.sendErr = n
+}
+
+// RejectSend makes the next n SendTx calls fail with ErrRejected
+func (w *FakeWallet) RejectSend(n int) {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	w.rejectErr = n
+}
+
+// LoseSend makes the next n SendTx calls broadcast but fail, as a timeout after the node took them
+func (w *FakeWallet) LoseSend(n int) {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	w.lostErr = n
+}
+
+// Sent returns the transactions sent so far in order
+func (w *FakeWallet) Sent() []*OutTx {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	var res = make([]*OutTx, 0)
+	for _, hash := range w.order {
+		var obj = *w.sent[hash]
+		res = append(res, &obj)
+	}
+	return res
+}
+
+// Hashes returns the hashes of the sent transactions in order
+func (w *FakeWallet) Hashes() []string {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	return append([]string{}, w.order...)
+}
+
+// Drop evicts a transaction from the mempool
+func (w *FakeWallet) Drop(hash string) {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	w.drop(hash)
+}
+
+// must be called with w.mu held
+func (w *FakeWallet) drop(hash string) {
+	for i, item := range w.pending {
+		if item.Hash == hash {
+			w.pending = append(w.pending[:i:i], w.pending[i+1:]...)
+			return
+		}
+	}
+}
+
+// Replace evicts hash and pends another transaction of the same nonce, it returns its hash
+func (w *FakeWallet) Replace(hash string) string {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	w.drop(hash)
+	var obj = *w.sent[hash]
+	obj.To = "replacement"
+	return w.pend(&obj)
+}
+
+// must be called with w.mu held
+func (w *FakeWallet) mined(hash string) (int64, bool) {
+	for height, txs := range w.blocks {
+		for _, item := range txs {
+			if item.Hash == hash {
+				return height, true
+			}
+		}
+	}
+	return 0, false
+}
+
+func (w *FakeWallet) LookupTx(ctx context.Context, hash string) (*TxInfo, error) {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	var tx = w.sent[hash]
+	var content = &BlockMessage{Hash: hash}
+	if tx != nil {
+		content = &BlockMessage{Hash: hash, From: tx.From, To: tx.To, Amount: tx.Amount}
+	}
+	if height, ok := w.mined(hash); ok {
+		return &TxInfo{State: TxMined, Height: height, Reverted: w.failed[hash], Content: content}, nil
+	}
+	for _, item := range w.pending {
+		if item.Hash == hash {
+			return &TxInfo{State: TxPending, Content: content}, nil
+		}
+	}
+	// another transaction of the same nonce got mined
+	if tx != nil && tx.HasNonce {
+		for other, item := range w.sent {
+			if _, ok := w.mined(other); ok && other != hash && item.From == tx.From && item.Nonce == tx.Nonce {
+				return &TxInfo{State: TxReplaced}, nil
+			}
+		}
+	}
+	return &TxInfo{State: TxUnknown}, nil
+}
+
+// PendingNonce counts the sent transactions of addr
+func (w *FakeWallet) PendingNonce(ctx context.Context, addr string) (uint64, error) {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	var next uint64
+	for _, item := range w.sent {
+		if item.From == addr && item.HasNonce && item.Nonce+1 > next {
+			next = item.Nonce + 1
+		}
+	}
+	return next, nil
 }
@@ -10,9 +10,30 @@ type BlockMessage struct {
 	To     string
 	Fee    string
 	Amount string
+	// the receipt of the transaction reports a failure
+	Reverted bool `json:",omitempty"`
+	// token contract, token ID and log index of a transfer decoded from a log
+	Contract string `json:",omitempty"`
+	TokenID  string `json:",omitempty"`
+	LogIndex int64  `json:",omitempty"`
+	// metadata of an unlisted token
+	Token *TokenInfo `json:",omitempty"`
+	// nested call of an internal transfer
+	TracePath string `json:",omitempty"`
+	// bitcoin output of a deposit
+	Vout *uint32 `json:",omitempty"`
+	// outputs spent by a bitcoin withdrawal and the change back to its address
+	Spent  []string `json:",omitempty"`
+	Change string   `json:",omitempty"`
+	// decoded memo of a deposit to a shared address
+	Memo string `json:",omitempty"`
 }
 
 func NewBlockMessage(tx types.TXN) *BlockMessage {
+	if msg, ok := tx.(*BlockMessage); ok {
+		var obj = *msg
+		return &obj
+	}
 	return &BlockMessage{
 		Hash:   tx.HexStr(),
 		From:   tx.FromStr(),
@@ -5,4 +5,24 @@ import "errors"
 var (
 	AddErr = errors.New("chainpot add error")
 	RegErr = errors.New("chainpot register error")
+
+	NotRegErr  = errors.New("chainpot chain not registered")
+	JournalErr = errors.New("chainpot storage has no event journal")
+	TrackErr   = errors.New("chainpot chain can't look transactions up")
+	StoppedErr = errors.New("chainpot chain is not running")
+
+	FilterErr = errors.New("chainpot filter MinAmount is not a decimal")
+
+	RequestErr  = errors.New("chainpot withdrawal request needs an ID, From, To and Amount")
+	WithdrawErr = errors.New("chainpot chain can't send withdrawals of the symbol")
+	DoubtErr    = errors.New("chainpot withdrawal is unknown or not in doubt")
+
+	XPubErr = errors.New("chainpot extended public key is malformed, unknown or not of the chain")
+
+	AddressErr  = errors.New("chainpot address is malformed")
+	ChecksumErr = errors.New("chainpot address checksum mismatch")
+	NetworkErr  = errors.New("chainpot address or key of another network")
+
+	InvoiceErr     = errors.New("chainpot invoice request needs an ID, Address, a Symbol of the chain, a positive Amount and Expiry")
+	InvoiceAddrErr = errors.New("chainpot invoice address is taken by another invoice")
 )
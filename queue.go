@@ -1,6 +1,10 @@
 package chainpot
 
-import "github.com/fadeAce/claws/types"
+import (
+	"github.com/fadeAce/claws/types"
+	"strconv"
+	"time"
+)
 
 const (
 	HEAD = "_head"
@@ -13,6 +17,27 @@ type Value struct {
 	EventID    int64
 	Contract   *contract
 	IsOldBlock bool
+	// when it was matched, invoices count it before their expiry
+	Seen time.Time
+	// pended after its block, its first events are still due
+	Delayed bool
+}
+
+// CorrelationID is shared by the events of the transfer, hash and index in its block,
+// followed by the token ID for the transfers of a batch log or the path of an internal transfer,
+// bitcoin deposits are indexed by their output and withdrawals by their first input followed by "in"
+func (v *Value) CorrelationID() string {
+	var id = v.TXN.HexStr() + ":" + strconv.FormatInt(v.Index, 10)
+	if msg, ok := v.TXN.(*BlockMessage); ok && msg.TokenID != "" {
+		id += ":" + msg.TokenID
+	}
+	if msg, ok := v.TXN.(*BlockMessage); ok && msg.TracePath != "" {
+		id += ":" + msg.TracePath
+	}
+	if msg, ok := v.TXN.(*BlockMessage); ok && len(msg.Spent) > 0 {
+		id += ":in"
+	}
+	return id
 }
 
 type Queue struct {
@@ -32,8 +57,11 @@ func (q *Queue) Pend(v *Value) {
 	q.data = append(q.data, v)
 }
 
-// todo: it occurs panic when no value's left
+// returns nil when no value's left
 func (q *Queue) Pop() *Value {
+	if q.Len() == 0 {
+		return nil
+	}
 	var val = q.data[0]
 	q.data = q.data[1:q.Len()]
 	return val
@@ -66,8 +94,11 @@ func (q *SafeQueue) Pend(v *Value) {
 	q.data = append(q.data, v)
 }
 
-// todo: it occurs panic when no value's left
+// returns nil when no value's left
 func (q *SafeQueue) Pop() *Value {
+	if q.Len() == 0 {
+		return nil
+	}
 	var val = q.data[0]
 	q.data = q.data[1:q.Len()]
 	return val
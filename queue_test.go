@@ -96,6 +96,7 @@ func TestSerializeInterface(t *testing.T) {
 	va2.TXN = &BlockMessage{}
 	err = json.Unmarshal(sa, va2)
 	var vb2 = new(Value)
+	vb2.TXN = &BlockMessage{}
 	err = json.Unmarshal(sb, vb2)
 
 
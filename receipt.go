@@ -0,0 +1,143 @@
+package chainpot
+
+import (
+	"context"
+	"github.com/fadeAce/claws/types"
+	"math/big"
+	"strings"
+)
+
+// Receipt is the outcome of a mined transaction
+type Receipt struct {
+	Reverted bool
+	// gas used times its price, empty when unknown
+	Fee string
+}
+
+// ReceiptReader is implemented by wallets reading the receipts of ethereum transactions,
+// the json-rpc of the chain conf is asked otherwise. nil is returned for an unknown receipt
+type ReceiptReader interface {
+	Receipt(ctx context.Context, hash string) (*Receipt, error)
+}
+
+// failed reads of a receipt before its transaction is queued unchecked
+const maxReceiptAttempts = 5
+
+// a matched transaction waiting for its receipt
+type unreceipted struct {
+	node               *Value
+	outgoing, incoming bool
+	attempts           int
+}
+
+// receipt of a matched transaction, nil when it can't be told
+func (c *chain) receipt(ctx context.Context, cont *contract, tx types.TXN) (*Receipt, error) {
+	if c.name != "eth" {
+		return nil, nil
+	}
+	reader, ok := optional[ReceiptReader](cont.wallet)
+	if !ok {
+		if reader, ok = optional[ReceiptReader](c.lookup); !ok {
+			return nil, nil
+		}
+	}
+	res, err := reader.Receipt(ctx, tx.HexStr())
+	if err != nil {
+		c.health.fail(err)
+		c.logger.Error().Msgf("receipt of %s error: %s", tx.HexStr(), err.Error())
+		return nil, err
+	}
+	return res, nil
+}
+
+// queue node once its receipt is read, a transaction whose receipt can't be read
+// is never credited but waits for the next block
+func (c *chain) checked(ctx context.Context, node *Value, outgoing, incoming bool) {
+	c.check(ctx, &unreceipted{node: node, outgoing: outgoing, incoming: incoming})
+}
+
+// past maxReceiptAttempts the transaction is queued as if the chain read no receipts
+func (c *chain) check(ctx context.Context, item *unreceipted) {
+	var node = item.node
+	receipt, err := c.receipt(ctx, node.Contract, node.TXN)
+	if err != nil {
+		item.attempts++
+		if item.attempts < maxReceiptAttempts {
+			c.unreceipted = append(c.unreceipted, item)
+			return
+		}
+		c.logger.Error().Msgf("receipt of %s unread after %d attempts, queued without it", node.TXN.HexStr(), item.attempts)
+	}
+	if receipt != nil && receipt.Reverted {
+		c.reverted(node.Contract, node.TXN, node.Height, receipt, item.outgoing, item.incoming)
+		return
+	}
+	node.EventID = c.eventID
+	c.pend(node, item.outgoing, item.incoming)
+}
+
+// read the receipts that failed on the previous blocks again
+func (c *chain) retryReceipts() {
+	var list = c.unreceipted
+	c.unreceipted = nil
+	for _, item := range list {
+		// the events of the blocks it missed are caught up
+		item.node.Delayed = !item.node.IsOldBlock
+		c.check(c.ctx, item)
+	}
+}
+
+// report a reverted transaction at once, it's never credited: the watched sender
+// gets T_WITHDRAW_FAIL for the burned gas and the watched receiver T_DEPOSIT_FAIL
+func (c *chain) reverted(cont *contract, tx types.TXN, height int64, receipt *Receipt, outgoing, incoming bool) {
+	c.logger.Warn().Msgf("transaction %s reverted at %d", tx.HexStr(), height)
+	var events = make([]EventType, 0)
+	if outgoing {
+		events = append(events, T_WITHDRAW_FAIL)
+	}
+	if incoming && tx.FromStr() != tx.ToStr() {
+		events = append(events, T_DEPOSIT_FAIL)
+	}
+	for _, e := range events {
+		var content = NewBlockMessage(tx)
+		content.Reverted = true
+		if receipt.Fee != "" {
+			content.Fee = receipt.Fee
+		}
+		if c.eventID == 0 {
+			c.eventID++
+		}
+		c.messageQueue <- &PotEvent{
+			Symbol:   cont.Symbol,
+			Chain:    cont.Chain,
+			CoinType: cont.CoinType,
+			Event:    e,
+			ID:       c.eventID,
+			Height:   height,
+			Content:  content,
+			Reason:   "reverted",
+		}
+		c.eventID++
+	}
+}
+
+func (c *ethLookup) Receipt(ctx context.Context, hash string) (*Receipt, error) {
+	var receipt *struct {
+		Status            string
+		GasUsed           string
+		EffectiveGasPrice string
+	}
+	if err := c.rpc.call(ctx, "eth_getTransactionReceipt", &receipt, hash); err != nil {
+		return nil, err
+	}
+	if receipt == nil {
+		return nil, nil
+	}
+	var res = &Receipt{Reverted: receipt.Status == "0x0"}
+	if gas, ok := new(big.Int).SetString(strings.TrimPrefix(receipt.GasUsed, "0x"), 16); ok {
+		if price, ok := new(big.Int).SetString(strings.TrimPrefix(receipt.EffectiveGasPrice, "0x"), 16); ok {
+			res.Fee = new(big.Int).Mul(gas, price).String()
+		}
+	}
+	return res, nil
+}
@@ -0,0 +1,112 @@
+package chainpot
+
+import (
+	"context"
+	"github.com/fadeAce/chainpot/chainsim"
+	"github.com/fadeAce/claws"
+	"math/big"
+	"net/http/httptest"
+	"os"
+	"testing"
+)
+
+func TestChainpot_Reverted(t *testing.T) {
+	var dir = tempDir(t)
+	defer os.RemoveAll(dir)
+	var fake = NewFakeChain(100)
+	var cp = NewChainpot(&ChainConf{
+		Coins:    []Coins{{CoinType: "origin", Chain: "eth", Symbol: "eth"}},
+		Eth:      &EthConf{ConfirmTimes: 2, Storage: boltStorage(t, dir, "eth")},
+		Builders: map[string]claws.WalletBuilder{"eth": fake},
+	})
+	if err := cp.Register(Ethereum); err != nil {
+		t.Fatal(err)
+	}
+	cp.Add(Ethereum, []string{simFrom})
+	var ch = startPot(t, cp, fake)
+
+	// reverted transactions fail at once and are never credited
+	fake.FailTx("0xr1")
+	fake.FailTx("0xr2")
+	fake.Mine(
+		BlockMessage{Hash: "0xr1", From: simTo, To: simFrom, Amount: "5"},
+		BlockMessage{Hash: "0xr2", From: simFrom, To: simTo, Amount: "5"},
+		BlockMessage{Hash: "0xd1", From: simTo, To: simFrom, Amount: "5"},
+	)
+	fake.Mine()
+	expectEvents(t, ch,
+		expected{T_DEPOSIT_FAIL, 1, "0xr1"},
+		expected{T_WITHDRAW_FAIL, 2, "0xr2"},
+		expected{T_DEPOSIT, 3, "0xd1"},
+	)
+	fake.Mine()
+	expectEvents(t, ch, expected{T_DEPOSIT_CONFIRM, 4, "0xd1"})
+	expectNone(t, ch)
+	stopPot(t, cp)
+}
+
+func TestChainpot_ReceiptRetry(t *testing.T) {
+	var dir = tempDir(t)
+	defer os.RemoveAll(dir)
+	var fake = NewFakeChain(100)
+	var cp = NewChainpot(&ChainConf{
+		Coins:    []Coins{{CoinType: "origin", Chain: "eth", Symbol: "eth"}},
+		Eth:      &EthConf{ConfirmTimes: 2, Storage: boltStorage(t, dir, "eth")},
+		Builders: map[string]claws.WalletBuilder{"eth": fake},
+	})
+	if err := cp.Register(Ethereum); err != nil {
+		t.Fatal(err)
+	}
+	cp.Add(Ethereum, []string{simFrom})
+	var ch = startPot(t, cp, fake)
+
+	// nothing is credited before the receipt is read, the missed events come on the next block
+	fake.FailReceipts(1)
+	fake.Mine(BlockMessage{Hash: "0xd1", From: simTo, To: simFrom, Amount: "5"})
+	fake.Mine()
+	expectNone(t, ch)
+	fake.Mine()
+	expectEvents(t, ch, expected{T_DEPOSIT, 1, "0xd1"}, expected{T_DEPOSIT_CONFIRM, 2, "0xd1"})
+
+	fake.FailReceipts(1)
+	fake.FailTx("0xr1")
+	fake.Mine(BlockMessage{Hash: "0xr1", From: simTo, To: simFrom, Amount: "5"})
+	fake.Mine()
+	expectNone(t, ch)
+	fake.Mine()
+	expectEvents(t, ch, expected{T_DEPOSIT_FAIL, 3, "0xr1"})
+	expectNone(t, ch)
+
+	// a receipt failing maxReceiptAttempts times is given up, the transaction is credited unchecked
+	fake.FailReceipts(maxReceiptAttempts)
+	fake.Mine(BlockMessage{Hash: "0xd2", From: simTo, To: simFrom, Amount: "5"})
+	for i := 0; i < maxReceiptAttempts; i++ {
+		expectNone(t, ch)
+		fake.Mine()
+	}
+	expectEvents(t, ch, expected{T_DEPOSIT, 4, "0xd2"}, expected{T_DEPOSIT_CONFIRM, 5, "0xd2"})
+	expectNone(t, ch)
+	stopPot(t, cp)
+}
+
+func TestEthLookup_Receipt(t *testing.T) {
+	var sim = chainsim.New(100)
+	var server = httptest.NewServer(chainsim.NewEthServer(sim))
+	defer server.Close()
+	var lookup = newEthLookup(server.URL)
+
+	var ok = sim.Submit(chainsim.Pay(simFrom, simTo, big.NewInt(5)))
+	var failed = chainsim.Pay(simFrom, simTo, big.NewInt(5))
+	failed.Status = 0
+	sim.Submit(failed)
+	if res, err := lookup.Receipt(context.Background(), ok.Hash); err != nil || res != nil {
+		t.Fatalf("unexpected receipt of a pending transaction %v %v", res, err)
+	}
+	sim.Mine()
+	if res, err := lookup.Receipt(context.Background(), ok.Hash); err != nil || res.Reverted {
+		t.Fatalf("unexpected receipt %v %v", res, err)
+	}
+	if res, err := lookup.Receipt(context.Background(), failed.Hash); err != nil || !res.Reverted {
+		t.Fatalf("unexpected receipt %v %v", res, err)
+	}
+}
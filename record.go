@@ -0,0 +1,278 @@
+package chainpot
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"github.com/fadeAce/claws"
+	"github.com/fadeAce/claws/types"
+	"io"
+	"math/big"
+	"sync"
+	"time"
+)
+
+var ErrNotRecorded = errors.New("chainpot: response not recorded")
+
+// one line of a recording
+type recordLine struct {
+	Symbol string          `json:"symbol"`
+	Kind   string          `json:"kind"`
+	Time   int64           `json:"time"`
+	Height int64           `json:"height,omitempty"`
+	Hash   string          `json:"hash,omitempty"`
+	Txs    []*BlockMessage `json:"txs,omitempty"`
+	Found  bool            `json:"found,omitempty"`
+	Error  string          `json:"error,omitempty"`
+}
+
+const (
+	recordHead   = "head"
+	recordUnfold = "unfold"
+	recordSeek   = "seek"
+)
+
+// Recorder writes the head notifications, UnfoldTxs and Seek responses
+// of the wrapped wallets as json lines, set ChainConf.Record to record a chainpot
+type Recorder struct {
+	mu  sync.Mutex
+	enc *json.Encoder
+}
+
+func NewRecorder(w io.Writer) *Recorder {
+	return &Recorder{enc: json.NewEncoder(w)}
+}
+
+func (r *Recorder) write(line *recordLine) {
+	line.Time = time.Now().UnixNano()
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.enc.Encode(line)
+}
+
+// Wrap returns wallet recording its traffic under symbol
+func (r *Recorder) Wrap(symbol string, wallet claws.Wallet) claws.Wallet {
+	return &recordingWallet{Wallet: wallet, symbol: symbol, recorder: r}
+}
+
+type recordingWallet struct {
+	claws.Wallet
+	symbol   string
+	recorder *Recorder
+}
+
+func (c *recordingWallet) NotifyHead(ctx context.Context, f func(num *big.Int)) error {
+	return c.Wallet.NotifyHead(ctx, func(num *big.Int) {
+		c.recorder.write(&recordLine{Symbol: c.symbol, Kind: recordHead, Height: num.Int64()})
+		f(num)
+	})
+}
+
+func (c *recordingWallet) UnfoldTxs(ctx context.Context, num *big.Int) ([]types.TXN, error) {
+	txns, err := c.Wallet.UnfoldTxs(ctx, num)
+	var line = &recordLine{Symbol: c.symbol, Kind: recordUnfold, Height: num.Int64(), Txs: make([]*BlockMessage, 0)}
+	if err != nil {
+		line.Error = err.Error()
+	}
+	for _, tx := range txns {
+		line.Txs = append(line.Txs, NewBlockMessage(tx))
+	}
+	c.recorder.write(line)
+	return txns, err
+}
+
+func (c *recordingWallet) unwrap() interface{} {
+	return c.Wallet
+}
+
+func (c *recordingWallet) BlockHash(ctx context.Context, num *big.Int) (string, error) {
+	return forward(c.Wallet, func(obj BlockHasher) (string, error) { return obj.BlockHash(ctx, num) })
+}
+
+func (c *recordingWallet) Reconnect(ctx context.Context) error {
+	if obj, ok := optional[Reconnector](c.Wallet); ok {
+		return obj.Reconnect(ctx)
+	}
+	return errUnsupported
+}
+
+func (c *recordingWallet) SendTx(ctx context.Context, tx *OutTx) (string, error) {
+	return forward(c.Wallet, func(obj Sender) (string, error) { return obj.SendTx(ctx, tx) })
+}
+
+func (c *recordingWallet) ReplaceTx(ctx context.Context, tx *OutTx) (string, error) {
+	return forward(c.Wallet, func(obj Replacer) (string, error) { return obj.ReplaceTx(ctx, tx) })
+}
+
+func (c *recordingWallet) Rebroadcast(ctx context.Context, hash string) error {
+	if obj, ok := optional[Rebroadcaster](c.Wallet); ok {
+		return obj.Rebroadcast(ctx, hash)
+	}
+	return errUnsupported
+}
+
+func (c *recordingWallet) LookupTx(ctx context.Context, hash string) (*TxInfo, error) {
+	return forward(c.Wallet, func(obj TxLookup) (*TxInfo, error) { return obj.LookupTx(ctx, hash) })
+}
+
+func (c *recordingWallet) Receipt(ctx context.Context, hash string) (*Receipt, error) {
+	return forward(c.Wallet, func(obj ReceiptReader) (*Receipt, error) { return obj.Receipt(ctx, hash) })
+}
+
+func (c *recordingWallet) UTXOTxs(ctx context.Context, num *big.Int) ([]*UTXOTx, error) {
+	return forward(c.Wallet, func(obj UTXOReader) ([]*UTXOTx, error) { return obj.UTXOTxs(ctx, num) })
+}
+
+func (c *recordingWallet) Calldata(ctx context.Context, hash string) (string, error) {
+	return forward(c.Wallet, func(obj CalldataReader) (string, error) { return obj.Calldata(ctx, hash) })
+}
+
+func (c *recordingWallet) PendingNonce(ctx context.Context, addr string) (uint64, error) {
+	return forward(c.Wallet, func(obj NonceSource) (uint64, error) { return obj.PendingNonce(ctx, addr) })
+}
+
+func (c *recordingWallet) GasPrice(ctx context.Context) (*big.Int, error) {
+	return forward(c.Wallet, func(obj GasPricer) (*big.Int, error) { return obj.GasPrice(ctx) })
+}
+
+func (c *recordingWallet) Logs(ctx context.Context, num *big.Int, addrs []string) ([]*Log, error) {
+	return forward(c.Wallet, func(obj LogReader) ([]*Log, error) { return obj.Logs(ctx, num, addrs) })
+}
+
+func (c *recordingWallet) TokenInfo(ctx context.Context, contract string) (*TokenInfo, error) {
+	return forward(c.Wallet, func(obj TokenInfoReader) (*TokenInfo, error) { return obj.TokenInfo(ctx, contract) })
+}
+
+func (c *recordingWallet) InternalTransfers(ctx context.Context, num *big.Int) ([]*InternalTransfer, error) {
+	return forward(c.Wallet, func(obj TraceReader) ([]*InternalTransfer, error) { return obj.InternalTransfers(ctx, num) })
+}
+
+func (c *recordingWallet) MinedAt(ctx context.Context, num *big.Int) (time.Time, error) {
+	return forward(c.Wallet, func(obj BlockTimer) (time.Time, error) { return obj.MinedAt(ctx, num) })
+}
+
+func (c *recordingWallet) Seek(txn types.TXN) bool {
+	var found = c.Wallet.Seek(txn)
+	c.recorder.write(&recordLine{Symbol: c.symbol, Kind: recordSeek, Hash: txn.HexStr(), Found: found})
+	return found
+}
+
+// Replayer feeds a recording back deterministically, its builders
+// are meant for ChainConf.Builders in place of the recorded wallets
+type Replayer struct {
+	wallets map[string]*ReplayWallet
+}
+
+// ReplayWallet answers from a recording, the calls that were not recorded
+// behave like a FakeChain
+type ReplayWallet struct {
+	*FakeChain
+	mu      sync.Mutex
+	heads   []int64
+	unfolds map[int64][]*recordLine
+	seeks   map[string][]bool
+}
+
+func NewReplayer(r io.Reader) (*Replayer, error) {
+	var obj = &Replayer{wallets: make(map[string]*ReplayWallet)}
+	var dec = json.NewDecoder(r)
+	for {
+		var line = &recordLine{}
+		if err := dec.Decode(line); err == io.EOF {
+			break
+		} else if err != nil {
+			return nil, err
+		}
+
+		wallet, ok := obj.wallets[line.Symbol]
+		if !ok {
+			wallet = &ReplayWallet{
+				FakeChain: NewFakeChain(0),
+				unfolds:   make(map[int64][]*recordLine),
+				seeks:     make(map[string][]bool),
+			}
+			obj.wallets[line.Symbol] = wallet
+		}
+		switch line.Kind {
+		case recordHead:
+			wallet.heads = append(wallet.heads, line.Height)
+		case recordUnfold:
+			wallet.unfolds[line.Height] = append(wallet.unfolds[line.Height], line)
+		case recordSeek:
+			wallet.seeks[line.Hash] = append(wallet.seeks[line.Hash], line.Found)
+		}
+	}
+	return obj, nil
+}
+
+// Builders returns a wallet builder per recorded symbol
+func (r *Replayer) Builders() map[string]claws.WalletBuilder {
+	var res = make(map[string]claws.WalletBuilder)
+	for symbol, wallet := range r.wallets {
+		res[symbol] = wallet
+	}
+	return res
+}
+
+// Wallet returns the replay wallet of symbol or nil
+func (r *Replayer) Wallet(symbol string) *ReplayWallet {
+	return r.wallets[symbol]
+}
+
+func (c *ReplayWallet) Build() claws.Wallet {
+	return c
+}
+
+// NotifyHead feeds the recorded heads in order
+func (c *ReplayWallet) NotifyHead(ctx context.Context, f func(num *big.Int)) error {
+	go func() {
+		for _, height := range c.heads {
+			if ctx.Err() != nil {
+				return
+			}
+			f(big.NewInt(height))
+		}
+	}()
+	return nil
+}
+
+// UnfoldTxs answers the calls of a height in the order they were recorded
+func (c *ReplayWallet) UnfoldTxs(ctx context.Context, num *big.Int) ([]types.TXN, error) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	var height = num.Int64()
+	var lines = c.unfolds[height]
+	if len(lines) == 0 {
+		return nil, ErrNotRecorded
+	}
+	var line = lines[0]
+	if len(lines) > 1 {
+		c.unfolds[height] = lines[1:]
+	}
+
+	if line.Error != "" {
+		return nil, errors.New(line.Error)
+	}
+	var txns = make([]types.TXN, 0)
+	for _, tx := range line.Txs {
+		var cp = *tx
+		txns = append(txns, &cp)
+	}
+	return txns, nil
+}
+
+// Seek answers the calls of a transaction in the order they were recorded
+func (c *ReplayWallet) Seek(txn types.TXN) bool {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	var list = c.seeks[txn.HexStr()]
+	if len(list) == 0 {
+		return false
+	}
+	if len(list) > 1 {
+		c.seeks[txn.HexStr()] = list[1:]
+	}
+	return list[0]
+}
@@ -0,0 +1,88 @@
+package chainpot
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"sync/atomic"
+	"time"
+)
+
+// json-rpc error returned by a node
+type rpcError struct {
+	Code    int    `json:"code"`
+	Message string `json:"message"`
+}
+
+func (e *rpcError) Error() string {
+	return fmt.Sprintf("rpc error %d: %s", e.Code, e.Message)
+}
+
+// minimal json-rpc client of the nodes, used for the calls claws doesn't expose
+type rpcClient struct {
+	url      string
+	user     string
+	password string
+	version  string
+	client   *http.Client
+	seq      int64
+}
+
+func newRPCClient(url, user, password, version string) *rpcClient {
+	return &rpcClient{
+		url:      url,
+		user:     user,
+		password: password,
+		version:  version,
+		client:   &http.Client{Timeout: 30 * time.Second},
+	}
+}
+
+// call method and decode its result into result, a null result leaves it untouched
+func (c *rpcClient) call(ctx context.Context, method string, result interface{}, params ...interface{}) error {
+	if params == nil {
+		params = make([]interface{}, 0)
+	}
+	bs, err := json.Marshal(map[string]interface{}{
+		"jsonrpc": c.version,
+		"id":      atomic.AddInt64(&c.seq, 1),
+		"method":  method,
+		"params":  params,
+	})
+	if err != nil {
+		return err
+	}
+
+	req, err := http.NewRequest(http.MethodPost, c.url, bytes.NewReader(bs))
+	if err != nil {
+		return err
+	}
+	req = req.WithContext(ctx)
+	req.Header.Set("Content-Type", "application/json")
+	if c.user != "" || c.password != "" {
+		req.SetBasicAuth(c.user, c.password)
+	}
+
+	res, err := c.client.Do(req)
+	if err != nil {
+		return err
+	}
+	defer res.Body.Close()
+
+	var body struct {
+		Result json.RawMessage `json:"result"`
+		Error  *rpcError       `json:"error"`
+	}
+	if err := json.NewDecoder(res.Body).Decode(&body); err != nil {
+		return fmt.Errorf("%s: %s", method, res.Status)
+	}
+	if body.Error != nil {
+		return body.Error
+	}
+	if result == nil || len(body.Result) == 0 || string(body.Result) == "null" {
+		return nil
+	}
+	return json.Unmarshal(body.Result, result)
+}
@@ -0,0 +1,20 @@
+package chainpot
+
+// StopReport describes the state chainpot was left in by Stop
+type StopReport struct {
+	Chains map[PublicChain]*ChainReport
+}
+
+type ChainReport struct {
+	// height saved as endpoint, the next start syncs from there
+	EndPoint int64
+	EventID  int64
+	// transactions waiting for confirmations, they're synced again from the endpoint
+	Pending int
+	// events not handed to the handlers before the deadline,
+	// the ones still in the chain queue are journaled when supported
+	Undelivered []*PotEvent
+	// the chain routines exited before the deadline, the fields above are
+	// left empty otherwise as the chain is still writing them
+	Drained bool
+}
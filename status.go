@@ -0,0 +1,127 @@
+package chainpot
+
+import (
+	"encoding/json"
+	"net/http"
+	"sync"
+	"time"
+)
+
+// ChainStatus is a snapshot of a registered chain
+type ChainStatus struct {
+	Running         bool
+	LastHead        time.Time
+	NodeHeight      int64
+	ProcessedHeight int64
+	// last height saved as endpoint
+	EndPoint int64
+	// transactions waiting for confirmations
+	Pending   int
+	Addrs     int
+	LastError string
+	// no head for longer than StallAfter
+	Stalled bool
+	// processed height trails the node by more than MaxLag, or nothing is processed yet
+	CatchingUp bool
+	// nodes of the chain when it has several endpoints
+	Endpoints []*EndpointStatus
+}
+
+// health of a chain, written by the chain routines and read by Status
+type health struct {
+	sync.Mutex
+	running    bool
+	started    time.Time
+	lastHead   time.Time
+	nodeHeight int64
+	processed  int64
+	endpoint   int64
+	pending    int
+	lastErr    string
+	stalled    bool
+	// last time the watchdog reconnected
+	reconnected time.Time
+	stallAfter  time.Duration
+	maxLag      int64
+}
+
+func (h *health) fail(err error) {
+	h.Lock()
+	defer h.Unlock()
+	h.lastErr = err.Error()
+}
+
+func (c *chain) status(now time.Time) *ChainStatus {
+	c.Lock()
+	var addrs = len(c.addrs)
+	c.Unlock()
+
+	var h = c.health
+	h.Lock()
+	defer h.Unlock()
+	var obj = &ChainStatus{
+		Running:         h.running,
+		LastHead:        h.lastHead,
+		NodeHeight:      h.nodeHeight,
+		ProcessedHeight: h.processed,
+		EndPoint:        h.endpoint,
+		Pending:         h.pending,
+		Addrs:           addrs,
+		LastError:       h.lastErr,
+	}
+	if wallet, ok := c.origin.wallet.(*failoverWallet); ok {
+		obj.Endpoints = wallet.status()
+	}
+
+	var since = h.lastHead
+	if since.IsZero() {
+		since = h.started
+	}
+	obj.Stalled = h.running && h.stallAfter > 0 && now.Sub(since) > h.stallAfter
+	obj.CatchingUp = h.processed == 0 || h.nodeHeight-h.processed > h.maxLag
+	return obj
+}
+
+// Status reports every registered chain
+func (c *Chainpot) Status() map[PublicChain]*ChainStatus {
+	var now = c.now()
+	var res = make(map[PublicChain]*ChainStatus)
+	for i, item := range c.allChains() {
+		if item != nil {
+			res[PublicChain(i)] = item.status(now)
+		}
+	}
+	return res
+}
+
+// HealthHandler answers 503 when a chain is not running or stalled
+func (c *Chainpot) HealthHandler() http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		writeStatus(w, c.Status(), func(obj *ChainStatus) bool {
+			return obj.Running && !obj.Stalled
+		})
+	})
+}
+
+// ReadyHandler answers 503 when a chain is unhealthy or still catching up
+func (c *Chainpot) ReadyHandler() http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		writeStatus(w, c.Status(), func(obj *ChainStatus) bool {
+			return obj.Running && !obj.Stalled && !obj.CatchingUp
+		})
+	})
+}
+
+func writeStatus(w http.ResponseWriter, status map[PublicChain]*ChainStatus, ok func(obj *ChainStatus) bool) {
+	var code = http.StatusOK
+	var body = make(map[string]*ChainStatus)
+	for chain, obj := range status {
+		if !ok(obj) {
+			code = http.StatusServiceUnavailable
+		}
+		body[chain.String()] = obj
+	}
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(code)
+	json.NewEncoder(w).Encode(body)
+}
@@ -0,0 +1,79 @@
+package chainpot
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"testing"
+	"time"
+)
+
+func probe(h http.Handler) int {
+	var rec = httptest.NewRecorder()
+	h.ServeHTTP(rec, httptest.NewRequest("GET", "/", nil))
+	return rec.Code
+}
+
+func TestChainpot_Status(t *testing.T) {
+	var dir = tempDir(t)
+	defer os.RemoveAll(dir)
+	var fake = NewFakeChain(100)
+	var cp = newTestPot(t, dir, fake, 2)
+	cp.chains[int(Bitcoin)].health.stallAfter = 300 * time.Millisecond
+	cp.Add(Bitcoin, []string{testAddr})
+
+	if probe(cp.HealthHandler()) != http.StatusServiceUnavailable {
+		t.Fatal("chain not started is reported healthy")
+	}
+
+	var ch = startPot(t, cp, fake)
+	fake.Mine(BlockMessage{Hash: "s1", From: testOther, To: testAddr})
+	expectEvents(t, ch, expected{T_DEPOSIT, 1, "s1"})
+
+	var obj = cp.Status()[Bitcoin]
+	if !obj.Running || obj.NodeHeight != 101 || obj.ProcessedHeight != 101 || obj.EndPoint != 101 ||
+		obj.Pending != 1 || obj.Addrs != 1 || obj.LastHead.IsZero() || obj.Stalled || obj.CatchingUp {
+		t.Fatalf("unexpected status %+v", obj)
+	}
+	if probe(cp.HealthHandler()) != http.StatusOK || probe(cp.ReadyHandler()) != http.StatusOK {
+		t.Fatal("synced chain is not ready")
+	}
+
+	expectEvents(t, ch, expected{Event: T_STALL})
+	if !cp.Status()[Bitcoin].Stalled || probe(cp.HealthHandler()) != http.StatusServiceUnavailable {
+		t.Fatal("stall is not reported")
+	}
+	fake.Mine()
+	expectEvents(t, ch, expected{Event: T_RECOVER}, expected{T_DEPOSIT_CONFIRM, 2, "s1"})
+	if cp.Status()[Bitcoin].Stalled {
+		t.Fatal("stall is reported after a new head")
+	}
+
+	fake.FailUnfold(103, 1)
+	fake.Mine()
+	time.Sleep(50 * time.Millisecond)
+	if cp.Status()[Bitcoin].LastError != ErrFakeRPC.Error() {
+		t.Fatalf("unexpected last error %q", cp.Status()[Bitcoin].LastError)
+	}
+
+	stopPot(t, cp)
+	if cp.Status()[Bitcoin].Running {
+		t.Fatal("stopped chain is reported running")
+	}
+}
+
+func TestChainpot_Ready(t *testing.T) {
+	var dir = tempDir(t)
+	defer os.RemoveAll(dir)
+	var fake = NewFakeChain(100)
+	var cp = newTestPot(t, dir, fake, 2)
+	startPot(t, cp, fake)
+	defer stopPot(t, cp)
+
+	if !cp.Status()[Bitcoin].CatchingUp || probe(cp.ReadyHandler()) != http.StatusServiceUnavailable {
+		t.Fatal("chain without any processed block is ready")
+	}
+	if probe(cp.HealthHandler()) != http.StatusOK {
+		t.Fatal("running chain is not healthy")
+	}
+}
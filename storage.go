@@ -4,10 +4,10 @@ import (
 	"encoding/json"
 	"fmt"
 	"github.com/boltdb/bolt"
-	"github.com/rs/zerolog/log"
 	"path/filepath"
 	"strconv"
 	"strings"
+	"time"
 )
 
 type ConfigCache struct {
@@ -25,41 +25,52 @@ type Storage interface {
 type BoltStorage struct {
 	Chain    string
 	Database *bolt.DB
+	// time of the journal records, time.Now when nil
+	Clock func() time.Time
 }
 
-func NewBoltStorage(dbPath string, chain string) Storage {
-	var obj = &BoltStorage{
-		Chain: strings.ToLower(chain),
-	}
+// NewBoltStorage opens the bolt database of chain in dbPath with the buckets of every store
+func NewBoltStorage(dbPath string, chain string) (Storage, error) {
 	absPath, err := filepath.Abs(dbPath)
 	if err != nil {
-		panic("db_path error")
+		return nil, err
 	}
-
 	var filename = fmt.Sprintf("%s/%s.db", absPath, chain)
-	if db, err := bolt.Open(filename, 0755, nil); err == nil {
-		obj.Database = db
-	} else {
-		log.Fatal().Msgf("Open DB Error: %s", err.Error())
+	db, err := bolt.Open(filename, 0755, nil)
+	if err != nil {
+		return nil, err
 	}
-
-	if err := obj.Database.Update(func(tx *bolt.Tx) error {
-		_, err := tx.CreateBucketIfNotExists([]byte("config"))
-		return err
-	}); err != nil {
-		log.Fatal().Msgf("Create Bucket Error: %s", err.Error())
+	var obj = &BoltStorage{
+		Chain:    strings.ToLower(chain),
+		Database: db,
 	}
 
-	if err := obj.Database.Update(func(tx *bolt.Tx) error {
-		if _, err := tx.CreateBucketIfNotExists([]byte("addrs")); err != nil {
-			return err
+	var create = []func() error{
+		obj.createConfig,
+		obj.createJournal,
+		obj.createWithdrawals,
+		obj.createUTXOs,
+		obj.createXPubs,
+		obj.createMemos,
+		obj.createInvoices,
+	}
+	for _, fn := range create {
+		if err := fn(); err != nil {
+			db.Close()
+			return nil, err
 		}
-		return nil
-	}); err != nil {
-		log.Fatal().Msgf("Create Bucket Error: %s", err.Error())
 	}
+	return obj, nil
+}
 
-	return obj
+func (c *BoltStorage) createConfig() error {
+	return c.Database.Update(func(tx *bolt.Tx) error {
+		if _, err := tx.CreateBucketIfNotExists([]byte("config")); err != nil {
+			return err
+		}
+		_, err := tx.CreateBucketIfNotExists([]byte("addrs"))
+		return err
+	})
 }
 
 func (c *BoltStorage) GetConfig() (cfg *ConfigCache, addrs map[string]int64) {
@@ -84,73 +95,51 @@ func (c *BoltStorage) GetConfig() (cfg *ConfigCache, addrs map[string]int64) {
 }
 
 func (c *BoltStorage) SaveConfig(cfg *ConfigCache, addrs map[string]int64) error {
-	bs, _ := json.Marshal(cfg)
-	err1 := c.Database.Update(func(tx *bolt.Tx) error {
-		bucket := tx.Bucket([]byte("config"))
-		err := bucket.Put([]byte(c.Chain), bs)
-		if err != nil {
-			log.Error().Msg(err.Error())
-		}
+	bs, err := json.Marshal(cfg)
+	if err != nil {
 		return err
-	})
-	if err1 != nil {
-		log.Error().Msgf(err1.Error())
 	}
-
-	err2 := c.Database.Update(func(tx *bolt.Tx) error {
-		bucketName := []byte(fmt.Sprintf("%s_addrs", strings.ToLower(c.Chain)))
-		bucket := tx.Bucket(bucketName)
-		var hasError error
-		for key, val := range addrs {
-			h := strconv.Itoa(int(val))
-			err := bucket.Put([]byte(key), []byte(h))
-			if err != nil {
-				hasError = err
-				log.Error().Msgf("BoltDB Put Error: %s", err.Error())
-			}
-		}
-		return hasError
+	err = c.Database.Update(func(tx *bolt.Tx) error {
+		return tx.Bucket([]byte("config")).Put([]byte(c.Chain), bs)
 	})
-	if err2 != nil {
-		log.Error().Msgf(err2.Error())
+	if err != nil {
+		return err
 	}
-	return nil
+	return c.SaveAddrs(addrs)
 }
 
 func (c *BoltStorage) SaveAddrs(records map[string]int64) error {
-	err := c.Database.Update(func(tx *bolt.Tx) error {
+	return c.Database.Update(func(tx *bolt.Tx) error {
 		bucket := tx.Bucket([]byte("addrs"))
-		var hasError error
 		for addr, height := range records {
 			h := strconv.Itoa(int(height))
-			err := bucket.Put([]byte(addr), []byte(h))
-			if err != nil {
-				hasError = err
-				log.Error().Msgf("BoltDB Put Error: %s", err.Error())
+			if err := bucket.Put([]byte(addr), []byte(h)); err != nil {
+				return err
 			}
 		}
-		return hasError
+		return nil
 	})
-	if err != nil {
-		log.Error().Msgf(err.Error())
-	}
-	return err
 }
 
-func (c *BoltStorage) ClearConfig() error {
-	err := c.Database.Update(func(tx *bolt.Tx) error {
-		bucket := tx.Bucket([]byte("config"))
-		return bucket.Delete([]byte(c.Chain))
-	})
-	if err != nil {
-		return err
-	}
+func (c *BoltStorage) Close() error {
+	return c.Database.Close()
+}
 
-	err = c.Database.Update(func(tx *bolt.Tx) error {
-		bucketName := []byte("addrs")
-		err := tx.DeleteBucket(bucketName)
-		tx.CreateBucketIfNotExists(bucketName)
-		return err
+// ClearConfig forgets the chain: its endpoint, watched addresses, withdrawals, outputs,
+// extended keys, memos and invoices. the event journal is kept
+func (c *BoltStorage) ClearConfig() error {
+	return c.Database.Update(func(tx *bolt.Tx) error {
+		if err := tx.Bucket([]byte("config")).Delete([]byte(c.Chain)); err != nil {
+			return err
+		}
+		for _, name := range [][]byte{[]byte("addrs"), withdrawalsBucket, utxosBucket, xpubsBucket, memosBucket, invoicesBucket} {
+			if err := tx.DeleteBucket(name); err != nil && err != bolt.ErrBucketNotFound {
+				return err
+			}
+			if _, err := tx.CreateBucket(name); err != nil {
+				return err
+			}
+		}
+		return nil
 	})
-	return err
 }
@@ -0,0 +1,160 @@
+package chainpot
+
+import (
+	"context"
+	"sync"
+)
+
+type replayKey struct {
+	chain PublicChain
+	id    int64
+	event EventType
+}
+
+// channel based delivery of a subscription
+type stream struct {
+	sub     *Subscription
+	matcher *matcher
+	out     chan *PotEvent
+	quit    chan struct{}
+	once    sync.Once
+}
+
+// Events streams the events passing filter until ctx is done or chainpot
+// is stopped or reset, the channel is closed afterwards. it's closed at once
+// when the filter is invalid
+func (c *Chainpot) Events(ctx context.Context, filter *Filter) <-chan *PotEvent {
+	return c.EventsFrom(ctx, filter, nil)
+}
+
+// EventsFrom is like Events but first replays the journaled events of each chain of from
+// with an ID greater than its cursor, event IDs are numbered per chain. chains missing
+// from it or whose storage doesn't implement EventJournal aren't replayed
+func (c *Chainpot) EventsFrom(ctx context.Context, filter *Filter, from map[PublicChain]int64) <-chan *PotEvent {
+	m, err := filter.compile()
+	if err != nil {
+		c.logger.Error().Msgf("stream filter error: %s", err.Error())
+		var out = make(chan *PotEvent)
+		close(out)
+		return out
+	}
+	var s = &stream{
+		matcher: m,
+		out:     make(chan *PotEvent),
+		quit:    make(chan struct{}),
+	}
+
+	var ready = make(chan struct{})
+	var replayed = make(map[replayKey]bool)
+	s.sub, _ = c.Subscribe(filter, func(chain PublicChain, event *PotEvent) {
+		select {
+		case <-ready:
+		case <-s.quit:
+			return
+		}
+		if event.ID > 0 && replayed[replayKey{chain: chain, id: event.ID, event: event.Event}] {
+			return
+		}
+		select {
+		case s.out <- event:
+		case <-s.quit:
+		}
+	})
+
+	c.streamsMu.Lock()
+	c.streams[s.sub.id] = s
+	c.streamsMu.Unlock()
+
+	go func() {
+		if len(from) > 0 {
+		replay:
+			for chain, events := range c.journaled(s.matcher, from) {
+				for _, event := range events {
+					replayed[replayKey{chain: chain, id: event.ID, event: event.Event}] = true
+					select {
+					case s.out <- event:
+					case <-s.quit:
+						break replay
+					case <-ctx.Done():
+						break replay
+					}
+				}
+			}
+		}
+		close(ready)
+
+		select {
+		case <-ctx.Done():
+			c.closeStream(s)
+		case <-s.quit:
+		}
+	}()
+
+	return s.out
+}
+
+// read journaled events of the chains of from selected by m
+func (c *Chainpot) journaled(m *matcher, from map[PublicChain]int64) map[PublicChain][]*PotEvent {
+	var res = make(map[PublicChain][]*PotEvent)
+	for i, item := range c.allChains() {
+		if item == nil {
+			continue
+		}
+		var chain = PublicChain(i)
+		id, ok := from[chain]
+		if !ok || (m.chains != nil && !m.chains[chain]) {
+			continue
+		}
+		journal, ok := item.storage.(EventJournal)
+		if !ok {
+			continue
+		}
+		events, err := journal.EventsSince(id)
+		if err != nil {
+			c.logger.Error().Msgf("read event journal error: %s", err.Error())
+			continue
+		}
+		for _, event := range events {
+			if m.match(chain, event) {
+				res[chain] = append(res[chain], event)
+			}
+		}
+	}
+	return res
+}
+
+func (c *Chainpot) closeStream(s *stream) {
+	s.once.Do(func() {
+		c.streamsMu.Lock()
+		delete(c.streams, s.sub.id)
+		c.streamsMu.Unlock()
+
+		close(s.quit)
+		s.sub.Unsubscribe()
+		<-s.sub.Done()
+		close(s.out)
+	})
+}
+
+// close the streams receiving events of any given chain, all streams if none given
+func (c *Chainpot) closeStreams(chains ...PublicChain) {
+	var list = make([]*stream, 0)
+	c.streamsMu.Lock()
+	for _, s := range c.streams {
+		if len(chains) == 0 || s.matcher.chains == nil {
+			list = append(list, s)
+			continue
+		}
+		for _, chain := range chains {
+			if s.matcher.chains[chain] {
+				list = append(list, s)
+				break
+			}
+		}
+	}
+	c.streamsMu.Unlock()
+
+	for _, s := range list {
+		c.closeStream(s)
+	}
+}
@@ -0,0 +1,362 @@
+package chainpot
+
+import (
+	"context"
+	"github.com/fadeAce/chainpot/poterr"
+	"math/big"
+	"sync"
+	"time"
+)
+
+// events queued per subscription before the oldest ones are dropped
+const defaultSubscriptionBuffer = 10000
+
+type Direction uint8
+
+// direction of a transfer relative to the watched addresses
+const (
+	AnyDirection Direction = iota
+	Incoming
+	Outgoing
+	// both sides are watched
+	Internal
+)
+
+// Filter selects the events delivered to a subscription,
+// empty fields match everything
+type Filter struct {
+	Chains    []PublicChain
+	Symbols   []string
+	CoinTypes []string
+	Events    []EventType
+	Direction Direction
+	// matched in the canonical form of each chain, as Chainpot.Add watches them
+	Addrs []string
+	// decimal string compared with BlockMessage.Amount
+	MinAmount string
+	// memos of the deposits to shared addresses, see Chainpot.AddMemo
+	Memos []string
+}
+
+// compiled form of Filter used on the delivery path
+type matcher struct {
+	chains    map[PublicChain]bool
+	symbols   map[string]bool
+	coinTypes map[string]bool
+	events    map[EventType]bool
+	addrs     map[PublicChain]map[string]bool
+	direction Direction
+	minAmount *big.Float
+	memos     map[string]bool
+}
+
+func (f *Filter) compile() (*matcher, error) {
+	var m = &matcher{}
+	if f == nil {
+		return m, nil
+	}
+
+	m.direction = f.Direction
+	if len(f.Chains) > 0 {
+		m.chains = make(map[PublicChain]bool)
+		for _, item := range f.Chains {
+			m.chains[item] = true
+		}
+	}
+	m.symbols = stringSet(f.Symbols)
+	m.coinTypes = stringSet(f.CoinTypes)
+	if len(f.Events) > 0 {
+		m.events = make(map[EventType]bool)
+		for _, item := range f.Events {
+			m.events[item] = true
+		}
+	}
+	if len(f.Addrs) > 0 {
+		m.addrs = make(map[PublicChain]map[string]bool)
+		for _, chain := range []PublicChain{Bitcoin, Ethereum} {
+			var set = make(map[string]bool)
+			for _, item := range f.Addrs {
+				set[normalizeAddr(chain.String(), item)] = true
+			}
+			m.addrs[chain] = set
+		}
+	}
+	m.memos = stringSet(f.Memos)
+	if f.MinAmount != "" {
+		num, ok := new(big.Float).SetString(f.MinAmount)
+		if !ok {
+			return nil, poterr.FilterErr
+		}
+		m.minAmount = num
+	}
+	return m, nil
+}
+
+func stringSet(arr []string) map[string]bool {
+	if len(arr) == 0 {
+		return nil
+	}
+	var set = make(map[string]bool)
+	for _, item := range arr {
+		set[item] = true
+	}
+	return set
+}
+
+// Match reports whether the event emitted on chain passes the filter, an invalid filter matches nothing
+func (f *Filter) Match(chain PublicChain, event *PotEvent) bool {
+	m, err := f.compile()
+	if err != nil {
+		return false
+	}
+	return m.match(chain, event)
+}
+
+func (m *matcher) match(chain PublicChain, event *PotEvent) bool {
+	if m.chains != nil && !m.chains[chain] {
+		return false
+	}
+	if m.symbols != nil && !m.symbols[event.Symbol] {
+		return false
+	}
+	if m.coinTypes != nil && !m.coinTypes[event.CoinType] {
+		return false
+	}
+	if m.events != nil && !m.events[event.Event] {
+		return false
+	}
+
+	var dir = event.Event.Direction()
+	if m.direction != AnyDirection && m.direction != dir {
+		return false
+	}
+
+	if m.addrs != nil {
+		if event.Content == nil {
+			return false
+		}
+		var in = m.addrs[chain][event.Content.To]
+		var out = m.addrs[chain][event.Content.From]
+		switch dir {
+		case Incoming:
+			if !in {
+				return false
+			}
+		case Outgoing:
+			if !out {
+				return false
+			}
+		default:
+			if !in && !out {
+				return false
+			}
+		}
+	}
+
+	if m.memos != nil && (event.Content == nil || !m.memos[event.Content.Memo]) {
+		return false
+	}
+
+	if m.minAmount != nil {
+		if event.Content == nil {
+			return false
+		}
+		amount, ok := new(big.Float).SetString(event.Content.Amount)
+		if !ok || amount.Cmp(m.minAmount) < 0 {
+			return false
+		}
+	}
+	return true
+}
+
+// Subscription is an independent delivery of filtered events to a handler,
+// a slow handler never blocks the chains or the other subscriptions. past its buffer
+// the oldest queued events are dropped, they can be read again from the journal
+type Subscription struct {
+	id      int64
+	pot     *Chainpot
+	matcher *matcher
+	handler MessageHandler
+
+	mu       sync.Mutex
+	pending  []subEvent
+	buffer   int
+	dropping bool
+	signal   chan struct{}
+	closed   bool
+	done     chan struct{}
+}
+
+type subEvent struct {
+	chain PublicChain
+	event *PotEvent
+}
+
+func newSubscription(id int64, pot *Chainpot, m *matcher, fn MessageHandler) *Subscription {
+	var sub = &Subscription{
+		id:      id,
+		pot:     pot,
+		matcher: m,
+		handler: fn,
+		buffer:  pot.subBuffer,
+		signal:  make(chan struct{}, 1),
+		done:    make(chan struct{}),
+	}
+	if sub.buffer <= 0 {
+		sub.buffer = defaultSubscriptionBuffer
+	}
+	go sub.loop()
+	return sub
+}
+
+func (s *Subscription) ID() int64 {
+	return s.id
+}
+
+// push event into the subscription without blocking the caller
+func (s *Subscription) push(chain PublicChain, event *PotEvent) {
+	if !s.matcher.match(chain, event) {
+		return
+	}
+
+	s.mu.Lock()
+	if s.closed {
+		s.mu.Unlock()
+		return
+	}
+	if len(s.pending) >= s.buffer {
+		if !s.dropping {
+			s.pot.logger.Warn().Msgf("subscription %d is %d events behind, dropping the oldest", s.id, len(s.pending))
+		}
+		s.dropping = true
+		s.pending = s.pending[1:]
+		s.pot.metrics.Add("chainpot_subscription_dropped_total", 1, chain.String())
+	}
+	s.pending = append(s.pending, subEvent{chain: chain, event: event})
+	s.mu.Unlock()
+
+	select {
+	case s.signal <- struct{}{}:
+	default:
+	}
+}
+
+func (s *Subscription) loop() {
+	defer close(s.done)
+	for {
+		s.mu.Lock()
+		var batch = s.pending
+		var closed = s.closed
+		s.pending = nil
+		s.dropping = false
+		s.mu.Unlock()
+
+		for _, item := range batch {
+			s.handle(item)
+		}
+		if closed && len(batch) == 0 {
+			return
+		}
+		if len(batch) == 0 {
+			<-s.signal
+		}
+	}
+}
+
+func (s *Subscription) handle(item subEvent) {
+	var begin = time.Now()
+	if !s.call(item) {
+		s.pot.metrics.Add("chainpot_handler_failures_total", 1, item.chain.String())
+	}
+	s.pot.metrics.Since("chainpot_handler_duration_seconds", begin, item.chain.String())
+}
+
+// a panicking handler is logged, it doesn't stop the subscription
+func (s *Subscription) call(item subEvent) (ok bool) {
+	defer func() {
+		if err := recover(); err != nil {
+			s.pot.logger.Error().Msgf("subscription %d handler panic: %v", s.id, err)
+		}
+	}()
+	s.handler(item.chain, item.event)
+	return true
+}
+
+// close stops accepting events, the ones already queued are still delivered
+func (s *Subscription) close() {
+	s.mu.Lock()
+	s.closed = true
+	s.mu.Unlock()
+
+	select {
+	case s.signal <- struct{}{}:
+	default:
+	}
+}
+
+// Unsubscribe detaches the subscription, its queued events are still delivered.
+// it doesn't wait for them so the handler may call it, wait on Done otherwise
+func (s *Subscription) Unsubscribe() {
+	s.pot.subsMu.Lock()
+	delete(s.pot.subs, s.id)
+	s.pot.subsMu.Unlock()
+
+	s.close()
+}
+
+// Done is closed once the subscription is detached and its queued events are delivered
+func (s *Subscription) Done() <-chan struct{} {
+	return s.done
+}
+
+// Subscribe registers fn for the events passing filter, a nil filter receives everything,
+// a MinAmount that isn't a decimal is rejected with FilterErr
+func (c *Chainpot) Subscribe(filter *Filter, fn MessageHandler) (*Subscription, error) {
+	m, err := filter.compile()
+	if err != nil {
+		return nil, err
+	}
+	c.subsMu.Lock()
+	defer c.subsMu.Unlock()
+
+	c.subSeq++
+	var sub = newSubscription(c.subSeq, c, m, fn)
+	c.subs[sub.id] = sub
+	return sub, nil
+}
+
+// fan out event to every subscription
+func (c *Chainpot) dispatch(chain PublicChain, event *PotEvent) {
+	c.subsMu.RLock()
+	defer c.subsMu.RUnlock()
+
+	for _, sub := range c.subs {
+		sub.push(chain, event)
+	}
+}
+
+// close all subscriptions and wait for their queued events until ctx is done,
+// the events still queued at that moment are returned
+func (c *Chainpot) closeSubscriptions(ctx context.Context) []subEvent {
+	c.subsMu.Lock()
+	var subs = c.subs
+	c.subs = make(map[int64]*Subscription)
+	c.subsMu.Unlock()
+
+	for _, sub := range subs {
+		sub.close()
+	}
+
+	var left = make([]subEvent, 0)
+	for _, sub := range subs {
+		select {
+		case <-sub.done:
+		case <-ctx.Done():
+			sub.mu.Lock()
+			left = append(left, sub.pending...)
+			sub.pending = nil
+			sub.mu.Unlock()
+		}
+	}
+	return left
+}
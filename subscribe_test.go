@@ -0,0 +1,235 @@
+package chainpot
+
+import (
+	"context"
+	"github.com/fadeAce/chainpot/poterr"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+func TestFilter_Match(t *testing.T) {
+	var event = &PotEvent{
+		Symbol:   "eth",
+		Chain:    "eth",
+		CoinType: "origin",
+		Event:    T_DEPOSIT,
+		Content: &BlockMessage{
+			From:   "0x78ae889cd04cb9274c2600d68ccc5058f43db63e",
+			To:     "0x54a298ee9fccbf0ad8e55bc641d3086b81a48c41",
+			Amount: "0.01",
+		},
+	}
+
+	var cases = []struct {
+		filter *Filter
+		expect bool
+	}{
+		{nil, true},
+		{&Filter{Chains: []PublicChain{Ethereum}}, true},
+		{&Filter{Chains: []PublicChain{Bitcoin}}, false},
+		{&Filter{Symbols: []string{"usdt"}}, false},
+		{&Filter{Events: []EventType{T_DEPOSIT, T_DEPOSIT_CONFIRM}}, true},
+		{&Filter{Direction: Outgoing}, false},
+		{&Filter{Addrs: []string{"0x54a298ee9fccbf0ad8e55bc641d3086b81a48c41"}}, true},
+		{&Filter{Addrs: []string{"0x78ae889cd04cb9274c2600d68ccc5058f43db63e"}}, false},
+		{&Filter{Addrs: []string{"0x54A298EE9FCCBF0AD8E55BC641D3086B81A48C41"}}, true},
+		{&Filter{Addrs: []string{"0x78AE889CD04CB9274C2600D68CCC5058F43DB63E"}}, false},
+		{&Filter{MinAmount: "0.01"}, true},
+		{&Filter{MinAmount: "0.1"}, false},
+	}
+	for i, item := range cases {
+		if item.filter.Match(Ethereum, event) != item.expect {
+			t.Fatalf("case %d: expect %v", i, item.expect)
+		}
+	}
+
+	// bech32 addresses are lowercased, base58 ones are case sensitive
+	var deposit = &PotEvent{Event: T_DEPOSIT, Content: &BlockMessage{
+		From: testAddr,
+		To:   "bc1qcr8te4kr609gcawutmrza0j4xv80jy8z306fyu",
+	}}
+	if !(&Filter{Addrs: []string{"BC1QCR8TE4KR609GCAWUTMRZA0J4XV80JY8Z306FYU"}}).Match(Bitcoin, deposit) {
+		t.Fatal("expect a mixed case bech32 filter to match")
+	}
+	if (&Filter{Addrs: []string{strings.ToLower(testAddr)}, Direction: Outgoing}).Match(Bitcoin, &PotEvent{Event: T_WITHDRAW, Content: deposit.Content}) {
+		t.Fatal("expect a base58 filter to keep its case")
+	}
+}
+
+func TestChainpot_Subscribe(t *testing.T) {
+	var cp = &Chainpot{subs: make(map[int64]*Subscription)}
+	var wg = &sync.WaitGroup{}
+	var deposits, all int
+
+	wg.Add(3)
+	cp.Subscribe(&Filter{Direction: Incoming}, func(chain PublicChain, event *PotEvent) {
+		deposits++
+		wg.Done()
+	})
+	sub, err := cp.Subscribe(nil, func(chain PublicChain, event *PotEvent) {
+		all++
+		wg.Done()
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	cp.dispatch(Ethereum, &PotEvent{Event: T_DEPOSIT})
+	cp.dispatch(Ethereum, &PotEvent{Event: T_WITHDRAW})
+	wg.Wait()
+	sub.Unsubscribe()
+	<-sub.Done()
+	cp.dispatch(Ethereum, &PotEvent{Event: T_WITHDRAW})
+	cp.closeSubscriptions(context.Background())
+
+	if deposits != 1 || all != 2 {
+		t.Fatalf("unexpected deliveries: deposits %d, all %d", deposits, all)
+	}
+}
+
+func TestChainpot_SubscribeInvalid(t *testing.T) {
+	var cp = &Chainpot{subs: make(map[int64]*Subscription)}
+	if _, err := cp.Subscribe(&Filter{MinAmount: "ten"}, func(chain PublicChain, event *PotEvent) {}); err != poterr.FilterErr {
+		t.Fatalf("unexpected error %v", err)
+	}
+	if (&Filter{MinAmount: "ten"}).Match(Ethereum, &PotEvent{Content: &BlockMessage{Amount: "1"}}) {
+		t.Fatal("an invalid filter matches nothing")
+	}
+}
+
+func TestChainpot_SubscribePanic(t *testing.T) {
+	var cp = &Chainpot{subs: make(map[int64]*Subscription), metrics: NewMetrics()}
+	var ids = make(chan int64, 2)
+	cp.Subscribe(nil, func(chain PublicChain, event *PotEvent) {
+		if event.ID == 1 {
+			panic("handler failure")
+		}
+		ids <- event.ID
+	})
+	cp.dispatch(Ethereum, &PotEvent{ID: 1})
+	cp.dispatch(Ethereum, &PotEvent{ID: 2})
+	select {
+	case id := <-ids:
+		if id != 2 {
+			t.Fatalf("unexpected event %d", id)
+		}
+	case <-time.After(2 * time.Second):
+		t.Fatal("subscription stopped by the panic")
+	}
+	cp.closeSubscriptions(context.Background())
+	if !strings.Contains(scrape(cp.metrics), `chainpot_handler_failures_total{chain="eth"} 1`) {
+		t.Fatal("panic not counted")
+	}
+}
+
+func TestChainpot_UnsubscribeInHandler(t *testing.T) {
+	var cp = &Chainpot{subs: make(map[int64]*Subscription)}
+	var sub *Subscription
+	sub, _ = cp.Subscribe(nil, func(chain PublicChain, event *PotEvent) {
+		sub.Unsubscribe()
+	})
+	cp.dispatch(Ethereum, &PotEvent{ID: 1})
+	select {
+	case <-sub.Done():
+	case <-time.After(2 * time.Second):
+		t.Fatal("unsubscribe from the handler deadlocked")
+	}
+	if len(cp.subs) != 0 {
+		t.Fatal("subscription not detached")
+	}
+}
+
+func TestChainpot_SubscribeBuffer(t *testing.T) {
+	var cp = &Chainpot{subs: make(map[int64]*Subscription), subBuffer: 2}
+	var block = make(chan struct{})
+	var ids = make([]int64, 0)
+	cp.Subscribe(nil, func(chain PublicChain, event *PotEvent) {
+		if event.ID == 1 {
+			<-block
+		}
+		ids = append(ids, event.ID)
+	})
+	cp.dispatch(Ethereum, &PotEvent{ID: 1})
+	for {
+		cp.subsMu.RLock()
+		var sub = cp.subs[1]
+		cp.subsMu.RUnlock()
+		sub.mu.Lock()
+		var left = len(sub.pending)
+		sub.mu.Unlock()
+		if left == 0 {
+			break
+		}
+		time.Sleep(time.Millisecond)
+	}
+	// the handler is busy with 1, 2 is dropped past the buffer
+	for id := int64(2); id <= 4; id++ {
+		cp.dispatch(Ethereum, &PotEvent{ID: id})
+	}
+	close(block)
+	cp.closeSubscriptions(context.Background())
+	if len(ids) != 3 || ids[0] != 1 || ids[1] != 3 || ids[2] != 4 {
+		t.Fatalf("unexpected deliveries %v", ids)
+	}
+}
+
+type journalStorage struct {
+	Storage
+	EventJournal
+	events []*PotEvent
+}
+
+func (s *journalStorage) EventsSince(id int64) ([]*PotEvent, error) {
+	var res = make([]*PotEvent, 0)
+	for _, item := range s.events {
+		if item.ID > id {
+			res = append(res, item)
+		}
+	}
+	return res, nil
+}
+
+func TestChainpot_EventsFrom(t *testing.T) {
+	var cp = &Chainpot{
+		chains:  make([]*chain, 128),
+		subs:    make(map[int64]*Subscription),
+		streams: make(map[int64]*stream),
+	}
+	cp.chains[Ethereum] = &chain{storage: &journalStorage{events: []*PotEvent{
+		{ID: 1, Event: T_DEPOSIT},
+		{ID: 2, Event: T_DEPOSIT_CONFIRM},
+	}}}
+	// event IDs are numbered per chain, each one resumes from its own cursor
+	cp.chains[Bitcoin] = &chain{storage: &journalStorage{events: []*PotEvent{
+		{ID: 1, Event: T_DEPOSIT},
+		{ID: 2, Event: T_DEPOSIT_CONFIRM},
+		{ID: 3, Event: T_WITHDRAW},
+	}}}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	var ch = cp.EventsFrom(ctx, nil, map[PublicChain]int64{Ethereum: 1, Bitcoin: 2})
+	var replayed = make(map[EventType]int64)
+	for i := 0; i < 2; i++ {
+		var event = <-ch
+		replayed[event.Event] = event.ID
+	}
+	if len(replayed) != 2 || replayed[T_DEPOSIT_CONFIRM] != 2 || replayed[T_WITHDRAW] != 3 {
+		t.Fatalf("unexpected replay %v", replayed)
+	}
+
+	// already replayed events are not delivered twice
+	cp.dispatch(Ethereum, &PotEvent{ID: 2, Event: T_DEPOSIT_CONFIRM})
+	cp.dispatch(Ethereum, &PotEvent{ID: 3, Event: T_DEPOSIT})
+	if event := <-ch; event.ID != 3 {
+		t.Fatalf("expect live event 3, got %d", event.ID)
+	}
+
+	cancel()
+	for range ch {
+	}
+	if len(cp.streams) != 0 || len(cp.subs) != 0 {
+		t.Fatal("stream not released after cancel")
+	}
+}
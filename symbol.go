@@ -2,13 +2,15 @@ package chainpot
 
 import (
 	"context"
+	"github.com/fadeAce/chainpot/hdkey"
 	"github.com/fadeAce/chainpot/poterr"
 	"github.com/fadeAce/claws"
 	"github.com/fadeAce/claws/types"
-	"github.com/rs/zerolog/log"
+	"github.com/rs/zerolog"
 	"math/big"
 	"strings"
 	"sync"
+	"time"
 )
 
 type EventType int
@@ -26,8 +28,79 @@ const (
 	// ABNORMAL STATE
 	T_WITHDRAW_FAIL
 	T_ERROR
+
+	// WATCHDOG
+	T_STALL
+	T_RECOVER
+
+	// TRACKED TRANSACTIONS
+	T_WITHDRAW_PENDING
+
+	// REVERTED TRANSACTIONS
+	T_DEPOSIT_FAIL
+
+	// INTERNAL TRANSFERS
+	T_INTERNAL
+	T_INTERNAL_UPDATE
+	T_INTERNAL_CONFIRM
+
+	// TOKEN DISCOVERY
+	T_UNLISTED_DEPOSIT
+
+	// INVOICES
+	T_INVOICE_PAID
+	T_INVOICE_UNDERPAID
+	T_INVOICE_OVERPAID
+	T_INVOICE_EXPIRED
+	T_INVOICE_LATE
 )
 
+var eventNames = map[EventType]string{
+	T_DEPOSIT:           "deposit",
+	T_WITHDRAW:          "withdraw",
+	T_DEPOSIT_UPDATE:    "deposit_update",
+	T_WITHDRAW_UPDATE:   "withdraw_update",
+	T_WITHDRAW_CONFIRM:  "withdraw_confirm",
+	T_DEPOSIT_CONFIRM:   "deposit_confirm",
+	T_WITHDRAW_FAIL:     "withdraw_fail",
+	T_ERROR:             "error",
+	T_STALL:             "stall",
+	T_RECOVER:           "recover",
+	T_WITHDRAW_PENDING:  "withdraw_pending",
+	T_DEPOSIT_FAIL:      "deposit_fail",
+	T_INTERNAL:          "internal",
+	T_INTERNAL_UPDATE:   "internal_update",
+	T_INTERNAL_CONFIRM:  "internal_confirm",
+	T_UNLISTED_DEPOSIT:  "unlisted_deposit",
+	T_INVOICE_PAID:      "invoice_paid",
+	T_INVOICE_UNDERPAID: "invoice_underpaid",
+	T_INVOICE_OVERPAID:  "invoice_overpaid",
+	T_INVOICE_EXPIRED:   "invoice_expired",
+	T_INVOICE_LATE:      "invoice_late",
+}
+
+func (e EventType) String() string {
+	if name, ok := eventNames[e]; ok {
+		return name
+	}
+	return "unknown"
+}
+
+// direction of the transfer reported by the event type
+func (e EventType) Direction() Direction {
+	switch e {
+	case T_DEPOSIT, T_DEPOSIT_UPDATE, T_DEPOSIT_CONFIRM, T_DEPOSIT_FAIL, T_UNLISTED_DEPOSIT:
+		return Incoming
+	case T_INVOICE_PAID, T_INVOICE_UNDERPAID, T_INVOICE_OVERPAID, T_INVOICE_EXPIRED, T_INVOICE_LATE:
+		return Incoming
+	case T_WITHDRAW, T_WITHDRAW_UPDATE, T_WITHDRAW_CONFIRM, T_WITHDRAW_FAIL, T_WITHDRAW_PENDING:
+		return Outgoing
+	case T_INTERNAL, T_INTERNAL_UPDATE, T_INTERNAL_CONFIRM:
+		return Internal
+	}
+	return AnyDirection
+}
+
 // pot event carrier
 type PotEvent struct {
 	Symbol   string
@@ -35,7 +108,14 @@ type PotEvent struct {
 	CoinType string
 	Event    EventType
 	ID       int64
+	Height   int64
 	Content  *BlockMessage
+	// why a tracked transaction failed
+	Reason string `json:",omitempty"`
+	// ID of the withdrawal request or of the invoice the event reports on
+	RequestID string `json:",omitempty"`
+	// shared by the events of one transfer, hash and index in its block
+	CorrelationID string `json:",omitempty"`
 }
 
 type contract struct {
@@ -46,6 +126,7 @@ type contract struct {
 // main structure for implement a set functions of a chain
 type chain struct {
 	*sync.Mutex
+	name           string
 	origin         *contract
 	contracts      []*contract
 	addrs          map[string]int64
@@ -53,26 +134,87 @@ type chain struct {
 	syncedEndPoint bool
 	depositTxs     *Queue
 	withdrawTxs    *Queue
+	internalTxs    *Queue
+	decodeLogs     bool
+	tokens         map[string]*contract
+	unlisted       bool
+	traces         bool
+	utxo           bool
+	utxos          map[string]*UTXO
+	tokenInfos     map[string]*TokenInfo
 	storage        Storage
 	noticer        chan *big.Int
 	onMessage      func(msg *PotEvent)
 	messageQueue   chan *PotEvent
 	ctx            context.Context
 	cancel         context.CancelFunc
+	headCtx        context.Context
+	headCancel     context.CancelFunc
+	headSub        context.CancelFunc
+	stopCtx        context.Context
+	routines       *sync.WaitGroup
+	logger         zerolog.Logger
+	metrics        *Metrics
+	health         *health
+	now            func() time.Time
+	reconnect      bool
+	report         *ChainReport
 	height         int64
+	processed      int64
 	confirmTimes   int64
 	endpoint       int64
+	retention      JournalRetention
+	journaled      int64
+	lookup         TxLookup
+	tracking       map[string]*trackedTx
+	trackQueue     chan string
+	unreceipted    []*unreceipted
+	trackLast      string
+	blockAt        time.Time
+	blockAtHeight  int64
+	dropAfter      time.Duration
+	withdrawMu     sync.Mutex
+	withdrawals    map[string]*Withdrawal
+	withdrawSeq    int64
+	withdrawQueue  chan struct{}
+	senders        map[string]Sender
+	// next nonce of the accounts sending withdrawals
+	nonces map[string]uint64
+	// hashes submitted by the withdrawal queue
+	ownHashes  map[string]bool
+	stuckAfter time.Duration
+	feeBump    int
+	maxBumps   int
+	// bitcoin network the addresses are checked against
+	network string
+	// addresses derived from the extended keys
+	gapLimit int
+	hdMu     sync.Mutex
+	xpubs    map[string]*XPub
+	hdKeys   map[string]*hdkey.Key
+	derived  map[string]derivation
+	// memos of the shared addresses
+	memoMu sync.Mutex
+	memos  map[string]map[string]bool
+	// invoices keyed by their ID
+	invoiceMu    sync.Mutex
+	invoices     map[string]*Invoice
+	invoiceGrace time.Duration
 }
 
 // pot event iterator
 func (c *PotEvent) Next(e EventType) *PotEvent {
 	return &PotEvent{
-		Symbol:   c.Symbol,
-		Chain:    c.Chain,
-		CoinType: c.CoinType,
-		Event:    e,
-		ID:       c.ID + 1,
-		Content:  c.Content,
+		Symbol:        c.Symbol,
+		Chain:         c.Chain,
+		CoinType:      c.CoinType,
+		Event:         e,
+		ID:            c.ID + 1,
+		Height:        c.Height,
+		Content:       c.Content,
+		Reason:        c.Reason,
+		RequestID:     c.RequestID,
+		CorrelationID: c.CorrelationID,
 	}
 }
 
@@ -82,14 +224,37 @@ type chain_option struct {
 	ConfirmTimes int64
 	Endpoint     int64
 	Storage      Storage
+	Retention    JournalRetention
+	Wallets      map[string]claws.Wallet
+	Logger       zerolog.Logger
+	Metrics      *Metrics
+	StallAfter   time.Duration
+	MaxLag       int64
+	Reconnect    bool
+	Clock        func() time.Time
+	Lookup       TxLookup
+	DropAfter    time.Duration
+	Accounts     map[string]types.Bundle
+	StuckAfter   time.Duration
+	FeeBump      int
+	MaxBumps     int
+	DecodeLogs   bool
+	Discover     bool
+	Traces       bool
+	UTXO         bool
+	GapLimit     int
+	Network      string
+	InvoiceGrace time.Duration
 }
 
 func newChain(opt *chain_option) *chain {
 	ctx, cancel := context.WithCancel(context.Background())
+	headCtx, headCancel := context.WithCancel(ctx)
 	cache, addrs := opt.Storage.GetConfig()
 
 	chain := &chain{
 		Mutex:        &sync.Mutex{},
+		name:         opt.ChainName,
 		contracts:    make([]*contract, 0),
 		addrs:        addrs,
 		height:       opt.Endpoint,
@@ -97,19 +262,80 @@ func newChain(opt *chain_option) *chain {
 		endpoint:     cache.EndPoint,
 		eventID:      cache.EventID,
 		// todo: 128 is not quiet sufficient for concurrent consideration , need a much more flexible capacity
-		messageQueue: make(chan *PotEvent, 128),
-		depositTxs:   NewQueue(),
-		withdrawTxs:  NewQueue(),
-		storage:      opt.Storage,
-		noticer:      make(chan *big.Int, 128),
-		ctx:          ctx,
-		cancel:       cancel,
+		messageQueue:  make(chan *PotEvent, 128),
+		depositTxs:    NewQueue(),
+		withdrawTxs:   NewQueue(),
+		internalTxs:   NewQueue(),
+		decodeLogs:    opt.DecodeLogs,
+		tokens:        make(map[string]*contract),
+		unlisted:      opt.Discover,
+		traces:        opt.Traces,
+		utxo:          opt.UTXO,
+		utxos:         make(map[string]*UTXO),
+		tokenInfos:    make(map[string]*TokenInfo),
+		storage:       opt.Storage,
+		retention:     opt.Retention,
+		noticer:       make(chan *big.Int, 128),
+		ctx:           ctx,
+		cancel:        cancel,
+		headCtx:       headCtx,
+		headCancel:    headCancel,
+		stopCtx:       context.Background(),
+		routines:      &sync.WaitGroup{},
+		logger:        opt.Logger,
+		metrics:       opt.Metrics,
+		health:        &health{endpoint: cache.EndPoint, stallAfter: opt.StallAfter, maxLag: opt.MaxLag},
+		now:           opt.Clock,
+		reconnect:     opt.Reconnect,
+		tracking:      make(map[string]*trackedTx),
+		trackQueue:    make(chan string, 128),
+		dropAfter:     opt.DropAfter,
+		withdrawals:   make(map[string]*Withdrawal),
+		withdrawQueue: make(chan struct{}, 1),
+		senders:       make(map[string]Sender),
+		nonces:        make(map[string]uint64),
+		ownHashes:     make(map[string]bool),
+		stuckAfter:    opt.StuckAfter,
+		feeBump:       opt.FeeBump,
+		maxBumps:      opt.MaxBumps,
+		gapLimit:      opt.GapLimit,
+		network:       opt.Network,
+		xpubs:         make(map[string]*XPub),
+		hdKeys:        make(map[string]*hdkey.Key),
+		derived:       make(map[string]derivation),
+		memos:         make(map[string]map[string]bool),
+		invoices:      make(map[string]*Invoice),
+		invoiceGrace:  opt.InvoiceGrace,
+	}
+	if chain.invoiceGrace <= 0 {
+		chain.invoiceGrace = defaultInvoiceGrace
+	}
+	if chain.gapLimit <= 0 {
+		chain.gapLimit = defaultGapLimit
+	}
+	if chain.dropAfter <= 0 {
+		chain.dropAfter = defaultDropAfter
+	}
+	if chain.stuckAfter <= 0 {
+		chain.stuckAfter = defaultStuckAfter
+	}
+	if chain.feeBump <= 0 {
+		chain.feeBump = defaultFeeBump
+	}
+	if chain.maxBumps <= 0 {
+		chain.maxBumps = defaultMaxBumps
+	}
+	if chain.now == nil {
+		chain.now = time.Now
+	}
+	if clocked, ok := opt.Storage.(ClockedStorage); ok && opt.Clock != nil {
+		clocked.SetClock(opt.Clock)
 	}
 
 	for _, item := range opt.Contracts {
 		if item.Chain == opt.ChainName {
 			var obj = &contract{
-				wallet: claws.Builder.BuildWallet(item.Symbol),
+				wallet: opt.Wallets[item.Symbol],
 				Coins:  item,
 			}
 			if item.CoinType == "origin" {
@@ -117,70 +343,253 @@ func newChain(opt *chain_option) *chain {
 			} else {
 				chain.contracts = append(chain.contracts, obj)
 			}
+			if sender, ok := optional[Sender](obj.wallet); ok {
+				chain.senders[item.Symbol] = sender
+			} else if opt.Accounts != nil && obj.wallet != nil {
+				chain.senders[item.Symbol] = &clawsSender{wallet: obj.wallet, accounts: opt.Accounts}
+			}
+		}
+	}
+
+	chain.lookup = opt.Lookup
+	if chain.origin != nil {
+		if lookup, ok := optional[TxLookup](chain.origin.wallet); ok {
+			chain.lookup = lookup
+		}
+	}
+	if chain.origin != nil {
+		for _, item := range chain.contracts {
+			if item.ContractAddr != "" {
+				// confirmations are seeked on the origin wallet
+				chain.tokens[strings.ToLower(item.ContractAddr)] = &contract{Coins: item.Coins, wallet: chain.origin.wallet}
+			}
 		}
 	}
+	chain.loadWithdrawals()
+	if chain.utxo {
+		chain.loadUTXOs()
+	}
+	chain.loadXPubs()
+	chain.loadMemos()
+	// addresses stored before they were canonicalized
+	for addr, height := range chain.addrs {
+		if norm := chain.normalize(addr); norm != addr {
+			delete(chain.addrs, addr)
+			chain.addrs[norm] = height
+		}
+	}
+	chain.loadInvoices()
 
 	return chain
 }
 
 func (c *chain) start() {
-	log.Info().Msgf("%s start", strings.ToUpper(c.origin.Chain))
-
-	go func() {
-		err := c.origin.wallet.NotifyHead(c.ctx, func(num *big.Int) {
-			var height = num.Int64()
-			if c.origin.Chain == "eth" {
-				height--
-			}
-			if height > c.height {
-				c.height = height
-				c.noticer <- big.NewInt(height)
-				log.Info().Msgf("%d received new block from claws ", height)
-				c.storage.SaveConfig(&ConfigCache{EndPoint: height, EventID: c.eventID}, nil)
-			}
-		})
-		if err != nil {
-			log.Error().Msgf("fatal error when starting head syncing: %s", err.Error())
-		}
-	}()
+	c.health.Lock()
+	c.health.running = true
+	c.health.started = c.now()
+	c.health.Unlock()
+	c.logger.Info().Msgf("%s start", strings.ToUpper(c.origin.Chain))
+
+	c.subscribeHead()
+	if c.health.stallAfter > 0 {
+		c.routines.Add(1)
+		go c.watch()
+	}
 
+	c.routines.Add(1)
 	go func() {
+		defer c.routines.Done()
 		for {
 			select {
 			case <-c.ctx.Done():
-				c.storage.SaveConfig(&ConfigCache{EndPoint: c.height}, c.addrs)
-				wg.Done()
-				log.Info().Msgf("%s stopped, endpoint: %d", strings.ToUpper(c.origin.Chain), c.height)
+				c.shutdown()
+				c.health.Lock()
+				c.health.running = false
+				c.health.Unlock()
+				c.logger.Info().Msgf("%s stopped, endpoint: %d", strings.ToUpper(c.origin.Chain), c.report.EndPoint)
 				return
 			case num := <-c.noticer:
 				height := num.Int64()
+				c.retryReceipts()
 				c.syncEndpoint(c.origin, height)
 				c.syncBlock(c.origin, num, false)
 				for _, item := range c.contracts {
 					c.syncEndpoint(item, height)
 					c.syncBlock(item, num, false)
 				}
-				c.emitter()
+				c.emitter(height)
+				c.processed = height
+				// the event ID belongs to the main loop, the endpoint is saved here only
+				c.saveConfig(&ConfigCache{EndPoint: height, EventID: c.eventID}, nil)
+				c.processWithdrawals()
+				c.checkTracked()
+				c.processInvoices()
+				c.observe()
+			case hash := <-c.trackQueue:
+				c.track(hash)
+			case <-c.withdrawQueue:
+				c.processWithdrawals()
 			case event := <-c.messageQueue:
-				log.Debug().Msgf("New Event: %s", mustMarshal(event))
-				c.onMessage(event)
+				c.deliver(event)
 				// todo: only been consumed it would cause a cache mark event
 			}
 		}
 	}()
 }
 
+// subscribe to the heads of the node, a previous subscription is cancelled
+func (c *chain) subscribeHead() {
+	ctx, cancel := context.WithCancel(c.headCtx)
+	c.Lock()
+	if c.headSub != nil {
+		c.headSub()
+	}
+	c.headSub = cancel
+	c.Unlock()
+
+	c.routines.Add(1)
+	go func() {
+		defer c.routines.Done()
+		err := c.origin.wallet.NotifyHead(ctx, func(num *big.Int) {
+			if ctx.Err() != nil {
+				return
+			}
+			var height = num.Int64()
+			if c.origin.Chain == "eth" {
+				height--
+			}
+			c.metrics.Set("chainpot_node_height", float64(height), c.name)
+			c.health.Lock()
+			c.health.lastHead = c.now()
+			c.health.nodeHeight = height
+			var recovered = c.health.stalled
+			c.health.stalled = false
+			c.health.Unlock()
+			if recovered {
+				c.logger.Info().Msgf("%s heads resumed at %d", strings.ToUpper(c.origin.Chain), height)
+				c.metrics.Set("chainpot_stalled", 0, c.name)
+				c.alert(T_RECOVER, height)
+			}
+			if height > c.height {
+				c.height = height
+				select {
+				case c.noticer <- big.NewInt(height):
+				case <-ctx.Done():
+					return
+				}
+				c.logger.Info().Msgf("%d received new block from claws ", height)
+			}
+		})
+		if err != nil {
+			c.health.fail(err)
+			c.logger.Error().Msgf("fatal error when starting head syncing: %s", err.Error())
+		}
+	}()
+}
+
+// wait for the routines of a cancelled chain to exit
+func (c *chain) wait() {
+	c.routines.Wait()
+}
+
+// refresh the gauges of the chain after a block is processed
+func (c *chain) observe() {
+	var name = c.name
+	c.metrics.Set("chainpot_processed_height", float64(c.processed), name)
+	c.metrics.Add("chainpot_blocks_processed_total", 1, name)
+	c.metrics.Set("chainpot_pending_transactions", float64(c.depositTxs.Len()), name, "deposit")
+	c.metrics.Set("chainpot_pending_transactions", float64(c.withdrawTxs.Len()), name, "withdraw")
+	c.metrics.Set("chainpot_pending_transactions", float64(c.internalTxs.Len()), name, "internal")
+	c.metrics.Set("chainpot_message_queue_depth", float64(len(c.messageQueue)), name)
+
+	c.health.Lock()
+	c.health.processed = c.processed
+	c.health.pending = c.depositTxs.Len() + c.withdrawTxs.Len() + c.internalTxs.Len()
+	c.health.Unlock()
+}
+
+// save config and time the write
+func (c *chain) saveConfig(cache *ConfigCache, addrs map[string]int64) error {
+	defer c.metrics.Since("chainpot_storage_write_duration_seconds", time.Now(), c.name, "save_config")
+	if err := c.storage.SaveConfig(cache, addrs); err != nil {
+		c.health.fail(err)
+		c.logger.Error().Msgf("save config error: %s", err.Error())
+		return err
+	}
+	c.health.Lock()
+	c.health.endpoint = cache.EndPoint
+	c.health.Unlock()
+	return nil
+}
+
+func (c *chain) deliver(event *PotEvent) {
+	c.logger.Debug().Msgf("New Event: %s", mustMarshal(event))
+	c.metrics.Add("chainpot_events_total", 1, c.name, event.Symbol, event.Event.String())
+	c.metrics.Set("chainpot_message_queue_depth", float64(len(c.messageQueue)), c.name)
+	c.journal(event)
+	c.onMessage(event)
+}
+
+// deliver the queued events until the stop deadline and save the endpoint,
+// events left at the deadline are journaled and reported
+func (c *chain) shutdown() {
+	var report = &ChainReport{
+		EndPoint:    c.processed,
+		Undelivered: make([]*PotEvent, 0),
+	}
+	if report.EndPoint == 0 {
+		report.EndPoint = c.height
+	}
+
+	for drained := false; !drained; {
+		select {
+		case event := <-c.messageQueue:
+			if c.stopCtx.Err() != nil {
+				c.journal(event)
+				report.Undelivered = append(report.Undelivered, event)
+			} else {
+				c.deliver(event)
+			}
+		default:
+			drained = true
+		}
+	}
+
+	report.EventID = c.eventID
+	report.Pending = c.depositTxs.Len() + c.withdrawTxs.Len() + c.internalTxs.Len() + len(c.unreceipted)
+	c.saveConfig(&ConfigCache{EndPoint: report.EndPoint, EventID: c.eventID}, c.addrs)
+	c.report = report
+}
+
 //
 // @param isNextHeight bool "if current height is bigger than last"
 func (c *chain) syncBlock(cont *contract, num *big.Int, isOldBlock bool) {
 	var height = num.Int64()
 	// todo: shouldn't depend on syncing noticer but height calculation | or maybe suitable because of suitability
 	//if cont.CoinType == "origin" {
-	//	log.Info().Msgf("%s Synchronizing Block: %d", strings.ToUpper(c.origin.Chain), height)
+	//	c.logger.Info().Msgf("%s Synchronizing Block: %d", strings.ToUpper(c.origin.Chain), height)
 	//}
 
-	txns, err := cont.wallet.UnfoldTxs(context.Background(), num)
+	// the tokens come from the logs of the origin blocks
+	if cont != c.origin && c.decodeLogs {
+		return
+	}
+
+	// catch-up gives way to the live blocks on the endpoint limiter
+	var ctx = context.Background()
+	if isOldBlock {
+		ctx = WithPriority(ctx, PriorityBackground)
+	}
+	if cont == c.origin && c.utxo {
+		c.syncUTXO(ctx, num, isOldBlock)
+		return
+	}
+	var begin = time.Now()
+	txns, err := cont.wallet.UnfoldTxs(ctx, num)
+	c.metrics.Since("chainpot_unfold_duration_seconds", begin, c.name, cont.Symbol)
 	if err != nil {
+		c.metrics.Add("chainpot_unfold_errors_total", 1, c.name, cont.Symbol)
+		c.health.fail(err)
 		return
 	}
 
@@ -190,33 +599,55 @@ func (c *chain) syncBlock(cont *contract, num *big.Int, isOldBlock bool) {
 			continue
 		}
 
-		var _, f1 = c.addrs[tx.FromStr()]
-		var _, f2 = c.addrs[tx.ToStr()]
+		var f1, f2 = c.watched(tx)
 		if !f1 && !f2 {
 			continue
 		}
+		c.metrics.Add("chainpot_matched_transactions_total", 1, c.name, cont.Symbol)
+		c.checked(ctx, &Value{TXN: tx, Height: height, Index: int64(i), IsOldBlock: isOldBlock, Contract: cont}, f1, f2)
+	}
+	if cont == c.origin && (c.decodeLogs || c.unlisted) {
+		c.syncLogs(ctx, num, isOldBlock)
+	}
+	if cont == c.origin && c.traces {
+		c.syncTraces(ctx, num, isOldBlock)
+	}
+}
 
-		var node = &Value{TXN: tx, Height: height, Index: int64(i), IsOldBlock: isOldBlock, EventID: c.eventID, Contract: cont}
-		if tx.FromStr() == tx.ToStr() {
-			c.messageQueue <- &PotEvent{
-				Symbol: c.origin.Symbol,
-				Event:  T_ERROR,
-			}
-		} else if f1 && f2 {
-			c.withdrawTxs.Pend(node)
-			c.eventID += c.confirmTimes
-			var cp = *node
-
-			c.depositTxs.Pend(&cp)
-			c.eventID += c.confirmTimes
-		} else if f1 {
-			c.withdrawTxs.Pend(node)
-			c.eventID += c.confirmTimes
-		} else if f2 {
-			c.depositTxs.Pend(node)
-			c.eventID += c.confirmTimes
-		}
+// whether the sender and the receiver of tx are watched
+func (c *chain) watched(tx types.TXN) (outgoing bool, incoming bool) {
+	_, outgoing = c.addrs[c.normalize(tx.FromStr())]
+	_, incoming = c.addrs[c.normalize(tx.ToStr())]
+	// tracked transactions report their own withdraw lifecycle
+	if _, ok := c.tracking[strings.ToLower(tx.HexStr())]; ok {
+		outgoing = false
 	}
+	if c.ownHashes[strings.ToLower(tx.HexStr())] {
+		outgoing = false
+	}
+	return
+}
+
+// queue a matched transfer, its events take confirmTimes IDs
+func (c *chain) pend(node *Value, outgoing, incoming bool) {
+	node.Seen = c.now()
+	if node.IsOldBlock {
+		// caught up transactions were seen when their block was mined
+		node.Seen = c.blockTime(node.Height)
+	}
+	if incoming {
+		c.received(c.normalize(node.TXN.ToStr()))
+		c.routeMemo(node)
+	}
+	if outgoing && incoming {
+		// both sides are watched, a self-send only costs its fee
+		c.internalTxs.Pend(node)
+	} else if outgoing {
+		c.withdrawTxs.Pend(node)
+	} else {
+		c.depositTxs.Pend(node)
+	}
+	c.eventID += c.confirmTimes
 }
 
 func (c *chain) syncEndpoint(cont *contract, currentHeight int64) {
@@ -233,91 +664,92 @@ func (c *chain) syncEndpoint(cont *contract, currentHeight int64) {
 	c.syncedEndPoint = true
 }
 
-// emit events
-func (c *chain) emitter() {
-	c.depositTxs.PopEach(func(i int, val *Value) {
+// emit events of the pending transactions once the block at height is synced
+func (c *chain) emitter(height int64) {
+	c.emitQueue(c.depositTxs, height, T_DEPOSIT, T_DEPOSIT_UPDATE, T_DEPOSIT_CONFIRM)
+	c.emitQueue(c.withdrawTxs, height, T_WITHDRAW, T_WITHDRAW_UPDATE, T_WITHDRAW_CONFIRM)
+	c.emitQueue(c.internalTxs, height, T_INTERNAL, T_INTERNAL_UPDATE, T_INTERNAL_CONFIRM)
+}
+
+// emit the first, update and confirm events of the transactions of queue
+func (c *chain) emitQueue(queue *Queue, height int64, first, update, confirm EventType) {
+	queue.PopEach(func(i int, val *Value) {
 		var event = &PotEvent{
-			Chain:    val.Contract.Chain,
-			CoinType: val.Contract.CoinType,
-			Symbol:   val.Contract.Symbol,
-			Content:  NewBlockMessage(val.TXN),
-			ID:       val.EventID,
+			Chain:         val.Contract.Chain,
+			CoinType:      val.Contract.CoinType,
+			Symbol:        val.Contract.Symbol,
+			Content:       NewBlockMessage(val.TXN),
+			ID:            val.EventID,
+			Height:        val.Height,
+			CorrelationID: val.CorrelationID(),
+		}
+		if first != T_WITHDRAW && c.unknownMemo(event.Content) {
+			event.Reason = unknownMemo
 		}
 
 		// todo: if coming block is not a new block, it need a check event is processing
 		if val.IsOldBlock {
-			event.Event = T_DEPOSIT
+			event.Event = first
 			c.messageQueue <- event
 			for j := 0; j < int(c.confirmTimes-2); j++ {
-				event = event.Next(T_DEPOSIT_UPDATE)
+				event = event.Next(update)
 				c.messageQueue <- event
 			}
-			c.messageQueue <- event.Next(T_DEPOSIT_CONFIRM)
-			return
-		}
-
-		if c.height-val.Height+1 >= c.confirmTimes {
-			event = event.Next(T_DEPOSIT_CONFIRM)
-			if !val.Contract.wallet.Seek(val.TXN) {
-				return
+			event = event.Next(confirm)
+			c.messageQueue <- event
+			if event.Event == T_DEPOSIT_CONFIRM || event.Event == T_INTERNAL_CONFIRM {
+				c.invoiced(event, val.Seen)
 			}
-		} else if c.height-val.Height == 0 {
-			event.Event = T_DEPOSIT
-			c.depositTxs.Pend(val)
-		} else {
-			event = event.Next(T_DEPOSIT_UPDATE)
-			val.EventID = event.ID
-			c.depositTxs.Pend(val)
-		}
-		c.messageQueue <- event
-	})
-
-	c.withdrawTxs.PopEach(func(i int, val *Value) {
-		var event = &PotEvent{
-			Chain:    val.Contract.Chain,
-			CoinType: val.Contract.CoinType,
-			Symbol:   val.Contract.Symbol,
-			Content:  NewBlockMessage(val.TXN),
-			ID:       val.EventID,
+			return
 		}
 
-		if val.IsOldBlock {
-			event.Event = T_WITHDRAW
+		if val.Delayed {
+			// pended blocks after its own, the events of the blocks in between are caught up
+			val.Delayed = false
+			event.Event = first
 			c.messageQueue <- event
-			for j := 0; j < int(c.confirmTimes-2); j++ {
-				event = event.Next(T_WITHDRAW_UPDATE)
+			for j := int64(1); j < height-val.Height && j <= c.confirmTimes-2; j++ {
+				event = event.Next(update)
 				c.messageQueue <- event
 			}
-			c.messageQueue <- event.Next(T_WITHDRAW_CONFIRM)
-			return
+			val.EventID = event.ID
 		}
-
-		if c.height-val.Height+1 >= c.confirmTimes {
-			event = event.Next(T_WITHDRAW_CONFIRM)
+		if height-val.Height+1 >= c.confirmTimes {
+			event = event.Next(confirm)
 			if !val.Contract.wallet.Seek(val.TXN) {
 				return
 			}
-		} else if c.height-val.Height == 0 {
-			event.Event = T_WITHDRAW
-			c.withdrawTxs.Pend(val)
+		} else if height-val.Height == 0 {
+			event.Event = first
+			queue.Pend(val)
 		} else {
-			event = event.Next(T_WITHDRAW_UPDATE)
+			event = event.Next(update)
 			val.EventID = event.ID
-			c.withdrawTxs.Pend(val)
+			queue.Pend(val)
 		}
 		c.messageQueue <- event
+		if event.Event == T_DEPOSIT_CONFIRM || event.Event == T_INTERNAL_CONFIRM {
+			c.invoiced(event, val.Seen)
+		}
 	})
 }
 
-// add address to listen on chain
-func (c *chain) add(addrs []string) (records map[string]int64) {
+// add address to listen on chain, records are keyed by the canonical addresses
+// and the invalid ones are rejected with their error
+func (c *chain) add(addrs []string) (records map[string]int64, rejected map[string]error) {
 	c.Lock()
 	defer c.Unlock()
 
 	changed := make(map[string]int64)
 
 	records = make(map[string]int64)
-	for _, addr := range addrs {
+	rejected = make(map[string]error)
+	for _, item := range addrs {
+		addr, err := c.canonical(item)
+		if err != nil {
+			rejected[item] = err
+			continue
+		}
 		if height, exist := c.addrs[addr]; exist {
 			records[addr] = height
 		} else {
@@ -326,11 +758,14 @@ func (c *chain) add(addrs []string) (records map[string]int64) {
 			changed[addr] = c.height
 		}
 	}
+	var begin = time.Now()
 	err := c.storage.SaveAddrs(changed)
+	c.metrics.Since("chainpot_storage_write_duration_seconds", begin, c.name, "save_addrs")
 	if err != nil {
-		log.Error().Str(poterr.AddErr.Error(), err.Error())
+		c.health.fail(err)
+		c.logger.Error().Msgf("%s: %s", poterr.AddErr.Error(), err.Error())
 	}
-	return records
+	return records, rejected
 }
 
 func (c *chain) isContractTx(tx types.TXN) bool {
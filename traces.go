@@ -0,0 +1,214 @@
+package chainpot
+
+import (
+	"context"
+	"fmt"
+	"math/big"
+	"strconv"
+	"strings"
+)
+
+// trace apis of the ethereum nodes
+const (
+	// geth debug_traceBlockByNumber with the callTracer
+	TraceDebug = "debug"
+	// openethereum and erigon trace_block
+	TraceParity = "parity"
+)
+
+// InternalTransfer is a value transfer made by a contract call inside a transaction
+type InternalTransfer struct {
+	Hash   string
+	From   string
+	To     string
+	Amount string
+	// indexes of the nested calls leading to the transfer, as "0.1"
+	Path string
+}
+
+// TraceReader is implemented by wallets tracing the internal transfers of a block,
+// the json-rpc of the chain conf is asked otherwise
+type TraceReader interface {
+	InternalTransfers(ctx context.Context, num *big.Int) ([]*InternalTransfer, error)
+}
+
+// sync the internal transfers of the block at num into or out of watched addresses
+func (c *chain) syncTraces(ctx context.Context, num *big.Int, isOldBlock bool) {
+	reader, ok := optional[TraceReader](c.origin.wallet)
+	if !ok {
+		if reader, ok = optional[TraceReader](c.lookup); !ok {
+			c.logger.Error().Msg("traces need the chain url or a TraceReader wallet")
+			return
+		}
+	}
+	transfers, err := reader.InternalTransfers(ctx, num)
+	if err != nil {
+		c.metrics.Add("chainpot_unfold_errors_total", 1, c.name, "traces")
+		c.health.fail(err)
+		c.logger.Error().Msgf("traces of block %d error: %s", num.Int64(), err.Error())
+		return
+	}
+
+	var height = num.Int64()
+	for _, item := range transfers {
+		var msg = &BlockMessage{
+			Hash:      strings.ToLower(item.Hash),
+			From:      strings.ToLower(item.From),
+			To:        strings.ToLower(item.To),
+			Amount:    item.Amount,
+			TracePath: item.Path,
+		}
+		var f1, f2 = c.watched(msg)
+		if !f1 && !f2 {
+			continue
+		}
+		c.metrics.Add("chainpot_matched_transactions_total", 1, c.name, c.origin.Symbol)
+		c.pend(&Value{TXN: msg, Height: height, IsOldBlock: isOldBlock, EventID: c.eventID, Contract: c.origin}, f1, f2)
+	}
+}
+
+// call frame of the geth callTracer
+type callFrame struct {
+	Type  string
+	From  string
+	To    string
+	Value string
+	Error string
+	Calls []*callFrame
+}
+
+// value transfers of the nested calls of frame, the failed calls and their children are skipped
+func (f *callFrame) transfers(hash string, path string, res []*InternalTransfer) []*InternalTransfer {
+	for i, call := range f.Calls {
+		if call.Error != "" {
+			continue
+		}
+		var sub = strconv.Itoa(i)
+		if path != "" {
+			sub = path + "." + sub
+		}
+		var kind = strings.ToUpper(call.Type)
+		if kind != "DELEGATECALL" && kind != "STATICCALL" && hexDecimal(call.Value) != "0" {
+			res = append(res, &InternalTransfer{Hash: hash, From: call.From, To: call.To, Amount: hexDecimal(call.Value), Path: sub})
+		}
+		res = call.transfers(hash, sub, res)
+	}
+	return res
+}
+
+// trace of the parity trace_block
+type parityTrace struct {
+	Type   string
+	Action struct {
+		CallType      string
+		From          string
+		To            string
+		Value         string
+		Address       string
+		RefundAddress string
+		Balance       string
+	}
+	Result *struct {
+		Address string
+	}
+	TraceAddress    []int
+	TransactionHash string
+	Error           string
+}
+
+// value transfers of the nested traces, the failed traces and their children are skipped
+func parityTransfers(traces []*parityTrace) []*InternalTransfer {
+	var res = make([]*InternalTransfer, 0)
+	var failed = make(map[string]bool)
+	for _, item := range traces {
+		var parts = make([]string, 0, len(item.TraceAddress))
+		for _, n := range item.TraceAddress {
+			parts = append(parts, strconv.Itoa(n))
+		}
+		var path = strings.Join(parts, ".")
+		var key = item.TransactionHash + "/" + path
+
+		var skip = item.Error != ""
+		for i := range parts {
+			if failed[item.TransactionHash+"/"+strings.Join(parts[:i], ".")] {
+				skip = true
+			}
+		}
+		if skip {
+			failed[key] = true
+			continue
+		}
+		// the top level call is the transaction itself
+		if len(parts) == 0 {
+			continue
+		}
+
+		var transfer = &InternalTransfer{Hash: item.TransactionHash, Path: path}
+		switch item.Type {
+		case "call":
+			if item.Action.CallType == "delegatecall" || item.Action.CallType == "staticcall" {
+				continue
+			}
+			transfer.From, transfer.To, transfer.Amount = item.Action.From, item.Action.To, hexDecimal(item.Action.Value)
+		case "create":
+			if item.Result == nil {
+				continue
+			}
+			transfer.From, transfer.To, transfer.Amount = item.Action.From, item.Result.Address, hexDecimal(item.Action.Value)
+		case "suicide":
+			transfer.From, transfer.To, transfer.Amount = item.Action.Address, item.Action.RefundAddress, hexDecimal(item.Action.Balance)
+		default:
+			continue
+		}
+		if transfer.Amount != "0" {
+			res = append(res, transfer)
+		}
+	}
+	return res
+}
+
+func (c *ethLookup) InternalTransfers(ctx context.Context, num *big.Int) ([]*InternalTransfer, error) {
+	var block = fmt.Sprintf("0x%x", num)
+	if c.traces == TraceParity {
+		var traces []*parityTrace
+		if err := c.rpc.call(ctx, "trace_block", &traces, block); err != nil {
+			return nil, err
+		}
+		return parityTransfers(traces), nil
+	}
+
+	var results []struct {
+		TxHash string
+		Result *callFrame
+	}
+	if err := c.rpc.call(ctx, "debug_traceBlockByNumber", &results, block, map[string]string{"tracer": "callTracer"}); err != nil {
+		return nil, err
+	}
+	// older nodes leave the hashes out, they're in the order of the block
+	var hashes []string
+	for _, item := range results {
+		if item.TxHash == "" {
+			var obj struct {
+				Transactions []string
+			}
+			if err := c.rpc.call(ctx, "eth_getBlockByNumber", &obj, block, false); err != nil {
+				return nil, err
+			}
+			hashes = obj.Transactions
+			break
+		}
+	}
+
+	var res = make([]*InternalTransfer, 0)
+	for i, item := range results {
+		var hash = item.TxHash
+		if hash == "" && i < len(hashes) {
+			hash = hashes[i]
+		}
+		if item.Result == nil || item.Result.Error != "" {
+			continue
+		}
+		res = item.Result.transfers(hash, "", res)
+	}
+	return res, nil
+}
@@ -0,0 +1,67 @@
+package chainpot
+
+import (
+	"github.com/fadeAce/chainpot/chainsim"
+	"github.com/fadeAce/claws"
+	"math/big"
+	"net/http/httptest"
+	"os"
+	"testing"
+)
+
+const simContract = "0x00000000000000000000000000000000000000c3"
+
+func TestChainpot_Traces(t *testing.T) {
+	for _, api := range []string{TraceDebug, TraceParity} {
+		t.Run(api, func(t *testing.T) {
+			var dir = tempDir(t)
+			defer os.RemoveAll(dir)
+
+			// heads come from the fake chain, traces are read on the simulator
+			var sim = chainsim.New(100)
+			var server = httptest.NewServer(chainsim.NewEthServer(sim))
+			defer server.Close()
+			var fake = NewFakeChain(100)
+
+			var cp = NewChainpot(&ChainConf{
+				Coins:    []Coins{{CoinType: "origin", Chain: "eth", Symbol: "eth"}},
+				Eth:      &EthConf{Url: server.URL, ConfirmTimes: 2, Storage: boltStorage(t, dir, "eth"), Traces: api},
+				Builders: map[string]claws.WalletBuilder{"eth": fake},
+			})
+			if err := cp.Register(Ethereum); err != nil {
+				t.Fatal(err)
+			}
+			cp.Add(Ethereum, []string{simTo})
+			var ch = startPot(t, cp, fake)
+
+			// the contract pays the watched address, which forwards a part,
+			// delegate calls and reverted calls move nothing
+			var tx = chainsim.Pay(simFrom, simContract, big.NewInt(10))
+			tx.Calls = []*chainsim.Call{
+				{Type: "CALL", From: simContract, To: simTo, Value: big.NewInt(3), Calls: []*chainsim.Call{
+					{Type: "CALL", From: simTo, To: simFrom, Value: big.NewInt(1)},
+				}},
+				{Type: "DELEGATECALL", From: simContract, To: simTo, Value: big.NewInt(5)},
+				{Type: "CALL", From: simContract, To: simTo, Value: big.NewInt(9), Error: "execution reverted", Calls: []*chainsim.Call{
+					{Type: "CALL", From: simTo, To: simFrom, Value: big.NewInt(4)},
+				}},
+			}
+			sim.Mine(tx)
+			fake.Mine()
+			sim.Mine()
+			fake.Mine()
+
+			var deposit = <-ch
+			if deposit.Event != T_DEPOSIT || deposit.ID != 1 || deposit.Content.Amount != "3" || deposit.Content.TracePath != "0" ||
+				deposit.Content.Hash != tx.Hash || deposit.CorrelationID != tx.Hash+":0:0" {
+				t.Fatalf("unexpected deposit %s", mustMarshal(deposit))
+			}
+			var withdraw = <-ch
+			if withdraw.Event != T_WITHDRAW || withdraw.ID != 3 || withdraw.Content.Amount != "1" || withdraw.Content.TracePath != "0.0" {
+				t.Fatalf("unexpected withdraw %s", mustMarshal(withdraw))
+			}
+			expectNone(t, ch)
+			stopPot(t, cp)
+		})
+	}
+}
@@ -0,0 +1,376 @@
+package chainpot
+
+import (
+	"context"
+	"github.com/fadeAce/chainpot/poterr"
+	"math/big"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+// a tracked transaction unknown to the node for that long is dropped
+const defaultDropAfter = 10 * time.Minute
+
+// tracked transactions looked up per block, the others wait for the next blocks,
+// and the time given to the lookups of a block
+const (
+	trackBatch   = 64
+	trackTimeout = 10 * time.Second
+)
+
+type TxState int
+
+// state of a transaction as seen by the node
+const (
+	TxUnknown TxState = iota
+	TxPending
+	TxMined
+	// its nonce was used by another transaction
+	TxReplaced
+)
+
+// TxInfo is what a node knows about a transaction
+type TxInfo struct {
+	State  TxState
+	Height int64
+	// mined with a failed receipt
+	Reverted bool
+	Content  *BlockMessage
+}
+
+// TxLookup is implemented by wallets able to look a transaction up by hash,
+// Track falls back to the json-rpc of the chain conf otherwise
+type TxLookup interface {
+	LookupTx(ctx context.Context, hash string) (*TxInfo, error)
+}
+
+type trackedTx struct {
+	hash    string
+	eventID int64
+	// last time the node knew the transaction
+	seen    time.Time
+	pending bool
+	// mined height, zero while not mined
+	height  int64
+	last    int64
+	content *BlockMessage
+	// symbol and request ID of a transaction of the withdrawal queue
+	symbol     string
+	withdrawal string
+}
+
+// Track follows an outgoing transaction through pending, mined and confirmed,
+// T_WITHDRAW_FAIL is emitted once it's reverted, replaced or dropped.
+// tracked transactions are kept in memory until they're confirmed or failed.
+// it fails with poterr.StoppedErr when the chain isn't running
+func (c *Chainpot) Track(chain PublicChain, hash string) error {
+	var obj = c.chainOf(chain)
+	if obj == nil {
+		return poterr.NotRegErr
+	}
+	if obj.lookup == nil {
+		return poterr.TrackErr
+	}
+	obj.health.Lock()
+	var running = obj.health.running
+	obj.health.Unlock()
+	if !running {
+		return poterr.StoppedErr
+	}
+	select {
+	case obj.trackQueue <- strings.ToLower(hash):
+		return nil
+	case <-obj.ctx.Done():
+		return poterr.StoppedErr
+	}
+}
+
+// start tracking hash, the events of a transaction take confirmTimes+1 IDs
+func (c *chain) track(hash string) {
+	if _, ok := c.tracking[hash]; ok {
+		return
+	}
+	if c.eventID == 0 {
+		c.eventID++
+	}
+	var t = &trackedTx{
+		hash:    hash,
+		eventID: c.eventID,
+		seen:    c.now(),
+		content: &BlockMessage{Hash: hash},
+	}
+	c.eventID += c.confirmTimes + 1
+	c.tracking[hash] = t
+
+	ctx, cancel := context.WithTimeout(c.ctx, trackTimeout)
+	defer cancel()
+	c.checkTx(ctx, t)
+}
+
+// look a batch of the tracked transactions up, it goes on from the last
+// one looked up so that every transaction gets its turn
+func (c *chain) checkTracked() {
+	var hashes = make([]string, 0, len(c.tracking))
+	for hash := range c.tracking {
+		hashes = append(hashes, hash)
+	}
+	sort.Strings(hashes)
+	if len(hashes) > trackBatch {
+		var start = sort.Search(len(hashes), func(i int) bool { return hashes[i] > c.trackLast })
+		var batch = make([]string, 0, trackBatch)
+		for i := 0; i < trackBatch; i++ {
+			batch = append(batch, hashes[(start+i)%len(hashes)])
+		}
+		hashes = batch
+	}
+
+	ctx, cancel := context.WithTimeout(c.ctx, trackTimeout)
+	defer cancel()
+	for _, hash := range hashes {
+		if ctx.Err() != nil {
+			return
+		}
+		c.trackLast = hash
+		if t, ok := c.tracking[hash]; ok {
+			c.checkTx(ctx, t)
+		}
+	}
+}
+
+func (c *chain) checkTx(ctx context.Context, t *trackedTx) {
+	info, err := c.lookup.LookupTx(ctx, t.hash)
+	if err != nil {
+		c.health.fail(err)
+		c.logger.Error().Msgf("lookup transaction %s error: %s", t.hash, err.Error())
+		return
+	}
+	if info.Content != nil {
+		t.content = info.Content
+	}
+
+	var now = c.now()
+	switch {
+	case info.State == TxReplaced:
+		c.untrack(t, "replaced")
+	case info.State == TxMined && info.Reverted:
+		t.height = info.Height
+		t.content.Reverted = true
+		c.untrack(t, "reverted")
+	case info.State == TxMined && info.Height <= c.processed:
+		t.seen = now
+		if t.height != info.Height {
+			t.height = info.Height
+			c.emitTracked(t, T_WITHDRAW, t.eventID+1, "")
+		}
+		var confirmations = c.processed - t.height + 1
+		if confirmations >= c.confirmTimes {
+			c.emitTracked(t, T_WITHDRAW_CONFIRM, t.eventID+c.confirmTimes, "")
+			delete(c.tracking, t.hash)
+			if t.withdrawal != "" {
+				c.settle(t.withdrawal, "")
+			}
+			return
+		}
+		if confirmations > 1 && c.processed > t.last {
+			c.emitTracked(t, T_WITHDRAW_UPDATE, t.eventID+confirmations, "")
+		}
+		t.last = c.processed
+	case info.State == TxUnknown:
+		// mined then reorganized out, it's waited for like a pending one
+		t.height = 0
+		if now.Sub(t.seen) > c.dropAfter {
+			c.untrack(t, "dropped")
+		}
+	default:
+		// pending, or mined beyond the processed height
+		t.seen = now
+		if !t.pending {
+			t.pending = true
+			c.emitTracked(t, T_WITHDRAW_PENDING, t.eventID, "")
+		}
+	}
+}
+
+func (c *chain) untrack(t *trackedTx, reason string) {
+	c.logger.Warn().Msgf("tracked transaction %s failed: %s", t.hash, reason)
+	c.emitTracked(t, T_WITHDRAW_FAIL, t.eventID+c.confirmTimes, reason)
+	delete(c.tracking, t.hash)
+	if t.withdrawal != "" {
+		c.settle(t.withdrawal, reason)
+	}
+}
+
+func (c *chain) emitTracked(t *trackedTx, e EventType, id int64, reason string) {
+	var symbol = c.origin.Symbol
+	if t.symbol != "" {
+		symbol = t.symbol
+	}
+	c.messageQueue <- &PotEvent{
+		Symbol:    symbol,
+		Chain:     c.name,
+		CoinType:  c.coinType(symbol),
+		Event:     e,
+		ID:        id,
+		Height:    t.height,
+		Content:   t.content,
+		Reason:    reason,
+		RequestID: t.withdrawal,
+	}
+}
+
+// ethereum lookup over json-rpc, the sender nonces are remembered to spot replacements
+type ethLookup struct {
+	rpc    *rpcClient
+	mu     sync.Mutex
+	nonces map[string]ethNonce
+	// trace api, TraceDebug or TraceParity
+	traces string
+}
+
+type ethNonce struct {
+	from  string
+	nonce uint64
+}
+
+func newEthLookup(url string) *ethLookup {
+	return &ethLookup{rpc: newRPCClient(url, "", "", "2.0"), nonces: make(map[string]ethNonce)}
+}
+
+func (c *ethLookup) LookupTx(ctx context.Context, hash string) (*TxInfo, error) {
+	var tx *struct {
+		Hash        string
+		From        string
+		To          string
+		Value       string
+		Nonce       string
+		BlockNumber *string
+	}
+	if err := c.rpc.call(ctx, "eth_getTransactionByHash", &tx, hash); err != nil {
+		return nil, err
+	}
+
+	if tx == nil {
+		c.mu.Lock()
+		seen, ok := c.nonces[hash]
+		c.mu.Unlock()
+		if !ok {
+			return &TxInfo{State: TxUnknown}, nil
+		}
+		used, err := c.nonceUsed(ctx, seen)
+		if err != nil {
+			return nil, err
+		}
+		if used {
+			c.mu.Lock()
+			delete(c.nonces, hash)
+			c.mu.Unlock()
+			return &TxInfo{State: TxReplaced}, nil
+		}
+		return &TxInfo{State: TxUnknown}, nil
+	}
+
+	var seen = ethNonce{from: tx.From, nonce: hexUint64(tx.Nonce)}
+	c.mu.Lock()
+	c.nonces[hash] = seen
+	c.mu.Unlock()
+
+	var info = &TxInfo{
+		State:   TxPending,
+		Content: &BlockMessage{Hash: tx.Hash, From: tx.From, To: tx.To, Amount: hexDecimal(tx.Value)},
+	}
+	if tx.BlockNumber == nil {
+		// another transaction of the same nonce got mined
+		if used, err := c.nonceUsed(ctx, seen); err == nil && used {
+			info.State = TxReplaced
+		}
+		return info, nil
+	}
+
+	var receipt *struct {
+		Status            string
+		BlockNumber       string
+		GasUsed           string
+		EffectiveGasPrice string
+	}
+	if err := c.rpc.call(ctx, "eth_getTransactionReceipt", &receipt, hash); err != nil {
+		return nil, err
+	}
+	if receipt == nil {
+		return info, nil
+	}
+	info.State = TxMined
+	info.Height = int64(hexUint64(receipt.BlockNumber))
+	info.Reverted = receipt.Status == "0x0"
+	if gas, ok := new(big.Int).SetString(strings.TrimPrefix(receipt.GasUsed, "0x"), 16); ok {
+		if price, ok := new(big.Int).SetString(strings.TrimPrefix(receipt.EffectiveGasPrice, "0x"), 16); ok {
+			info.Content.Fee = new(big.Int).Mul(gas, price).String()
+		}
+	}
+	return info, nil
+}
+
+func (c *ethLookup) nonceUsed(ctx context.Context, seen ethNonce) (bool, error) {
+	var count string
+	if err := c.rpc.call(ctx, "eth_getTransactionCount", &count, seen.from, "latest"); err != nil {
+		return false, err
+	}
+	return hexUint64(count) > seen.nonce, nil
+}
+
+// bitcoin lookup over json-rpc, it needs a node with txindex for mined transactions
+type btcLookup struct {
+	rpc *rpcClient
+}
+
+func newBtcLookup(url, user, password string) *btcLookup {
+	return &btcLookup{rpc: newRPCClient(url, user, password, "1.0")}
+}
+
+func (c *btcLookup) LookupTx(ctx context.Context, hash string) (*TxInfo, error) {
+	var tx *struct {
+		Txid      string
+		Blockhash string
+	}
+	err := c.rpc.call(ctx, "getrawtransaction", &tx, strings.TrimPrefix(hash, "0x"), true)
+	if obj, ok := err.(*rpcError); ok && obj.Code == -5 {
+		return &TxInfo{State: TxUnknown}, nil
+	} else if err != nil {
+		return nil, err
+	}
+	if tx == nil {
+		return &TxInfo{State: TxUnknown}, nil
+	}
+
+	var info = &TxInfo{State: TxPending, Content: &BlockMessage{Hash: hash}}
+	if tx.Blockhash == "" {
+		return info, nil
+	}
+	var block struct {
+		Height int64
+	}
+	if err := c.rpc.call(ctx, "getblock", &block, tx.Blockhash, 1); err != nil {
+		return nil, err
+	}
+	info.State = TxMined
+	info.Height = block.Height
+	return info, nil
+}
+
+func hexUint64(s string) uint64 {
+	num, ok := new(big.Int).SetString(strings.TrimPrefix(s, "0x"), 16)
+	if !ok {
+		return 0
+	}
+	return num.Uint64()
+}
+
+// hex quantity as a decimal string
+func hexDecimal(s string) string {
+	num, ok := new(big.Int).SetString(strings.TrimPrefix(s, "0x"), 16)
+	if !ok {
+		return "0"
+	}
+	return num.String()
+}
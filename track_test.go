@@ -0,0 +1,180 @@
+package chainpot
+
+import (
+	"context"
+	"fmt"
+	"github.com/fadeAce/chainpot/chainsim"
+	"github.com/fadeAce/chainpot/poterr"
+	"github.com/fadeAce/claws"
+	"math/big"
+	"net/http/httptest"
+	"os"
+	"testing"
+	"time"
+)
+
+const (
+	simFrom = "0x00000000000000000000000000000000000000f1"
+	simTo   = "0x00000000000000000000000000000000000000f2"
+)
+
+func expectFail(t *testing.T, ch <-chan *PotEvent, id int64, reason string) {
+	select {
+	case event := <-ch:
+		if event.Event != T_WITHDRAW_FAIL || event.ID != id || event.Reason != reason {
+			t.Fatalf("expect %s failure %d, got %s", reason, id, mustMarshal(event))
+		}
+	case <-time.After(2 * time.Second):
+		t.Fatalf("timeout waiting for %s failure", reason)
+	}
+}
+
+func TestChainpot_Track(t *testing.T) {
+	var dir = tempDir(t)
+	defer os.RemoveAll(dir)
+
+	// heads come from the fake chain, transactions are looked up on the simulator
+	var sim = chainsim.New(100)
+	var server = httptest.NewServer(chainsim.NewEthServer(sim))
+	defer server.Close()
+	var fake = NewFakeChain(100)
+	var mine = func(txs ...BlockMessage) {
+		sim.Mine()
+		fake.Mine(txs...)
+	}
+
+	var cp = NewChainpot(&ChainConf{
+		Coins:    []Coins{{CoinType: "origin", Chain: "eth", Symbol: "eth"}},
+		Eth:      &EthConf{Url: server.URL, ConfirmTimes: 2, Storage: boltStorage(t, dir, "eth")},
+		Builders: map[string]claws.WalletBuilder{"eth": fake},
+		Clock:    fake.Now,
+	})
+	if err := cp.Track(Ethereum, "0x01"); err != poterr.NotRegErr {
+		t.Fatalf("unexpected error %v", err)
+	}
+	if err := cp.Register(Ethereum); err != nil {
+		t.Fatal(err)
+	}
+	if err := cp.Track(Ethereum, "0x01"); err != poterr.StoppedErr {
+		t.Fatalf("unexpected error before start %v", err)
+	}
+	cp.Add(Ethereum, []string{simFrom})
+	var ch = startPot(t, cp, fake)
+
+	// mined and confirmed, the block pipeline leaves the tracked transaction alone
+	var ok = sim.Submit(chainsim.Pay(simFrom, simTo, big.NewInt(5)))
+	if err := cp.Track(Ethereum, ok.Hash); err != nil {
+		t.Fatal(err)
+	}
+	expectEvents(t, ch, expected{T_WITHDRAW_PENDING, 1, ok.Hash})
+	mine(BlockMessage{Hash: ok.Hash, From: simFrom, To: simTo, Amount: "5"})
+	mine()
+	expectEvents(t, ch, expected{T_WITHDRAW, 2, ok.Hash})
+	mine()
+	expectEvents(t, ch, expected{T_WITHDRAW_CONFIRM, 3, ok.Hash})
+
+	// reverted
+	var reverted = chainsim.Pay(simFrom, simTo, big.NewInt(5))
+	reverted.Status = 0
+	sim.Submit(reverted)
+	cp.Track(Ethereum, reverted.Hash)
+	expectEvents(t, ch, expected{T_WITHDRAW_PENDING, 4, reverted.Hash})
+	mine()
+	mine()
+	expectFail(t, ch, 6, "reverted")
+
+	// replaced by another transaction of the same nonce
+	var replaced = sim.Submit(chainsim.Pay(simFrom, simTo, big.NewInt(5)))
+	cp.Track(Ethereum, replaced.Hash)
+	expectEvents(t, ch, expected{T_WITHDRAW_PENDING, 7, replaced.Hash})
+	sim.Drop(replaced.Hash)
+	var other = chainsim.Pay(simFrom, simTo, big.NewInt(6))
+	other.Nonce = replaced.Nonce
+	sim.Submit(other)
+	mine()
+	expectFail(t, ch, 9, "replaced")
+
+	// evicted and never mined
+	var dropped = sim.Submit(chainsim.Pay(simFrom, simTo, big.NewInt(5)))
+	cp.Track(Ethereum, dropped.Hash)
+	expectEvents(t, ch, expected{T_WITHDRAW_PENDING, 10, dropped.Hash})
+	sim.Drop(dropped.Hash)
+	mine()
+	expectNone(t, ch)
+	fake.Advance(defaultDropAfter + time.Minute)
+	mine()
+	expectFail(t, ch, 12, "dropped")
+
+	stopPot(t, cp)
+	if err := cp.Track(Ethereum, "0x01"); err != poterr.StoppedErr {
+		t.Fatalf("unexpected error after stop %v", err)
+	}
+}
+
+func TestChainpot_TrackFailover(t *testing.T) {
+	var dir = tempDir(t)
+	defer os.RemoveAll(dir)
+	var sim = chainsim.New(100)
+	var server = httptest.NewServer(chainsim.NewEthServer(sim))
+	defer server.Close()
+	var down = httptest.NewServer(nil)
+	down.Close()
+	var fake = NewFakeChain(100)
+	var cp = NewChainpot(&ChainConf{
+		Coins: []Coins{{CoinType: "origin", Chain: "eth", Symbol: "eth"}},
+		Eth: &EthConf{
+			Urls:         []string{down.URL, server.URL},
+			ConfirmTimes: 2,
+			Storage:      boltStorage(t, dir, "eth"),
+			RateLimit:    1000,
+		},
+		Builders: map[string]claws.WalletBuilder{"eth": fake},
+		Clock:    fake.Now,
+	})
+	if err := cp.Register(Ethereum); err != nil {
+		t.Fatal(err)
+	}
+	var ch = startPot(t, cp, fake)
+
+	// the json-rpc lookup fails over to the next endpoint
+	var tx = sim.Submit(chainsim.Pay(simFrom, simTo, big.NewInt(5)))
+	if err := cp.Track(Ethereum, tx.Hash); err != nil {
+		t.Fatal(err)
+	}
+	expectEvents(t, ch, expected{T_WITHDRAW_PENDING, 1, tx.Hash})
+	stopPot(t, cp)
+}
+
+type countingLookup struct {
+	seen map[string]int
+}
+
+func (l *countingLookup) LookupTx(ctx context.Context, hash string) (*TxInfo, error) {
+	l.seen[hash]++
+	return &TxInfo{State: TxUnknown}, nil
+}
+
+func TestChain_CheckTrackedBatch(t *testing.T) {
+	var lookup = &countingLookup{seen: make(map[string]int)}
+	var c = &chain{
+		ctx:       context.Background(),
+		lookup:    lookup,
+		tracking:  make(map[string]*trackedTx),
+		now:       time.Now,
+		dropAfter: time.Hour,
+	}
+	for i := 0; i < 100; i++ {
+		var hash = fmt.Sprintf("0x%02d", i)
+		c.tracking[hash] = &trackedTx{hash: hash, seen: time.Now()}
+	}
+
+	c.checkTracked()
+	if len(lookup.seen) != trackBatch {
+		t.Fatalf("expect a batch of %d lookups, got %d", trackBatch, len(lookup.seen))
+	}
+	// the next block goes on with the others
+	c.checkTracked()
+	if len(lookup.seen) != 100 {
+		t.Fatalf("expect every transaction looked up, got %d", len(lookup.seen))
+	}
+}
@@ -0,0 +1,469 @@
+package chainpot
+
+import (
+	"context"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"github.com/boltdb/bolt"
+	"math/big"
+	"sort"
+	"strconv"
+	"strings"
+)
+
+// UTXO is an output paying a watched bitcoin address
+type UTXO struct {
+	Txid    string
+	Vout    uint32
+	Address string
+	Amount  string
+	Height  int64
+	// transaction spending the output and its height
+	SpentBy string `json:",omitempty"`
+	SpentAt int64  `json:",omitempty"`
+}
+
+func (u *UTXO) key() string {
+	return outpoint(u.Txid, u.Vout)
+}
+
+func outpoint(txid string, vout uint32) string {
+	return txid + ":" + strconv.FormatUint(uint64(vout), 10)
+}
+
+// TxInput spends the output Txid:Vout, its Address and Amount are set when the node serves the previous outputs
+type TxInput struct {
+	Txid    string
+	Vout    uint32
+	Address string
+	Amount  string
+}
+
+// TxOutput pays Address, Data is the payload of an OP_RETURN output
+type TxOutput struct {
+	Address string
+	Amount  string
+	Data    []byte
+}
+
+// UTXOTx is a bitcoin transaction with its inputs and outputs, amounts are in satoshis
+type UTXOTx struct {
+	Hash    string
+	Inputs  []*TxInput
+	Outputs []*TxOutput
+}
+
+// UTXOReader is implemented by wallets unfolding the inputs and outputs of a block,
+// the json-rpc of the chain conf is asked otherwise
+type UTXOReader interface {
+	UTXOTxs(ctx context.Context, num *big.Int) ([]*UTXOTx, error)
+}
+
+// UTXOStore is implemented by storages persisting the outputs of the watched addresses
+type UTXOStore interface {
+	SaveUTXOs(list []*UTXO) error
+	DeleteUTXOs(keys []string) error
+	LoadUTXOs() ([]*UTXO, error)
+}
+
+// load the persisted outputs of the watched addresses
+func (c *chain) loadUTXOs() {
+	store, ok := c.storage.(UTXOStore)
+	if !ok {
+		return
+	}
+	list, err := store.LoadUTXOs()
+	if err != nil {
+		c.logger.Error().Msgf("load utxos error: %s", err.Error())
+		return
+	}
+	for _, item := range list {
+		c.utxos[item.key()] = item
+	}
+}
+
+// sync the inputs and outputs of the block at num, replacing the transfers unfolded by the wallet
+func (c *chain) syncUTXO(ctx context.Context, num *big.Int, isOldBlock bool) {
+	reader, ok := optional[UTXOReader](c.origin.wallet)
+	if !ok {
+		if reader, ok = optional[UTXOReader](c.lookup); !ok {
+			c.logger.Error().Msg("utxo model needs the chain url or a UTXOReader wallet")
+			return
+		}
+	}
+	txs, err := reader.UTXOTxs(ctx, num)
+	if err != nil {
+		c.metrics.Add("chainpot_unfold_errors_total", 1, c.name, c.origin.Symbol)
+		c.health.fail(err)
+		c.logger.Error().Msgf("utxos of block %d error: %s", num.Int64(), err.Error())
+		return
+	}
+
+	var height = num.Int64()
+	var changed = make([]*UTXO, 0)
+	for _, tx := range txs {
+		changed = append(changed, c.matchUTXO(tx, height, isOldBlock)...)
+	}
+
+	// spent outputs are kept while their block may be synced again
+	var pruned = make([]string, 0)
+	for key, item := range c.utxos {
+		if item.SpentBy != "" && item.SpentAt < height-c.confirmTimes {
+			delete(c.utxos, key)
+			pruned = append(pruned, key)
+		}
+	}
+	if store, ok := c.storage.(UTXOStore); ok {
+		if err := store.SaveUTXOs(changed); err != nil {
+			c.health.fail(err)
+			c.logger.Error().Msgf("save utxos error: %s", err.Error())
+		}
+		if err := store.DeleteUTXOs(pruned); err != nil {
+			c.logger.Error().Msgf("delete utxos error: %s", err.Error())
+		}
+	}
+}
+
+// pend a deposit per watched output and a withdrawal per watched address spending tx,
+// the outputs back to a spending address are change netted from its withdrawal
+func (c *chain) matchUTXO(tx *UTXOTx, height int64, isOldBlock bool) []*UTXO {
+	var changed = make([]*UTXO, 0)
+	var spent = make(map[string]*big.Int)
+	var spentKeys = make(map[string][]string)
+	var firstInput = make(map[string]int)
+	var inputs, known = new(big.Int), true
+	for i, in := range tx.Inputs {
+		var key = outpoint(in.Txid, in.Vout)
+		var addr, amount = in.Address, in.Amount
+		if item, ok := c.utxos[key]; ok {
+			addr, amount = item.Address, item.Amount
+			item.SpentBy, item.SpentAt = tx.Hash, height
+			changed = append(changed, item)
+		}
+		value, ok := new(big.Int).SetString(amount, 10)
+		if !ok {
+			known = false
+			continue
+		}
+		inputs.Add(inputs, value)
+		addr = c.normalize(addr)
+		if _, ok := c.addrs[addr]; !ok {
+			continue
+		}
+		if _, ok := spent[addr]; !ok {
+			spent[addr] = new(big.Int)
+			firstInput[addr] = i
+		}
+		spent[addr].Add(spent[addr], value)
+		spentKeys[addr] = append(spentKeys[addr], key)
+	}
+
+	// the first OP_RETURN output is the memo of the deposits to shared addresses
+	var memo string
+	for _, out := range tx.Outputs {
+		if len(out.Data) > 0 {
+			memo = memoString(out.Data)
+			break
+		}
+	}
+
+	// tracked transactions report their own withdraw lifecycle
+	var hash = strings.ToLower(tx.Hash)
+	_, tracked := c.tracking[hash]
+	tracked = tracked || c.ownHashes[hash]
+	var addrs = make([]string, 0, len(spent))
+	for addr := range spent {
+		addrs = append(addrs, addr)
+	}
+	sort.Slice(addrs, func(i, j int) bool {
+		return firstInput[addrs[i]] < firstInput[addrs[j]]
+	})
+	// outputs to the other watched addresses are internal transfers from the first spending one
+	var sender string
+	if len(addrs) > 0 && !tracked {
+		sender = addrs[0]
+	}
+
+	var payee string
+	for _, out := range tx.Outputs {
+		out.Address = c.normalize(out.Address)
+		if _, ok := c.addrs[out.Address]; !ok && payee == "" {
+			payee = out.Address
+		}
+	}
+	// a spend paying the watched addresses only has no change, every output is internal
+	var internalOnly = sender != "" && payee == ""
+
+	var change = make(map[string]*big.Int)
+	var outputs, internal = new(big.Int), new(big.Int)
+	var received = make([]int, 0)
+	var values = make([]*big.Int, len(tx.Outputs))
+	for i, out := range tx.Outputs {
+		value, ok := new(big.Int).SetString(out.Amount, 10)
+		if !ok {
+			value = new(big.Int)
+		}
+		values[i] = value
+		outputs.Add(outputs, value)
+		if _, ok := c.addrs[out.Address]; !ok {
+			continue
+		}
+
+		var vout = uint32(i)
+		var key = outpoint(tx.Hash, vout)
+		if _, ok := c.utxos[key]; !ok {
+			var item = &UTXO{Txid: tx.Hash, Vout: vout, Address: out.Address, Amount: value.String(), Height: height}
+			c.utxos[key] = item
+			changed = append(changed, item)
+		}
+		if _, ok := spent[out.Address]; ok && !internalOnly {
+			if change[out.Address] == nil {
+				change[out.Address] = new(big.Int)
+			}
+			change[out.Address].Add(change[out.Address], value)
+			continue
+		}
+		received = append(received, i)
+		if sender != "" {
+			internal.Add(internal, value)
+		}
+	}
+	var fee string
+	if known && len(tx.Inputs) > 0 {
+		fee = new(big.Int).Sub(inputs, outputs).String()
+	}
+
+	for n, i := range received {
+		var out = tx.Outputs[i]
+		var vout = uint32(i)
+		var from = sender
+		if from == "" && len(tx.Inputs) > 0 {
+			from = tx.Inputs[0].Address
+		}
+		var msg = &BlockMessage{Hash: tx.Hash, From: from, To: out.Address, Amount: values[i].String(), Vout: &vout}
+		if c.shared(out.Address) {
+			msg.Memo = memo
+		}
+		if internalOnly && n == 0 {
+			// nothing left the watched addresses, the internal transfers carry the fee
+			msg.Fee = fee
+		}
+		c.metrics.Add("chainpot_matched_transactions_total", 1, c.name, c.origin.Symbol)
+		c.pend(&Value{TXN: msg, Height: height, Index: int64(i), IsOldBlock: isOldBlock, EventID: c.eventID, Contract: c.origin}, sender != "", true)
+	}
+
+	if tracked || internalOnly {
+		return changed
+	}
+	// the internal transfers are taken off the spending addresses pro rata of what they paid out
+	var paid = make(map[string]*big.Int)
+	var total = new(big.Int)
+	for _, addr := range addrs {
+		paid[addr] = new(big.Int).Set(spent[addr])
+		if change[addr] != nil {
+			paid[addr].Sub(paid[addr], change[addr])
+		}
+		if paid[addr].Sign() > 0 {
+			total.Add(total, paid[addr])
+		}
+	}
+	if internal.Sign() > 0 && total.Sign() > 0 {
+		var left = new(big.Int).Set(internal)
+		for _, addr := range addrs {
+			if paid[addr].Sign() <= 0 {
+				continue
+			}
+			var share = new(big.Int).Mul(internal, paid[addr])
+			share.Div(share, total)
+			paid[addr].Sub(paid[addr], share)
+			left.Sub(left, share)
+		}
+		// the rounding remainder goes to the ones paying out the most
+		var order = append([]string{}, addrs...)
+		sort.SliceStable(order, func(i, j int) bool {
+			return paid[order[i]].Cmp(paid[order[j]]) > 0
+		})
+		for _, addr := range order {
+			if left.Sign() <= 0 {
+				break
+			}
+			var take = new(big.Int).Set(left)
+			if paid[addr].Cmp(take) < 0 {
+				take.Set(paid[addr])
+			}
+			if take.Sign() > 0 {
+				paid[addr].Sub(paid[addr], take)
+				left.Sub(left, take)
+			}
+		}
+	}
+	for _, addr := range addrs {
+		var msg = &BlockMessage{Hash: tx.Hash, From: addr, To: payee, Fee: fee, Amount: paid[addr].String(), Spent: spentKeys[addr]}
+		if change[addr] != nil {
+			msg.Change = change[addr].String()
+		}
+		c.metrics.Add("chainpot_matched_transactions_total", 1, c.name, c.origin.Symbol)
+		c.pend(&Value{TXN: msg, Height: height, Index: int64(firstInput[addr]), IsOldBlock: isOldBlock, EventID: c.eventID, Contract: c.origin}, true, false)
+	}
+	return changed
+}
+
+// decimal BTC amount of the node as satoshis
+func satoshis(s string) string {
+	var neg = strings.HasPrefix(s, "-")
+	s = strings.TrimPrefix(s, "-")
+	var parts = strings.SplitN(s, ".", 2)
+	var frac string
+	if len(parts) == 2 {
+		frac = parts[1]
+	}
+	if len(frac) > 8 {
+		frac = frac[:8]
+	}
+	num, ok := new(big.Int).SetString(parts[0]+frac+strings.Repeat("0", 8-len(frac)), 10)
+	if !ok {
+		return "0"
+	}
+	if neg {
+		num.Neg(num)
+	}
+	return num.String()
+}
+
+type btcScript struct {
+	Type      string
+	Address   string
+	Addresses []string
+	Hex       string
+}
+
+func (s *btcScript) address() string {
+	if s.Address == "" && len(s.Addresses) > 0 {
+		return s.Addresses[0]
+	}
+	return s.Address
+}
+
+func (c *btcLookup) UTXOTxs(ctx context.Context, num *big.Int) ([]*UTXOTx, error) {
+	var hash string
+	if err := c.rpc.call(ctx, "getblockhash", &hash, num.Int64()); err != nil {
+		return nil, err
+	}
+	// verbosity 3 adds the previous outputs of the inputs, older nodes serve 2
+	var block struct {
+		Tx []struct {
+			Txid string
+			Vin  []struct {
+				Coinbase string
+				Txid     string
+				Vout     uint32
+				Prevout  *struct {
+					Value        json.Number
+					ScriptPubKey btcScript
+				}
+			}
+			Vout []struct {
+				Value        json.Number
+				N            uint32
+				ScriptPubKey btcScript
+			}
+		}
+	}
+	if err := c.rpc.call(ctx, "getblock", &block, hash, 3); err != nil {
+		return nil, err
+	}
+
+	var res = make([]*UTXOTx, 0, len(block.Tx))
+	for _, item := range block.Tx {
+		var tx = &UTXOTx{Hash: item.Txid}
+		for _, in := range item.Vin {
+			if in.Coinbase != "" {
+				continue
+			}
+			var input = &TxInput{Txid: in.Txid, Vout: in.Vout}
+			if in.Prevout != nil {
+				input.Address = in.Prevout.ScriptPubKey.address()
+				input.Amount = satoshis(in.Prevout.Value.String())
+			}
+			tx.Inputs = append(tx.Inputs, input)
+		}
+		tx.Outputs = make([]*TxOutput, len(item.Vout))
+		for i, out := range item.Vout {
+			var n = out.N
+			if int(n) >= len(tx.Outputs) {
+				n = uint32(i)
+			}
+			tx.Outputs[n] = &TxOutput{Address: out.ScriptPubKey.address(), Amount: satoshis(out.Value.String())}
+			if out.ScriptPubKey.Type == "nulldata" {
+				script, _ := hex.DecodeString(out.ScriptPubKey.Hex)
+				tx.Outputs[n].Data = nullData(script)
+			}
+		}
+		for i := range tx.Outputs {
+			if tx.Outputs[i] == nil {
+				tx.Outputs[i] = &TxOutput{Amount: "0"}
+			}
+		}
+		res = append(res, tx)
+	}
+	return res, nil
+}
+
+var utxosBucket = []byte("utxos")
+
+func (c *BoltStorage) createUTXOs() error {
+	return c.Database.Update(func(tx *bolt.Tx) error {
+		_, err := tx.CreateBucketIfNotExists(utxosBucket)
+		return err
+	})
+}
+
+func (c *BoltStorage) SaveUTXOs(list []*UTXO) error {
+	if len(list) == 0 {
+		return nil
+	}
+	return c.Database.Update(func(tx *bolt.Tx) error {
+		var bucket = tx.Bucket(utxosBucket)
+		for _, item := range list {
+			bs, err := json.Marshal(item)
+			if err != nil {
+				return err
+			}
+			if err := bucket.Put([]byte(item.key()), bs); err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+}
+
+func (c *BoltStorage) DeleteUTXOs(keys []string) error {
+	if len(keys) == 0 {
+		return nil
+	}
+	return c.Database.Update(func(tx *bolt.Tx) error {
+		var bucket = tx.Bucket(utxosBucket)
+		for _, key := range keys {
+			if err := bucket.Delete([]byte(key)); err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+}
+
+func (c *BoltStorage) LoadUTXOs() ([]*UTXO, error) {
+	var res = make([]*UTXO, 0)
+	err := c.Database.View(func(tx *bolt.Tx) error {
+		return tx.Bucket(utxosBucket).ForEach(func(k, v []byte) error {
+			var item = &UTXO{}
+			if err := json.Unmarshal(v, item); err != nil {
+				return fmt.Errorf("utxo %s: %s", k, err.Error())
+			}
+			res = append(res, item)
+			return nil
+		})
+	})
+	return res, err
+}
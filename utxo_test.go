@@ -0,0 +1,155 @@
+package chainpot
+
+import (
+	"github.com/fadeAce/chainpot/chainsim"
+	"github.com/fadeAce/claws"
+	"math/big"
+	"net/http/httptest"
+	"os"
+	"strings"
+	"testing"
+)
+
+func TestSatoshis(t *testing.T) {
+	for in, want := range map[string]string{"1.5": "150000000", "0.00000001": "1", "21": "2100000000", "0.123456789": "12345678", "-0.1": "-10000000"} {
+		if res := satoshis(in); res != want {
+			t.Fatalf("satoshis of %s: expect %s, got %s", in, want, res)
+		}
+	}
+}
+
+func TestChainpot_UTXO(t *testing.T) {
+	for _, legacy := range []bool{false, true} {
+		t.Run(map[bool]string{false: "prevouts", true: "legacy"}[legacy], func(t *testing.T) {
+			var dir = tempDir(t)
+			defer os.RemoveAll(dir)
+
+			// heads come from the fake chain, blocks are read on the simulator
+			var sim = chainsim.New(100)
+			var node = chainsim.NewBtcServer(sim)
+			node.Legacy = legacy
+			var server = httptest.NewServer(node)
+			defer server.Close()
+			var fake = NewFakeChain(100)
+
+			var storage = boltStorage(t, dir, "btc")
+			var cp = NewChainpot(&ChainConf{
+				Coins:    []Coins{{CoinType: "origin", Chain: "btc", Symbol: "btc"}},
+				Btc:      &BtcConf{Url: server.URL, ConfirmTimes: 2, Storage: storage, UTXO: true},
+				Builders: map[string]claws.WalletBuilder{"btc": fake},
+			})
+			if err := cp.Register(Bitcoin); err != nil {
+				t.Fatal(err)
+			}
+			cp.Add(Bitcoin, []string{testAddr, testOther})
+			var ch = startPot(t, cp, fake)
+
+			// one transaction paying both watched addresses
+			var pay = chainsim.Spend(nil,
+				&chainsim.TxOut{Address: testAddr, Value: big.NewInt(100000)},
+				&chainsim.TxOut{Address: "bc1qexternal", Value: big.NewInt(5)},
+				&chainsim.TxOut{Address: testOther, Value: big.NewInt(2000)},
+			)
+			sim.Mine(pay)
+			fake.Mine()
+			var payHash = strings.TrimPrefix(pay.Hash, "0x")
+			for i, want := range []struct {
+				id     int64
+				to     string
+				vout   uint32
+				amount string
+			}{{1, testAddr, 0, "100000"}, {3, testOther, 2, "2000"}} {
+				var event = <-ch
+				if event.Event != T_DEPOSIT || event.ID != want.id || event.Content.To != want.to || event.Content.Vout == nil ||
+					*event.Content.Vout != want.vout || event.Content.Amount != want.amount || event.Content.Hash != payHash {
+					t.Fatalf("unexpected deposit %d: %s", i, mustMarshal(event))
+				}
+			}
+
+			// the first one is spent with change back and a part to the other watched address
+			var spend = chainsim.Spend([]*chainsim.TxIn{{Txid: pay.Hash, Vout: 0}},
+				&chainsim.TxOut{Address: "bc1qexternal", Value: big.NewInt(60000)},
+				&chainsim.TxOut{Address: testAddr, Value: big.NewInt(39000)},
+				&chainsim.TxOut{Address: testOther, Value: big.NewInt(500)},
+			)
+			sim.Mine(spend)
+			fake.Mine()
+			var spendHash = strings.TrimPrefix(spend.Hash, "0x")
+			var withdraw = <-ch
+			if withdraw.Event != T_WITHDRAW || withdraw.ID != 7 || withdraw.Content.From != testAddr || withdraw.Content.To != "bc1qexternal" ||
+				withdraw.Content.Amount != "60500" || withdraw.Content.Change != "39000" || withdraw.Content.Fee != "500" ||
+				len(withdraw.Content.Spent) != 1 || withdraw.Content.Spent[0] != payHash+":0" || withdraw.CorrelationID != spendHash+":0:in" {
+				t.Fatalf("unexpected withdraw %s", mustMarshal(withdraw))
+			}
+			// the part to the other watched address is an internal transfer
+			var transfer = <-ch
+			if transfer.Event != T_INTERNAL || transfer.ID != 5 || transfer.Content.From != testAddr || transfer.Content.To != testOther ||
+				*transfer.Content.Vout != 2 || transfer.Content.Amount != "500" || transfer.CorrelationID != spendHash+":2" {
+				t.Fatalf("unexpected internal transfer %s", mustMarshal(transfer))
+			}
+			expectNone(t, ch)
+
+			// a spend between watched addresses only is a single internal transfer carrying the fee
+			var merge = chainsim.Spend([]*chainsim.TxIn{{Txid: pay.Hash, Vout: 2}, {Txid: spend.Hash, Vout: 2}},
+				&chainsim.TxOut{Address: testAddr, Value: big.NewInt(2400)},
+			)
+			sim.Mine(merge)
+			fake.Mine()
+			var mergeHash = strings.TrimPrefix(merge.Hash, "0x")
+			transfer = <-ch
+			if transfer.Event != T_INTERNAL || transfer.ID != 9 || transfer.Content.From != testOther || transfer.Content.To != testAddr ||
+				transfer.Content.Amount != "2400" || transfer.Content.Fee != "100" || transfer.CorrelationID != mergeHash+":0" {
+				t.Fatalf("unexpected internal transfer %s", mustMarshal(transfer))
+			}
+			expectNone(t, ch)
+
+			// the outputs of the watched addresses are persisted with the spent ones
+			list, err := storage.(UTXOStore).LoadUTXOs()
+			if err != nil {
+				t.Fatal(err)
+			}
+			var spent = 0
+			for _, item := range list {
+				if item.SpentBy != "" {
+					spent++
+					if item.key() == payHash+":0" && (item.SpentBy != spendHash || item.SpentAt != 102) {
+						t.Fatalf("unexpected spent output %s", mustMarshal(item))
+					}
+				}
+			}
+			if len(list) != 5 || spent != 3 {
+				t.Fatalf("unexpected outputs %s", mustMarshal(list))
+			}
+
+			// the transfer to a third watched address is taken off both spending ones pro rata
+			var third = "bc1qcr8te4kr609gcawutmrza0j4xv80jy8z306fyu"
+			cp.Add(Bitcoin, []string{third})
+			var pay2 = chainsim.Spend(nil, &chainsim.TxOut{Address: testOther, Value: big.NewInt(5000)})
+			sim.Mine(pay2)
+			fake.Mine()
+			expectEvents(t, ch, expected{T_DEPOSIT, 11, strings.TrimPrefix(pay2.Hash, "0x")})
+			var both = chainsim.Spend([]*chainsim.TxIn{{Txid: merge.Hash, Vout: 0}, {Txid: pay2.Hash, Vout: 0}},
+				&chainsim.TxOut{Address: third, Value: big.NewInt(4000)},
+				&chainsim.TxOut{Address: "bc1qexternal", Value: big.NewInt(3000)},
+			)
+			sim.Mine(both)
+			fake.Mine()
+			for _, want := range []struct {
+				e      EventType
+				id     int64
+				from   string
+				amount string
+			}{{T_WITHDRAW, 15, testAddr, "1103"}, {T_WITHDRAW, 17, testOther, "2297"}, {T_INTERNAL, 13, testAddr, "4000"}} {
+				var event = <-ch
+				if event.Event != want.e || event.ID != want.id || event.Content.From != want.from || event.Content.Amount != want.amount {
+					t.Fatalf("unexpected event %s", mustMarshal(event))
+				}
+				if want.e == T_WITHDRAW && (event.Content.To != "bc1qexternal" || event.Content.Fee != "400") {
+					t.Fatalf("unexpected withdraw %s", mustMarshal(event))
+				}
+			}
+			expectNone(t, ch)
+			stopPot(t, cp)
+		})
+	}
+}
@@ -0,0 +1,96 @@
+package chainpot
+
+import (
+	"context"
+	"strings"
+	"time"
+)
+
+// Reconnector is implemented by wallets able to re-establish their node connection,
+// the watchdog calls it on a stall when Reconnect is enabled in the chain conf
+type Reconnector interface {
+	Reconnect(ctx context.Context) error
+}
+
+// the watchdog looks for a stall at most every second
+const maxWatchTick = time.Second
+
+// watch the heads of the chain until head intake stops,
+// T_STALL is emitted once no head came for StallAfter
+func (c *chain) watch() {
+	defer c.routines.Done()
+
+	var tick = c.health.stallAfter / 4
+	if tick > maxWatchTick {
+		tick = maxWatchTick
+	}
+	var ticker = time.NewTicker(tick)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-c.headCtx.Done():
+			return
+		case <-ticker.C:
+			c.checkStall()
+		}
+	}
+}
+
+func (c *chain) checkStall() {
+	var now = c.now()
+	var h = c.health
+	h.Lock()
+	var since = h.lastHead
+	if since.IsZero() {
+		since = h.started
+	}
+	var stalled = now.Sub(since) > h.stallAfter
+	var changed = stalled && !h.stalled
+	var retry = stalled && c.reconnect && now.Sub(h.reconnected) >= h.stallAfter
+	if changed {
+		h.stalled = true
+	}
+	if retry {
+		h.reconnected = now
+	}
+	var height = h.nodeHeight
+	h.Unlock()
+
+	if changed {
+		c.logger.Warn().Msgf("%s stalled, no head since %s", strings.ToUpper(c.origin.Chain), since.Format(time.RFC3339))
+		c.metrics.Set("chainpot_stalled", 1, c.name)
+		c.alert(T_STALL, height)
+	}
+	if retry {
+		c.reconnectHead()
+	}
+}
+
+// reconnect the wallet when it supports it and subscribe to the heads again
+func (c *chain) reconnectHead() {
+	if obj, ok := optional[Reconnector](c.origin.wallet); ok {
+		if err := obj.Reconnect(c.headCtx); err != nil {
+			c.health.fail(err)
+			c.logger.Error().Msgf("reconnect error: %s", err.Error())
+			return
+		}
+	}
+	c.logger.Info().Msgf("%s subscribing to heads again", strings.ToUpper(c.origin.Chain))
+	c.subscribeHead()
+}
+
+// queue a watchdog event of the chain
+func (c *chain) alert(e EventType, height int64) {
+	var event = &PotEvent{
+		Symbol:   c.origin.Symbol,
+		Chain:    c.name,
+		CoinType: c.origin.CoinType,
+		Event:    e,
+		Height:   height,
+	}
+	select {
+	case c.messageQueue <- event:
+	case <-c.headCtx.Done():
+	}
+}
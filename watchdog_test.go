@@ -0,0 +1,53 @@
+package chainpot
+
+import (
+	"context"
+	"github.com/fadeAce/claws"
+	"os"
+	"testing"
+	"time"
+)
+
+func TestChainpot_Stall(t *testing.T) {
+	var dir = tempDir(t)
+	defer os.RemoveAll(dir)
+	var fake = NewFakeChain(100)
+	var cp = NewChainpot(&ChainConf{
+		Coins: []Coins{{CoinType: "origin", Chain: "btc", Symbol: "btc"}},
+		Btc: &BtcConf{
+			ConfirmTimes: 2,
+			Storage:      boltStorage(t, dir, "btc"),
+			StallAfter:   30 * time.Minute,
+			Reconnect:    true,
+		},
+		Builders: map[string]claws.WalletBuilder{"btc": fake},
+		Clock:    fake.Now,
+	})
+	if err := cp.Register(Bitcoin); err != nil {
+		t.Fatal(err)
+	}
+	var ch = cp.Events(context.Background(), &Filter{Events: []EventType{T_STALL, T_RECOVER}})
+	var n = fake.Listen(-1, 0)
+	cp.Start(nil)
+	n = fake.Listen(n, 2*time.Second)
+
+	fake.Mine()
+	fake.Advance(20 * time.Minute)
+	expectNone(t, ch)
+
+	fake.Advance(11 * time.Minute)
+	expectEvents(t, ch, expected{Event: T_STALL})
+	if !cp.Status()[Bitcoin].Stalled {
+		t.Fatal("stall is not reported by status")
+	}
+	if fake.Listen(n, 2*time.Second) <= n || fake.Reconnects() != 1 {
+		t.Fatal("watchdog did not reconnect")
+	}
+
+	fake.Mine()
+	expectEvents(t, ch, expected{Event: T_RECOVER})
+	if cp.Status()[Bitcoin].Stalled {
+		t.Fatal("stall is reported after heads resumed")
+	}
+	stopPot(t, cp)
+}
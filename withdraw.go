@@ -0,0 +1,742 @@
+package chainpot
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"github.com/boltdb/bolt"
+	"github.com/fadeAce/chainpot/poterr"
+	"github.com/fadeAce/claws"
+	"github.com/fadeAce/claws/types"
+	"math/big"
+	"sort"
+	"strings"
+	"time"
+)
+
+const (
+	// a submitted withdrawal neither mined nor replaced for that long is resubmitted
+	defaultStuckAfter = 10 * time.Minute
+	// percent added to the last gas price on every replacement
+	defaultFeeBump  = 10
+	defaultMaxBumps = 3
+	// failed submissions before a withdrawal is given up
+	maxSendAttempts = 5
+)
+
+var withdrawalsBucket = []byte("withdrawals")
+
+// WithdrawRequest asks the withdrawal queue of a chain to send Amount of Symbol
+type WithdrawRequest struct {
+	// idempotency key, a request repeating it gets the first withdrawal back
+	ID     string
+	Symbol string
+	From   string
+	To     string
+	Amount string
+}
+
+type WithdrawState int
+
+const (
+	WithdrawQueued WithdrawState = iota
+	WithdrawSubmitted
+	// mined, its confirmations are followed like a tracked transaction
+	WithdrawMined
+	WithdrawConfirmed
+	WithdrawFailed
+	// persisted before its broadcast, a send without a known outcome leaves it there until
+	// resolved by its nonce or ResolveWithdrawal, it's never sent again blindly
+	WithdrawSending
+)
+
+// ErrRejected is wrapped by senders when the node refused the transaction, only such an
+// error lets a withdrawal without a nonce be sent again
+var ErrRejected = errors.New("chainpot: the node rejected the transaction")
+
+// Withdrawal is the persisted progress of a WithdrawRequest
+type Withdrawal struct {
+	Request *WithdrawRequest
+	State   WithdrawState
+	// order of the requests, nonces are given in that order
+	Seq int64
+	// first ID of the events of the withdrawal, they take confirmTimes+1 IDs
+	EventID  int64
+	Nonce    uint64
+	HasNonce bool
+	// every submitted hash, a replacement appends one
+	Hashes []string
+	// the mined one of Hashes
+	Hash string
+	// gas price in wei of the last submission, replacements raise it
+	GasPrice  string `json:",omitempty"`
+	Bumps     int
+	Attempts  int
+	Submitted time.Time
+	// why it failed, as in PotEvent.Reason
+	Reason string `json:",omitempty"`
+	// last submission error
+	Error string `json:",omitempty"`
+	// hash of the send in doubt given by ResolveWithdrawal, taken over by the chain loop
+	Resolved string `json:",omitempty"`
+}
+
+func (w *Withdrawal) copy() *Withdrawal {
+	var obj = *w
+	var req = *w.Request
+	obj.Request = &req
+	obj.Hashes = append([]string{}, w.Hashes...)
+	return &obj
+}
+
+// WithdrawalStore is implemented by storages persisting the withdrawal queue,
+// the queue is only kept in memory otherwise
+type WithdrawalStore interface {
+	SaveWithdrawal(w *Withdrawal) error
+	LoadWithdrawals() ([]*Withdrawal, error)
+}
+
+// OutTx is a transaction submitted by the withdrawal queue
+type OutTx struct {
+	Symbol string
+	From   string
+	To     string
+	Amount string
+	// account nonce, only set on ethereum
+	Nonce    uint64
+	HasNonce bool
+	// replacements of a stuck withdrawal so far
+	Bump int
+	// gas price in wei as a decimal, empty leaves the fee to the sender
+	GasPrice string
+}
+
+// Sender is implemented by wallets submitting the withdrawals with the nonce and fee
+// chosen by the queue, other wallets are sent through claws with ChainConf.Accounts
+type Sender interface {
+	SendTx(ctx context.Context, tx *OutTx) (hash string, err error)
+}
+
+// Replacer is implemented by senders signing OutTx.Nonce and OutTx.GasPrice as given,
+// a stuck ethereum withdrawal is replaced through them by one of the same nonce
+type Replacer interface {
+	ReplaceTx(ctx context.Context, tx *OutTx) (hash string, err error)
+}
+
+// Rebroadcaster is implemented by senders able to broadcast again the signed transaction
+// of a hash they sent, it's how a stuck withdrawal is resubmitted without a Replacer
+type Rebroadcaster interface {
+	Rebroadcast(ctx context.Context, hash string) error
+}
+
+// NonceSource is implemented by senders or lookups knowing the next nonce of an
+// account including the node mempool
+type NonceSource interface {
+	PendingNonce(ctx context.Context, addr string) (uint64, error)
+}
+
+// GasPricer is implemented by senders or lookups suggesting the gas price of first submissions
+type GasPricer interface {
+	GasPrice(ctx context.Context) (*big.Int, error)
+}
+
+// claws sender signing with the account bundles of the conf, the nonce and the fee
+// are left to claws as its send option is opaque to chainpot
+type clawsSender struct {
+	wallet   claws.Wallet
+	accounts map[string]types.Bundle
+}
+
+func (s *clawsSender) SendTx(ctx context.Context, tx *OutTx) (string, error) {
+	var from, ok = s.accounts[tx.From]
+	if !ok {
+		return "", errors.New("no account bundle for " + tx.From)
+	}
+	res, err := s.wallet.Send(ctx, from, s.wallet.BuildBundle("", "", tx.To), tx.Amount, &types.Option{})
+	if err != nil {
+		return "", err
+	}
+	if obj, ok := res.(interface{ HexStr() string }); ok {
+		return obj.HexStr(), nil
+	}
+	return "", errors.New("claws transaction has no hash")
+}
+
+// Withdraw enqueues req on chain, a request with a known ID returns the first withdrawal.
+// its outcome is streamed as the tracked transactions one with PotEvent.RequestID set
+func (c *Chainpot) Withdraw(chain PublicChain, req *WithdrawRequest) (*Withdrawal, error) {
+	var obj = c.chainOf(chain)
+	if obj == nil {
+		return nil, poterr.NotRegErr
+	}
+	return obj.withdraw(req)
+}
+
+// Withdrawal returns the progress of the request id, nil when unknown
+func (c *Chainpot) Withdrawal(chain PublicChain, id string) *Withdrawal {
+	var obj = c.chainOf(chain)
+	if obj == nil {
+		return nil
+	}
+	obj.withdrawMu.Lock()
+	defer obj.withdrawMu.Unlock()
+	if w, ok := obj.withdrawals[id]; ok {
+		return w.copy()
+	}
+	return nil
+}
+
+// ResolveWithdrawal settles a withdrawal left in doubt by a send error or a crash during its
+// broadcast: hash is the transaction that went out and is followed from then on, an empty
+// one tells nothing went out and the withdrawal is sent again
+func (c *Chainpot) ResolveWithdrawal(chain PublicChain, id, hash string) (*Withdrawal, error) {
+	var obj = c.chainOf(chain)
+	if obj == nil {
+		return nil, poterr.NotRegErr
+	}
+	return obj.resolveWithdrawal(id, hash)
+}
+
+func (c *chain) resolveWithdrawal(id, hash string) (*Withdrawal, error) {
+	c.withdrawMu.Lock()
+	var w, ok = c.withdrawals[id]
+	if !ok || w.State != WithdrawSending {
+		c.withdrawMu.Unlock()
+		return nil, poterr.DoubtErr
+	}
+	if hash != "" {
+		w.Resolved = hash
+	} else {
+		w.State = WithdrawQueued
+		w.Attempts = 0
+	}
+	err := c.saveWithdrawal(w)
+	var res = w.copy()
+	c.withdrawMu.Unlock()
+	if err != nil {
+		return nil, err
+	}
+	select {
+	case c.withdrawQueue <- struct{}{}:
+	default:
+	}
+	return res, nil
+}
+
+func (c *chain) withdraw(req *WithdrawRequest) (*Withdrawal, error) {
+	if req.ID == "" || req.From == "" || req.To == "" || req.Amount == "" {
+		return nil, poterr.RequestErr
+	}
+	if c.lookup == nil || c.senders[req.Symbol] == nil {
+		return nil, poterr.WithdrawErr
+	}
+
+	c.withdrawMu.Lock()
+	if w, ok := c.withdrawals[req.ID]; ok {
+		c.withdrawMu.Unlock()
+		return w.copy(), nil
+	}
+	var obj = *req
+	obj.From = c.normalize(obj.From)
+	obj.To = c.normalize(obj.To)
+	c.withdrawSeq++
+	var w = &Withdrawal{Request: &obj, State: WithdrawQueued, Seq: c.withdrawSeq}
+	c.withdrawals[req.ID] = w
+	err := c.saveWithdrawal(w)
+	var res = w.copy()
+	c.withdrawMu.Unlock()
+	if err != nil {
+		return nil, err
+	}
+
+	// picked on the next head when the loop is busy
+	select {
+	case c.withdrawQueue <- struct{}{}:
+	default:
+	}
+	return res, nil
+}
+
+// must be called with c.withdrawMu held
+func (c *chain) saveWithdrawal(w *Withdrawal) error {
+	store, ok := c.storage.(WithdrawalStore)
+	if !ok {
+		return nil
+	}
+	if err := store.SaveWithdrawal(w); err != nil {
+		c.health.fail(err)
+		c.logger.Error().Msgf("save withdrawal %s error: %s", w.Request.ID, err.Error())
+		return err
+	}
+	return nil
+}
+
+// load the persisted withdrawals, the mined ones are followed again
+func (c *chain) loadWithdrawals() {
+	store, ok := c.storage.(WithdrawalStore)
+	if !ok {
+		return
+	}
+	list, err := store.LoadWithdrawals()
+	if err != nil {
+		c.logger.Error().Msgf("load withdrawals error: %s", err.Error())
+		return
+	}
+	for _, w := range list {
+		c.withdrawals[w.Request.ID] = w
+		if w.Seq > c.withdrawSeq {
+			c.withdrawSeq = w.Seq
+		}
+		if w.HasNonce {
+			if next, ok := c.nonces[w.Request.From]; !ok || w.Nonce+1 > next {
+				c.nonces[w.Request.From] = w.Nonce + 1
+			}
+		}
+		switch w.State {
+		case WithdrawSubmitted:
+			for _, hash := range w.Hashes {
+				c.ownHashes[hash] = true
+			}
+		case WithdrawMined:
+			c.follow(w)
+		}
+	}
+}
+
+// submit the queued withdrawals and check the submitted ones, run by the chain loop.
+// withdrawals only change on the loop, c.withdrawMu is held for the changes but never
+// for the calls to the node
+func (c *chain) processWithdrawals() {
+	c.withdrawMu.Lock()
+	var list = make([]*Withdrawal, 0)
+	var states = make(map[*Withdrawal]WithdrawState)
+	for _, w := range c.withdrawals {
+		if w.State == WithdrawQueued || w.State == WithdrawSending || w.State == WithdrawSubmitted {
+			list = append(list, w)
+			states[w] = w.State
+		}
+	}
+	c.withdrawMu.Unlock()
+
+	sort.Slice(list, func(i, j int) bool {
+		return list[i].Seq < list[j].Seq
+	})
+	for _, w := range list {
+		switch states[w] {
+		case WithdrawQueued:
+			c.submit(w)
+		case WithdrawSending:
+			c.resolveSending(w)
+		default:
+			c.checkWithdrawal(w)
+		}
+	}
+}
+
+// persist the nonce and the sending state of w, then broadcast it. a crash in between
+// leaves w in doubt rather than queued for another send
+func (c *chain) submit(w *Withdrawal) {
+	var req = w.Request
+	var tx = &OutTx{Symbol: req.Symbol, From: req.From, To: req.To, Amount: req.Amount}
+	if c.name == "eth" {
+		tx.Nonce, tx.HasNonce = w.Nonce, true
+		if !w.HasNonce {
+			tx.Nonce = c.nextNonce(c.ctx, req.From)
+		}
+		tx.GasPrice = c.gasPrice(c.ctx, req.Symbol)
+	}
+
+	c.withdrawMu.Lock()
+	if w.EventID == 0 {
+		if c.eventID == 0 {
+			c.eventID++
+		}
+		w.EventID = c.eventID
+		c.eventID += c.confirmTimes + 1
+	}
+	w.Nonce, w.HasNonce = tx.Nonce, tx.HasNonce
+	w.GasPrice = tx.GasPrice
+	w.State = WithdrawSending
+	if err := c.saveWithdrawal(w); err != nil {
+		w.State = WithdrawQueued
+		c.withdrawMu.Unlock()
+		return
+	}
+	c.withdrawMu.Unlock()
+	c.send(w, tx)
+}
+
+// broadcast tx of w, which is in the sending state
+func (c *chain) send(w *Withdrawal, tx *OutTx) {
+	var req = w.Request
+	hash, err := c.senders[req.Symbol].SendTx(c.ctx, tx)
+
+	c.withdrawMu.Lock()
+	defer c.withdrawMu.Unlock()
+	if err != nil && hash != "" {
+		// the node took it after all, LookupTx tells the rest
+		c.logger.Warn().Msgf("withdrawal %s sent as %s with error: %s", req.ID, hash, err.Error())
+	}
+	if err == nil || hash != "" {
+		c.submitted(w, tx, hash)
+		return
+	}
+	w.Attempts++
+	w.Error = err.Error()
+	if !errors.Is(err, ErrRejected) {
+		// ethereum ones are resolved by their nonce on the next head, others by ResolveWithdrawal
+		c.logger.Error().Msgf("withdrawal %s in doubt after send error: %s", req.ID, err.Error())
+		c.saveWithdrawal(w)
+		return
+	}
+	c.logger.Warn().Msgf("withdrawal %s send error: %s", req.ID, err.Error())
+	if w.Attempts >= maxSendAttempts {
+		// the node is asked again so the nonce is not left as a gap
+		delete(c.nonces, req.From)
+		c.failWithdrawal(w, "rejected")
+		return
+	}
+	w.State = WithdrawQueued
+	c.saveWithdrawal(w)
+}
+
+// settle a withdrawal in doubt: the hash given by ResolveWithdrawal is followed, an
+// ethereum one whose nonce is still unused is sent again with it as it can't be mined twice
+func (c *chain) resolveSending(w *Withdrawal) {
+	var req = w.Request
+	c.withdrawMu.Lock()
+	if hash := w.Resolved; hash != "" {
+		w.Resolved = ""
+		c.submitted(w, &OutTx{GasPrice: w.GasPrice}, hash)
+		c.withdrawMu.Unlock()
+		return
+	}
+	c.withdrawMu.Unlock()
+	if !w.HasNonce {
+		return
+	}
+	var source, ok = c.nonceSource()
+	if !ok {
+		return
+	}
+	next, err := source.PendingNonce(c.ctx, req.From)
+	if err != nil {
+		c.health.fail(err)
+		c.logger.Error().Msgf("pending nonce of withdrawal %s error: %s", req.ID, err.Error())
+		return
+	}
+
+	c.withdrawMu.Lock()
+	if next > w.Nonce {
+		// the nonce went out, maybe with this withdrawal, only ResolveWithdrawal tells
+		const doubt = "nonce used by an unknown transaction"
+		if w.Error != doubt {
+			w.Error = doubt
+			c.logger.Error().Msgf("withdrawal %s in doubt, nonce %d used by an unknown transaction", req.ID, w.Nonce)
+			c.saveWithdrawal(w)
+		}
+		c.withdrawMu.Unlock()
+		return
+	}
+	if w.Attempts >= maxSendAttempts {
+		delete(c.nonces, req.From)
+		c.failWithdrawal(w, "rejected")
+		c.withdrawMu.Unlock()
+		return
+	}
+	c.withdrawMu.Unlock()
+	c.send(w, &OutTx{Symbol: req.Symbol, From: req.From, To: req.To, Amount: req.Amount, Nonce: w.Nonce, HasNonce: true, GasPrice: w.GasPrice})
+}
+
+// record hash as the last submission of w, it must be called with c.withdrawMu held
+func (c *chain) submitted(w *Withdrawal, tx *OutTx, hash string) {
+	var req = w.Request
+	hash = strings.ToLower(hash)
+	w.Hashes = append(w.Hashes, hash)
+	w.State = WithdrawSubmitted
+	w.GasPrice = tx.GasPrice
+	w.Submitted = c.now()
+	w.Attempts = 0
+	w.Error = ""
+	c.ownHashes[hash] = true
+	c.saveWithdrawal(w)
+	c.logger.Info().Msgf("withdrawal %s submitted as %s", req.ID, hash)
+	if len(w.Hashes) == 1 {
+		c.emitWithdrawal(w, T_WITHDRAW_PENDING, w.EventID, 0, &BlockMessage{Hash: hash, From: req.From, To: req.To, Amount: req.Amount}, "")
+	}
+}
+
+func (c *chain) checkWithdrawal(w *Withdrawal) {
+	var known, replaced bool
+	for _, hash := range w.Hashes {
+		info, err := c.lookup.LookupTx(c.ctx, hash)
+		if err != nil {
+			c.health.fail(err)
+			c.logger.Error().Msgf("lookup withdrawal %s error: %s", w.Request.ID, err.Error())
+			return
+		}
+		switch info.State {
+		case TxMined:
+			// any mined submission settles the withdrawal, the tracker takes it from there
+			c.withdrawMu.Lock()
+			w.State = WithdrawMined
+			w.Hash = hash
+			c.saveWithdrawal(w)
+			c.withdrawMu.Unlock()
+			c.follow(w)
+			return
+		case TxPending:
+			known = true
+		case TxReplaced:
+			replaced = true
+		}
+	}
+	if replaced && !known {
+		c.withdrawMu.Lock()
+		c.failWithdrawal(w, "replaced")
+		c.withdrawMu.Unlock()
+		return
+	}
+	if c.now().Sub(w.Submitted) < c.stuckAfter {
+		return
+	}
+	if w.Bumps >= c.maxBumps {
+		// an unknown ethereum transaction left its nonce unused, a bitcoin node
+		// without txindex doesn't know the mined ones so it proves nothing there
+		if !known && c.name == "eth" {
+			c.withdrawMu.Lock()
+			c.failWithdrawal(w, "dropped")
+			c.withdrawMu.Unlock()
+		}
+		return
+	}
+	c.resubmit(w)
+}
+
+// resubmit a stuck withdrawal without ever paying twice: an ethereum one is replaced by
+// a Replacer with the same nonce and a higher fee, otherwise the signed transaction is
+// broadcast again by a Rebroadcaster. nothing is sent through other senders
+func (c *chain) resubmit(w *Withdrawal) {
+	var req = w.Request
+	var sender = c.senders[req.Symbol]
+	var tx *OutTx
+	var hash string
+	var err error
+	if replacer, ok := optional[Replacer](sender); ok && c.name == "eth" && w.HasNonce {
+		tx = &OutTx{Symbol: req.Symbol, From: req.From, To: req.To, Amount: req.Amount, Nonce: w.Nonce, HasNonce: true, Bump: w.Bumps + 1}
+		tx.GasPrice = c.bumpPrice(c.ctx, req.Symbol, w.GasPrice)
+		c.logger.Warn().Msgf("withdrawal %s stuck, replacing it with bump %d", req.ID, tx.Bump)
+		hash, err = replacer.ReplaceTx(c.ctx, tx)
+	} else if rebroadcaster, ok := optional[Rebroadcaster](sender); ok {
+		c.logger.Warn().Msgf("withdrawal %s stuck, broadcasting it again", req.ID)
+		err = rebroadcaster.Rebroadcast(c.ctx, w.Hashes[len(w.Hashes)-1])
+	} else {
+		c.logger.Warn().Msgf("withdrawal %s stuck, its sender can neither replace nor rebroadcast it", req.ID)
+	}
+
+	c.withdrawMu.Lock()
+	defer c.withdrawMu.Unlock()
+	w.Bumps++
+	if err != nil {
+		w.Error = err.Error()
+		c.logger.Warn().Msgf("withdrawal %s resubmit error: %s", req.ID, err.Error())
+	}
+	if tx != nil && err == nil {
+		c.submitted(w, tx, hash)
+		return
+	}
+	w.Submitted = c.now()
+	c.saveWithdrawal(w)
+}
+
+// must be called with c.withdrawMu held
+func (c *chain) failWithdrawal(w *Withdrawal, reason string) {
+	c.logger.Warn().Msgf("withdrawal %s failed: %s", w.Request.ID, reason)
+	w.State = WithdrawFailed
+	w.Reason = reason
+	for _, hash := range w.Hashes {
+		delete(c.ownHashes, hash)
+	}
+	c.saveWithdrawal(w)
+	var req = w.Request
+	var content = &BlockMessage{From: req.From, To: req.To, Amount: req.Amount}
+	if len(w.Hashes) > 0 {
+		content.Hash = w.Hashes[len(w.Hashes)-1]
+	}
+	c.emitWithdrawal(w, T_WITHDRAW_FAIL, w.EventID+c.confirmTimes, 0, content, reason)
+}
+
+// hand the mined hash of w to the tracker, it keeps the event IDs of w
+func (c *chain) follow(w *Withdrawal) {
+	if _, ok := c.tracking[w.Hash]; ok {
+		return
+	}
+	var req = w.Request
+	c.ownHashes[w.Hash] = true
+	c.tracking[w.Hash] = &trackedTx{
+		hash:       w.Hash,
+		eventID:    w.EventID,
+		seen:       c.now(),
+		pending:    true,
+		content:    &BlockMessage{Hash: w.Hash, From: req.From, To: req.To, Amount: req.Amount},
+		symbol:     req.Symbol,
+		withdrawal: req.ID,
+	}
+}
+
+// the tracker is done with the withdrawal id, reason is empty once confirmed
+func (c *chain) settle(id string, reason string) {
+	c.withdrawMu.Lock()
+	defer c.withdrawMu.Unlock()
+	var w, ok = c.withdrawals[id]
+	if !ok {
+		return
+	}
+	for _, hash := range w.Hashes {
+		delete(c.ownHashes, hash)
+	}
+	if reason == "" {
+		w.State = WithdrawConfirmed
+	} else {
+		w.State = WithdrawFailed
+		w.Reason = reason
+	}
+	c.saveWithdrawal(w)
+}
+
+func (c *chain) emitWithdrawal(w *Withdrawal, e EventType, id int64, height int64, content *BlockMessage, reason string) {
+	c.messageQueue <- &PotEvent{
+		Symbol:    w.Request.Symbol,
+		Chain:     c.name,
+		CoinType:  c.coinType(w.Request.Symbol),
+		Event:     e,
+		ID:        id,
+		Height:    height,
+		Content:   content,
+		Reason:    reason,
+		RequestID: w.Request.ID,
+	}
+}
+
+func (c *chain) coinType(symbol string) string {
+	for _, item := range c.contracts {
+		if item.Symbol == symbol {
+			return item.CoinType
+		}
+	}
+	return c.origin.CoinType
+}
+
+// the lookup or a sender knowing the pending nonces
+func (c *chain) nonceSource() (NonceSource, bool) {
+	var source, ok = optional[NonceSource](c.lookup)
+	if !ok {
+		for _, sender := range c.senders {
+			if source, ok = optional[NonceSource](sender); ok {
+				break
+			}
+		}
+	}
+	return source, ok
+}
+
+// next nonce of addr, the node is asked when it can tell and may move it forward
+func (c *chain) nextNonce(ctx context.Context, addr string) uint64 {
+	var next = c.nonces[addr]
+	var source, ok = c.nonceSource()
+	if ok {
+		if n, err := source.PendingNonce(ctx, addr); err == nil && n > next {
+			next = n
+		} else if err != nil {
+			c.logger.Warn().Msgf("pending nonce of %s error: %s", addr, err.Error())
+		}
+	}
+	c.nonces[addr] = next + 1
+	return next
+}
+
+// suggested gas price of a first submission, empty when nothing suggests one
+func (c *chain) gasPrice(ctx context.Context, symbol string) string {
+	var pricer, ok = optional[GasPricer](c.senders[symbol])
+	if !ok {
+		if pricer, ok = optional[GasPricer](c.lookup); !ok {
+			return ""
+		}
+	}
+	price, err := pricer.GasPrice(ctx)
+	if err != nil || price == nil {
+		return ""
+	}
+	return price.String()
+}
+
+// gas price of a replacement, the last submitted price raised by the fee bump as nodes
+// refuse a replacement not raising it enough. the suggested price is taken when higher
+func (c *chain) bumpPrice(ctx context.Context, symbol string, last string) string {
+	var res, ok = new(big.Int).SetString(last, 10)
+	var suggested, known = new(big.Int).SetString(c.gasPrice(ctx, symbol), 10)
+	if !ok {
+		if !known {
+			return ""
+		}
+		res = suggested
+	}
+	res.Mul(res, big.NewInt(int64(100+c.feeBump)))
+	res.Div(res, big.NewInt(100))
+	if ok && known && suggested.Cmp(res) > 0 {
+		res = suggested
+	}
+	return res.String()
+}
+
+func (c *ethLookup) PendingNonce(ctx context.Context, addr string) (uint64, error) {
+	var count string
+	if err := c.rpc.call(ctx, "eth_getTransactionCount", &count, addr, "pending"); err != nil {
+		return 0, err
+	}
+	return hexUint64(count), nil
+}
+
+func (c *ethLookup) GasPrice(ctx context.Context) (*big.Int, error) {
+	var price string
+	if err := c.rpc.call(ctx, "eth_gasPrice", &price); err != nil {
+		return nil, err
+	}
+	num, ok := new(big.Int).SetString(strings.TrimPrefix(price, "0x"), 16)
+	if !ok {
+		return nil, errors.New("bad gas price " + price)
+	}
+	return num, nil
+}
+
+func (c *BoltStorage) createWithdrawals() error {
+	return c.Database.Update(func(tx *bolt.Tx) error {
+		_, err := tx.CreateBucketIfNotExists(withdrawalsBucket)
+		return err
+	})
+}
+
+func (c *BoltStorage) SaveWithdrawal(w *Withdrawal) error {
+	bs, err := json.Marshal(w)
+	if err != nil {
+		return err
+	}
+	return c.Database.Update(func(tx *bolt.Tx) error {
+		return tx.Bucket(withdrawalsBucket).Put([]byte(w.Request.ID), bs)
+	})
+}
+
+func (c *BoltStorage) LoadWithdrawals() ([]*Withdrawal, error) {
+	var res = make([]*Withdrawal, 0)
+	err := c.Database.View(func(tx *bolt.Tx) error {
+		return tx.Bucket(withdrawalsBucket).ForEach(func(k, v []byte) error {
+			var w = &Withdrawal{}
+			if err := json.Unmarshal(v, w); err != nil {
+				return err
+			}
+			res = append(res, w)
+			return nil
+		})
+	})
+	return res, err
+}
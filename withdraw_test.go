@@ -0,0 +1,354 @@
+package chainpot
+
+import (
+	"context"
+	"github.com/fadeAce/chainpot/poterr"
+	"github.com/fadeAce/claws"
+	"math/big"
+	"os"
+	"strings"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+func expectWithdrawal(t *testing.T, ch <-chan *PotEvent, e EventType, id int64, request string) *PotEvent {
+	select {
+	case event := <-ch:
+		if event.Event != e || event.ID != id || event.RequestID != request {
+			t.Fatalf("expect %s %d of %s, got %s", e, id, request, mustMarshal(event))
+		}
+		return event
+	case <-time.After(2 * time.Second):
+		t.Fatalf("timeout waiting for %s %d of %s", e, id, request)
+	}
+	return nil
+}
+
+func newWithdrawPot(t *testing.T, dir string, wallet *FakeWallet) *Chainpot {
+	var cp = NewChainpot(&ChainConf{
+		Coins:    []Coins{{CoinType: "origin", Chain: "eth", Symbol: "eth"}},
+		Eth:      &EthConf{ConfirmTimes: 2, Storage: boltStorage(t, dir, "eth"), StuckAfter: time.Minute},
+		Builders: map[string]claws.WalletBuilder{"eth": wallet},
+		Clock:    wallet.Now,
+	})
+	if err := cp.Register(Ethereum); err != nil {
+		t.Fatal(err)
+	}
+	return cp
+}
+
+func TestChainpot_WithdrawQueue(t *testing.T) {
+	var dir = tempDir(t)
+	defer os.RemoveAll(dir)
+	var fake = NewFakeChain(100)
+	var wallet = NewFakeWallet(fake)
+	var cp = newWithdrawPot(t, dir, wallet)
+
+	if _, err := cp.Withdraw(Bitcoin, &WithdrawRequest{ID: "r0"}); err != poterr.NotRegErr {
+		t.Fatalf("unexpected error %v", err)
+	}
+	if _, err := cp.Withdraw(Ethereum, &WithdrawRequest{ID: "r0", Symbol: "eth"}); err != poterr.RequestErr {
+		t.Fatalf("unexpected error %v", err)
+	}
+	if _, err := cp.Withdraw(Ethereum, &WithdrawRequest{ID: "r0", Symbol: "usdt", From: "0xA1", To: "0xb2", Amount: "1"}); err != poterr.WithdrawErr {
+		t.Fatalf("unexpected error %v", err)
+	}
+	var ch = startPot(t, cp, fake)
+
+	// submitted, mined and confirmed, a repeated request gets the same withdrawal
+	var r1 = &WithdrawRequest{ID: "r1", Symbol: "eth", From: "0xA1", To: "0xb2", Amount: "5"}
+	if _, err := cp.Withdraw(Ethereum, r1); err != nil {
+		t.Fatal(err)
+	}
+	expectWithdrawal(t, ch, T_WITHDRAW_PENDING, 1, "r1")
+	if w, _ := cp.Withdraw(Ethereum, r1); w.State != WithdrawSubmitted || len(w.Hashes) != 1 || len(wallet.Sent()) != 1 {
+		t.Fatalf("unexpected repeated withdrawal %s", mustMarshal(w))
+	}
+	fake.Mine()
+	fake.Mine()
+	if event := expectWithdrawal(t, ch, T_WITHDRAW, 2, "r1"); event.Content.From != "0xa1" {
+		t.Fatalf("unexpected content %s", mustMarshal(event))
+	}
+	fake.Mine()
+	expectWithdrawal(t, ch, T_WITHDRAW_CONFIRM, 3, "r1")
+	if w := cp.Withdrawal(Ethereum, "r1"); w.State != WithdrawConfirmed || w.Nonce != 0 {
+		t.Fatalf("unexpected withdrawal %s", mustMarshal(w))
+	}
+
+	// a failed send is retried on the next head, a dropped one is resubmitted with the same nonce
+	wallet.FailSend(1)
+	cp.Withdraw(Ethereum, &WithdrawRequest{ID: "r2", Symbol: "eth", From: "0xa1", To: "0xb2", Amount: "6"})
+	expectNone(t, ch)
+	fake.Mine()
+	expectWithdrawal(t, ch, T_WITHDRAW_PENDING, 4, "r2")
+	wallet.Drop(wallet.Hashes()[1])
+	fake.Advance(2 * time.Minute)
+	fake.Mine()
+	expectNone(t, ch)
+	var sent = wallet.Sent()
+	if len(sent) != 3 || sent[1].Nonce != 1 || sent[2].Nonce != 1 || sent[2].Bump != 1 {
+		t.Fatalf("unexpected sent transactions %s", mustMarshal(sent))
+	}
+	fake.Mine()
+	fake.Mine()
+	if event := expectWithdrawal(t, ch, T_WITHDRAW, 5, "r2"); event.Content.Hash != wallet.Hashes()[2] {
+		t.Fatalf("unexpected content %s", mustMarshal(event))
+	}
+	fake.Mine()
+	expectWithdrawal(t, ch, T_WITHDRAW_CONFIRM, 6, "r2")
+
+	// its nonce taken by another transaction
+	cp.Withdraw(Ethereum, &WithdrawRequest{ID: "r3", Symbol: "eth", From: "0xa1", To: "0xb2", Amount: "7"})
+	expectWithdrawal(t, ch, T_WITHDRAW_PENDING, 7, "r3")
+	wallet.Replace(wallet.Hashes()[3])
+	fake.Mine()
+	if event := expectWithdrawal(t, ch, T_WITHDRAW_FAIL, 9, "r3"); event.Reason != "replaced" {
+		t.Fatalf("unexpected failure %s", mustMarshal(event))
+	}
+	stopPot(t, cp)
+	cp.chains[int(Ethereum)].storage.(*BoltStorage).Close()
+
+	// the queue survives a restart
+	cp = newWithdrawPot(t, dir, wallet)
+	if w, _ := cp.Withdraw(Ethereum, r1); w.State != WithdrawConfirmed {
+		t.Fatalf("unexpected withdrawal after restart %s", mustMarshal(w))
+	}
+	if w := cp.Withdrawal(Ethereum, "r3"); w.State != WithdrawFailed || w.Reason != "replaced" || w.Nonce != 2 {
+		t.Fatalf("unexpected withdrawal after restart %s", mustMarshal(w))
+	}
+	if next := cp.chains[int(Ethereum)].nonces["0xa1"]; next != 3 {
+		t.Fatalf("unexpected next nonce %d", next)
+	}
+	cp.chains[int(Ethereum)].storage.(*BoltStorage).Close()
+}
+
+// a sender of no replacement nor rebroadcast
+type plainWallet struct {
+	claws.Wallet
+	wallet *FakeWallet
+}
+
+func (w *plainWallet) Build() claws.Wallet {
+	return w
+}
+
+func (w *plainWallet) SendTx(ctx context.Context, tx *OutTx) (string, error) {
+	return w.wallet.SendTx(ctx, tx)
+}
+
+func (w *plainWallet) LookupTx(ctx context.Context, hash string) (*TxInfo, error) {
+	return w.wallet.LookupTx(ctx, hash)
+}
+
+// a wallet suggesting price as the gas price
+type pricedWallet struct {
+	*FakeWallet
+	price int64
+}
+
+func (w *pricedWallet) Build() claws.Wallet {
+	return w
+}
+
+func (w *pricedWallet) GasPrice(ctx context.Context) (*big.Int, error) {
+	return big.NewInt(atomic.LoadInt64(&w.price)), nil
+}
+
+func TestChainpot_WithdrawStuck(t *testing.T) {
+	var dir = tempDir(t)
+	defer os.RemoveAll(dir)
+	var fake = NewFakeChain(100)
+	var wallet = NewFakeWallet(fake)
+	var cp = NewChainpot(&ChainConf{
+		Coins:    []Coins{{CoinType: "origin", Chain: "eth", Symbol: "eth"}},
+		Eth:      &EthConf{ConfirmTimes: 2, Storage: boltStorage(t, dir, "eth"), StuckAfter: time.Minute},
+		Builders: map[string]claws.WalletBuilder{"eth": &plainWallet{Wallet: wallet, wallet: wallet}},
+		Clock:    fake.Now,
+	})
+	if err := cp.Register(Ethereum); err != nil {
+		t.Fatal(err)
+	}
+	var ch = startPot(t, cp, fake)
+
+	// the sender can't keep the nonce, a dropped withdrawal is never sent again
+	cp.Withdraw(Ethereum, &WithdrawRequest{ID: "r1", Symbol: "eth", From: "0xa1", To: "0xb2", Amount: "5"})
+	expectWithdrawal(t, ch, T_WITHDRAW_PENDING, 1, "r1")
+	wallet.Drop(wallet.Hashes()[0])
+	for i := 0; i < defaultMaxBumps; i++ {
+		fake.Advance(2 * time.Minute)
+		fake.Mine()
+		expectNone(t, ch)
+	}
+	fake.Advance(2 * time.Minute)
+	fake.Mine()
+	if event := expectWithdrawal(t, ch, T_WITHDRAW_FAIL, 3, "r1"); event.Reason != "dropped" {
+		t.Fatalf("unexpected failure %s", mustMarshal(event))
+	}
+	if sent := wallet.Sent(); len(sent) != 1 {
+		t.Fatalf("unexpected sent transactions %s", mustMarshal(sent))
+	}
+	stopPot(t, cp)
+}
+
+func TestChainpot_WithdrawBump(t *testing.T) {
+	var dir = tempDir(t)
+	defer os.RemoveAll(dir)
+	var fake = NewFakeChain(100)
+	var wallet = &pricedWallet{FakeWallet: NewFakeWallet(fake), price: 100}
+	var cp = NewChainpot(&ChainConf{
+		Coins:    []Coins{{CoinType: "origin", Chain: "eth", Symbol: "eth"}},
+		Eth:      &EthConf{ConfirmTimes: 2, Storage: boltStorage(t, dir, "eth"), StuckAfter: time.Minute},
+		Builders: map[string]claws.WalletBuilder{"eth": wallet},
+		Clock:    fake.Now,
+	})
+	if err := cp.Register(Ethereum); err != nil {
+		t.Fatal(err)
+	}
+	var ch = startPot(t, cp, fake)
+
+	// replacements raise the last price, the suggested one is taken when higher
+	cp.Withdraw(Ethereum, &WithdrawRequest{ID: "r1", Symbol: "eth", From: "0xa1", To: "0xb2", Amount: "5"})
+	expectWithdrawal(t, ch, T_WITHDRAW_PENDING, 1, "r1")
+	for _, price := range []int64{50, 50, 200} {
+		atomic.StoreInt64(&wallet.price, price)
+		var hashes = wallet.Hashes()
+		wallet.Drop(hashes[len(hashes)-1])
+		fake.Advance(2 * time.Minute)
+		fake.Mine()
+		expectNone(t, ch)
+	}
+	var prices = make([]string, 0)
+	for _, tx := range wallet.Sent() {
+		if tx.Nonce != 0 {
+			t.Fatalf("unexpected nonce %s", mustMarshal(tx))
+		}
+		prices = append(prices, tx.GasPrice)
+	}
+	if strings.Join(prices, " ") != "100 110 121 200" {
+		t.Fatalf("unexpected gas prices %v", prices)
+	}
+	stopPot(t, cp)
+}
+
+func TestChainpot_WithdrawRebroadcast(t *testing.T) {
+	var dir = tempDir(t)
+	defer os.RemoveAll(dir)
+	var fake = NewFakeChain(100)
+	var wallet = NewFakeWallet(fake)
+	var cp = NewChainpot(&ChainConf{
+		Coins:    []Coins{{CoinType: "origin", Chain: "btc", Symbol: "btc"}},
+		Btc:      &BtcConf{ConfirmTimes: 2, Storage: boltStorage(t, dir, "btc"), StuckAfter: time.Minute},
+		Builders: map[string]claws.WalletBuilder{"btc": wallet},
+		Clock:    fake.Now,
+	})
+	if err := cp.Register(Bitcoin); err != nil {
+		t.Fatal(err)
+	}
+	var ch = startPot(t, cp, fake)
+
+	// base58 addresses keep their case, a stuck bitcoin withdrawal is broadcast again as it was
+	cp.Withdraw(Bitcoin, &WithdrawRequest{ID: "r1", Symbol: "btc", From: testOther, To: testAddr, Amount: "1"})
+	expectWithdrawal(t, ch, T_WITHDRAW_PENDING, 1, "r1")
+	wallet.Drop(wallet.Hashes()[0])
+	fake.Advance(2 * time.Minute)
+	fake.Mine()
+	expectNone(t, ch)
+	fake.Mine()
+	if event := expectWithdrawal(t, ch, T_WITHDRAW, 2, "r1"); event.Content.To != testAddr || event.Content.Hash != wallet.Hashes()[0] {
+		t.Fatalf("unexpected content %s", mustMarshal(event))
+	}
+	if sent := wallet.Sent(); len(sent) != 1 || sent[0].From != testOther {
+		t.Fatalf("unexpected sent transactions %s", mustMarshal(sent))
+	}
+	stopPot(t, cp)
+}
+
+func TestChainpot_WithdrawInDoubt(t *testing.T) {
+	var dir = tempDir(t)
+	defer os.RemoveAll(dir)
+	var fake = NewFakeChain(100)
+	var wallet = NewFakeWallet(fake)
+	var cp = newWithdrawPot(t, dir, wallet)
+	var ch = startPot(t, cp, fake)
+
+	// broadcast but failed, its nonce is used so it's never sent again
+	wallet.LoseSend(1)
+	cp.Withdraw(Ethereum, &WithdrawRequest{ID: "r1", Symbol: "eth", From: "0xa1", To: "0xb2", Amount: "5"})
+	expectNone(t, ch)
+	fake.Mine()
+	expectNone(t, ch)
+	if w := cp.Withdrawal(Ethereum, "r1"); w.State != WithdrawSending || !w.HasNonce || len(wallet.Sent()) != 1 {
+		t.Fatalf("unexpected withdrawal %s", mustMarshal(w))
+	}
+	stopPot(t, cp)
+	cp.chains[int(Ethereum)].storage.(*BoltStorage).Close()
+
+	// still in doubt after a restart until told the hash that went out
+	cp = newWithdrawPot(t, dir, wallet)
+	ch = startPot(t, cp, fake)
+	fake.Mine()
+	expectNone(t, ch)
+	if _, err := cp.ResolveWithdrawal(Ethereum, "r2", ""); err != poterr.DoubtErr {
+		t.Fatalf("unexpected error %v", err)
+	}
+	if _, err := cp.ResolveWithdrawal(Ethereum, "r1", wallet.Hashes()[0]); err != nil {
+		t.Fatal(err)
+	}
+	expectWithdrawal(t, ch, T_WITHDRAW_PENDING, 1, "r1")
+	fake.Mine()
+	expectWithdrawal(t, ch, T_WITHDRAW, 2, "r1")
+	fake.Mine()
+	expectWithdrawal(t, ch, T_WITHDRAW_CONFIRM, 3, "r1")
+	if sent := wallet.Sent(); len(sent) != 1 {
+		t.Fatalf("unexpected sent transactions %s", mustMarshal(sent))
+	}
+	stopPot(t, cp)
+	cp.chains[int(Ethereum)].storage.(*BoltStorage).Close()
+}
+
+func TestChainpot_WithdrawInDoubtBtc(t *testing.T) {
+	var dir = tempDir(t)
+	defer os.RemoveAll(dir)
+	var fake = NewFakeChain(100)
+	var wallet = NewFakeWallet(fake)
+	var cp = NewChainpot(&ChainConf{
+		Coins:    []Coins{{CoinType: "origin", Chain: "btc", Symbol: "btc"}},
+		Btc:      &BtcConf{ConfirmTimes: 2, Storage: boltStorage(t, dir, "btc"), StuckAfter: time.Minute},
+		Builders: map[string]claws.WalletBuilder{"btc": wallet},
+		Clock:    fake.Now,
+	})
+	if err := cp.Register(Bitcoin); err != nil {
+		t.Fatal(err)
+	}
+	var ch = startPot(t, cp, fake)
+
+	// a rejection is retried, any other error waits for the withdrawal to be resolved
+	wallet.RejectSend(1)
+	cp.Withdraw(Bitcoin, &WithdrawRequest{ID: "r1", Symbol: "btc", From: testOther, To: testAddr, Amount: "1"})
+	expectNone(t, ch)
+	fake.Mine()
+	expectWithdrawal(t, ch, T_WITHDRAW_PENDING, 1, "r1")
+
+	wallet.FailSend(1)
+	cp.Withdraw(Bitcoin, &WithdrawRequest{ID: "r2", Symbol: "btc", From: testOther, To: testAddr, Amount: "2"})
+	fake.Mine()
+	expectWithdrawal(t, ch, T_WITHDRAW, 2, "r1")
+	fake.Mine()
+	expectWithdrawal(t, ch, T_WITHDRAW_CONFIRM, 3, "r1")
+	for i := 0; i < maxSendAttempts; i++ {
+		fake.Mine()
+	}
+	expectNone(t, ch)
+	if w := cp.Withdrawal(Bitcoin, "r2"); w.State != WithdrawSending || w.Attempts != 1 || len(wallet.Sent()) != 1 {
+		t.Fatalf("unexpected withdrawal %s", mustMarshal(w))
+	}
+	if _, err := cp.ResolveWithdrawal(Bitcoin, "r2", ""); err != nil {
+		t.Fatal(err)
+	}
+	expectWithdrawal(t, ch, T_WITHDRAW_PENDING, 4, "r2")
+	if sent := wallet.Sent(); len(sent) != 2 || sent[1].Amount != "2" {
+		t.Fatalf("unexpected sent transactions %s", mustMarshal(sent))
+	}
+	stopPot(t, cp)
+}
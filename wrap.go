@@ -0,0 +1,56 @@
+package chainpot
+
+import (
+	"errors"
+	"github.com/fadeAce/claws"
+)
+
+// errUnsupported fails a call of a wallet wrapper its wallet doesn't implement
+var errUnsupported = errors.New("chainpot: the wrapped wallet doesn't implement the call")
+
+// walletWrapper is implemented by the wallets wrapping another one, the limiter, the failover
+// and the recorder ones. they implement every optional interface and forward the calls the
+// wrapped wallet implements, the other ones fail with errUnsupported
+type walletWrapper interface {
+	unwrap() interface{}
+}
+
+// optional returns obj as T when the innermost wallet of its wrappers implements T,
+// the optional interfaces of the wallets and the lookups are asked for through it
+func optional[T any](obj interface{}) (T, bool) {
+	res, ok := obj.(T)
+	for {
+		wrapper, wraps := obj.(walletWrapper)
+		if !wraps {
+			break
+		}
+		obj = wrapper.unwrap()
+		if !ok {
+			res, ok = obj.(T)
+		}
+	}
+	_, inner := obj.(T)
+	return res, ok && inner
+}
+
+// forward calls f with obj as T, errUnsupported when the innermost wallet doesn't implement T.
+// the wrappers implement the optional interfaces with it and their own helper on top
+func forward[T, R any](obj interface{}, f func(T) (R, error)) (R, error) {
+	res, ok := optional[T](obj)
+	if !ok {
+		var zero R
+		return zero, errUnsupported
+	}
+	return f(res)
+}
+
+// lookupWallet puts the json-rpc lookup of an endpoint behind the limiter and the failover
+// of its chain, it is no claws wallet of its own
+type lookupWallet struct {
+	claws.Wallet
+	TxLookup
+}
+
+func (w *lookupWallet) unwrap() interface{} {
+	return w.TxLookup
+}